@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/storepath"
+)
+
+// atticPreambleThreshold is the size above which the path info is sent at
+// the start of the body instead of in a header, as the Attic client does.
+const atticPreambleThreshold = 4 << 10
+
+// atticCache is an Attic cache, given as attic+https://server/cache. It is
+// read as the binary cache it serves at that URL, but paths are uploaded
+// through the Attic API, which takes the uncompressed NAR and its path info
+// in one request and chunks, deduplicates and compresses it on the server.
+type atticCache struct {
+	*httpCache
+
+	api  *httpCache
+	name string
+
+	// nar is the spooled NAR putNar was given, uploaded with the narinfo.
+	nar string
+}
+
+func openAtticCache(u *url.URL, auth *cacheAuthOptions) (binaryCache, error) {
+	u.Scheme = strings.TrimPrefix(u.Scheme, "attic+")
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	name := path.Base(u.Path)
+	if u.Path == "" || name == "/" {
+		return nil, fmt.Errorf("attic URL %s must end with the cache name", u.Redacted())
+	}
+
+	cache, err := openBinaryCache(u.String(), auth)
+	if err != nil {
+		return nil, err
+	}
+
+	api := *cache.(*httpCache)
+	apiBase := *api.base
+	apiBase.Path = path.Dir(u.Path)
+	if apiBase.Path == "/" {
+		apiBase.Path = ""
+	}
+	api.base = &apiBase
+
+	return &atticCache{httpCache: cache.(*httpCache), api: &api, name: name}, nil
+}
+
+// atticPathInfo is the path info Attic takes with an upload.
+type atticPathInfo struct {
+	Cache         string   `json:"cache"`
+	StorePathHash string   `json:"store_path_hash"`
+	StorePath     string   `json:"store_path"`
+	References    []string `json:"references"`
+	System        *string  `json:"system"`
+	Deriver       *string  `json:"deriver"`
+	Sigs          []string `json:"sigs"`
+	CA            *string  `json:"ca"`
+	NarHash       string   `json:"nar_hash"`
+	NarSize       uint64   `json:"nar_size"`
+}
+
+// atticUploadResult is Attic's answer to an upload.
+type atticUploadResult struct {
+	Kind             string  `json:"kind"`
+	FileSize         *int64  `json:"file_size"`
+	FracDeduplicated float64 `json:"frac_deduplicated"`
+}
+
+// putNar keeps the NAR for putFile, as Attic takes it with the narinfo.
+func (c *atticCache) putNar(spooled, _ string) error {
+	c.nar = spooled
+	return nil
+}
+
+// putFile uploads the NAR with the path info of the narinfo b. Attic makes
+// its own narinfos and has no listings.
+func (c *atticCache) putFile(name string, b []byte, _, _ string) error {
+	if !strings.HasSuffix(name, ".narinfo") {
+		return fmt.Errorf("attic caches do not store %s; drop -write-listing", name)
+	}
+
+	ni, err := parseNarinfo(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	sp, err := storepath.FromAbsolutePath(ni.StorePath)
+	if err != nil {
+		return err
+	}
+
+	info := atticPathInfo{
+		Cache:         c.name,
+		StorePathHash: strings.TrimSuffix(name, ".narinfo"),
+		StorePath:     sp.Absolute(),
+		References:    []string{},
+		Sigs:          []string{},
+		NarHash:       "sha256:" + hex.EncodeToString(ni.NarHash.Digest()),
+		NarSize:       ni.NarSize,
+	}
+
+	for _, r := range ni.References {
+		info.References = append(info.References, storepath.StoreDir+"/"+r)
+	}
+
+	for _, s := range ni.Signatures {
+		info.Sigs = append(info.Sigs, s.String())
+	}
+
+	if ni.Deriver != "" {
+		deriver := storepath.StoreDir + "/" + ni.Deriver
+		info.Deriver = &deriver
+	}
+
+	if ni.System != "" {
+		info.System = &ni.System
+	}
+
+	if ni.CA != "" {
+		info.CA = &ni.CA
+	}
+
+	return c.upload(&info)
+}
+
+func (c *atticCache) upload(info *atticPathInfo) error {
+	f, err := os.Open(c.nar)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	j, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{"Content-Type": {"application/x-nix-nar"}}
+	body, size := io.Reader(f), fi.Size()
+
+	if len(j) > atticPreambleThreshold {
+		header.Set("X-Attic-Nar-Info-Preamble-Size", strconv.Itoa(len(j)))
+		body, size = io.MultiReader(bytes.NewReader(j), f), size+int64(len(j))
+	} else {
+		header.Set("X-Attic-Nar-Info", string(j))
+	}
+
+	const endpoint = "_api/v1/upload-path"
+
+	resp, err := c.api.do(http.MethodPut, endpoint, body, size, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode/100 != 2 {
+		err := fmt.Errorf("PUT %s: %s", c.api.redacted(endpoint), resp.Status)
+		if s := strings.TrimSpace(string(msg)); s != "" {
+			err = fmt.Errorf("%w: %s", err, s)
+		}
+
+		return err
+	}
+
+	var result atticUploadResult
+	if err := json.Unmarshal(msg, &result); err != nil {
+		return fmt.Errorf("PUT %s: unexpected answer: %w", c.api.redacted(endpoint), err)
+	}
+
+	if verbosity > 0 {
+		clearProgress()
+		fmt.Fprintf(os.Stderr, "%s: %s, %.0f%% deduplicated\n", info.StorePath, strings.ToLower(result.Kind), 100*result.FracDeduplicated)
+	}
+
+	return nil
+}
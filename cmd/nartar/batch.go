@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+)
+
+// outputTemplate names the output of each input in batch mode. Placeholders
+// are {dir}, {name}, {ext}, {base} and {hash}; "{{" and "}}" stand for
+// literal braces.
+type outputTemplate struct {
+	parts []templatePart
+}
+
+// templatePart is literal text, or the placeholder field if it is set.
+type templatePart struct {
+	text  string
+	field string
+}
+
+var templateFields = map[string]bool{
+	"dir": true, "name": true, "ext": true, "base": true, "hash": true,
+}
+
+func parseOutputTemplate(s string) (*outputTemplate, error) {
+	t := &outputTemplate{}
+
+	var lit strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "{{"), strings.HasPrefix(s[i:], "}}"):
+			lit.WriteByte(s[i])
+			i++
+		case s[i] == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("output template %q has an unclosed '{'", s)
+			}
+
+			field := s[i+1 : i+end]
+			if !templateFields[field] {
+				return nil, fmt.Errorf("unknown placeholder {%s} in output template (use {dir}, {name}, {ext}, {base} or {hash})", field)
+			}
+
+			t.parts = append(t.parts, templatePart{text: lit.String()}, templatePart{field: field})
+			lit.Reset()
+			i += end
+		case s[i] == '}':
+			return nil, fmt.Errorf("output template %q has an unmatched '}'", s)
+		default:
+			lit.WriteByte(s[i])
+		}
+	}
+
+	t.parts = append(t.parts, templatePart{text: lit.String()})
+
+	return t, nil
+}
+
+func (t *outputTemplate) uses(field string) bool {
+	for _, p := range t.parts {
+		if p.field == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expand returns the output name for the input file name. {dir} is the
+// directory of the input, {base} its file name, {name} the file name without
+// the archive extensions that {ext} holds, and {hash} the SHA-256 of its
+// contents in Nix base32, as binary caches name their files.
+func (t *outputTemplate) expand(input string) (string, error) {
+	name, err := inputPrefix(input)
+	if err != nil {
+		return "", err
+	}
+
+	base := filepath.Base(input)
+
+	values := map[string]string{
+		"dir":  filepath.Dir(input),
+		"name": name,
+		"ext":  base[len(name):],
+		"base": base,
+	}
+
+	if t.uses("hash") {
+		if values["hash"], err = fileHash(input); err != nil {
+			return "", err
+		}
+	}
+
+	var b strings.Builder
+
+	for _, p := range t.parts {
+		if p.field != "" {
+			b.WriteString(values[p.field])
+		} else {
+			b.WriteString(p.text)
+		}
+	}
+
+	return b.String(), nil
+}
+
+func fileHash(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := copyContents(h, f); err != nil {
+		return "", fmt.Errorf("hashing %s: %w", name, err)
+	}
+
+	return nixbase32.EncodeToString(h.Sum(nil)), nil
+}
+
+// convertBatch converts every input to its own output, named by t, jobs of
+// them at once. Missing output directories are created, so a template
+// starting with {dir} mirrors the input tree. Outputs kept by -no-clobber are
+// skipped with a warning. An input that fails does not stop the others: the
+// failures are reported together once every input has been tried.
+func convertBatch(inputs []string, t *outputTemplate, jobs int, side narSide, narFormat *narFormatOptions, open func(string) (io.WriteCloser, error), convert func(io.Reader, io.Writer, string) error) error {
+	outputs := make([]string, len(inputs))
+	inputOf := make(map[string]string)
+
+	for i, input := range inputs {
+		if isStdio(input) {
+			return fmt.Errorf("-output-template needs input files, not stdin")
+		}
+
+		output, err := t.expand(input)
+		if err != nil {
+			return err
+		}
+
+		if isStdio(output) {
+			return fmt.Errorf("output template gives %q for %s", output, input)
+		}
+
+		if other, ok := inputOf[output]; ok {
+			return fmt.Errorf("output template gives %s for both %s and %s", output, other, input)
+		}
+
+		inputOf[output] = input
+		outputs[i] = output
+	}
+
+	// The progress bars of inputs converted at once would be drawn over
+	// each other.
+	if jobs > 1 {
+		progress = false
+	}
+
+	errs := make([]error, len(inputs))
+	next := make(chan int)
+
+	var wg sync.WaitGroup
+
+	for n := 0; n < jobs && n < len(inputs); n++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range next {
+				errs[i] = convertBatchFile(inputs[i], outputs[i], side, narFormat, open, convert)
+			}
+		}()
+	}
+
+	for i := range inputs {
+		next <- i
+	}
+
+	close(next)
+	wg.Wait()
+
+	var failed []error
+
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Errorf("%s: %w", inputs[i], err))
+		}
+	}
+
+	switch len(failed) {
+	case 0:
+		return nil
+	case 1:
+		return failed[0]
+	default:
+		return fmt.Errorf("%d of %d inputs failed:\n%w", len(failed), len(inputs), errors.Join(failed...))
+	}
+}
+
+// convertBatchFile converts a single input of convertBatch.
+func convertBatchFile(input, output string, side narSide, narFormat *narFormatOptions, open func(string) (io.WriteCloser, error), convert func(io.Reader, io.Writer, string) error) error {
+	if err := os.MkdirAll(filepath.Dir(output), 0o755); err != nil {
+		return fmt.Errorf("creating output directory: %w", err)
+	}
+
+	err := convertFile(input, output, side, narFormat, open, convert)
+	if errors.Is(err, errNoClobber) {
+		warnf("%v", err)
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// benchDirSize is the number of files the synthetic tree of bench puts in
+// each directory.
+const benchDirSize = 100
+
+// benchDirection is a conversion bench measures, from the archive format
+// from to the format it writes.
+type benchDirection struct {
+	name    string
+	from    string
+	convert func(in io.Reader, out io.Writer) error
+}
+
+var benchDirections = []benchDirection{
+	{name: "nar2tar", from: "nar", convert: func(in io.Reader, out io.Writer) error {
+		opts := &tarOptions{mtime: zeroTime, modes: defaultModes, paths: &pathMap{}}
+		return narToTarRoot(in, out, tarRootName, opts)
+	}},
+	{name: "tar2nar", from: "tar", convert: func(in io.Reader, out io.Writer) error {
+		return tarToNar(in, out, tarRootName, paxIgnore, "", false, benchReadOptions())
+	}},
+	{name: "nar2cpio", from: "nar", convert: func(in io.Reader, out io.Writer) error {
+		return narToCpio(in, out, zeroTime, defaultModes)
+	}},
+	{name: "cpio2nar", from: "cpio", convert: func(in io.Reader, out io.Writer) error {
+		return cpioToNar(in, out, benchReadOptions())
+	}},
+}
+
+// benchReadOptions returns the defaults of the archive input flags.
+func benchReadOptions() *readOptions {
+	return &readOptions{special: specialError, executable: executableMode, paths: &pathMap{}}
+}
+
+// benchResult is one line of the bench report.
+type benchResult struct {
+	Direction   string  `json:"direction"`
+	Compression string  `json:"compression"`
+	BytesIn     int64   `json:"bytesIn"`
+	BytesOut    int64   `json:"bytesOut"`
+	Seconds     float64 `json:"seconds"`
+	Throughput  float64 `json:"throughput"`
+}
+
+// benchReport is the JSON form of the bench report.
+type benchReport struct {
+	Go         string        `json:"go"`
+	Platform   string        `json:"platform"`
+	CPUs       int           `json:"cpus"`
+	Threads    int           `json:"threads"`
+	BufferSize int           `json:"bufferSize"`
+	Files      int           `json:"files"`
+	MinSize    int64         `json:"minSize"`
+	MaxSize    int64         `json:"maxSize"`
+	Sizes      string        `json:"sizes"`
+	TreeBytes  int64         `json:"treeBytes"`
+	Results    []benchResult `json:"results"`
+}
+
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	output := fs.String("output", "-", "report file ('-' for stdout)")
+	fs.StringVar(output, "o", "-", "shorthand for -output")
+	files := fs.Int("files", 1000, "number of files in the synthetic tree")
+	minSize, maxSize := int64(1<<10), int64(256<<10)
+
+	fs.Func("min-size", "size of the smallest files, such as 1K (default 1K)", func(v string) (err error) {
+		minSize, err = parseByteSize(v)
+		return err
+	})
+
+	fs.Func("max-size", "size of the largest files, such as 4M (default 256K)", func(v string) (err error) {
+		maxSize, err = parseByteSize(v)
+		return err
+	})
+
+	sizes := fs.String("sizes", "log", "how file sizes are spread between -min-size and -max-size: log, as many small as large files by order of magnitude, or uniform")
+	seed := fs.Int64("seed", 1, "seed of the synthetic tree; the same seed and sizes give the same tree")
+	directions := fs.String("directions", "nar2tar,tar2nar,nar2cpio,cpio2nar", "comma-separated conversions to measure")
+	compressions := fs.String("compression", "none,gzip,zstd", "comma-separated compressions of the output to measure each conversion with: none, gzip, zstd or xz")
+	runs := fs.Int("runs", 3, "time each conversion this many times and report the fastest")
+	format := fs.String("format", "text", "report format: text or json")
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) > 0 {
+		return fmt.Errorf("unexpected argument %q", positional[0])
+	}
+
+	switch {
+	case *files < 1:
+		return fmt.Errorf("-files must be a positive number")
+	case minSize > maxSize:
+		return fmt.Errorf("-min-size is larger than -max-size")
+	case *sizes != "log" && *sizes != "uniform":
+		return fmt.Errorf("unsupported -sizes %q (use log or uniform)", *sizes)
+	case *runs < 1:
+		return fmt.Errorf("-runs must be a positive number")
+	case *format != "text" && *format != "json":
+		return fmt.Errorf("unsupported report format %q (use text or json)", *format)
+	}
+
+	var selected []benchDirection
+
+	for _, name := range strings.Split(*directions, ",") {
+		found := false
+
+		for _, d := range benchDirections {
+			if d.name == name {
+				selected = append(selected, d)
+				found = true
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("unknown conversion %q in -directions", name)
+		}
+	}
+
+	algorithms := strings.Split(*compressions, ",")
+	for _, algorithm := range algorithms {
+		w, err := compressWriter(io.Discard, algorithm)
+		if err != nil {
+			return err
+		}
+
+		w.Close()
+	}
+
+	out, err := openTextOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	rng := rand.New(rand.NewSource(*seed))
+
+	narData, treeBytes, err := benchTree(rng, *files, minSize, maxSize, *sizes)
+	if err != nil {
+		return err
+	}
+
+	inputs := map[string][]byte{"nar": narData}
+
+	var tarData, cpioData bytes.Buffer
+
+	if err := benchDirections[0].convert(bytes.NewReader(narData), &tarData); err != nil {
+		return fmt.Errorf("writing the tar input: %w", err)
+	}
+
+	if err := narToCpio(bytes.NewReader(narData), &cpioData, zeroTime, defaultModes); err != nil {
+		return fmt.Errorf("writing the cpio input: %w", err)
+	}
+
+	inputs["tar"], inputs["cpio"] = tarData.Bytes(), cpioData.Bytes()
+
+	report := benchReport{
+		Go:         runtime.Version(),
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+		CPUs:       runtime.NumCPU(),
+		Threads:    compressThreads,
+		BufferSize: bufferSize,
+		Files:      *files,
+		MinSize:    minSize,
+		MaxSize:    maxSize,
+		Sizes:      *sizes,
+		TreeBytes:  treeBytes,
+	}
+
+	if *format == "text" {
+		fmt.Fprintf(out, "%s %s, %d CPUs, -threads %d, -buffer-size %d\n", report.Go, report.Platform, report.CPUs, report.Threads, report.BufferSize)
+		fmt.Fprintf(out, "%d files of %s to %s (%s), %s in all\n\n", *files,
+			formatBytes(float64(minSize)), formatBytes(float64(maxSize)), *sizes, formatBytes(float64(treeBytes)))
+		fmt.Fprintf(out, "%-10s %-6s %12s %12s %9s %14s\n", "conversion", "output", "read", "written", "seconds", "throughput")
+	}
+
+	for _, d := range selected {
+		for _, algorithm := range algorithms {
+			r, err := benchConversion(d, algorithm, inputs[d.from], *runs)
+			if err != nil {
+				return fmt.Errorf("%s with %s output: %w", d.name, algorithm, err)
+			}
+
+			report.Results = append(report.Results, r)
+
+			if *format == "text" {
+				fmt.Fprintf(out, "%-10s %-6s %12s %12s %9.3f %12s/s\n", r.Direction, r.Compression,
+					formatBytes(float64(r.BytesIn)), formatBytes(float64(r.BytesOut)), r.Seconds, formatBytes(r.Throughput))
+			}
+		}
+	}
+
+	if *format == "json" {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if _, err := fmt.Fprintf(out, "%s\n", b); err != nil {
+			return err
+		}
+	}
+
+	return out.Close()
+}
+
+// benchConversion times the conversion d of in, with its output compressed
+// with algorithm, runs times and returns the fastest run.
+func benchConversion(d benchDirection, algorithm string, in []byte, runs int) (benchResult, error) {
+	r := benchResult{Direction: d.name, Compression: algorithm, BytesIn: int64(len(in))}
+
+	for i := 0; i < runs; i++ {
+		var counter byteCounter
+
+		start := time.Now()
+
+		w, err := compressWriter(&counter, algorithm)
+		if err != nil {
+			return r, err
+		}
+
+		if err := d.convert(bytes.NewReader(in), w); err != nil {
+			return r, err
+		}
+
+		if err := w.Close(); err != nil {
+			return r, err
+		}
+
+		if elapsed := time.Since(start).Seconds(); i == 0 || elapsed < r.Seconds {
+			r.Seconds = elapsed
+		}
+
+		r.BytesOut = int64(counter)
+	}
+
+	if r.Seconds > 0 {
+		r.Throughput = float64(r.BytesIn) / r.Seconds
+	}
+
+	return r, nil
+}
+
+// byteCounter discards what is written to it, counting the bytes.
+type byteCounter int64
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	*c += byteCounter(len(b))
+	return len(b), nil
+}
+
+// benchTree writes a NAR of a synthetic tree of n files with sizes between
+// minSize and maxSize, spread as sizes says, in directories of benchDirSize
+// files each. Every eighth file is executable and every directory has a symlink.
+// The files hold random words, to compress about as well as text does. It
+// returns the NAR and the size of the files in it.
+func benchTree(rng *rand.Rand, n int, minSize, maxSize int64, sizes string) ([]byte, int64, error) {
+	var b bytes.Buffer
+
+	nw, err := nar.NewWriter(&b)
+	if err != nil {
+		return nil, 0, fmt.Errorf("creating nar writer: %w", err)
+	}
+
+	if err := nw.WriteHeader(&nar.Header{Path: "/", Type: nar.TypeDirectory}); err != nil {
+		return nil, 0, err
+	}
+
+	words := benchWords(rng)
+	width := len(fmt.Sprint(n - 1))
+	total := int64(0)
+
+	for i := 0; i < n; i++ {
+		dir := fmt.Sprintf("/d%0*d", width, i/benchDirSize)
+		name := path.Join(dir, fmt.Sprintf("f%0*d", width, i))
+
+		if i%benchDirSize == 0 {
+			if err := nw.WriteHeader(&nar.Header{Path: dir, Type: nar.TypeDirectory}); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		size := minSize
+		switch {
+		case minSize == maxSize:
+		case sizes == "uniform":
+			size += rng.Int63n(maxSize - minSize + 1)
+		default:
+			lo, hi := math.Log(float64(minSize+1)), math.Log(float64(maxSize+1))
+			size = int64(math.Exp(lo+rng.Float64()*(hi-lo))) - 1
+		}
+
+		hdr := &nar.Header{Path: name, Type: nar.TypeRegular, Size: size, Executable: i%8 == 7}
+		if err := nw.WriteHeader(hdr); err != nil {
+			return nil, 0, err
+		}
+
+		if _, err := nw.Write(benchContents(rng, words, size)); err != nil {
+			return nil, 0, err
+		}
+
+		total += size
+
+		// The symlink sorts after the files of its directory.
+		if i%benchDirSize == benchDirSize-1 || i == n-1 {
+			link := &nar.Header{Path: path.Join(dir, "link"), Type: nar.TypeSymlink, LinkTarget: path.Base(name)}
+			if err := nw.WriteHeader(link); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	if err := nw.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	return b.Bytes(), total, nil
+}
+
+// benchWords returns a vocabulary of random lowercase words.
+func benchWords(rng *rand.Rand) []string {
+	words := make([]string, 4096)
+
+	for i := range words {
+		w := make([]byte, 2+rng.Intn(9))
+		for j := range w {
+			w[j] = byte('a' + rng.Intn(26))
+		}
+
+		words[i] = string(w)
+	}
+
+	return words
+}
+
+// benchContents returns size bytes of lines of random words.
+func benchContents(rng *rand.Rand, words []string, size int64) []byte {
+	b := make([]byte, 0, size+16)
+
+	for int64(len(b)) < size {
+		b = append(b, words[rng.Intn(len(words))]...)
+
+		if rng.Intn(12) == 0 {
+			b = append(b, '\n')
+		} else {
+			b = append(b, ' ')
+		}
+	}
+
+	return b[:size]
+}
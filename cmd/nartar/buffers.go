@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// defaultBufferSize is the size of the buffers file contents are copied
+// through, the one io.Copy uses.
+const defaultBufferSize = 32 << 10
+
+// bufferSize is set by -buffer-size, which every command accepts.
+var bufferSize = defaultBufferSize
+
+// copyBuffers holds the buffers file contents are copied through, so that
+// converting many small files does not allocate one for each.
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, bufferSize)
+		return &b
+	},
+}
+
+func addBufferSizeFlag(fs *flag.FlagSet) {
+	fs.Func("buffer-size", "size of the buffers file contents are copied through, such as 1M (default 32K)", func(v string) error {
+		n, err := parseByteSize(v)
+		if err != nil {
+			return err
+		}
+
+		if n < 1<<10 || n > 1<<30 {
+			return fmt.Errorf("-buffer-size must be between 1K and 1G")
+		}
+
+		bufferSize = int(n)
+
+		return nil
+	})
+}
+
+// copyContents copies src to dst through a pooled buffer, as io.Copy does.
+func copyContents(dst io.Writer, src io.Reader) (int64, error) {
+	b := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(b)
+
+	return io.CopyBuffer(dst, src, *b)
+}
+
+// copyContentsN copies n bytes from src to dst through a pooled buffer, as
+// io.CopyN does.
+func copyContentsN(dst io.Writer, src io.Reader, n int64) (int64, error) {
+	written, err := copyContents(dst, io.LimitReader(src, n))
+	if written == n {
+		return n, nil
+	}
+
+	if err == nil {
+		err = io.EOF
+	}
+
+	return written, err
+}
+
+// maxScratchSize is the capacity above which a scratch buffer is dropped
+// instead of being kept for reuse.
+const maxScratchSize = 4 << 20
+
+// scratchBuffers holds growable buffers for file contents that are only
+// needed while a file is written.
+var scratchBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// withScratch reads r, of size bytes, into a reused buffer and calls use
+// with the contents, which must not be kept after it returns.
+func withScratch(r io.Reader, size int64, use func([]byte) error) error {
+	buf := scratchBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	defer func() {
+		if buf.Cap() <= maxScratchSize {
+			scratchBuffers.Put(buf)
+		}
+	}()
+
+	buf.Grow(int(size))
+
+	if _, err := buf.ReadFrom(r); err != nil {
+		return fmt.Errorf("reading file content: %w", err)
+	}
+
+	return use(buf.Bytes())
+}
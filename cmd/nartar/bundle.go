@@ -0,0 +1,416 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/nixhash"
+	"github.com/nix-community/go-nix/pkg/storepath"
+	"github.com/nix-community/go-nix/pkg/wire"
+)
+
+// bundleManifestName is the tar member describing the store paths in a
+// bundle. Store path names always start with a hash, so it cannot clash.
+const bundleManifestName = "manifest.json"
+
+// bundleManifest lists the store paths of a closure bundle in the order they
+// were added, which is also the order they are written out again.
+type bundleManifest struct {
+	Version int          `json:"version"`
+	Paths   []bundlePath `json:"paths"`
+}
+
+type bundlePath struct {
+	Path       string   `json:"path"`
+	NarHash    string   `json:"narHash"`
+	NarSize    int64    `json:"narSize"`
+	References []string `json:"references"`
+	Deriver    string   `json:"deriver,omitempty"`
+}
+
+// narsToBundle writes a tar holding each store path under its hash-name
+// directory, followed by the manifest. Plain NAR inputs must be named
+// <hash>-<name>.nar; export streams carry their own store paths and may
+// hold several of them. known are registrations supplying the references
+// and deriver of plain NARs, and checking the NAR hashes of all of them.
+// The registration of the bundle is written to the file registration if
+// it is not empty.
+func narsToBundle(inputs []string, format string, out io.Writer, opts *tarOptions, known map[string]*bundlePath, registration string) error {
+	tw := tar.NewWriter(out)
+	defer tw.Close()
+
+	manifest := &bundleManifest{Version: 1}
+	seen := make(map[string]bool)
+
+	add := func(r io.Reader, info *exportInfo) error {
+		sp, err := storepath.FromAbsolutePath(info.storePath)
+		if err != nil {
+			return fmt.Errorf("invalid store path %q: %w", info.storePath, err)
+		}
+
+		if seen[sp.String()] {
+			return fmt.Errorf("store path %s occurs more than once", info.storePath)
+		}
+		seen[sp.String()] = true
+
+		h := sha256.New()
+		cr := &countingReader{r: io.TeeReader(r, h)}
+
+		if err := writeNarToTar(cr, out, tw, sp.String(), true, opts); err != nil {
+			return fmt.Errorf("adding %s: %w", info.storePath, err)
+		}
+
+		bp := bundlePath{
+			Path:       info.storePath,
+			NarHash:    narHashString(h.Sum(nil)),
+			NarSize:    cr.n,
+			References: append([]string{}, info.references...),
+			Deriver:    info.deriver,
+		}
+
+		if reg := known[info.storePath]; reg != nil {
+			if reg.NarHash != "" && reg.NarHash != bp.NarHash {
+				return fmt.Errorf("NAR hash mismatch for %s: registration has %s, contents give %s", bp.Path, reg.NarHash, bp.NarHash)
+			}
+
+			if reg.NarSize != 0 && reg.NarSize != bp.NarSize {
+				return fmt.Errorf("NAR size mismatch for %s: registration has %d, contents give %d", bp.Path, reg.NarSize, bp.NarSize)
+			}
+
+			if len(bp.References) == 0 {
+				bp.References = reg.References
+			}
+
+			if bp.Deriver == "" {
+				bp.Deriver = reg.Deriver
+			}
+		}
+
+		manifest.Paths = append(manifest.Paths, bp)
+
+		return nil
+	}
+
+	for _, name := range inputs {
+		if err := addBundleInput(name, format, add); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	b = append(b, '\n')
+
+	th := &tar.Header{
+		Name:     bundleManifestName,
+		Mode:     opts.modes.file,
+		Size:     int64(len(b)),
+		ModTime:  opts.mtime,
+		Typeflag: tar.TypeReg,
+	}
+
+	if err := opts.setFormat(th); err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(th); err != nil {
+		return fmt.Errorf("writing bundle manifest: %w", err)
+	}
+
+	if _, err := tw.Write(b); err != nil {
+		return fmt.Errorf("writing bundle manifest: %w", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if registration != "" {
+		return writeRegistrationFile(registration, manifest.Paths)
+	}
+
+	return nil
+}
+
+func addBundleInput(name string, format string, add func(io.Reader, *exportInfo) error) error {
+	in, err := openInput(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	switch format {
+	case narFormatPlain:
+		if isStdio(name) {
+			return fmt.Errorf("plain NAR inputs must be files named <hash>-<name>.nar")
+		}
+
+		base := strings.TrimSuffix(filepath.Base(name), ".nar")
+
+		sp, err := storepath.FromString(base)
+		if err != nil {
+			return fmt.Errorf("cannot derive a store path from %q: %w", name, err)
+		}
+
+		return add(in, &exportInfo{storePath: sp.Absolute()})
+	case narFormatExport:
+		for {
+			more, err := wire.ReadUint64(in)
+			if err != nil {
+				return fmt.Errorf("reading export stream %s: %w", name, err)
+			}
+
+			if more == 0 {
+				return nil
+			}
+
+			if more != 1 {
+				return fmt.Errorf("%s is not a nix-store export stream", name)
+			}
+
+			// The store path follows the NAR, so the NAR has to be held
+			// until its name is known.
+			data, err := readNarBytes(in)
+			if err != nil {
+				return fmt.Errorf("reading export stream %s: %w", name, err)
+			}
+
+			info, err := readExportTrailer(in)
+			if err != nil {
+				return fmt.Errorf("reading export stream %s: %w", name, err)
+			}
+
+			if err := add(bytes.NewReader(data), info); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported NAR format %q", format)
+	}
+}
+
+// readNarBytes returns the raw bytes of the NAR at the start of r, leaving r
+// positioned right after it.
+func readNarBytes(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+
+	nr, err := nar.NewReader(io.TeeReader(checkedNar(r), &buf))
+	if nn := notNar(err); nn != nil {
+		return nil, nn
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("opening nar: %w", err)
+	}
+	defer nr.Close()
+
+	// The NAR is held in memory, so it is held to the -max-* limits.
+	limited := &limitedNarReader{Reader: nr}
+
+	for {
+		_, err := limited.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("reading nar header: %w", err)
+		}
+
+		if _, err := io.Copy(io.Discard, nr); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// bundleToNars splits a closure bundle back into NARs. With the plain format
+// each store path is written to dir/<hash>-<name>.nar; with the export format
+// all of them are written to output as one nix-store --import stream. The
+// registration of the store paths is written to the file registration if it
+// is not empty.
+func bundleToNars(in io.Reader, output string, format string, opts *readOptions, registration string) error {
+	entries := newEntryTree()
+	if err := readTarEntries(tar.NewReader(in), "", entries, opts); err != nil {
+		return err
+	}
+
+	mentry := entries.get("/" + bundleManifestName)
+	if mentry == nil || mentry.kind != tar.TypeReg {
+		return fmt.Errorf("bundle has no %s", bundleManifestName)
+	}
+	entries.remove("/"+bundleManifestName, false)
+
+	mdata, err := mentry.contents()
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", bundleManifestName, err)
+	}
+
+	var manifest bundleManifest
+	if err := json.Unmarshal(mdata, &manifest); err != nil {
+		return fmt.Errorf("parsing %s: %w", bundleManifestName, err)
+	}
+
+	if manifest.Version != 1 {
+		return fmt.Errorf("unsupported bundle version %d", manifest.Version)
+	}
+
+	groups := make(map[string]*entryTree)
+
+	entries.walk(func(p string, e *tarEntry) error {
+		if p == "/" {
+			return nil
+		}
+
+		top, rest, _ := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+
+		if groups[top] == nil {
+			groups[top] = newEntryTree()
+		}
+
+		groups[top].set("/"+rest, fileSpool.link(e))
+
+		return nil
+	})
+
+	var out io.WriteCloser
+
+	switch format {
+	case narFormatPlain:
+		if output == "" || isStdio(output) {
+			return fmt.Errorf("-o must name the output directory")
+		}
+
+		if err := os.MkdirAll(output, 0o755); err != nil {
+			return err
+		}
+	case narFormatExport:
+		if output == "" {
+			output = "-"
+		}
+
+		var err error
+		if out, err = openOutput(output); err != nil {
+			return err
+		}
+		defer out.Close()
+	default:
+		return fmt.Errorf("unsupported NAR format %q", format)
+	}
+
+	for _, bp := range manifest.Paths {
+		sp, err := storepath.FromAbsolutePath(bp.Path)
+		if err != nil {
+			return fmt.Errorf("invalid store path %q in manifest: %w", bp.Path, err)
+		}
+
+		group := groups[sp.String()]
+		if group == nil {
+			return fmt.Errorf("bundle has no contents for %s", bp.Path)
+		}
+		delete(groups, sp.String())
+
+		var buf bytes.Buffer
+		if err := writeNarEntries(group, &buf); err != nil {
+			return fmt.Errorf("writing nar for %s: %w", bp.Path, err)
+		}
+
+		sum := sha256.Sum256(buf.Bytes())
+		if got := narHashString(sum[:]); bp.NarHash != "" && got != bp.NarHash {
+			return fmt.Errorf("NAR hash mismatch for %s: manifest has %s, contents give %s", bp.Path, bp.NarHash, got)
+		}
+
+		if bp.NarSize != 0 && bp.NarSize != int64(buf.Len()) {
+			return fmt.Errorf("NAR size mismatch for %s: manifest has %d, contents give %d", bp.Path, bp.NarSize, buf.Len())
+		}
+
+		if format == narFormatPlain {
+			name := filepath.Join(output, sp.String()+".nar")
+
+			f, err := createOutputFile(name)
+			if errors.Is(err, errNoClobber) {
+				warnf("%v", err)
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if _, err := f.Write(buf.Bytes()); err != nil {
+				f.Close()
+				return err
+			}
+
+			if err := f.Close(); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := wire.WriteUint64(out, 1); err != nil {
+			return err
+		}
+
+		if _, err := out.Write(buf.Bytes()); err != nil {
+			return err
+		}
+
+		info := &exportInfo{storePath: bp.Path, references: bp.References, deriver: bp.Deriver}
+		if err := writeExportTrailer(out, info); err != nil {
+			return err
+		}
+	}
+
+	for name := range groups {
+		return fmt.Errorf("bundle entry %s is not listed in %s", name, bundleManifestName)
+	}
+
+	if registration != "" {
+		if err := writeRegistrationFile(registration, manifest.Paths); err != nil {
+			return err
+		}
+	}
+
+	if format == narFormatExport {
+		if err := wire.WriteUint64(out, 0); err != nil {
+			return err
+		}
+
+		return out.Close()
+	}
+
+	return nil
+}
+
+// narHashString formats a NAR hash the way narinfo files and Nix itself do.
+func narHashString(digest []byte) string {
+	return nixhash.MustNewHashWithEncoding(nixhash.SHA256, digest, nixhash.NixBase32, true).String()
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+
+	return n, err
+}
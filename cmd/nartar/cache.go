@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// binaryCache is where nar2narinfo and push store a compressed NAR and its
+// narinfo, and pull fetches them from, under the names Nix looks for:
+// nar/<file hash>.nar.<ext> and <store path hash>.narinfo.
+type binaryCache interface {
+	// get opens the file name, failing with an os.ErrNotExist error if the
+	// cache does not have it.
+	get(name string) (io.ReadCloser, error)
+	// getRange opens size bytes of the file name from offset.
+	getRange(name string, offset, size int64) (io.ReadCloser, error)
+	// spoolDir is the directory to compress the NAR into before it is stored.
+	spoolDir() (string, error)
+	// has reports whether the narinfo name is already stored and should be
+	// left alone.
+	has(name string) (bool, error)
+	// putNar stores the compressed NAR in the file spooled under name.
+	putNar(spooled, name string) error
+	// putFile stores a narinfo or listing b under name, with the content
+	// type and encoding it is served with over HTTP.
+	putFile(name string, b []byte, contentType, contentEncoding string) error
+}
+
+// localCache is a binary cache in a local directory, as written by
+// nix copy --to file://DIR.
+type localCache struct {
+	dir string
+}
+
+func (c *localCache) get(name string) (io.ReadCloser, error) {
+	return os.Open(c.path(name))
+}
+
+func (c *localCache) getRange(name string, offset, size int64) (io.ReadCloser, error) {
+	f, err := os.Open(c.path(name))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return readCloser{Reader: io.LimitReader(f, size), Closer: f}, nil
+}
+
+// path is the file of name, without the query string Harmonia adds to the
+// URLs of its NARs.
+func (c *localCache) path(name string) string {
+	name, _, _ = strings.Cut(name, "?")
+	return filepath.Join(c.dir, filepath.FromSlash(name))
+}
+
+func (c *localCache) spoolDir() (string, error) {
+	nars := filepath.Join(c.dir, "nar")
+	if err := os.MkdirAll(nars, 0o755); err != nil {
+		return "", err
+	}
+
+	return nars, nil
+}
+
+// has leaves an existing narinfo to putFile, which asks before
+// overwriting it as any output file.
+func (c *localCache) has(string) (bool, error) {
+	return false, nil
+}
+
+// putNar moves the NAR into place. It is named by its hash, so an existing
+// one is the same.
+func (c *localCache) putNar(spooled, name string) error {
+	return os.Rename(spooled, filepath.Join(c.dir, filepath.FromSlash(name)))
+}
+
+func (c *localCache) putFile(name string, b []byte, _, _ string) error {
+	out, err := openTextOutput(filepath.Join(c.dir, name))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := out.Write(b); err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+
+	return out.Close()
+}
+
+// httpCache is a binary cache that accepts uploads with HTTP PUT, as
+// nix-serve-ng and most object stores behind a proxy do. The caches Harmonia
+// and Attic serve are read the same way.
+type httpCache struct {
+	base    *url.URL
+	headers http.Header
+	client  *http.Client
+	// sign, if set, authenticates each request, as S3 requires.
+	sign func(req *http.Request) error
+}
+
+// cacheAuthOptions are the credentials sent to an HTTP binary cache.
+type cacheAuthOptions struct {
+	headers http.Header
+	token   string
+}
+
+func addCacheAuthFlags(fs *flag.FlagSet) *cacheAuthOptions {
+	a := &cacheAuthOptions{headers: make(http.Header)}
+
+	fs.Func("header", "'Name: value' header sent with every request to the cache (repeatable)", func(v string) error {
+		name, value, ok := strings.Cut(v, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("expected 'Name: value'")
+		}
+
+		a.headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+
+		return nil
+	})
+	fs.StringVar(&a.token, "token", "", "bearer token sent to the cache, as Attic expects")
+	addLimitRateFlag(fs)
+
+	return a
+}
+
+// openBinaryCache returns the binary cache at spec: an http:// or https://
+// URL, whose user information if any is sent with basic authentication, an
+// attic+https:// URL, an s3:// URL, or a local directory, given as a path or
+// a file:// URL.
+func openBinaryCache(spec string, auth *cacheAuthOptions) (binaryCache, error) {
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme == "" {
+		return &localCache{dir: spec}, nil
+	}
+
+	switch u.Scheme {
+	case "file":
+		return &localCache{dir: u.Path}, nil
+	case "http", "https":
+		headers := auth.headers.Clone()
+		if auth.token != "" && headers.Get("Authorization") == "" {
+			headers.Set("Authorization", "Bearer "+auth.token)
+		}
+
+		u.Path = strings.TrimSuffix(u.Path, "/")
+
+		return &httpCache{base: u, headers: headers, client: http.DefaultClient}, nil
+	case "s3":
+		return openS3Cache(u)
+	case "attic+http", "attic+https":
+		return openAtticCache(u, auth)
+	default:
+		return nil, fmt.Errorf("unsupported binary cache URL %q (use http://, https://, attic+https://, s3:// or a directory)", spec)
+	}
+}
+
+// url is the URL of the file name, which may end in a query string, as the
+// NAR URLs in Harmonia's narinfos do.
+func (c *httpCache) url(name string) string {
+	return c.fileURL(name).String()
+}
+
+// redacted is the cache URL without its password, for messages.
+func (c *httpCache) redacted(name string) string {
+	return c.fileURL(name).Redacted()
+}
+
+func (c *httpCache) fileURL(name string) *url.URL {
+	u := *c.base
+	name, u.RawQuery, _ = strings.Cut(name, "?")
+	u.Path += "/" + name
+
+	return &u
+}
+
+func (c *httpCache) get(name string) (io.ReadCloser, error) {
+	resp, err := c.do(http.MethodGet, name, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+
+		// S3 answers 403 for missing files, as for exists.
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden {
+			return nil, fmt.Errorf("GET %s: %s: %w", c.redacted(name), resp.Status, os.ErrNotExist)
+		}
+
+		return nil, fmt.Errorf("GET %s: %s", c.redacted(name), resp.Status)
+	}
+
+	return newReadAheadBody(resp.Body), nil
+}
+
+// getRange asks for the range with a Range header, and skips to it if the
+// server sends the whole file instead.
+func (c *httpCache) getRange(name string, offset, size int64) (io.ReadCloser, error) {
+	if size == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+size-1)}}
+
+	resp, err := c.do(http.MethodGet, name, nil, 0, header)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: %w", c.redacted(name), err)
+		}
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", c.redacted(name), resp.Status)
+	}
+
+	body := newReadAheadBody(resp.Body)
+
+	return readCloser{Reader: io.LimitReader(body, size), Closer: body}, nil
+}
+
+func (c *httpCache) spoolDir() (string, error) {
+	return os.TempDir(), nil
+}
+
+// has reports whether the narinfo is already in the cache, which is then
+// left alone unless -force is given.
+func (c *httpCache) has(name string) (bool, error) {
+	exists, err := c.exists(name)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	if clobber == clobberForce {
+		return false, nil
+	}
+
+	if verbosity > 0 {
+		clearProgress()
+		fmt.Fprintf(os.Stderr, "%s is already in the cache\n", c.redacted(name))
+	}
+
+	return true, nil
+}
+
+// putNar uploads the NAR unless the cache has it already, which it then has
+// with the same contents since it is named by its hash.
+func (c *httpCache) putNar(spooled, name string) error {
+	if exists, err := c.exists(name); err != nil || exists {
+		return err
+	}
+
+	f, err := os.Open(spooled)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return c.put(name, f, fi.Size(), "application/x-nix-nar", "")
+}
+
+func (c *httpCache) putFile(name string, b []byte, contentType, contentEncoding string) error {
+	return c.put(name, bytes.NewReader(b), int64(len(b)), contentType, contentEncoding)
+}
+
+// exists reports whether the cache has the file name. A 403 is taken as
+// absent, as S3 answers it for missing files without the right to list them.
+func (c *httpCache) exists(name string) (bool, error) {
+	resp, err := c.do(http.MethodHead, name, nil, 0, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	case resp.StatusCode/100 == 2:
+		return true, nil
+	default:
+		return false, fmt.Errorf("HEAD %s: %s", c.redacted(name), resp.Status)
+	}
+}
+
+func (c *httpCache) put(name string, body io.Reader, size int64, contentType, contentEncoding string) error {
+	header := http.Header{"Content-Type": {contentType}}
+	if contentEncoding != "" {
+		header.Set("Content-Encoding", contentEncoding)
+	}
+
+	resp, err := c.do(http.MethodPut, name, body, size, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+		err := fmt.Errorf("PUT %s: %s", c.redacted(name), resp.Status)
+		if s := strings.TrimSpace(string(msg)); s != "" {
+			err = fmt.Errorf("%w: %s", err, s)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (c *httpCache) do(method, name string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.url(name), limitReader(body, uploadLimit))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range c.headers {
+		req.Header[k] = v
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	if c.sign != nil {
+		if err := c.sign(req); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+
+		return nil, fmt.Errorf("%s %s: %w", method, c.redacted(name), err)
+	}
+
+	if limitRate > 0 {
+		resp.Body = readCloser{Reader: limitReader(resp.Body, downloadLimit), Closer: resp.Body}
+	}
+
+	return resp, nil
+}
+
+// runPush adds a NAR to a binary cache, local or over HTTP, as
+// nix copy --to does.
+func runPush(args []string) error {
+	fs := flag.NewFlagSet("push", flag.ContinueOnError)
+	input, output := addIOFlags(fs, "-", "input NAR file ('-' for stdin)", "", "binary cache to upload to: an http://, https://, attic+https:// or s3:// URL or a directory")
+	narFormat := addNarFormatFlags(fs, narInput)
+	opts := addNarinfoFlags(fs)
+	auth := addCacheAuthFlags(fs)
+	if err := parseIOArgs(fs, args); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return fmt.Errorf("-o must name the binary cache")
+	}
+
+	cache, err := openBinaryCache(*output, auth)
+	if err != nil {
+		return err
+	}
+
+	// Attic compresses what it stores itself.
+	if _, ok := cache.(*atticCache); ok {
+		set := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+		if set["compression"] && opts.compression != "none" {
+			return fmt.Errorf("attic caches take the NAR uncompressed; drop -compression")
+		}
+
+		opts.compression = "none"
+	}
+
+	return addNarToCache(*input, narFormat, cache, opts)
+}
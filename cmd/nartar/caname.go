@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+)
+
+// caName is set by -ca-name, which names output files after the SHA-256 of
+// their contents, as binary caches name their NARs.
+var caName = false
+
+// caOutputs are the outputs written to temporary files for -ca-name. They
+// get their names once the command has succeeded, and are removed if it
+// fails. Batch conversions running at once add to them under caOutputsMu.
+var (
+	caOutputs   []*caOutput
+	caOutputsMu sync.Mutex
+)
+
+// caOutput is an output file written under a temporary name and hashed as
+// it is written.
+type caOutput struct {
+	*os.File
+	h hash.Hash
+
+	// name is the output as given, whose directory and extensions the
+	// final name keeps.
+	name string
+}
+
+// openCAOutput opens a temporary file next to the output name for -ca-name.
+func openCAOutput(name string) (*caOutput, error) {
+	dir := filepath.Dir(name)
+	if strings.HasSuffix(name, "/") {
+		dir = name
+	} else if fi, err := os.Stat(name); err == nil && fi.IsDir() {
+		dir = name
+	}
+
+	f, err := os.CreateTemp(dir, ".nartar-*")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &caOutput{File: f, h: sha256.New(), name: name}
+	caOutputsMu.Lock()
+	caOutputs = append(caOutputs, c)
+	caOutputsMu.Unlock()
+
+	return c, nil
+}
+
+func (c *caOutput) Write(b []byte) (int, error) {
+	n, err := c.File.Write(b)
+	c.h.Write(b[:n])
+
+	return n, err
+}
+
+// finalName is the output's name for its hash: the hash, in the directory
+// that -o names or in the directory of the file it names with the file's
+// extensions, so that -o nar/.nar.zst gives nar/<hash>.nar.zst.
+func (c *caOutput) finalName() string {
+	digest := nixbase32.EncodeToString(c.h.Sum(nil))
+
+	if filepath.Dir(c.File.Name()) == filepath.Clean(c.name) {
+		return filepath.Join(c.name, digest)
+	}
+
+	base := filepath.Base(c.name)
+
+	ext := ""
+	if i := strings.Index(base, "."); i >= 0 {
+		ext = base[i:]
+	}
+
+	return filepath.Join(filepath.Dir(c.name), digest+ext)
+}
+
+// commitCAOutputs gives the -ca-name outputs their names and prints them. An
+// existing file of the same name has the same contents, and is replaced.
+func commitCAOutputs() error {
+	for _, c := range caOutputs {
+		c.File.Close()
+
+		final := c.finalName()
+
+		if err := os.Chmod(c.File.Name(), 0o644); err != nil {
+			return err
+		}
+
+		if err := os.Rename(c.File.Name(), final); err != nil {
+			return err
+		}
+
+		fmt.Println(final)
+	}
+
+	caOutputs = nil
+
+	return nil
+}
+
+// removeCAOutputs removes the temporary files of a failed command.
+func removeCAOutputs() {
+	for _, c := range caOutputs {
+		c.File.Close()
+		os.Remove(c.File.Name())
+	}
+
+	caOutputs = nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// caseHackSuffix is what Nix appends, with a number, to names that differ
+// only in case from an earlier sibling when it unpacks a NAR on a
+// case-insensitive file system such as macOS's.
+const caseHackSuffix = "~nix~case~hack~"
+
+// stripCaseHack removes the case hack suffixes from the elements of p.
+func stripCaseHack(p string) string {
+	if !strings.Contains(p, caseHackSuffix) {
+		return p
+	}
+
+	elems := strings.Split(p, "/")
+	for i, elem := range elems {
+		if j := strings.LastIndex(elem, caseHackSuffix); j > 0 {
+			if _, err := strconv.ParseUint(elem[j+len(caseHackSuffix):], 10, 32); err == nil {
+				elems[i] = elem[:j]
+			}
+		}
+	}
+
+	return strings.Join(elems, "/")
+}
+
+// unhack applies -case-hack to the NAR path p of nar2tar, stripping its
+// suffixes. seen maps the paths returned so far to the NAR paths they came
+// from, to catch two entries that only the suffix told apart.
+func (m *pathMap) unhack(p string, seen map[string]string) (string, error) {
+	if m == nil || !m.caseHack {
+		return p, nil
+	}
+
+	stripped := stripCaseHack(p)
+
+	if prev, ok := seen[stripped]; ok && prev != p {
+		return "", fmt.Errorf("%s and %s are the same path without the case hack suffix", prev, p)
+	}
+
+	seen[stripped] = p
+
+	return stripped, nil
+}
+
+// addCaseHack applies -case-hack to the entries of tar2nar: as Nix does, in
+// NAR order, a name equal to an earlier sibling's but for ASCII case gets the
+// suffix and the number of such names before it. The contents of renamed
+// directories move with them.
+func (m *pathMap) addCaseHack(entries *entryTree) (*entryTree, error) {
+	if m == nil || !m.caseHack {
+		return entries, nil
+	}
+
+	out := newEntryTree()
+	renamed := make(map[string]string)
+	collisions := make(map[string]int)
+
+	err := entries.walk(func(p string, entry *tarEntry) error {
+		if p == "/" {
+			out.set(p, entry)
+			return nil
+		}
+
+		dir, name := path.Split(p)
+		dir = path.Clean(dir)
+
+		if r, ok := renamed[dir]; ok {
+			dir = r
+		}
+
+		key := dir + "/" + asciiLower(name)
+		if n, ok := collisions[key]; ok {
+			collisions[key] = n + 1
+			hacked := name + caseHackSuffix + strconv.Itoa(n+1)
+			if err := warnCategory(warnCaseHack, "case collision: storing %s as %s", path.Join(dir, name), hacked); err != nil {
+				return err
+			}
+
+			name = hacked
+		} else {
+			collisions[key] = 0
+		}
+
+		np := path.Join(dir, name)
+		if np != p {
+			renamed[p] = np
+		}
+
+		out.set(np, entry)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+
+		return r
+	}, s)
+}
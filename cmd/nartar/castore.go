@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+	"lukechampine.com/blake3"
+)
+
+// The tvix castore stores file contents as blobs and directories as
+// protobuf Directory messages, both addressed by their BLAKE3 digest:
+//
+//	message Directory {
+//	  repeated DirectoryNode directories = 1;
+//	  repeated FileNode files = 2;
+//	  repeated SymlinkNode symlinks = 3;
+//	}
+//	message DirectoryNode { bytes name = 1; bytes digest = 2; uint64 size = 3; }
+//	message FileNode { bytes name = 1; bytes digest = 2; uint64 size = 3; bool executable = 4; }
+//	message SymlinkNode { bytes name = 1; bytes target = 2; }
+//	message Node { oneof node { DirectoryNode directory = 1; FileNode file = 2; SymlinkNode symlink = 3; } }
+//
+// A directory's digest is that of its encoding, with the fields in order and
+// zero values left out, as protobuf encodes them deterministically.
+const castoreDigestLen = 32
+
+// castoreNode is a DirectoryNode, FileNode or SymlinkNode. The size of a
+// file is its length; that of a directory counts all the nodes below it.
+type castoreNode struct {
+	kind       nar.NodeType
+	name       string
+	digest     []byte
+	size       uint64
+	executable bool
+	target     string
+}
+
+// castoreDirectory is a Directory, each of its lists sorted by name.
+type castoreDirectory struct {
+	dirs, files, symlinks []castoreNode
+}
+
+// runNarToCastore adds the contents of a NAR to a castore directory, as
+// blobs and directories, and prints its root node.
+func runNarToCastore(args []string) error {
+	fs := flag.NewFlagSet("nar2castore", flag.ContinueOnError)
+	input, output := addIOFlags(fs, "-", "input NAR file ('-' for stdin)", "", "castore directory")
+	rootNode := fs.String("root-node", "", "also write the root node to this file as a protobuf Node")
+	addNarCheckFlags(fs)
+	if err := parseIOArgs(fs, args); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return fmt.Errorf("-o must name the castore directory")
+	}
+
+	in, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	root, err := narToCastore(in, *output)
+	if err != nil {
+		return err
+	}
+
+	if *rootNode != "" {
+		if err := os.WriteFile(*rootNode, encodeCastoreRoot(root), 0o644); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println(formatCastoreNode(root))
+
+	return nil
+}
+
+// runCastoreToNar writes the NAR of a node in a castore directory: a
+// directory named by its digest, or any node read from -root-node.
+func runCastoreToNar(args []string) error {
+	fs := flag.NewFlagSet("castore2nar", flag.ContinueOnError)
+	input, output := addIOFlags(fs, "", "castore directory", "-", "output NAR file ('-' for stdout)")
+	rootDigest := fs.String("root", "", "digest of the root directory, as b3:<base64> or hex")
+	rootNode := fs.String("root-node", "", "file holding the root node as a protobuf Node")
+	if err := parseIOArgs(fs, args); err != nil {
+		return err
+	}
+
+	if *input == "" {
+		return fmt.Errorf("-i must name the castore directory")
+	}
+
+	var root castoreNode
+
+	switch {
+	case *rootDigest != "" && *rootNode != "":
+		return fmt.Errorf("-root and -root-node cannot be combined")
+	case *rootDigest != "":
+		digest, err := parseCastoreDigest(*rootDigest)
+		if err != nil {
+			return err
+		}
+
+		root = castoreNode{kind: nar.TypeDirectory, digest: digest}
+	case *rootNode != "":
+		b, err := os.ReadFile(*rootNode)
+		if err != nil {
+			return err
+		}
+
+		if root, err = decodeCastoreRoot(b); err != nil {
+			return fmt.Errorf("reading %s: %w", *rootNode, err)
+		}
+	default:
+		return fmt.Errorf("castore2nar needs -root or -root-node")
+	}
+
+	out, err := openOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	nw, err := nar.NewWriter(out)
+	if err != nil {
+		return fmt.Errorf("creating nar writer: %w", err)
+	}
+
+	// The size of a directory given by its digest alone is not checked.
+	if _, err := writeCastoreNode(nw, *input, "/", root, *rootDigest == ""); err != nil {
+		return err
+	}
+
+	if err := nw.Close(); err != nil {
+		return fmt.Errorf("closing nar writer: %w", err)
+	}
+
+	return out.Close()
+}
+
+// narToCastore stores the blobs and directories of the NAR in the castore
+// directory store and returns its root node.
+func narToCastore(in io.Reader, store string) (castoreNode, error) {
+	var root castoreNode
+
+	nr, err := newNarReader(in)
+	if err != nil {
+		return root, fmt.Errorf("opening nar: %w", err)
+	}
+	defer nr.Close()
+
+	// open holds the directories being read, innermost last.
+	type openDir struct {
+		path string
+		dir  castoreDirectory
+	}
+
+	var open []*openDir
+
+	add := func(n castoreNode) {
+		if len(open) == 0 {
+			root = n
+			return
+		}
+
+		d := &open[len(open)-1].dir
+
+		switch n.kind {
+		case nar.TypeDirectory:
+			d.dirs = append(d.dirs, n)
+		case nar.TypeRegular:
+			d.files = append(d.files, n)
+		default:
+			d.symlinks = append(d.symlinks, n)
+		}
+	}
+
+	closeDir := func() error {
+		top := open[len(open)-1]
+		open = open[:len(open)-1]
+
+		digest, _, err := putCastoreObject(store, "directories", bytes.NewReader(encodeCastoreDirectory(&top.dir)))
+		if err != nil {
+			return err
+		}
+
+		add(castoreNode{
+			kind:   nar.TypeDirectory,
+			name:   path.Base(top.path),
+			digest: digest,
+			size:   top.dir.size(),
+		})
+
+		return nil
+	}
+
+	for {
+		hdr, err := nr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return root, fmt.Errorf("reading nar header: %w", err)
+		}
+
+		logNarEntry(hdr)
+
+		for len(open) > 0 && !strings.HasPrefix(hdr.Path, strings.TrimSuffix(open[len(open)-1].path, "/")+"/") {
+			if err := closeDir(); err != nil {
+				return root, err
+			}
+		}
+
+		n := castoreNode{kind: hdr.Type, name: path.Base(hdr.Path)}
+		if hdr.Path == "/" {
+			n.name = ""
+		}
+
+		switch hdr.Type {
+		case nar.TypeDirectory:
+			open = append(open, &openDir{path: hdr.Path})
+			continue
+		case nar.TypeRegular:
+			digest, size, err := putCastoreObject(store, "blobs", nr)
+			if err != nil {
+				return root, fmt.Errorf("storing %s: %w", hdr.Path, err)
+			}
+
+			n.digest, n.size, n.executable = digest, uint64(size), hdr.Executable
+		case nar.TypeSymlink:
+			n.target = hdr.LinkTarget
+		}
+
+		add(n)
+	}
+
+	for len(open) > 0 {
+		if err := closeDir(); err != nil {
+			return root, err
+		}
+	}
+
+	root.name = ""
+
+	return root, nil
+}
+
+// writeCastoreNode writes n to nw at p, reading blobs and directories from
+// store and checking them against their digests, and returns the number of
+// nodes below it. With checkSize the size of a directory node is checked
+// against that count.
+func writeCastoreNode(nw *nar.Writer, store, p string, n castoreNode, checkSize bool) (uint64, error) {
+	switch n.kind {
+	case nar.TypeSymlink:
+		return 0, nw.WriteHeader(&nar.Header{Path: p, Type: nar.TypeSymlink, LinkTarget: n.target})
+	case nar.TypeRegular:
+		return 0, writeCastoreBlob(nw, store, p, n)
+	}
+
+	b, err := readCastoreObject(store, "directories", n.digest)
+	if err != nil {
+		return 0, err
+	}
+
+	dir, err := decodeCastoreDirectory(b)
+	if err != nil {
+		return 0, fmt.Errorf("directory %s: %w", castoreDigest(n.digest), err)
+	}
+
+	if err := nw.WriteHeader(&nar.Header{Path: p, Type: nar.TypeDirectory}); err != nil {
+		return 0, err
+	}
+
+	var size uint64
+
+	for _, child := range dir.sorted() {
+		below, err := writeCastoreNode(nw, store, path.Join(p, child.name), child, true)
+		if err != nil {
+			return 0, err
+		}
+
+		size += 1 + below
+	}
+
+	if checkSize && size != n.size {
+		return 0, fmt.Errorf("directory %s holds %d nodes, its parent says %d", castoreDigest(n.digest), size, n.size)
+	}
+
+	return size, nil
+}
+
+func writeCastoreBlob(nw *nar.Writer, store, p string, n castoreNode) error {
+	f, err := os.Open(castoreObjectPath(store, "blobs", n.digest))
+	if err != nil {
+		return fmt.Errorf("reading blob for %s: %w", p, err)
+	}
+	defer f.Close()
+
+	if err := nw.WriteHeader(&nar.Header{Path: p, Type: nar.TypeRegular, Size: int64(n.size), Executable: n.executable}); err != nil {
+		return err
+	}
+
+	h := blake3.New(castoreDigestLen, nil)
+
+	copied, err := copyContents(io.MultiWriter(nw, h), io.LimitReader(f, int64(n.size)+1))
+	if err != nil {
+		return fmt.Errorf("reading blob for %s: %w", p, err)
+	}
+
+	if uint64(copied) != n.size || !bytes.Equal(h.Sum(nil), n.digest) {
+		return fmt.Errorf("blob %s for %s does not match its digest and size", castoreDigest(n.digest), p)
+	}
+
+	return nil
+}
+
+// castoreObjectPath is where the blob or directory with digest is stored:
+// in the blobs or directories subdirectory of store, named by its hex
+// digest.
+func castoreObjectPath(store, kind string, digest []byte) string {
+	return filepath.Join(store, kind, hex.EncodeToString(digest))
+}
+
+// putCastoreObject stores what r holds as a blob or directory of store,
+// named by its digest, and returns the digest and size.
+func putCastoreObject(store, kind string, r io.Reader) ([]byte, int64, error) {
+	dir := filepath.Join(store, kind)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, 0, err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".object-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := blake3.New(castoreDigestLen, nil)
+
+	n, err := copyContents(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	digest := h.Sum(nil)
+
+	return digest, n, os.Rename(tmp.Name(), castoreObjectPath(store, kind, digest))
+}
+
+// readCastoreObject reads an object of store, checking its digest.
+func readCastoreObject(store, kind string, digest []byte) ([]byte, error) {
+	b, err := os.ReadFile(castoreObjectPath(store, kind, digest))
+	if err != nil {
+		return nil, err
+	}
+
+	if sum := blake3.Sum256(b); !bytes.Equal(sum[:], digest) {
+		return nil, fmt.Errorf("%s %s is corrupt", strings.TrimSuffix(kind, "s"), castoreDigest(digest))
+	}
+
+	return b, nil
+}
+
+// castoreDigest formats a digest as tvix prints them.
+func castoreDigest(digest []byte) string {
+	return "b3:" + base64.StdEncoding.EncodeToString(digest)
+}
+
+func parseCastoreDigest(s string) ([]byte, error) {
+	var (
+		digest []byte
+		err    error
+	)
+
+	if b64, ok := strings.CutPrefix(s, "b3:"); ok {
+		digest, err = base64.StdEncoding.DecodeString(b64)
+	} else {
+		digest, err = hex.DecodeString(s)
+	}
+
+	if err != nil || len(digest) != castoreDigestLen {
+		return nil, fmt.Errorf("invalid castore digest %q (use b3:<base64> or hex)", s)
+	}
+
+	return digest, nil
+}
+
+// formatCastoreNode describes the root node n on one line.
+func formatCastoreNode(n castoreNode) string {
+	switch n.kind {
+	case nar.TypeDirectory:
+		return fmt.Sprintf("directory %s %d", castoreDigest(n.digest), n.size)
+	case nar.TypeRegular:
+		s := fmt.Sprintf("file %s %d", castoreDigest(n.digest), n.size)
+		if n.executable {
+			s += " executable"
+		}
+
+		return s
+	default:
+		return fmt.Sprintf("symlink %q", n.target)
+	}
+}
+
+// size counts the nodes below d.
+func (d *castoreDirectory) size() uint64 {
+	n := uint64(len(d.dirs) + len(d.files) + len(d.symlinks))
+	for _, c := range d.dirs {
+		n += c.size
+	}
+
+	return n
+}
+
+// sorted returns the nodes of d in NAR order.
+func (d *castoreDirectory) sorted() []castoreNode {
+	nodes := append(append(append([]castoreNode(nil), d.dirs...), d.files...), d.symlinks...)
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].name < nodes[j].name })
+
+	return nodes
+}
+
+func encodeCastoreDirectory(d *castoreDirectory) []byte {
+	var b []byte
+
+	for i, nodes := range [][]castoreNode{d.dirs, d.files, d.symlinks} {
+		for _, n := range nodes {
+			b = appendProtoBytes(b, i+1, encodeCastoreNode(n))
+		}
+	}
+
+	return b
+}
+
+// encodeCastoreNode encodes the DirectoryNode, FileNode or SymlinkNode n.
+func encodeCastoreNode(n castoreNode) []byte {
+	b := appendProtoBytes(nil, 1, []byte(n.name))
+
+	if n.kind == nar.TypeSymlink {
+		return appendProtoBytes(b, 2, []byte(n.target))
+	}
+
+	b = appendProtoBytes(b, 2, n.digest)
+	b = appendProtoVarint(b, 3, n.size)
+
+	if n.executable {
+		b = appendProtoVarint(b, 4, 1)
+	}
+
+	return b
+}
+
+// encodeCastoreRoot encodes n as a Node.
+func encodeCastoreRoot(n castoreNode) []byte {
+	field := map[nar.NodeType]int{nar.TypeDirectory: 1, nar.TypeRegular: 2, nar.TypeSymlink: 3}[n.kind]
+
+	return appendProtoBytes(nil, field, encodeCastoreNode(n))
+}
+
+func decodeCastoreRoot(b []byte) (castoreNode, error) {
+	fields, err := parseProto(b)
+	if err != nil {
+		return castoreNode{}, err
+	}
+
+	if len(fields) != 1 || fields[0].num < 1 || fields[0].num > 3 || fields[0].wire != 2 {
+		return castoreNode{}, fmt.Errorf("not a castore Node")
+	}
+
+	kind := []nar.NodeType{nar.TypeDirectory, nar.TypeRegular, nar.TypeSymlink}[fields[0].num-1]
+
+	return decodeCastoreNode(kind, fields[0].data)
+}
+
+// decodeCastoreDirectory decodes and validates a Directory: names must be
+// valid NAR names, sorted and unique across the three lists.
+func decodeCastoreDirectory(b []byte) (*castoreDirectory, error) {
+	fields, err := parseProto(b)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &castoreDirectory{}
+	lists := []*[]castoreNode{&d.dirs, &d.files, &d.symlinks}
+	kinds := []nar.NodeType{nar.TypeDirectory, nar.TypeRegular, nar.TypeSymlink}
+	names := make(map[string]bool)
+
+	for _, f := range fields {
+		if f.num < 1 || f.num > 3 || f.wire != 2 {
+			return nil, fmt.Errorf("unexpected field %d", f.num)
+		}
+
+		n, err := decodeCastoreNode(kinds[f.num-1], f.data)
+		if err != nil {
+			return nil, err
+		}
+
+		if n.name == "" || n.name == "." || n.name == ".." || strings.ContainsAny(n.name, "/\x00") {
+			return nil, fmt.Errorf("invalid name %q", n.name)
+		}
+
+		if names[n.name] {
+			return nil, fmt.Errorf("duplicate name %q", n.name)
+		}
+
+		names[n.name] = true
+
+		list := lists[f.num-1]
+		if len(*list) > 0 && (*list)[len(*list)-1].name > n.name {
+			return nil, fmt.Errorf("%q is out of order", n.name)
+		}
+
+		*list = append(*list, n)
+	}
+
+	return d, nil
+}
+
+func decodeCastoreNode(kind nar.NodeType, b []byte) (castoreNode, error) {
+	fields, err := parseProto(b)
+	if err != nil {
+		return castoreNode{}, err
+	}
+
+	n := castoreNode{kind: kind}
+
+	for _, f := range fields {
+		switch {
+		case f.num == 1 && f.wire == 2:
+			n.name = string(f.data)
+		case f.num == 2 && f.wire == 2 && kind == nar.TypeSymlink:
+			n.target = string(f.data)
+		case f.num == 2 && f.wire == 2:
+			n.digest = f.data
+		case f.num == 3 && f.wire == 0 && kind != nar.TypeSymlink:
+			n.size = f.value
+		case f.num == 4 && f.wire == 0 && kind == nar.TypeRegular:
+			n.executable = f.value != 0
+		default:
+			return n, fmt.Errorf("unexpected field %d in %s node", f.num, kind)
+		}
+	}
+
+	if kind != nar.TypeSymlink && len(n.digest) != castoreDigestLen {
+		return n, fmt.Errorf("%s node %q has no valid digest", kind, n.name)
+	}
+
+	if kind == nar.TypeSymlink && n.target == "" {
+		return n, fmt.Errorf("symlink %q has no target", n.name)
+	}
+
+	return n, nil
+}
+
+// protoField is a varint or length-delimited protobuf field, the only wire
+// types the castore messages use.
+type protoField struct {
+	num   int
+	wire  int
+	value uint64
+	data  []byte
+}
+
+func parseProto(b []byte) ([]protoField, error) {
+	var fields []protoField
+
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid protobuf tag")
+		}
+
+		b = b[n:]
+		f := protoField{num: int(tag >> 3), wire: int(tag & 7)}
+
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid protobuf field %d", f.num)
+		}
+
+		b = b[n:]
+
+		switch f.wire {
+		case 0:
+			f.value = v
+		case 2:
+			if v > uint64(len(b)) {
+				return nil, fmt.Errorf("truncated protobuf field %d", f.num)
+			}
+
+			f.data, b = b[:v], b[v:]
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", f.wire)
+		}
+
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
+
+// appendProtoBytes appends a length-delimited field, unless it is empty.
+func appendProtoBytes(b []byte, num int, data []byte) []byte {
+	if len(data) == 0 {
+		return b
+	}
+
+	b = binary.AppendUvarint(b, uint64(num)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+
+	return append(b, data...)
+}
+
+// appendProtoVarint appends a varint field, unless it is zero.
+func appendProtoVarint(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = binary.AppendUvarint(b, uint64(num)<<3)
+
+	return binary.AppendUvarint(b, v)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+)
+
+// chunkIndexVersion is the version of the index format nar2chunks writes.
+const chunkIndexVersion = 1
+
+// defaultChunkSize is the average chunk size, as with casync and desync;
+// chunks are cut between a quarter and four times it.
+const defaultChunkSize = 64 << 10
+
+// chunkIndex lists the chunks a NAR is made of, in order. The chunks are
+// stored by the hex SHA-256 of their contents, so that the chunks NARs
+// have in common are stored once.
+type chunkIndex struct {
+	Version int          `json:"version"`
+	NarHash string       `json:"narHash"`
+	NarSize int64        `json:"narSize"`
+	MinSize int          `json:"minChunkSize"`
+	AvgSize int          `json:"avgChunkSize"`
+	MaxSize int          `json:"maxChunkSize"`
+	Chunks  []chunkEntry `json:"chunks"`
+}
+
+type chunkEntry struct {
+	ID   string `json:"id"`
+	Size int    `json:"size"`
+}
+
+// runNarToChunks splits a NAR into content-defined chunks, adds those not
+// yet there to a chunk store and writes the index listing them.
+func runNarToChunks(args []string) error {
+	fs := flag.NewFlagSet("nar2chunks", flag.ContinueOnError)
+	input, output := addIOFlags(fs, "-", "input NAR file ('-' for stdin)", "-", "index file to write ('-' for stdout)")
+	store := fs.String("store", "", "chunk store directory")
+	avg := int64(defaultChunkSize)
+	fs.Func("chunk-size", "average chunk size, a power of two such as 64K (default 64K)", func(v string) (err error) {
+		avg, err = parseByteSize(v)
+		return err
+	})
+	addNarCheckFlags(fs)
+	if err := parseIOArgs(fs, args); err != nil {
+		return err
+	}
+
+	if *store == "" {
+		return fmt.Errorf("-store must name the chunk store directory")
+	}
+
+	if avg < 1<<10 || avg > 1<<30 || avg&(avg-1) != 0 {
+		return fmt.Errorf("-chunk-size must be a power of two between 1K and 1G")
+	}
+
+	in, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	index, err := narToChunks(in, *store, int(avg))
+	if err != nil {
+		return err
+	}
+
+	out, err := openTextOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := writeJSON(out, index); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// runChunksToNar reassembles the NAR an index lists from a chunk store.
+func runChunksToNar(args []string) error {
+	fs := flag.NewFlagSet("chunks2nar", flag.ContinueOnError)
+	input, output := addIOFlags(fs, "-", "index file ('-' for stdin)", "-", "output NAR file ('-' for stdout)")
+	store := fs.String("store", "", "chunk store directory")
+	if err := parseIOArgs(fs, args); err != nil {
+		return err
+	}
+
+	if *store == "" {
+		return fmt.Errorf("-store must name the chunk store directory")
+	}
+
+	in, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var index chunkIndex
+	if err := json.NewDecoder(in).Decode(&index); err != nil {
+		return fmt.Errorf("reading chunk index: %w", err)
+	}
+
+	if index.Version != chunkIndexVersion {
+		return fmt.Errorf("unsupported chunk index version %d", index.Version)
+	}
+
+	out, err := openOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := chunksToNar(&index, *store, out); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// narToChunks cuts the NAR read from in into chunks of about avg bytes,
+// storing the new ones in store, and returns their index.
+func narToChunks(in io.Reader, store string, avg int) (*chunkIndex, error) {
+	pr, pw := io.Pipe()
+
+	go func() {
+		_, err := copyNar(in, pw)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	narHash := sha256.New()
+	narSize := &countingWriter{w: narHash}
+	c := newChunker(io.TeeReader(pr, narSize), avg)
+
+	index := &chunkIndex{
+		Version: chunkIndexVersion,
+		MinSize: c.min,
+		AvgSize: avg,
+		MaxSize: len(c.buf),
+	}
+
+	var added, addedBytes int64
+
+	for {
+		chunk, err := c.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			if nn := notNar(err); nn != nil {
+				return nil, nn
+			}
+
+			return nil, fmt.Errorf("reading nar: %w", err)
+		}
+
+		sum := sha256.Sum256(chunk)
+		id := hex.EncodeToString(sum[:])
+
+		isNew, err := storeChunk(store, id, chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		if isNew {
+			added++
+			addedBytes += int64(len(chunk))
+		}
+
+		index.Chunks = append(index.Chunks, chunkEntry{ID: id, Size: len(chunk)})
+	}
+
+	index.NarHash = "sha256:" + nixbase32.EncodeToString(narHash.Sum(nil))
+	index.NarSize = narSize.n
+
+	if verbosity > 0 {
+		fmt.Fprintf(os.Stderr, "%d chunks, %d new (%s of %s)\n", len(index.Chunks), added, formatBytes(float64(addedBytes)), formatBytes(float64(index.NarSize)))
+	}
+
+	return index, nil
+}
+
+// chunksToNar writes the chunks of index from store to out, checking each
+// chunk and the whole NAR against their hashes.
+func chunksToNar(index *chunkIndex, store string, out io.Writer) error {
+	_, want, err := parseHash(index.NarHash, "sha256")
+	if err != nil {
+		return fmt.Errorf("chunk index: %w", err)
+	}
+
+	check, err := newDigestCheck("NAR", "sha256", want, uint64(index.NarSize))
+	if err != nil {
+		return err
+	}
+
+	w := io.MultiWriter(out, check)
+
+	for _, e := range index.Chunks {
+		chunk, err := loadChunk(store, e.ID)
+		if err != nil {
+			return err
+		}
+
+		if len(chunk) != e.Size {
+			return fmt.Errorf("chunk %s has %d bytes, the index says %d", e.ID, len(chunk), e.Size)
+		}
+
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	return check.check()
+}
+
+// chunkPath is where the chunk id is stored, zstd-compressed, in store: in a
+// directory named by the first four digits of the hash, as casync does.
+func chunkPath(store, id string) string {
+	return filepath.Join(store, id[:4], id+".chunk.zst")
+}
+
+// storeChunk adds chunk to store unless it is there already, and reports
+// whether it was added.
+func storeChunk(store, id string, chunk []byte) (bool, error) {
+	name := chunkPath(store, id)
+
+	if _, err := os.Stat(name); err == nil {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return false, err
+	}
+
+	// The chunk is written to a temporary file and renamed, so that a chunk
+	// in the store is always complete, whoever else is adding it.
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".chunk-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw, err := compressWriter(tmp, "zstd")
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := zw.Write(chunk); err != nil {
+		return false, fmt.Errorf("writing chunk %s: %w", id, err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return false, fmt.Errorf("writing chunk %s: %w", id, err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+
+	return true, os.Rename(tmp.Name(), name)
+}
+
+// loadChunk reads the chunk id from store and checks it against its hash.
+func loadChunk(store, id string) ([]byte, error) {
+	if len(id) != 2*sha256.Size {
+		return nil, fmt.Errorf("invalid chunk id %q", id)
+	}
+
+	want, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk id %q", id)
+	}
+
+	f, err := os.Open(chunkPath(store, id))
+	if err != nil {
+		return nil, fmt.Errorf("reading chunk: %w", err)
+	}
+	defer f.Close()
+
+	zr, err := decompress(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading chunk %s: %w", id, err)
+	}
+	defer zr.Close()
+
+	chunk, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("reading chunk %s: %w", id, err)
+	}
+
+	if sum := sha256.Sum256(chunk); !bytes.Equal(sum[:], want) {
+		return nil, fmt.Errorf("chunk %s is corrupt: its contents hash to %x", id, sum)
+	}
+
+	return chunk, nil
+}
+
+// gearTable holds the random values of the gear rolling hash, generated
+// with splitmix64 from a fixed seed so that every run cuts the same chunks.
+var gearTable = func() (t [256]uint64) {
+	x := uint64(0x6e61727461722d31)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+
+	return t
+}()
+
+// chunker cuts a stream into content-defined chunks with a gear rolling
+// hash, as FastCDC does: a chunk ends where the hash of the bytes before it
+// has its top bits clear, so that an insertion only changes the chunks
+// around it.
+type chunker struct {
+	r    io.Reader
+	buf  []byte
+	n    int
+	min  int
+	mask uint64
+	eof  bool
+}
+
+func newChunker(r io.Reader, avg int) *chunker {
+	b := bits.Len(uint(avg)) - 1
+
+	return &chunker{
+		r:    r,
+		buf:  make([]byte, 4*avg),
+		min:  avg / 4,
+		mask: (1<<b - 1) << (64 - b),
+	}
+}
+
+// next returns the next chunk, or io.EOF at the end of the stream.
+func (c *chunker) next() ([]byte, error) {
+	if !c.eof && c.n < len(c.buf) {
+		m, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += m
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := c.cut(c.buf[:c.n])
+	chunk := append([]byte(nil), c.buf[:cut]...)
+	c.n = copy(c.buf, c.buf[cut:c.n])
+
+	return chunk, nil
+}
+
+// cut returns the length of the chunk b starts with.
+func (c *chunker) cut(b []byte) int {
+	if len(b) <= c.min {
+		return len(b)
+	}
+
+	var h uint64
+	for i := c.min; i < len(b); i++ {
+		h = h<<1 + gearTable[b[i]]
+		if h&c.mask == 0 {
+			return i + 1
+		}
+	}
+
+	return len(b)
+}
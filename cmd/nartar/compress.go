@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lzmaMagic  = []byte{0x5d, 0x00, 0x00}
+)
+
+// decompress sniffs r for a known compression magic and returns a reader of
+// the decompressed stream. Uncompressed input is passed through unchanged.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("opening gzip stream: %w", err)
+		}
+
+		return zr, nil
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return io.NopCloser(bzip2.NewReader(br)), nil
+	case bytes.HasPrefix(magic, xzMagic):
+		zr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("opening xz stream: %w", err)
+		}
+
+		return io.NopCloser(zr), nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("opening zstd stream: %w", err)
+		}
+
+		return zr.IOReadCloser(), nil
+	case bytes.HasPrefix(magic, lzmaMagic):
+		zr, err := lzma.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("opening lzma stream: %w", err)
+		}
+
+		return io.NopCloser(zr), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+// decompressedInput is an input read through decompress. Closing it closes
+// both.
+type decompressedInput struct {
+	io.ReadCloser
+	raw io.Closer
+}
+
+func (d decompressedInput) Close() error {
+	d.ReadCloser.Close()
+
+	return d.raw.Close()
+}
+
+// compressWriter wraps w with a compressor for the named algorithm. Output is
+// deterministic: gzip headers carry no name or timestamp, and with -threads
+// the blocks compressed in parallel do not depend on the number of threads.
+func compressWriter(w io.Writer, algorithm string) (io.WriteCloser, error) {
+	switch algorithm {
+	case "", "none":
+		return nopWriteCloser{Writer: w}, nil
+	case "gzip":
+		if compressThreads > 1 {
+			return newParallelGzipWriter(w)
+		}
+
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		if compressThreads > 1 {
+			return newParallelZstdWriter(w)
+		}
+
+		return zstd.NewWriter(w)
+	case "xz":
+		return xz.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", algorithm)
+	}
+}
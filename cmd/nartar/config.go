@@ -0,0 +1,461 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// configEnv names a config file to read instead of the default one.
+const configEnv = "NARTAR_CONFIG"
+
+// flagEnvPrefix starts the environment variables giving flag defaults, as in
+// NARTAR_TAR_FORMAT for -tar-format.
+const flagEnvPrefix = "NARTAR_"
+
+// configEntry is a flag value from the config file. An array gives the flag
+// once per element.
+type configEntry struct {
+	key    string
+	values []string
+	line   int
+}
+
+// config holds the flag defaults of a config file: the top-level keys apply
+// to every command that has the flag, the keys of a [command] table to that
+// command only.
+type config struct {
+	name     string
+	global   []configEntry
+	commands map[string][]configEntry
+}
+
+// loadedConfig is read on first use, as parseFlags may run more than once.
+var loadedConfig *config
+
+// configPath returns $NARTAR_CONFIG, or config.toml in the nartar directory
+// of the user configuration directory, e.g. ~/.config/nartar/config.toml.
+func configPath() string {
+	if name, ok := os.LookupEnv(configEnv); ok {
+		return name
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "nartar", "config.toml")
+}
+
+// applyConfig sets the flags of fs given in the config file, before the
+// command line is parsed so that its flags take precedence. Repeatable flags
+// such as -exclude add to the values from the config file.
+func applyConfig(fs *flag.FlagSet) error {
+	if loadedConfig == nil {
+		c, err := readConfig(configPath())
+		if err != nil {
+			return err
+		}
+
+		loadedConfig = c
+	}
+
+	c := loadedConfig
+
+	for _, e := range c.global {
+		if fs.Lookup(e.key) == nil {
+			continue
+		}
+
+		if err := c.set(fs, e); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range c.commands[fs.Name()] {
+		if fs.Lookup(e.key) == nil {
+			return fmt.Errorf("%s:%d: %s has no flag -%s", c.name, e.line, fs.Name(), e.key)
+		}
+
+		if err := c.set(fs, e); err != nil {
+			return err
+		}
+	}
+
+	return applyEnv(fs)
+}
+
+// applyEnv sets the flags of fs from NARTAR_* environment variables, which
+// override the config file and are overridden by the command line. Empty
+// variables are ignored, as are shorthand flags and the inputs and outputs.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || len(f.Name) < 2 || f.Name == "input" || f.Name == "output" {
+			return
+		}
+
+		name := flagEnvName(f.Name)
+
+		v := os.Getenv(name)
+		if v == "" {
+			return
+		}
+
+		if serr := fs.Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("invalid value %q for $%s: %w", v, name, serr)
+		}
+	})
+
+	return err
+}
+
+// flagEnvName returns the environment variable for the flag name.
+func flagEnvName(name string) string {
+	return flagEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func (c *config) set(fs *flag.FlagSet, e configEntry) error {
+	for _, v := range e.values {
+		if err := fs.Set(e.key, v); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for -%s: %w", c.name, e.line, v, e.key, err)
+		}
+	}
+
+	return nil
+}
+
+// readConfig reads a config file. A missing file is an empty config.
+func readConfig(name string) (*config, error) {
+	c := &config{name: name, commands: make(map[string][]configEntry)}
+
+	if name == "" {
+		return c, nil
+	}
+
+	b, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	if err := c.parse(string(b)); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// parse reads the subset of TOML that flag values need: [command] tables and
+// key = value pairs whose value is a string, integer, boolean, or array of
+// those. Strings are passed to the flag as they are, integers as written, so
+// file-mode = 644 is octal as on the command line.
+func (c *config) parse(s string) error {
+	lines := strings.Split(s, "\n")
+	section := ""
+	seen := make(map[string]bool)
+
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimSpace(lines[i])
+
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			rest, err := stripComment(line[1:])
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", c.name, lineNo, err)
+			}
+
+			name, ok := strings.CutSuffix(strings.TrimSpace(rest), "]")
+			if !ok || strings.ContainsAny(name, "[]") {
+				return fmt.Errorf("%s:%d: invalid table header", c.name, lineNo)
+			}
+
+			section = strings.TrimSpace(name)
+			if seen["["+section] {
+				return fmt.Errorf("%s:%d: table [%s] is defined twice", c.name, lineNo, section)
+			}
+			seen["["+section] = true
+
+			continue
+		}
+
+		key, value, err := parseConfigKey(line)
+		if err == nil {
+			value, err = stripComment(value)
+		}
+
+		// Arrays may span several lines.
+		for err == nil && strings.HasPrefix(value, "[") && !arrayClosed(value) && i+1 < len(lines) {
+			var more string
+
+			i++
+			more, err = stripComment(lines[i])
+			value += " " + more
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", c.name, lineNo, err)
+		}
+
+		values, err := parseConfigValue(value)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", c.name, lineNo, key, err)
+		}
+
+		switch key {
+		case "input", "i", "output", "o":
+			return fmt.Errorf("%s:%d: inputs and outputs cannot be set in the config file", c.name, lineNo)
+		}
+
+		if seen[section+"."+key] {
+			return fmt.Errorf("%s:%d: %s is set twice", c.name, lineNo, key)
+		}
+		seen[section+"."+key] = true
+
+		e := configEntry{key: key, values: values, line: lineNo}
+		if section == "" {
+			c.global = append(c.global, e)
+		} else {
+			c.commands[section] = append(c.commands[section], e)
+		}
+	}
+
+	return nil
+}
+
+func parseConfigKey(line string) (string, string, error) {
+	var key string
+
+	if line[0] == '"' || line[0] == '\'' {
+		k, rest, err := parseConfigString(line)
+		if err != nil {
+			return "", "", err
+		}
+
+		key, line = k, rest
+	} else {
+		end := strings.IndexAny(line, " \t=")
+		if end <= 0 {
+			return "", "", fmt.Errorf("expected key = value")
+		}
+
+		key, line = line[:end], line[end:]
+		for _, r := range key {
+			if r != '-' && r != '_' && !isWordByte(byte(r)) || r >= utf8.RuneSelf {
+				return "", "", fmt.Errorf("invalid key %q", key)
+			}
+		}
+	}
+
+	value, ok := strings.CutPrefix(strings.TrimSpace(line), "=")
+	if !ok {
+		return "", "", fmt.Errorf("expected = after %s", key)
+	}
+
+	return key, strings.TrimSpace(value), nil
+}
+
+// parseConfigValue returns the flag values given by a TOML value without
+// comments.
+func parseConfigValue(s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+
+	if !strings.HasPrefix(s, "[") {
+		v, rest, err := parseConfigScalar(s)
+		if err != nil {
+			return nil, err
+		}
+
+		if rest = strings.TrimSpace(rest); rest != "" {
+			return nil, fmt.Errorf("unexpected %q after value", rest)
+		}
+
+		return []string{v}, nil
+	}
+
+	var values []string
+
+	s = s[1:]
+
+	for {
+		s = strings.TrimSpace(s)
+
+		if strings.HasPrefix(s, "]") {
+			if rest := strings.TrimSpace(s[1:]); rest != "" {
+				return nil, fmt.Errorf("unexpected %q after array", rest)
+			}
+
+			return values, nil
+		}
+
+		v, rest, err := parseConfigScalar(s)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, v)
+
+		rest = strings.TrimSpace(rest)
+		switch {
+		case strings.HasPrefix(rest, ","):
+			s = rest[1:]
+		case strings.HasPrefix(rest, "]"):
+			s = rest
+		default:
+			return nil, fmt.Errorf("expected , or ] in array")
+		}
+	}
+}
+
+func parseConfigScalar(s string) (string, string, error) {
+	if s == "" {
+		return "", "", fmt.Errorf("missing value")
+	}
+
+	if s[0] == '"' || s[0] == '\'' {
+		return parseConfigString(s)
+	}
+
+	end := strings.IndexAny(s, " \t,]")
+	if end < 0 {
+		end = len(s)
+	}
+
+	word, rest := s[:end], s[end:]
+
+	switch word {
+	case "true", "false":
+		return word, rest, nil
+	}
+
+	digits := strings.ReplaceAll(strings.TrimLeft(word, "+-"), "_", "")
+	if digits != "" && strings.Trim(digits, "0123456789") == "" {
+		return strings.ReplaceAll(word, "_", ""), rest, nil
+	}
+
+	return "", "", fmt.Errorf("unsupported value %q (use a string, integer, boolean or array)", word)
+}
+
+// parseConfigString parses a basic "..." or literal '...' string.
+func parseConfigString(s string) (string, string, error) {
+	quote := s[0]
+
+	if quote == '\'' {
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+
+		return s[1 : end+1], s[end+2:], nil
+	}
+
+	var b strings.Builder
+
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			if i+1 >= len(s) {
+				return "", "", fmt.Errorf("unterminated string")
+			}
+
+			i++
+
+			switch s[i] {
+			case '"', '\\':
+				b.WriteByte(s[i])
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'u', 'U':
+				n := 4
+				if s[i] == 'U' {
+					n = 8
+				}
+
+				if i+n >= len(s) {
+					return "", "", fmt.Errorf("invalid escape in string")
+				}
+
+				r, err := strconv.ParseUint(s[i+1:i+1+n], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(r)) {
+					return "", "", fmt.Errorf("invalid escape in string")
+				}
+
+				b.WriteRune(rune(r))
+				i += n
+			default:
+				return "", "", fmt.Errorf("unsupported escape \\%c in string", s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+// stripComment removes a trailing comment from s outside strings.
+func stripComment(s string) (string, error) {
+	var quote byte
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0 && s[i] == '\\' && quote == '"':
+			i++
+		case quote != 0 && s[i] == quote:
+			quote = 0
+		case quote != 0:
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == '#':
+			return s[:i], nil
+		}
+	}
+
+	if quote != 0 {
+		return "", fmt.Errorf("unterminated string")
+	}
+
+	return s, nil
+}
+
+// arrayClosed reports whether the array starting s is complete.
+func arrayClosed(s string) bool {
+	depth := 0
+	var quote byte
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0 && s[i] == '\\' && quote == '"':
+			i++
+		case quote != 0 && s[i] == quote:
+			quote = 0
+		case quote != 0:
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == '[':
+			depth++
+		case s[i] == ']':
+			depth--
+		}
+	}
+
+	return depth <= 0
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// Input formats recognized by the convert command.
+const (
+	formatNar  = "nar"
+	formatTar  = "tar"
+	formatCpio = "cpio"
+	formatDeb  = "deb"
+	formatRPM  = "rpm"
+)
+
+// sniffLen is how much of the input is looked at to recognize it: enough for
+// the magic of a ustar header.
+const sniffLen = 512
+
+var (
+	narMagic = "nix-archive-1"
+	debMagic = []byte("!<arch>\ndebian-binary")
+)
+
+// runConvert converts a NAR to a tarball and any other supported archive to
+// a NAR, recognizing the input by its contents so that it can come from a
+// pipe. Compressed inputs are decompressed first.
+func runConvert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	tarOpts := addTarOptionFlags(fs)
+	readOpts := addReadOptionFlags(fs)
+	paths := addPathMapFlags(fs)
+	root := addRootNameFlag(fs)
+	singleFile := addSingleFileNameFlag(fs, root)
+	tarOpts.paths, readOpts.paths = paths, paths
+
+	return runMultiConversion(fs, args, narInput, openOutput, func(in io.Reader, out io.Writer, output string) error {
+		r, format, err := sniffFormat(in)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		// Batch conversions may run at once, so each has its own options.
+		tarOpts := tarOpts.forOutput(singleFile(output))
+		readOpts := *readOpts
+		readOpts.paths = tarOpts.paths
+
+		switch format {
+		case formatNar:
+			return narToTarRoot(r, out, *root, tarOpts)
+		case formatTar:
+			return tarToNar(r, out, *root, paxIgnore, "", false, &readOpts)
+		case formatCpio:
+			return cpioToNar(r, out, &readOpts)
+		case formatDeb:
+			return debToNar(r, out, &readOpts)
+		default:
+			return rpmToNar(r, out, &readOpts)
+		}
+	}, nil)
+}
+
+// sniffFormat recognizes the archive in r, looking through one layer of
+// compression, and returns a reader of the archive with its format.
+func sniffFormat(in io.Reader) (io.ReadCloser, string, error) {
+	r, err := decompress(in)
+	if err != nil {
+		return nil, "", err
+	}
+
+	br := bufio.NewReaderSize(r, sniffLen)
+
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		r.Close()
+		return nil, "", fmt.Errorf("reading input: %w", err)
+	}
+
+	format := archiveFormat(head)
+	if format == "" {
+		r.Close()
+		return nil, "", fmt.Errorf("input is not a NAR, tar, cpio, deb or rpm archive")
+	}
+
+	return readCloser{Reader: br, Closer: r}, format, nil
+}
+
+// archiveFormat returns the format of the archive starting with head, or ""
+// if it is not recognized.
+func archiveFormat(head []byte) string {
+	switch {
+	case len(head) >= 8+len(narMagic) &&
+		binary.LittleEndian.Uint64(head) == uint64(len(narMagic)) &&
+		string(head[8:8+len(narMagic)]) == narMagic:
+		return formatNar
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return formatTar
+	case bytes.HasPrefix(head, []byte(cpioNewcMagic)), bytes.HasPrefix(head, []byte(cpioCrcMagic)):
+		return formatCpio
+	case bytes.HasPrefix(head, debMagic):
+		return formatDeb
+	case bytes.HasPrefix(head, []byte(rpmLeadMagic)):
+		return formatRPM
+	default:
+		return ""
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// minCopyRange is the size from which file contents held in a file are
+// copied into a NAR file by the kernel rather than through a buffer.
+const minCopyRange = 64 << 10
+
+// rangeZeros is what the NAR writer is given for the contents copied by the
+// kernel.
+var rangeZeros [minCopyRange]byte
+
+// narFile is a NAR being written from archive entries. When it goes
+// straight into a regular file, direct is the file underneath the NAR
+// writer, and file contents that need no rewriting are copied into it with
+// copy_file_range on Linux, without passing through the process.
+type narFile struct {
+	*nar.Writer
+	direct *directOutput
+}
+
+func newNarFile(out io.Writer) (*narFile, error) {
+	n := &narFile{}
+
+	if f := regularFile(out); f != nil {
+		n.direct = &directOutput{w: out, f: f}
+		out = n.direct
+	}
+
+	nw, err := nar.NewWriter(out)
+	if err != nil {
+		return nil, fmt.Errorf("creating nar writer: %w", err)
+	}
+
+	n.Writer = nw
+
+	return n, nil
+}
+
+// regularFile returns the regular file out writes to unchanged, or nil if it
+// writes somewhere else or through a compressor, hash or counter other
+// than the -stats one.
+func regularFile(out io.Writer) *os.File {
+	if c, ok := out.(countingOutput); ok {
+		out = c.WriteCloser
+	}
+
+	if n, ok := out.(nopWriteCloser); ok {
+		out = n.Writer
+	}
+
+	if r, ok := out.(*resumableOutput); ok {
+		out = r.f
+	}
+
+	f, ok := out.(*os.File)
+	if !ok {
+		return nil
+	}
+
+	// Only regular files are written at an offset the contents can be
+	// copied to.
+	if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	return f
+}
+
+// directOutput passes what the NAR writer writes on to w, except for the
+// contents already copied into f, which it skips.
+type directOutput struct {
+	w    io.Writer
+	f    *os.File
+	skip int64
+}
+
+func (d *directOutput) Write(b []byte) (int, error) {
+	if d.skip == 0 {
+		return d.w.Write(b)
+	}
+
+	n := int64(len(b))
+	if n > d.skip {
+		n = d.skip
+	}
+
+	d.skip -= n
+
+	if int(n) == len(b) {
+		return len(b), nil
+	}
+
+	m, err := d.w.Write(b[n:])
+
+	return int(n) + m, err
+}
+
+// canCopyRange reports whether the contents of the regular file e can be
+// copied into the NAR by the kernel.
+func (n *narFile) canCopyRange(e *tarEntry) bool {
+	if n.direct == nil || e.r != nil || e.size < minCopyRange {
+		return false
+	}
+
+	if len(storeRewrites) > 0 || referenceOutput != "" {
+		return false
+	}
+
+	return sourceFile(e) != nil
+}
+
+// sourceFile returns the file holding the contents of the regular file e,
+// or nil if they are not in a file.
+func sourceFile(e *tarEntry) *os.File {
+	switch src := e.src.(type) {
+	case *os.File:
+		return src
+	case inputFile:
+		return src.File
+	}
+
+	return nil
+}
+
+// copyRange copies the contents of the regular file e, whose header has
+// been written, into the NAR file, and has the NAR writer account for them
+// without writing them again.
+func (n *narFile) copyRange(e *tarEntry) error {
+	// The source is opened again to have a file offset of its own, as the
+	// spool file is shared by the conversions of -jobs.
+	src := sourceFile(e)
+
+	f, err := os.Open(src.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if sfi, err := src.Stat(); err != nil || !os.SameFile(fi, sfi) {
+		return fmt.Errorf("%s was replaced while it was read", src.Name())
+	}
+
+	if _, err := f.Seek(e.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	copied, err := n.direct.f.ReadFrom(io.LimitReader(f, e.size))
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&stats.bytesOut, copied)
+
+	if _, ok := e.src.(inputFile); ok {
+		atomic.AddInt64(&stats.bytesIn, copied)
+	}
+
+	if copied != e.size {
+		return fmt.Errorf("%s has %d bytes instead of %d: the input changed while it was converted", e.path, copied, e.size)
+	}
+
+	// The NAR writer still counts the contents, through zeros it is told
+	// to write and that are skipped.
+	n.direct.skip = e.size
+
+	for left := e.size; left > 0; {
+		b := rangeZeros[:]
+		if left < int64(len(b)) {
+			b = b[:left]
+		}
+
+		if _, err := n.Write(b); err != nil {
+			return err
+		}
+
+		left -= int64(len(b))
+	}
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+func TestCopyRange(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	contents := func(size int) string {
+		b := make([]byte, size)
+		rnd.Read(b)
+
+		return string(b)
+	}
+
+	// The contents are random, so that the zeros the NAR writer is given
+	// for them cannot go unnoticed.
+	small, at, large := contents(minCopyRange-1), contents(minCopyRange), contents(3*minCopyRange+5)
+
+	tarball := buildTar(t,
+		tarMember{name: "small", kind: tar.TypeReg, data: small},
+		tarMember{name: "at", kind: tar.TypeReg, data: at},
+		tarMember{name: "dir", kind: tar.TypeDir},
+		tarMember{name: "dir/large", kind: tar.TypeReg, data: large},
+		tarMember{name: "link", kind: tar.TypeLink, data: "dir/large"},
+		tarMember{name: "tail", kind: tar.TypeReg, data: "tail"},
+	)
+
+	want := map[string]testEntry{
+		"/":          {typ: nar.TypeDirectory},
+		"/small":     {typ: nar.TypeRegular, data: small},
+		"/at":        {typ: nar.TypeRegular, data: at},
+		"/dir":       {typ: nar.TypeDirectory},
+		"/dir/large": {typ: nar.TypeRegular, data: large},
+		"/link":      {typ: nar.TypeRegular, data: large},
+		"/tail":      {typ: nar.TypeRegular, data: "tail"},
+	}
+
+	dir := t.TempDir()
+
+	tarName := filepath.Join(dir, "in.tar")
+	if err := os.WriteFile(tarName, tarball, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc       string
+		fileInput  bool
+		spool      bool
+		fileOutput bool
+
+		// copied is how many bytes the kernel copies.
+		copied int64
+	}{
+		{desc: "stream to buffer"},
+		{desc: "file to buffer", fileInput: true},
+		{desc: "stream to file", fileOutput: true},
+		{desc: "file to file", fileInput: true, fileOutput: true, copied: int64(len(at) + 2*len(large))},
+		{desc: "spool to file", spool: true, fileOutput: true, copied: int64(len(at) + 2*len(large))},
+	}
+
+	var first []byte
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			threshold := int64(defaultSpoolThreshold)
+			if tt.spool {
+				threshold = 0
+			}
+
+			testSpool(t, threshold, 0)
+
+			var in io.Reader = bytes.NewReader(tarball)
+
+			if tt.fileInput {
+				f, err := os.Open(tarName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+
+				in = withProgress(f, nil, -1)
+			}
+
+			var (
+				out     io.Writer
+				buf     bytes.Buffer
+				outFile *os.File
+			)
+
+			out = &buf
+
+			if tt.fileOutput {
+				f, err := os.Create(filepath.Join(t.TempDir(), "out.nar"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+
+				out, outFile = f, f
+			}
+
+			bytesIn, bytesOut := atomic.LoadInt64(&stats.bytesIn), atomic.LoadInt64(&stats.bytesOut)
+
+			if err := tarToNar(in, out, "", paxIgnore, "", false, testReadOptions(t)); err != nil {
+				t.Fatal(err)
+			}
+
+			if copied := atomic.LoadInt64(&stats.bytesOut) - bytesOut; copied != tt.copied {
+				t.Errorf("%d bytes copied by the kernel, want %d", copied, tt.copied)
+			}
+
+			// The contents read back from the input count as they are
+			// read: the whole tarball, and the hard-linked contents once
+			// more.
+			wantRead := int64(len(tarball) + len(large))
+			if read := atomic.LoadInt64(&stats.bytesIn) - bytesIn; tt.fileInput && read != wantRead {
+				t.Errorf("%d bytes read, want %d", read, wantRead)
+			}
+
+			got := buf.Bytes()
+
+			if outFile != nil {
+				b, err := os.ReadFile(outFile.Name())
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got = b
+			}
+
+			checkEntries(t, readNar(t, got), want)
+
+			if first == nil {
+				first = got
+			} else if !bytes.Equal(got, first) {
+				t.Errorf("the NAR differs from the one written to a buffer")
+			}
+		})
+	}
+}
+
+func TestCanCopyRange(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.nar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	direct, err := newNarFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffered, err := newNarFile(&bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc     string
+		nw       *narFile
+		e        *tarEntry
+		rewrites bool
+		want     bool
+	}{
+		{desc: "input file", nw: direct, e: &tarEntry{size: minCopyRange, src: inputFile{f}}, want: true},
+		{desc: "spool file", nw: direct, e: &tarEntry{size: minCopyRange, src: f}, want: true},
+		{desc: "to a buffer", nw: buffered, e: &tarEntry{size: minCopyRange, src: f}},
+		{desc: "too small", nw: direct, e: &tarEntry{size: minCopyRange - 1, src: f}},
+		{desc: "in memory", nw: direct, e: &tarEntry{size: minCopyRange, data: make([]byte, minCopyRange)}},
+		{desc: "read as it is written", nw: direct, e: &tarEntry{size: minCopyRange, src: f, r: bytes.NewReader(nil)}},
+		{desc: "store paths rewritten", nw: direct, e: &tarEntry{size: minCopyRange, src: f}, rewrites: true},
+	}
+
+	for _, tt := range tests {
+		if tt.rewrites {
+			storeRewrites = []storeRewrite{{from: []byte("a"), to: []byte("b")}}
+		}
+
+		if got := tt.nw.canCopyRange(tt.e); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.desc, got, tt.want)
+		}
+
+		storeRewrites = nil
+	}
+}
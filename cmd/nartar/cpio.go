@@ -0,0 +1,449 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+const (
+	cpioNewcMagic   = "070701"
+	cpioCrcMagic    = "070702"
+	cpioHeaderLen   = 110
+	cpioTrailerName = "TRAILER!!!"
+
+	// cpioFieldMax is the largest value of the eight hex digits of a newc
+	// header field.
+	cpioFieldMax = 0xffffffff
+)
+
+// cpioHeader holds the fields of an SVR4 "newc" cpio header that nartar
+// cares about. Everything else (uid, gid, devices) is written as zero, and
+// the mtime is the same for all entries.
+type cpioHeader struct {
+	name  string
+	ino   int64
+	mode  int64
+	nlink int64
+	size  int64
+	dev   [2]int64
+}
+
+// cpioWriter writes SVR4 newc cpio archives as understood by the Linux
+// initramfs unpacker.
+type cpioWriter struct {
+	w     io.Writer
+	ino   int64
+	mtime int64
+}
+
+func newCpioWriter(w io.Writer, mtime time.Time) *cpioWriter {
+	return &cpioWriter{w: w, mtime: mtime.Unix()}
+}
+
+func (cw *cpioWriter) writeHeader(h *cpioHeader) error {
+	// A field wider than eight digits would shift every header after it.
+	if h.size < 0 || h.size > cpioFieldMax {
+		return fmt.Errorf("cpio entry %q is %d bytes, more than a newc header can hold", h.name, h.size)
+	}
+
+	if cw.mtime < 0 || cw.mtime > cpioFieldMax {
+		return fmt.Errorf("cpio entry %q cannot be written with mtime %d, outside the years 1970 to 2106 that a newc header can hold", h.name, cw.mtime)
+	}
+
+	var b strings.Builder
+
+	b.WriteString(cpioNewcMagic)
+
+	for _, v := range []int64{
+		h.ino,
+		h.mode,
+		0, // uid
+		0, // gid
+		h.nlink,
+		cw.mtime,
+		h.size,
+		0, // devmajor
+		0, // devminor
+		0, // rdevmajor
+		0, // rdevminor
+		int64(len(h.name) + 1),
+		0, // check
+	} {
+		if v < 0 || v > cpioFieldMax {
+			return fmt.Errorf("cpio entry %q has a header field of %d, which a newc header cannot hold", h.name, v)
+		}
+
+		fmt.Fprintf(&b, "%08x", v)
+	}
+
+	b.WriteString(h.name)
+	b.WriteByte(0)
+	b.Write(make([]byte, cpioPad(int64(b.Len()))))
+
+	_, err := io.WriteString(cw.w, b.String())
+	return err
+}
+
+// writeEntry writes a header followed by size bytes read from r and the
+// padding that aligns the next header to four bytes.
+func (cw *cpioWriter) writeEntry(name string, mode int64, size int64, r io.Reader) error {
+	cw.ino++
+
+	nlink := int64(1)
+	if mode&unixModeType == unixModeDir {
+		nlink = 2
+	}
+
+	h := &cpioHeader{
+		name:  name,
+		ino:   cw.ino,
+		mode:  mode,
+		nlink: nlink,
+		size:  size,
+	}
+
+	if err := cw.writeHeader(h); err != nil {
+		return err
+	}
+
+	if size == 0 {
+		return nil
+	}
+
+	if _, err := copyContentsN(cw.w, r, size); err != nil {
+		return err
+	}
+
+	_, err := cw.w.Write(make([]byte, cpioPad(size)))
+	return err
+}
+
+func (cw *cpioWriter) Close() error {
+	return cw.writeHeader(&cpioHeader{name: cpioTrailerName, nlink: 1})
+}
+
+func cpioPad(n int64) int64 {
+	return (4 - n%4) % 4
+}
+
+func narToCpio(in io.Reader, out io.Writer, mtime time.Time, modes modeMap) error {
+	nr, err := newNarReader(in)
+	if err != nil {
+		return fmt.Errorf("opening nar: %w", err)
+	}
+	defer nr.Close()
+
+	cw := newCpioWriter(out, mtime)
+
+	for {
+		hdr, err := nr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("reading nar header: %w", err)
+		}
+
+		logNarEntry(hdr)
+
+		name, err := cpioPathForNarHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Type {
+		case nar.TypeDirectory:
+			if err := cw.writeEntry(name, unixModeDir|modes.dir, 0, nil); err != nil {
+				return fmt.Errorf("writing cpio dir entry: %w", err)
+			}
+		case nar.TypeSymlink:
+			target := hdr.LinkTarget
+			err := cw.writeEntry(name, unixModeSymlink|symlinkMode, int64(len(target)), strings.NewReader(target))
+			if err != nil {
+				return fmt.Errorf("writing cpio symlink entry: %w", err)
+			}
+		case nar.TypeRegular:
+			if err := cw.writeEntry(name, unixModeRegular|modes.forFile(hdr.Executable), hdr.Size, nr); err != nil {
+				return fmt.Errorf("writing cpio file entry: %w", err)
+			}
+		default:
+			return fmt.Errorf("unsupported nar node type %q", hdr.Type)
+		}
+	}
+
+	return cw.Close()
+}
+
+// cpioPathForNarHeader maps NAR paths to the relative names used by
+// initramfs images: the root directory becomes "." and "/dir/file" becomes
+// "dir/file".
+func cpioPathForNarHeader(hdr *nar.Header) (string, error) {
+	p := strings.TrimPrefix(path.Clean("/"+hdr.Path), "/")
+	if p != "" {
+		return p, nil
+	}
+
+	if hdr.Type != nar.TypeDirectory {
+		return "", fmt.Errorf("cpio output requires a directory at the NAR root")
+	}
+
+	return ".", nil
+}
+
+// cpioReader reads SVR4 newc (and crc) cpio archives, as produced for
+// initramfs images and RPM payloads.
+type cpioReader struct {
+	r         io.Reader
+	remaining int64
+	pad       int64
+}
+
+func newCpioReader(r io.Reader) *cpioReader {
+	return &cpioReader{r: r}
+}
+
+// next skips the rest of the current entry and returns the following header.
+// io.EOF is returned once the trailer has been read.
+func (cr *cpioReader) next() (*cpioHeader, error) {
+	if _, err := io.CopyN(io.Discard, cr.r, cr.remaining+cr.pad); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	cr.remaining, cr.pad = 0, 0
+
+	var raw [cpioHeaderLen]byte
+	if _, err := io.ReadFull(cr.r, raw[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	magic := string(raw[:6])
+	if magic != cpioNewcMagic && magic != cpioCrcMagic {
+		return nil, fmt.Errorf("unsupported cpio header magic %q (only newc is supported)", magic)
+	}
+
+	var fields [13]int64
+	for i := range fields {
+		v, err := strconv.ParseUint(string(raw[6+8*i:14+8*i]), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpio header field: %w", err)
+		}
+
+		fields[i] = int64(v)
+	}
+
+	nameSize := fields[11]
+	if nameSize == 0 {
+		return nil, fmt.Errorf("invalid cpio name size 0")
+	}
+
+	name := make([]byte, nameSize+cpioPad(cpioHeaderLen+nameSize))
+	if _, err := io.ReadFull(cr.r, name); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	h := &cpioHeader{
+		name:  strings.TrimRight(string(name[:nameSize]), "\x00"),
+		ino:   fields[0],
+		mode:  fields[1],
+		nlink: fields[4],
+		size:  fields[6],
+		dev:   [2]int64{fields[7], fields[8]},
+	}
+
+	if h.name == cpioTrailerName {
+		return nil, io.EOF
+	}
+
+	cr.remaining = h.size
+	cr.pad = cpioPad(h.size)
+
+	return h, nil
+}
+
+func (cr *cpioReader) Read(b []byte) (int, error) {
+	if cr.remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(b)) > cr.remaining {
+		b = b[:cr.remaining]
+	}
+
+	n, err := cr.r.Read(b)
+	cr.remaining -= int64(n)
+	if errors.Is(err, io.EOF) && cr.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+func cpioToNar(in io.Reader, out io.Writer, opts *readOptions) error {
+	entries := newEntryTree()
+	if err := readCpioEntries(in, entries, opts); err != nil {
+		return err
+	}
+
+	return writeNarEntries(entries, out)
+}
+
+// readCpioEntries collects the members of a newc cpio archive into entries,
+// with the archive root as the NAR root.
+func readCpioEntries(in io.Reader, entries *entryTree, opts *readOptions) error {
+	cr := newCpioReader(in)
+
+	// newc stores the content of hard-linked files only once, with the last
+	// link; earlier links are recorded here to share it once it comes.
+	links := make(map[[3]int64][]cpioLink)
+
+	var slab entrySlab
+
+	var counter limitCounter
+
+	for {
+		h, err := cr.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("reading cpio: %w", err)
+		}
+
+		logEntry(cpioEntryKind(h.mode), h.name, h.size, "")
+
+		p, skip, err := opts.archivePath(h.name, "")
+		if err != nil {
+			return fmt.Errorf("invalid cpio entry path %q: %w", h.name, err)
+		}
+
+		if skip {
+			continue
+		}
+
+		if err := counter.entry(p); err != nil {
+			return err
+		}
+
+		switch h.mode & unixModeType {
+		case unixModeDir:
+			if err := opts.addEntry(entries, p, slab.entry(tarEntry{kind: tar.TypeDir})); err != nil {
+				return err
+			}
+		case unixModeSymlink:
+			target, err := io.ReadAll(cr)
+			if err != nil {
+				return fmt.Errorf("reading cpio symlink %q: %w", h.name, err)
+			}
+
+			e, err := opts.symlinkEntry(&slab, p, string(target))
+			if err != nil {
+				return err
+			}
+
+			if err := opts.addEntry(entries, p, e); err != nil {
+				return err
+			}
+		case unixModeRegular:
+			if err := counter.file(p, h.size); err != nil {
+				return err
+			}
+
+			entry := slab.entry(tarEntry{kind: tar.TypeReg})
+
+			head, err := fileSpool.read(entry, cr, h.size)
+			if err != nil {
+				return fmt.Errorf("reading cpio file %q: %w", h.name, err)
+			}
+
+			entry.executable = opts.isExecutable(h.mode&0o111 != 0, head)
+
+			if err := opts.addEntry(entries, p, entry); err != nil {
+				return err
+			}
+
+			if h.nlink > 1 {
+				key := [3]int64{h.dev[0], h.dev[1], h.ino}
+
+				if h.size > 0 {
+					for _, l := range links[key] {
+						// Each link is a copy of the contents in the NAR.
+						if err := counter.file(l.path, h.size); err != nil {
+							return err
+						}
+
+						fileSpool.linkTo(l.entry, entry)
+						l.entry.executable = opts.isExecutable(l.modeExec, head)
+					}
+				}
+
+				links[key] = append(links[key], cpioLink{path: p, entry: entry, modeExec: h.mode&0o111 != 0})
+			}
+		case unixModeChar, unixModeBlock, unixModeFifo, unixModeSocket:
+			e, err := opts.specialEntry(h.name, cpioSpecialKind(h.mode), p)
+			if err != nil {
+				return err
+			}
+
+			if e != nil {
+				if err := opts.addEntry(entries, p, e); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unsupported cpio entry %q with mode %o", h.name, h.mode)
+		}
+	}
+
+	return nil
+}
+
+// cpioLink is a hard link of a newc archive, whose contents may come with a
+// later link.
+type cpioLink struct {
+	path     string
+	entry    *tarEntry
+	modeExec bool
+}
+
+func cpioEntryKind(mode int64) string {
+	switch mode & unixModeType {
+	case unixModeRegular:
+		return "regular"
+	case unixModeDir:
+		return "directory"
+	case unixModeSymlink:
+		return "symlink"
+	default:
+		return cpioSpecialKind(mode)
+	}
+}
+
+func cpioSpecialKind(mode int64) string {
+	switch mode & unixModeType {
+	case unixModeChar:
+		return "character device"
+	case unixModeBlock:
+		return "block device"
+	case unixModeFifo:
+		return "FIFO"
+	default:
+		return "socket"
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+func TestCpioRoundTrip(t *testing.T) {
+	var archive bytes.Buffer
+	if err := narToCpio(bytes.NewReader(buildNar(t, testTree)), &archive, time.Unix(0, 0), defaultModes); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := cpioToNar(&archive, &out, testReadOptions(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	checkEntries(t, readNar(t, out.Bytes()), testTree)
+}
+
+func TestCpioHardLinks(t *testing.T) {
+	// newc stores the contents of hard-linked files once, with the last
+	// link, and the earlier links are empty.
+	links := []struct {
+		name string
+		mode int64
+		data string
+	}{
+		{"run", unixModeRegular | 0o755, ""},
+		{"run.sh", unixModeRegular | 0o644, ""},
+		{"start", unixModeRegular | 0o644, "#!/bin/sh\n"},
+	}
+
+	var archive bytes.Buffer
+
+	cw := newCpioWriter(&archive, time.Unix(0, 0))
+	if err := cw.writeEntry(".", unixModeDir|0o755, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cw.writeEntry("empty", unixModeRegular|0o644, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, l := range links {
+		h := &cpioHeader{name: l.name, ino: 100, mode: l.mode, nlink: int64(len(links)), size: int64(len(l.data))}
+		if err := cw.writeHeader(h); err != nil {
+			t.Fatal(err)
+		}
+
+		archive.WriteString(l.data)
+		archive.Write(make([]byte, cpioPad(h.size)))
+	}
+
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, policy := range []string{executableMode, executableShebang} {
+		t.Run(policy, func(t *testing.T) {
+			opts := testReadOptions(t)
+			opts.executable = policy
+
+			var out bytes.Buffer
+			if err := cpioToNar(bytes.NewReader(archive.Bytes()), &out, opts); err != nil {
+				t.Fatal(err)
+			}
+
+			shebang := policy == executableShebang
+
+			checkEntries(t, readNar(t, out.Bytes()), map[string]testEntry{
+				"/":       {typ: nar.TypeDirectory},
+				"/empty":  {typ: nar.TypeRegular},
+				"/run":    {typ: nar.TypeRegular, exec: true, data: "#!/bin/sh\n"},
+				"/run.sh": {typ: nar.TypeRegular, exec: shebang, data: "#!/bin/sh\n"},
+				"/start":  {typ: nar.TypeRegular, exec: shebang, data: "#!/bin/sh\n"},
+			})
+		})
+	}
+}
+
+func TestCpioDuplicates(t *testing.T) {
+	var archive bytes.Buffer
+
+	cw := newCpioWriter(&archive, time.Unix(0, 0))
+	for _, data := range []string{"first", "second"} {
+		if err := cw.writeEntry("a", unixModeRegular|0o644, int64(len(data)), strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		duplicates string
+		want       string
+		err        string
+	}{
+		{duplicates: conflictLast, want: "second"},
+		{duplicates: conflictFirst, want: "first"},
+		{duplicates: conflictError, err: "/a is in the archive more than once"},
+	}
+
+	for _, tt := range tests {
+		opts := testReadOptions(t)
+		opts.duplicates = tt.duplicates
+
+		var out bytes.Buffer
+
+		err := cpioToNar(bytes.NewReader(archive.Bytes()), &out, opts)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.duplicates, err, tt.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.duplicates, err)
+			continue
+		}
+
+		checkEntries(t, readNar(t, out.Bytes()), map[string]testEntry{
+			"/":  {typ: nar.TypeDirectory},
+			"/a": {typ: nar.TypeRegular, data: tt.want},
+		})
+	}
+}
+
+func TestCpioHeaderLimits(t *testing.T) {
+	tests := []struct {
+		size  int64
+		mtime int64
+		ok    bool
+	}{
+		{size: 0, mtime: 0, ok: true},
+		{size: cpioFieldMax, mtime: cpioFieldMax, ok: true},
+		{size: cpioFieldMax + 1, mtime: 0},
+		{size: -1, mtime: 0},
+		{size: 0, mtime: cpioFieldMax + 1},
+		{size: 0, mtime: -1},
+	}
+
+	for _, tt := range tests {
+		var b bytes.Buffer
+
+		cw := newCpioWriter(&b, time.Unix(tt.mtime, 0))
+		err := cw.writeHeader(&cpioHeader{name: "f", ino: 1, mode: unixModeRegular | 0o644, nlink: 1, size: tt.size})
+
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("size %d, mtime %d: no error", tt.size, tt.mtime)
+			}
+
+			if b.Len() != 0 {
+				t.Errorf("size %d, mtime %d: %d bytes written", tt.size, tt.mtime, b.Len())
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("size %d, mtime %d: %v", tt.size, tt.mtime, err)
+			continue
+		}
+
+		// The name "f" and its NUL end the header on a multiple of four.
+		if b.Len() != cpioHeaderLen+2 {
+			t.Errorf("size %d, mtime %d: header is %d bytes, want %d", tt.size, tt.mtime, b.Len(), cpioHeaderLen+2)
+		}
+
+		h, err := newCpioReader(&b).next()
+		if err != nil {
+			t.Errorf("size %d, mtime %d: reading the header back: %v", tt.size, tt.mtime, err)
+			continue
+		}
+
+		if h.name != "f" || h.size != tt.size {
+			t.Errorf("size %d, mtime %d: read back %q of %d bytes", tt.size, tt.mtime, h.name, h.size)
+		}
+	}
+}
+
+func TestCpioRejectsRootFile(t *testing.T) {
+	n := buildNar(t, map[string]testEntry{"/": {typ: nar.TypeRegular, data: "x"}})
+
+	err := narToCpio(bytes.NewReader(n), &bytes.Buffer{}, time.Unix(0, 0), defaultModes)
+	if err == nil || !strings.Contains(err.Error(), "directory at the NAR root") {
+		t.Errorf("got %v, want an error about the NAR root", err)
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/nixhash"
+	"github.com/nix-community/go-nix/pkg/storepath"
+	"github.com/nix-community/go-nix/pkg/wire"
+)
+
+// The nix-daemon worker protocol, as in Nix's worker-protocol.hh.
+const (
+	workerMagic1 = 0x6e697863
+	workerMagic2 = 0x6478696f
+
+	// daemonProtocol is the protocol version nartar speaks, 1.35. The lower
+	// of it and the daemon's is used.
+	daemonProtocol = 1<<8 | 35
+
+	// daemonMinProtocol is the first version taking the NAR of
+	// AddToStoreNar in frames, that of Nix 2.4.
+	daemonMinProtocol = 1<<8 | 23
+
+	opAddToStoreNar = 39
+
+	stderrNext          = 0x6f6c6d67
+	stderrLast          = 0x616c7473
+	stderrError         = 0x63787470
+	stderrStartActivity = 0x53545254
+	stderrStopActivity  = 0x53544f50
+	stderrResult        = 0x52534c54
+
+	daemonStringMax = 1 << 20
+	daemonFrameSize = 64 << 10
+
+	defaultDaemonSocket = "/nix/var/nix/daemon-socket/socket"
+)
+
+// ansiEscape matches the colours of the messages of the daemon.
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// runImport adds a NAR to the local Nix store through the nix-daemon, as
+// nix-store --import does, and prints its store path.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	input := fs.String("input", "-", "input NAR file ('-' for stdin)")
+	fs.StringVar(input, "i", "-", "shorthand for -input")
+	narFormat := addNarFormatFlags(fs, narInput)
+	opts := addPathInfoFlags(fs)
+	expect := addExpectedHashFlags(fs, false)
+	socket := fs.String("socket", firstNonEmpty(os.Getenv("NIX_DAEMON_SOCKET_PATH"), defaultDaemonSocket), "unix socket of the nix-daemon")
+	repair := fs.Bool("repair", false, "replace the store path if it is already valid")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(positional) > 1:
+		return fmt.Errorf("unexpected argument %q", positional[1])
+	case len(positional) == 1:
+		*input = positional[0]
+	}
+
+	if opts.info.storePath == "" && narFormat.format != narFormatExport {
+		return fmt.Errorf("import requires -store-path")
+	}
+
+	if err := opts.loadKeys(); err != nil {
+		return err
+	}
+
+	// The daemon is asked first, so that nothing is read if it is not there.
+	d, err := dialDaemon(*socket)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	in, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var export exportInfo
+
+	finish, err := narFormat.wrapInput(in, &export)
+	if err != nil {
+		return err
+	}
+
+	// The daemon needs the hash and size of the NAR before the NAR itself,
+	// so it is spooled to a temporary file as they are computed.
+	tmp, err := os.CreateTemp("", "nartar-import-*.nar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	narHash := sha256.New()
+	narSize := &countingWriter{w: io.MultiWriter(tmp, narHash)}
+	scanner := newRefScanner()
+	scanner.candidates = opts.candidates
+
+	sinks := expect.narOutput(narSize)
+	if opts.scan {
+		sinks = io.MultiWriter(sinks, scanner)
+	}
+
+	if _, err := copyNar(in, sinks); err != nil {
+		return err
+	}
+
+	if err := expect.verify(""); err != nil {
+		return err
+	}
+
+	if err := finish(); err != nil {
+		return err
+	}
+
+	ni, err := opts.pathInfo(scanner.references(), &export)
+	if err != nil {
+		return err
+	}
+
+	ni.NarHash = nixhash.MustNewHashWithEncoding(nixhash.SHA256, narHash.Sum(nil), nixhash.NixBase32, true)
+	ni.NarSize = uint64(narSize.n)
+
+	if err := signNarinfo(ni, opts.keys); err != nil {
+		return err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := d.addToStoreNar(ni, tmp, *repair); err != nil {
+		return fmt.Errorf("importing %s: %w", ni.StorePath, err)
+	}
+
+	atomic.AddInt64(&stats.bytesOut, narSize.n)
+
+	fmt.Println(ni.StorePath)
+
+	return nil
+}
+
+// daemonConn is a connection to the nix-daemon.
+type daemonConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	version uint64
+}
+
+// dialDaemon connects to the nix-daemon listening on socket.
+func dialDaemon(socket string) (*daemonConn, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the nix-daemon: %w", err)
+	}
+
+	d := &daemonConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	if err := d.handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connecting to the nix-daemon at %s: %w", socket, err)
+	}
+
+	return d, nil
+}
+
+func (d *daemonConn) Close() error {
+	return d.conn.Close()
+}
+
+// handshake agrees on the protocol version with the daemon.
+func (d *daemonConn) handshake() error {
+	if err := d.send(uint64(workerMagic1)); err != nil {
+		return err
+	}
+
+	magic, err := wire.ReadUint64(d.r)
+	if err != nil {
+		return err
+	}
+
+	if magic != workerMagic2 {
+		return fmt.Errorf("not a nix-daemon socket")
+	}
+
+	version, err := wire.ReadUint64(d.r)
+	if err != nil {
+		return err
+	}
+
+	if version>>8 != daemonProtocol>>8 || version < daemonMinProtocol {
+		return fmt.Errorf("unsupported protocol version %d.%d (Nix 2.4 or later is needed)", version>>8, version&0xff)
+	}
+
+	d.version = version
+	if d.version > daemonProtocol {
+		d.version = daemonProtocol
+	}
+
+	// No CPU affinity, and the obsolete reserveSpace.
+	if err := d.send(uint64(daemonProtocol), false, false); err != nil {
+		return err
+	}
+
+	if d.minor() >= 33 {
+		nixVersion, err := wire.ReadString(d.r, daemonStringMax)
+		if err != nil {
+			return err
+		}
+
+		if verbosity > 0 {
+			clearProgress()
+			fmt.Fprintf(os.Stderr, "nix-daemon %s, protocol 1.%d\n", nixVersion, d.minor())
+		}
+	}
+
+	if d.minor() >= 35 {
+		// Whether the daemon trusts us, which it decides for itself
+		// anyway when it checks signatures.
+		if _, err := wire.ReadUint64(d.r); err != nil {
+			return err
+		}
+	}
+
+	return d.processStderr()
+}
+
+func (d *daemonConn) minor() uint64 {
+	return d.version & 0xff
+}
+
+// addToStoreNar adds the store path ni with the NAR read from nar, which
+// must have the hash and size ni says.
+func (d *daemonConn) addToStoreNar(ni *narinfo.NarInfo, nar io.Reader, repair bool) error {
+	refs := make([]string, 0, len(ni.References))
+	for _, ref := range ni.References {
+		refs = append(refs, storepath.StoreDir+"/"+ref)
+	}
+
+	deriver := ""
+	if ni.Deriver != "" {
+		deriver = storepath.StoreDir + "/" + ni.Deriver
+	}
+
+	sigs := make([]string, 0, len(ni.Signatures))
+	for _, sig := range ni.Signatures {
+		sigs = append(sigs, sig.String())
+	}
+
+	// The path is not ultimately trusted, as it was not built here, and
+	// signatures are left to the daemon, which only skips checking them for
+	// trusted users, as nix-store --import does.
+	err := d.send(uint64(opAddToStoreNar), ni.StorePath, deriver, hex.EncodeToString(ni.NarHash.Digest()),
+		refs, uint64(time.Now().Unix()), ni.NarSize, false, sigs, "", repair, true)
+	if err != nil {
+		return err
+	}
+
+	if err := d.sendFramed(nar); err != nil {
+		// The daemon may have hung up with an error that says why.
+		if derr := d.processStderr(); derr != nil {
+			return derr
+		}
+
+		return err
+	}
+
+	return d.processStderr()
+}
+
+// sendFramed sends the contents of r as a framed stream: chunks preceded by
+// their length, ending with an empty one.
+func (d *daemonConn) sendFramed(r io.Reader) error {
+	buf := make([]byte, daemonFrameSize)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := wire.WriteUint64(d.w, uint64(n)); err != nil {
+				return err
+			}
+
+			if _, err := d.w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return d.send(uint64(0))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// send writes the fields of a request, and flushes them.
+func (d *daemonConn) send(fields ...interface{}) error {
+	for _, f := range fields {
+		var err error
+
+		switch f := f.(type) {
+		case uint64:
+			err = wire.WriteUint64(d.w, f)
+		case bool:
+			err = wire.WriteBool(d.w, f)
+		case string:
+			err = wire.WriteString(d.w, f)
+		case []string:
+			err = wire.WriteUint64(d.w, uint64(len(f)))
+			for _, s := range f {
+				if err == nil {
+					err = wire.WriteString(d.w, s)
+				}
+			}
+		default:
+			panic(fmt.Sprintf("unsupported daemon field %T", f))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.w.Flush()
+}
+
+// processStderr reads the log messages the daemon sends while it works, up
+// to the end of the work or its error.
+func (d *daemonConn) processStderr() error {
+	for {
+		msg, err := wire.ReadUint64(d.r)
+		if err != nil {
+			return fmt.Errorf("reading from the nix-daemon: %w", err)
+		}
+
+		switch msg {
+		case stderrLast:
+			return nil
+		case stderrError:
+			return d.readError()
+		case stderrNext:
+			s, err := wire.ReadString(d.r, daemonStringMax)
+			if err != nil {
+				return err
+			}
+
+			if verbosity >= 0 {
+				clearProgress()
+				fmt.Fprintf(os.Stderr, "nix-daemon: %s\n", strings.TrimSuffix(ansiEscape.ReplaceAllString(s, ""), "\n"))
+			}
+		case stderrStartActivity:
+			// The id, level and type of the activity, its text, its fields
+			// and its parent.
+			if _, err := d.readUint64s(3); err != nil {
+				return err
+			}
+
+			s, err := wire.ReadString(d.r, daemonStringMax)
+			if err != nil {
+				return err
+			}
+
+			if err := d.skipFields(); err != nil {
+				return err
+			}
+
+			if _, err := d.readUint64s(1); err != nil {
+				return err
+			}
+
+			if verbosity > 0 && s != "" {
+				clearProgress()
+				fmt.Fprintf(os.Stderr, "nix-daemon: %s\n", ansiEscape.ReplaceAllString(s, ""))
+			}
+		case stderrStopActivity:
+			if _, err := d.readUint64s(1); err != nil {
+				return err
+			}
+		case stderrResult:
+			if _, err := d.readUint64s(2); err != nil {
+				return err
+			}
+
+			if err := d.skipFields(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected message %#x from the nix-daemon", msg)
+		}
+	}
+}
+
+// readError reads the error the daemon failed with.
+func (d *daemonConn) readError() error {
+	if d.minor() < 26 {
+		s, err := wire.ReadString(d.r, daemonStringMax)
+		if err != nil {
+			return err
+		}
+
+		if _, err := d.readUint64s(1); err != nil {
+			return err
+		}
+
+		return errors.New(ansiEscape.ReplaceAllString(s, ""))
+	}
+
+	// The type, which is always "Error", the level and the obsolete name.
+	if _, err := wire.ReadString(d.r, daemonStringMax); err != nil {
+		return err
+	}
+
+	if _, err := d.readUint64s(1); err != nil {
+		return err
+	}
+
+	if _, err := wire.ReadString(d.r, daemonStringMax); err != nil {
+		return err
+	}
+
+	msg, err := wire.ReadString(d.r, daemonStringMax)
+	if err != nil {
+		return err
+	}
+
+	// Whether there is a position, which the daemon never sends, and the
+	// number of traces.
+	v, err := d.readUint64s(2)
+	if err != nil {
+		return err
+	}
+
+	lines := []string{msg}
+
+	for i := uint64(0); i < v[1]; i++ {
+		if _, err := d.readUint64s(1); err != nil {
+			return err
+		}
+
+		trace, err := wire.ReadString(d.r, daemonStringMax)
+		if err != nil {
+			return err
+		}
+
+		lines = append(lines, trace)
+	}
+
+	return errors.New(ansiEscape.ReplaceAllString(strings.Join(lines, "\n"), ""))
+}
+
+// skipFields reads the fields of an activity or result: numbers and strings.
+func (d *daemonConn) skipFields() error {
+	n, err := wire.ReadUint64(d.r)
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < n; i++ {
+		typ, err := wire.ReadUint64(d.r)
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case 0:
+			_, err = wire.ReadUint64(d.r)
+		case 1:
+			_, err = wire.ReadString(d.r, daemonStringMax)
+		default:
+			return fmt.Errorf("unknown field type %d from the nix-daemon", typ)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *daemonConn) readUint64s(n int) ([]uint64, error) {
+	v := make([]uint64, n)
+
+	for i := range v {
+		var err error
+		if v[i], err = wire.ReadUint64(d.r); err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
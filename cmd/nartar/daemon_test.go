@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/wire"
+)
+
+// daemonRequest is an AddToStoreNar request as the fake daemon received it.
+type daemonRequest struct {
+	path, deriver, narHash string
+	refs                   []string
+	narSize                uint64
+	ultimate               bool
+	sigs                   []string
+	ca                     string
+	repair, dontCheckSigs  bool
+	nar                    []byte
+}
+
+// fakeDaemon serves one connection on a socket in a temporary directory as
+// a nix-daemon of the given protocol version would, and answers an
+// AddToStoreNar request with the messages reply writes. It returns the
+// socket and a channel with the request received, or the error the
+// connection failed with.
+func fakeDaemon(t *testing.T, version uint64, magic uint64, reply func(d *daemonConn) error) (string, <-chan interface{}) {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "socket")
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	done := make(chan interface{}, 1)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+
+		d := &daemonConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn), version: version}
+
+		req, err := d.serveAddToStoreNar(magic, reply)
+		if err != nil {
+			done <- err
+			return
+		}
+
+		done <- req
+	}()
+
+	return socket, done
+}
+
+// serveAddToStoreNar is the daemon side of the handshake and of one
+// AddToStoreNar request.
+func (d *daemonConn) serveAddToStoreNar(magic uint64, reply func(d *daemonConn) error) (*daemonRequest, error) {
+	if m, err := wire.ReadUint64(d.r); err != nil || m != workerMagic1 {
+		return nil, fmt.Errorf("client magic %#x, %v", m, err)
+	}
+
+	if err := d.send(magic, d.version); err != nil || magic != workerMagic2 {
+		return nil, err
+	}
+
+	client, err := d.readUint64s(3)
+	if err != nil {
+		return nil, err
+	}
+
+	if client[0] != daemonProtocol || client[1] != 0 || client[2] != 0 {
+		return nil, fmt.Errorf("client sent version %#x, affinity %d, reserveSpace %d", client[0], client[1], client[2])
+	}
+
+	if d.version>>8 != 1 || d.version&0xff < 23 {
+		// The client hangs up on versions it does not speak.
+		return nil, nil
+	}
+
+	if client[0] < d.version {
+		d.version = client[0]
+	}
+
+	if d.minor() >= 33 {
+		if err := d.send("2.18.1"); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.minor() >= 35 {
+		if err := d.send(uint64(1)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := d.send(uint64(stderrLast)); err != nil {
+		return nil, err
+	}
+
+	if op, err := wire.ReadUint64(d.r); err != nil || op != opAddToStoreNar {
+		return nil, fmt.Errorf("op %d, %v", op, err)
+	}
+
+	req := &daemonRequest{}
+
+	readString := func() string {
+		s, rerr := wire.ReadString(d.r, daemonStringMax)
+		if err == nil {
+			err = rerr
+		}
+
+		return s
+	}
+
+	readStrings := func() []string {
+		n, rerr := wire.ReadUint64(d.r)
+		if err == nil {
+			err = rerr
+		}
+
+		var ss []string
+		for i := uint64(0); i < n && err == nil; i++ {
+			ss = append(ss, readString())
+		}
+
+		return ss
+	}
+
+	readBool := func() bool {
+		b, rerr := wire.ReadBool(d.r)
+		if err == nil {
+			err = rerr
+		}
+
+		return b
+	}
+
+	req.path, req.deriver, req.narHash = readString(), readString(), readString()
+	req.refs = readStrings()
+
+	readUint64 := func() uint64 {
+		n, rerr := wire.ReadUint64(d.r)
+		if err == nil {
+			err = rerr
+		}
+
+		return n
+	}
+
+	readUint64() // the registration time
+	req.narSize = readUint64()
+
+	req.ultimate, req.sigs, req.ca = readBool(), readStrings(), readString()
+	req.repair, req.dontCheckSigs = readBool(), readBool()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The NAR comes in frames, up to an empty one.
+	for {
+		n, err := wire.ReadUint64(d.r)
+		if err != nil {
+			return nil, err
+		}
+
+		if n == 0 {
+			break
+		}
+
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(d.r, frame); err != nil {
+			return nil, err
+		}
+
+		req.nar = append(req.nar, frame...)
+	}
+
+	return req, reply(d)
+}
+
+// daemonErrorReply fails the request with msg and a trace, as daemons of
+// protocol 1.26 or later do.
+func daemonErrorReply(d *daemonConn) error {
+	return d.send(uint64(stderrError), "Error", uint64(0), "Error", "\x1b[31;1merror:\x1b[0m path is not valid", uint64(0), uint64(1),
+		uint64(0), "while adding the path")
+}
+
+func TestDaemonAddToStoreNar(t *testing.T) {
+	nar := strings.Repeat("nar", 196040/3) + "n"
+
+	success := func(d *daemonConn) error {
+		// A log line, an activity and its result, as the daemon may send
+		// while it works.
+		return d.send(
+			uint64(stderrNext), "\x1b[1madding\x1b[0m\n",
+			uint64(stderrStartActivity), uint64(1), uint64(3), uint64(100), "copying", uint64(2), uint64(0), uint64(5), uint64(1), "field", uint64(0),
+			uint64(stderrResult), uint64(1), uint64(105), uint64(1), uint64(0), uint64(7),
+			uint64(stderrStopActivity), uint64(1),
+			uint64(stderrLast))
+	}
+
+	tests := []struct {
+		desc    string
+		version uint64
+		magic   uint64
+		reply   func(d *daemonConn) error
+		err     string
+	}{
+		{desc: "protocol 1.35", version: 1<<8 | 35, magic: workerMagic2, reply: success},
+		{desc: "newer protocol", version: 1<<8 | 37, magic: workerMagic2, reply: success},
+		{desc: "protocol 1.23", version: 1<<8 | 23, magic: workerMagic2, reply: success},
+		{desc: "error", version: 1<<8 | 35, magic: workerMagic2, reply: daemonErrorReply, err: "error: path is not valid\nwhile adding the path"},
+		{desc: "error before 1.26", version: 1<<8 | 25, magic: workerMagic2, reply: func(d *daemonConn) error {
+			return d.send(uint64(stderrError), "error: path is not valid", uint64(1))
+		}, err: "error: path is not valid"},
+		{desc: "protocol 1.22", version: 1<<8 | 22, magic: workerMagic2, err: "unsupported protocol version 1.22"},
+		{desc: "protocol 2.0", version: 2 << 8, magic: workerMagic2, err: "unsupported protocol version 2.0"},
+		{desc: "not a daemon", version: 1<<8 | 35, magic: 1, err: "not a nix-daemon socket"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			socket, done := fakeDaemon(t, tt.version, tt.magic, tt.reply)
+
+			ni, err := parseNarinfo(strings.NewReader(curlNarinfo + "Sig: " + curlTest1Sig + "\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d, err := dialDaemon(socket)
+			if err == nil {
+				defer d.Close()
+				err = d.addToStoreNar(ni, strings.NewReader(nar), true)
+			}
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want an error with %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := <-done
+			req, ok := got.(*daemonRequest)
+			if !ok {
+				t.Fatalf("daemon: %v", got)
+			}
+
+			want := &daemonRequest{
+				path:    "/nix/store/syd87l2rxw8cbsxmxl853h0r6pdwhwjr-curl-7.82.0-bin",
+				deriver: "/nix/store/5rwxzi7pal3qhpsyfc16gzkh939q1np6-curl-7.82.0.drv",
+				narHash: hex.EncodeToString(ni.NarHash.Digest()),
+				refs: []string{
+					"/nix/store/0jqd0rlxzra1rs38rdxl43yh6rxchgc6-curl-7.82.0",
+					"/nix/store/6w8g7njm4mck5dmjxws0z1xnrxvl81xa-glibc-2.34-115",
+					"/nix/store/j5jxw3iy7bbz4a57fh9g2xm2gxmyal8h-zlib-1.2.12",
+					"/nix/store/yxvjs9drzsphm9pcf42a4byzj1kb9m7k-openssl-1.1.1n",
+				},
+				narSize:       196040,
+				sigs:          []string{curlTest1Sig},
+				repair:        true,
+				dontCheckSigs: true,
+			}
+
+			if string(req.nar) != nar {
+				t.Errorf("the daemon received a NAR of %d bytes, not the %d sent", len(req.nar), len(nar))
+			}
+
+			req.nar = nil
+			if fmt.Sprint(req) != fmt.Sprint(want) {
+				t.Errorf("daemon received\n%+v\nwant\n%+v", req, want)
+			}
+		})
+	}
+}
+
+func TestImport(t *testing.T) {
+	withoutConfig(t)
+
+	socket, done := fakeDaemon(t, daemonProtocol, workerMagic2, func(d *daemonConn) error {
+		return d.send(uint64(stderrLast))
+	})
+
+	nar := buildNar(t, testTree)
+
+	input := filepath.Join(t.TempDir(), "in.nar")
+	if err := os.WriteFile(input, nar, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	storePath := "/nix/store/syd87l2rxw8cbsxmxl853h0r6pdwhwjr-test"
+
+	err := runImport([]string{"-socket", socket, "-store-path", storePath, "-reference", "/nix/store/0jqd0rlxzra1rs38rdxl43yh6rxchgc6-dep", input})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, ok := (<-done).(*daemonRequest)
+	if !ok {
+		t.Fatal("the daemon got no request")
+	}
+
+	sum := sha256.Sum256(nar)
+
+	switch {
+	case req.path != storePath:
+		t.Errorf("imported %s, want %s", req.path, storePath)
+	case req.narHash != hex.EncodeToString(sum[:]) || req.narSize != uint64(len(nar)):
+		t.Errorf("NAR hash %s and size %d, want %x and %d", req.narHash, req.narSize, sum, len(nar))
+	case string(req.nar) != string(nar):
+		t.Error("the daemon received a different NAR")
+	case strings.Join(req.refs, " ") != "/nix/store/0jqd0rlxzra1rs38rdxl43yh6rxchgc6-dep":
+		t.Errorf("references %q", req.refs)
+	case req.repair || !req.dontCheckSigs || req.ultimate:
+		t.Errorf("repair %t, dontCheckSigs %t, ultimate %t", req.repair, req.dontCheckSigs, req.ultimate)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	arMagic     = "!<arch>\n"
+	arHeaderLen = 60
+)
+
+type arHeader struct {
+	name string
+	size int64
+}
+
+// arReader reads the common ar archive format used by Debian packages.
+type arReader struct {
+	r         io.Reader
+	remaining int64
+	pad       int64
+}
+
+func newArReader(r io.Reader) (*arReader, error) {
+	magic := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, fmt.Errorf("reading ar magic: %w", unexpectedEOF(err))
+	}
+
+	if string(magic) != arMagic {
+		return nil, fmt.Errorf("not an ar archive")
+	}
+
+	return &arReader{r: r}, nil
+}
+
+func (ar *arReader) next() (*arHeader, error) {
+	if _, err := io.CopyN(io.Discard, ar.r, ar.remaining+ar.pad); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	ar.remaining, ar.pad = 0, 0
+
+	var raw [arHeaderLen]byte
+	if _, err := io.ReadFull(ar.r, raw[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+
+		return nil, unexpectedEOF(err)
+	}
+
+	if string(raw[58:60]) != "`\n" {
+		return nil, fmt.Errorf("invalid ar member header")
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(string(raw[48:58])), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ar member size: %w", err)
+	}
+
+	// GNU ar terminates names with a slash; BSD ar pads with spaces.
+	name := strings.TrimSpace(string(raw[:16]))
+	name = strings.TrimSuffix(name, "/")
+
+	ar.remaining = size
+	ar.pad = size % 2
+
+	return &arHeader{name: name, size: size}, nil
+}
+
+func (ar *arReader) Read(b []byte) (int, error) {
+	if ar.remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(b)) > ar.remaining {
+		b = b[:ar.remaining]
+	}
+
+	n, err := ar.r.Read(b)
+	ar.remaining -= int64(n)
+	if errors.Is(err, io.EOF) && ar.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+// debToNar converts the data.tar payload of a Debian package into a NAR
+// whose root directory corresponds to the filesystem root of the package.
+func debToNar(in io.Reader, out io.Writer, opts *readOptions) error {
+	ar, err := newArReader(in)
+	if err != nil {
+		return fmt.Errorf("opening deb: %w", err)
+	}
+
+	for {
+		h, err := ar.next()
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("deb contains no data.tar member")
+		}
+
+		if err != nil {
+			return fmt.Errorf("reading deb: %w", err)
+		}
+
+		switch {
+		case h.name == "debian-binary":
+			version, err := io.ReadAll(ar)
+			if err != nil {
+				return fmt.Errorf("reading deb version: %w", err)
+			}
+
+			if !bytes.HasPrefix(version, []byte("2.")) {
+				return fmt.Errorf("unsupported deb format version %q", strings.TrimSpace(string(version)))
+			}
+		case strings.HasPrefix(h.name, "data.tar"):
+			payload, err := decompress(ar)
+			if err != nil {
+				return fmt.Errorf("opening deb payload %s: %w", h.name, err)
+			}
+			defer payload.Close()
+
+			entries := newEntryTree()
+			if err := readTarEntries(tar.NewReader(payload), "", entries, opts); err != nil {
+				return err
+			}
+
+			return writeNarEntries(entries, out)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// assertDeterministic runs write with a writer that passes the tar it writes
+// on to out and reads it back as written, checking that it only depends on
+// the NAR and the options: the entries come in NAR order, and every entry
+// has the -mtime timestamp, the permissions of its type and the configured
+// ownership. roots are the top-level members of the inputs; entries are only
+// ordered against others of the same input.
+func assertDeterministic(out io.Writer, roots []string, opts *tarOptions, write func(io.Writer) error) error {
+	pr, pw := io.Pipe()
+	checked := make(chan error, 1)
+
+	go func() {
+		err := checkDeterministic(pr, roots, opts)
+
+		// Whatever follows the end of the archive is still written.
+		io.Copy(io.Discard, pr)
+		checked <- err
+	}()
+
+	err := write(io.MultiWriter(out, pw))
+	pw.CloseWithError(err)
+
+	if cerr := <-checked; err == nil && cerr != nil {
+		err = fmt.Errorf("output is not deterministic: %w", cerr)
+	}
+
+	return err
+}
+
+func checkDeterministic(r io.Reader, roots []string, opts *tarOptions) error {
+	tr := tar.NewReader(r)
+	last := make(map[string][]string)
+
+	for {
+		th, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimSuffix(th.Name, "/")
+		elems := strings.Split(name, "/")
+		group := inputRoot(roots, name)
+
+		if prev, ok := last[group]; ok && compareElems(prev, elems) >= 0 {
+			return fmt.Errorf("%s comes after %s, out of NAR order", th.Name, strings.Join(prev, "/"))
+		}
+
+		last[group] = elems
+
+		if err := checkHeader(th, opts); err != nil {
+			return fmt.Errorf("%s: %w", th.Name, err)
+		}
+	}
+}
+
+// checkHeader checks the metadata of a tar entry that the NAR does not
+// determine.
+func checkHeader(th *tar.Header, opts *tarOptions) error {
+	var mode int64
+
+	switch th.Typeflag {
+	case tar.TypeDir:
+		mode = opts.modes.dir
+	case tar.TypeSymlink:
+		mode = symlinkMode
+	case tar.TypeReg, tar.TypeLink:
+		mode = opts.modes.file
+		if th.Mode != mode {
+			mode = opts.modes.forFile(true)
+		}
+	default:
+		return fmt.Errorf("unexpected entry type %q", th.Typeflag)
+	}
+
+	switch {
+	case th.Mode != mode:
+		return fmt.Errorf("mode %o, expected %o", th.Mode, mode)
+	case opts.sidecar == nil && !th.ModTime.Equal(opts.mtime):
+		return fmt.Errorf("mtime %v, expected %v", th.ModTime.UTC(), opts.mtime.UTC())
+	case !th.AccessTime.IsZero() || !th.ChangeTime.IsZero():
+		return fmt.Errorf("has an atime or ctime")
+	case th.Uid != opts.uid || th.Gid != opts.gid:
+		return fmt.Errorf("owner %d:%d, expected %d:%d", th.Uid, th.Gid, opts.uid, opts.gid)
+	}
+
+	uname, gname := opts.uname, opts.gname
+	if opts.numericOwner {
+		uname, gname = "", ""
+	}
+
+	if th.Uname != uname || th.Gname != gname {
+		return fmt.Errorf("owner names %q:%q, expected %q:%q", th.Uname, th.Gname, uname, gname)
+	}
+
+	return nil
+}
+
+// inputRoot returns the longest of roots that name is in.
+func inputRoot(roots []string, name string) string {
+	best := ""
+
+	for _, r := range roots {
+		if (name == r || strings.HasPrefix(name, r+"/")) && len(r) > len(best) {
+			best = r
+		}
+	}
+
+	return best
+}
+
+// compareElems compares paths element by element, which is the order of a
+// NAR: a directory comes before its contents, and siblings are sorted.
+func compareElems(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := strings.Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+
+	return len(a) - len(b)
+}
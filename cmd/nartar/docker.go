@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// dockerManifestEntry is one image of the manifest.json written by
+// "docker save".
+type dockerManifestEntry struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// dockerArchive indexes the members of a "docker save" tarball so layers can
+// be read in manifest order regardless of their position in the stream.
+type dockerArchive struct {
+	f       *os.File
+	members map[string]*io.SectionReader
+}
+
+func openDockerArchive(f *os.File) (*dockerArchive, error) {
+	da := &dockerArchive{f: f, members: make(map[string]*io.SectionReader)}
+
+	tr := tar.NewReader(f)
+
+	for {
+		th, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("reading docker archive: %w", err)
+		}
+
+		if th.Typeflag != tar.TypeReg && th.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		// archive/tar does not read ahead, so the file offset is the start
+		// of the member data.
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+
+		da.members[path.Clean(th.Name)] = io.NewSectionReader(f, offset, th.Size)
+	}
+
+	return da, nil
+}
+
+func (da *dockerArchive) member(name string) (*io.SectionReader, error) {
+	m, ok := da.members[path.Clean(name)]
+	if !ok {
+		return nil, fmt.Errorf("docker archive has no member %q", name)
+	}
+
+	return io.NewSectionReader(m, 0, m.Size()), nil
+}
+
+// selectImage returns the image tagged tag, or the only image when tag is
+// empty.
+func (da *dockerArchive) selectImage(tag string) (*dockerManifestEntry, error) {
+	r, err := da.member("manifest.json")
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest []dockerManifestEntry
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("parsing manifest.json: %w", err)
+	}
+
+	var tags []string
+
+	for i := range manifest {
+		if tag == "" && len(manifest) == 1 {
+			return &manifest[i], nil
+		}
+
+		for _, t := range manifest[i].RepoTags {
+			if t == tag {
+				return &manifest[i], nil
+			}
+
+			tags = append(tags, t)
+		}
+	}
+
+	if tag != "" {
+		return nil, fmt.Errorf("no image tagged %q in docker archive", tag)
+	}
+
+	return nil, fmt.Errorf("docker archive contains %d images, select one with -image (tags: %s)", len(manifest), strings.Join(tags, ", "))
+}
+
+// dockerToNar converts an image from a "docker save" tarball into a NAR,
+// applying all layers in order unless layer selects a single one.
+func dockerToNar(f *os.File, tag string, layer int, whiteouts string, opts *readOptions, out io.Writer) error {
+	da, err := openDockerArchive(f)
+	if err != nil {
+		return err
+	}
+
+	img, err := da.selectImage(tag)
+	if err != nil {
+		return err
+	}
+
+	layers := img.Layers
+	if layer >= 0 {
+		if layer >= len(layers) {
+			return fmt.Errorf("image has %d layers, cannot select layer %d", len(layers), layer)
+		}
+
+		layers = layers[layer : layer+1]
+	}
+
+	entries := newEntryTree()
+
+	for _, name := range layers {
+		m, err := da.member(name)
+		if err != nil {
+			return err
+		}
+
+		r, err := decompress(m)
+		if err != nil {
+			return fmt.Errorf("opening layer %s: %w", name, err)
+		}
+
+		if err := applyLayer(r, entries, whiteouts, opts); err != nil {
+			return fmt.Errorf("applying layer %s: %w", name, err)
+		}
+	}
+
+	return writeNarEntries(entries, out)
+}
+
+// seekableInput returns in as a seekable file, spooling it to a temporary
+// file first if necessary. The returned cleanup function removes the spool.
+func seekableInput(in io.Reader) (*os.File, func(), error) {
+	// Random access cannot be followed by a progress bar. The input is
+	// counted as read completely.
+	if p, ok := in.(*progressReader); ok {
+		if p.size > 0 {
+			atomic.AddInt64(&stats.bytesIn, p.size-p.n)
+		}
+
+		in = p.r
+	}
+
+	if f, ok := in.(*os.File); ok {
+		if _, err := f.Seek(0, io.SeekCurrent); err == nil {
+			return f, func() {}, nil
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "nartar-spool-*")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("spooling input: %w", err)
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	return tmp, cleanup, nil
+}
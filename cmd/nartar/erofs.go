@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+const (
+	erofsMagic       uint32 = 0xe0f5e1e2
+	erofsBlockBits          = 12
+	erofsBlockSize          = 1 << erofsBlockBits
+	erofsSuperOffset        = 1024
+	erofsInodeSize          = 32
+	erofsDirentSize         = 12
+
+	// erofsLayoutFlatPlain stores data uncompressed in consecutive blocks.
+	erofsLayoutFlatPlain = 0
+
+	erofsFileTypeRegular = 1
+	erofsFileTypeDir     = 2
+	erofsFileTypeSymlink = 7
+)
+
+// erofsInode is a compact (32 byte) EROFS inode together with the data it
+// points at. The nid of an inode is its index in the inode table.
+type erofsInode struct {
+	node    *treeNode
+	nid     uint64
+	parent  uint64
+	mode    uint16
+	nlink   uint16
+	data    []byte
+	blkaddr uint32
+}
+
+type erofsDirent struct {
+	name     string
+	nid      uint64
+	fileType uint8
+}
+
+// narToErofs writes an uncompressed EROFS image of the NAR contents, ready to
+// be mounted with "mount -t erofs" without any extraction step.
+func narToErofs(in io.Reader, out io.Writer) error {
+	root, err := readNarTree(in)
+	if err != nil {
+		return err
+	}
+
+	if root.kind != nar.TypeDirectory {
+		return fmt.Errorf("erofs output requires a directory at the NAR root")
+	}
+
+	var inodes []*erofsInode
+
+	index := make(map[*treeNode]*erofsInode)
+
+	var collect func(n *treeNode, parent uint64)
+	collect = func(n *treeNode, parent uint64) {
+		ino := &erofsInode{node: n, nid: uint64(len(inodes)), parent: parent, nlink: 1}
+		inodes = append(inodes, ino)
+		index[n] = ino
+
+		for _, c := range n.children {
+			collect(c, ino.nid)
+		}
+	}
+	collect(root, 0)
+
+	if uint64(len(inodes)) > math.MaxUint32 {
+		return fmt.Errorf("too many entries for an erofs image")
+	}
+
+	for _, ino := range inodes {
+		n := ino.node
+
+		switch n.kind {
+		case nar.TypeDirectory:
+			ino.mode = uint16(unixModeDir | dirMode)
+			ino.nlink = 2
+
+			dirents := []erofsDirent{
+				{name: ".", nid: ino.nid, fileType: erofsFileTypeDir},
+				{name: "..", nid: ino.parent, fileType: erofsFileTypeDir},
+			}
+
+			for _, c := range n.children {
+				child := index[c]
+				dirents = append(dirents, erofsDirent{name: c.name, nid: child.nid, fileType: erofsFileType(c.kind)})
+
+				if c.kind == nar.TypeDirectory {
+					ino.nlink++
+				}
+			}
+
+			ino.data = erofsDirData(dirents)
+		case nar.TypeSymlink:
+			ino.mode = uint16(unixModeSymlink | symlinkMode)
+			ino.data = []byte(n.linkTarget)
+		case nar.TypeRegular:
+			ino.mode = uint16(unixModeRegular | pickFileMode(n.executable))
+			ino.data = n.data
+		default:
+			return fmt.Errorf("unsupported nar node type %q", n.kind)
+		}
+
+		if len(ino.data) > math.MaxUint32 {
+			return fmt.Errorf("file %q is too large for a compact erofs inode", n.name)
+		}
+	}
+
+	metaBlocks := erofsBlocks(uint64(len(inodes)) * erofsInodeSize)
+	next := 1 + metaBlocks
+
+	for _, ino := range inodes {
+		if len(ino.data) == 0 {
+			continue
+		}
+
+		ino.blkaddr = uint32(next)
+		next += erofsBlocks(uint64(len(ino.data)))
+	}
+
+	if next > math.MaxUint32 {
+		return fmt.Errorf("image exceeds the erofs block address space")
+	}
+
+	sb := make([]byte, erofsBlockSize)
+	le := binary.LittleEndian
+	le.PutUint32(sb[erofsSuperOffset:], erofsMagic)
+	sb[erofsSuperOffset+12] = erofsBlockBits
+	le.PutUint16(sb[erofsSuperOffset+14:], 0) // root nid
+	le.PutUint64(sb[erofsSuperOffset+16:], uint64(len(inodes)))
+	le.PutUint32(sb[erofsSuperOffset+36:], uint32(next))
+	le.PutUint32(sb[erofsSuperOffset+40:], 1) // meta_blkaddr
+
+	if _, err := out.Write(sb); err != nil {
+		return fmt.Errorf("writing erofs superblock: %w", err)
+	}
+
+	table := make([]byte, metaBlocks*erofsBlockSize)
+	for _, ino := range inodes {
+		b := table[ino.nid*erofsInodeSize:]
+		le.PutUint16(b[0:], erofsLayoutFlatPlain<<1)
+		le.PutUint16(b[4:], ino.mode)
+		le.PutUint16(b[6:], ino.nlink)
+		le.PutUint32(b[8:], uint32(len(ino.data)))
+		le.PutUint32(b[16:], ino.blkaddr)
+		le.PutUint32(b[20:], uint32(ino.nid+1))
+	}
+
+	if _, err := out.Write(table); err != nil {
+		return fmt.Errorf("writing erofs inode table: %w", err)
+	}
+
+	for _, ino := range inodes {
+		if len(ino.data) == 0 {
+			continue
+		}
+
+		if _, err := out.Write(ino.data); err != nil {
+			return fmt.Errorf("writing erofs data: %w", err)
+		}
+
+		if pad := erofsBlocks(uint64(len(ino.data)))*erofsBlockSize - uint64(len(ino.data)); pad > 0 {
+			if _, err := out.Write(make([]byte, pad)); err != nil {
+				return fmt.Errorf("writing erofs data: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// erofsDirData packs dirents into directory blocks. Each block holds a run of
+// 12-byte dirents followed by their names; the names are not terminated, so
+// the size of the final block is trimmed to the last name.
+func erofsDirData(dirents []erofsDirent) []byte {
+	sort.Slice(dirents, func(i, j int) bool { return dirents[i].name < dirents[j].name })
+
+	var buf bytes.Buffer
+
+	for i := 0; i < len(dirents); {
+		used := 0
+		j := i
+
+		for j < len(dirents) && used+erofsDirentSize+len(dirents[j].name) <= erofsBlockSize {
+			used += erofsDirentSize + len(dirents[j].name)
+			j++
+		}
+
+		block := make([]byte, used)
+		nameOff := (j - i) * erofsDirentSize
+
+		for k, d := range dirents[i:j] {
+			e := block[k*erofsDirentSize:]
+			binary.LittleEndian.PutUint64(e[0:], d.nid)
+			binary.LittleEndian.PutUint16(e[8:], uint16(nameOff))
+			e[10] = d.fileType
+			nameOff += copy(block[nameOff:], d.name)
+		}
+
+		buf.Write(block)
+
+		if j < len(dirents) {
+			buf.Write(make([]byte, erofsBlockSize-used))
+		}
+
+		i = j
+	}
+
+	return buf.Bytes()
+}
+
+func erofsFileType(kind nar.NodeType) uint8 {
+	switch kind {
+	case nar.TypeDirectory:
+		return erofsFileTypeDir
+	case nar.TypeSymlink:
+		return erofsFileTypeSymlink
+	default:
+		return erofsFileTypeRegular
+	}
+}
+
+func erofsBlocks(size uint64) uint64 {
+	return (size + erofsBlockSize - 1) / erofsBlockSize
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// erofsImage reads back the images narToErofs writes: compact inodes with
+// their data in consecutive blocks.
+type erofsImage struct {
+	t    *testing.T
+	b    []byte
+	meta uint64
+
+	entries map[string]testEntry
+	nlinks  map[string]uint16
+	nids    map[uint64]string
+}
+
+func readErofs(t *testing.T, b []byte) *erofsImage {
+	t.Helper()
+
+	le := binary.LittleEndian
+	sb := b[erofsSuperOffset:]
+
+	if le.Uint32(sb) != erofsMagic || sb[12] != erofsBlockBits {
+		t.Fatalf("bad superblock: magic %#x, block bits %d", le.Uint32(sb), sb[12])
+	}
+
+	if blocks := le.Uint32(sb[36:]); uint64(len(b)) != uint64(blocks)*erofsBlockSize {
+		t.Fatalf("image is %d bytes, the superblock gives %d blocks", len(b), blocks)
+	}
+
+	img := &erofsImage{
+		t:       t,
+		b:       b,
+		meta:    uint64(le.Uint32(sb[40:])),
+		entries: make(map[string]testEntry),
+		nlinks:  make(map[string]uint16),
+		nids:    make(map[uint64]string),
+	}
+
+	root := uint64(le.Uint16(sb[14:]))
+	img.walk(root, root, "/")
+
+	if n := le.Uint64(sb[16:]); n != uint64(len(img.nids)) {
+		t.Errorf("the superblock counts %d inodes, %d are reachable", n, len(img.nids))
+	}
+
+	return img
+}
+
+// inode returns the mode, link count and data of the inode nid.
+func (img *erofsImage) inode(nid uint64) (uint16, uint16, []byte) {
+	le := binary.LittleEndian
+	in := img.b[img.meta*erofsBlockSize+nid*erofsInodeSize:]
+
+	if format := le.Uint16(in); format != erofsLayoutFlatPlain<<1 {
+		img.t.Fatalf("inode %d has format %#x", nid, format)
+	}
+
+	size, blkaddr := le.Uint32(in[8:]), uint64(le.Uint32(in[16:]))
+	start := blkaddr * erofsBlockSize
+
+	return le.Uint16(in[4:]), le.Uint16(in[6:]), img.b[start : start+uint64(size)]
+}
+
+func (img *erofsImage) walk(nid, parent uint64, p string) {
+	t := img.t
+
+	if other, ok := img.nids[nid]; ok {
+		t.Fatalf("%s and %s share inode %d", p, other, nid)
+	}
+
+	img.nids[nid] = p
+
+	mode, nlink, data := img.inode(nid)
+	img.nlinks[p] = nlink
+
+	switch int64(mode) & unixModeType {
+	case unixModeDir:
+		img.entries[p] = testEntry{typ: nar.TypeDirectory}
+	case unixModeSymlink:
+		img.entries[p] = testEntry{typ: nar.TypeSymlink, target: string(data)}
+		return
+	case unixModeRegular:
+		img.entries[p] = testEntry{typ: nar.TypeRegular, exec: mode&0o111 != 0, data: string(data)}
+		return
+	default:
+		t.Fatalf("%s has mode %o", p, mode)
+	}
+
+	var names []string
+
+	for off := 0; off < len(data); off += erofsBlockSize {
+		block := data[off:]
+		if len(block) > erofsBlockSize {
+			block = block[:erofsBlockSize]
+		}
+
+		// The name of the first dirent starts after the last dirent.
+		count := int(binary.LittleEndian.Uint16(block[8:])) / erofsDirentSize
+
+		for i := 0; i < count; i++ {
+			d := block[i*erofsDirentSize:]
+			child := binary.LittleEndian.Uint64(d)
+
+			end := len(block)
+			if i+1 < count {
+				end = int(binary.LittleEndian.Uint16(d[erofsDirentSize+8:]))
+			}
+
+			name := string(bytes.TrimRight(block[binary.LittleEndian.Uint16(d[8:]):end], "\x00"))
+			names = append(names, name)
+
+			switch name {
+			case ".":
+				if child != nid {
+					t.Errorf("%s: . is inode %d, not %d", p, child, nid)
+				}
+			case "..":
+				if child != parent {
+					t.Errorf("%s: .. is inode %d, not %d", p, child, parent)
+				}
+			default:
+				img.walk(child, nid, path.Join(p, name))
+
+				if want := erofsFileType(img.entries[path.Join(p, name)].typ); d[10] != want {
+					t.Errorf("%s/%s has file type %d, want %d", p, name, d[10], want)
+				}
+			}
+		}
+	}
+
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("%s: entries are not sorted: %q", p, names)
+	}
+}
+
+func TestErofsRoundTrip(t *testing.T) {
+	var out bytes.Buffer
+	if err := narToErofs(bytes.NewReader(buildNar(t, testTree)), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	img := readErofs(t, out.Bytes())
+	checkEntries(t, img.entries, testTree)
+
+	// A directory is linked from its parent, its own . and the .. of each
+	// subdirectory; everything else has a single link.
+	nlinks := map[string]uint16{"/": 5, "/bin": 2, "/emptydir": 2, "/share": 3, "/share/doc": 2}
+	for p := range testTree {
+		want, ok := nlinks[p]
+		if !ok {
+			want = 1
+		}
+
+		if img.nlinks[p] != want {
+			t.Errorf("%s has %d links, want %d", p, img.nlinks[p], want)
+		}
+	}
+}
+
+func TestErofsLargeDirectory(t *testing.T) {
+	// Enough entries for the directory to take several blocks.
+	entries := map[string]testEntry{"/": {typ: nar.TypeDirectory}}
+	for i := 0; i < 500; i++ {
+		entries[fmt.Sprintf("/file-with-a-long-name-%04d", i)] = testEntry{typ: nar.TypeRegular, data: fmt.Sprint(i)}
+	}
+
+	var out bytes.Buffer
+	if err := narToErofs(bytes.NewReader(buildNar(t, entries)), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	checkEntries(t, readErofs(t, out.Bytes()).entries, entries)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+)
+
+// expectedHashes are the hashes -expected-narhash and -expected-filehash
+// require of the NAR and of the output file, so that a pipeline passes on
+// nothing but what it was told to expect.
+type expectedHashes struct {
+	nar  *expectedHash
+	file *expectedHash
+
+	narCheck  *hashCheck
+	fileCheck *hashCheck
+}
+
+// addExpectedHashFlags registers -expected-narhash, and -expected-filehash
+// for commands writing a file.
+func addExpectedHashFlags(fs *flag.FlagSet, file bool) *expectedHashes {
+	e := &expectedHashes{}
+
+	fs.Func("expected-narhash", "fail, removing the output, unless the NAR has this hash (sha256:..., SRI sha256-..., or another algorithm Nix knows)", func(v string) (err error) {
+		e.nar, err = parseExpectedHash(v)
+		return err
+	})
+
+	if file {
+		fs.Func("expected-filehash", "fail, removing the output, unless the output file has this hash", func(v string) (err error) {
+			e.file, err = parseExpectedHash(v)
+			return err
+		})
+	}
+
+	return e
+}
+
+// expectedHash is a digest of the algorithm algo.
+type expectedHash struct {
+	algo string
+	sum  []byte
+}
+
+// parseExpectedHash parses a hash as Nix writes them, taking bare digests
+// to be SHA-256.
+func parseExpectedHash(s string) (*expectedHash, error) {
+	algo, sum, err := parseHash(s, "sha256")
+	if err != nil {
+		return nil, err
+	}
+
+	return &expectedHash{algo: algo, sum: sum}, nil
+}
+
+func (e *expectedHashes) any() bool {
+	return e != nil && (e.nar != nil || e.file != nil)
+}
+
+// output returns out, with what is written to it hashed for
+// -expected-filehash.
+func (e *expectedHashes) output(out io.Writer) io.Writer {
+	if e == nil || e.file == nil {
+		return out
+	}
+
+	e.fileCheck, _ = newDigestCheck("file", e.file.algo, e.file.sum, 0)
+
+	return io.MultiWriter(out, e.fileCheck)
+}
+
+// narInput returns in, with the NAR read from it hashed for
+// -expected-narhash.
+func (e *expectedHashes) narInput(in io.Reader) io.Reader {
+	if e == nil || e.nar == nil {
+		return in
+	}
+
+	e.narCheck, _ = newDigestCheck("NAR", e.nar.algo, e.nar.sum, 0)
+
+	return io.TeeReader(in, e.narCheck)
+}
+
+// narOutput returns w, with the NAR written to it hashed for
+// -expected-narhash.
+func (e *expectedHashes) narOutput(w io.Writer) io.Writer {
+	if e == nil || e.nar == nil {
+		return w
+	}
+
+	e.narCheck, _ = newDigestCheck("NAR", e.nar.algo, e.nar.sum, 0)
+
+	return io.MultiWriter(w, e.narCheck)
+}
+
+// verify checks the hashes once everything is written, and removes the
+// output file name if one of them is not the expected one. Outputs named by
+// -ca-name are removed by the failure itself.
+func (e *expectedHashes) verify(output string) error {
+	if e == nil {
+		return nil
+	}
+
+	for _, c := range []*hashCheck{e.narCheck, e.fileCheck} {
+		if c == nil {
+			continue
+		}
+
+		if err := c.check(); err != nil {
+			// Devices such as /dev/null are written to, not created.
+			if fi, serr := os.Lstat(output); serr == nil && fi.Mode().IsRegular() && !caName {
+				os.Remove(output)
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/storepath"
+	"github.com/nix-community/go-nix/pkg/wire"
+)
+
+const (
+	// exportMagic follows each NAR in a "nix-store --export" stream.
+	exportMagic = 0x4558494e
+
+	narFormatPlain  = "nar"
+	narFormatExport = "export"
+
+	exportStringMax = 4096
+)
+
+// narSide tells which end of a conversion carries the NAR.
+type narSide int
+
+const (
+	narInput narSide = iota
+	narOutput
+)
+
+// exportInfo is the metadata stored after a NAR in an export stream.
+type exportInfo struct {
+	storePath  string
+	references []string
+	deriver    string
+}
+
+// narFormatOptions selects between bare NARs and the nix-store export
+// envelope on the NAR side of a conversion.
+type narFormatOptions struct {
+	side   narSide
+	format string
+	info   exportInfo
+
+	// expect holds the hashes the NAR and output must have, for the
+	// conversions that check them.
+	expect *expectedHashes
+
+	// index is the file -write-index writes the listing of the NAR to.
+	index string
+
+	// sums is the file -write-hashes writes the hashes of the NAR and the
+	// output file to.
+	sums string
+}
+
+func addNarFormatFlags(fs *flag.FlagSet, side narSide) *narFormatOptions {
+	o := &narFormatOptions{side: side}
+
+	fs.StringVar(&o.format, "nar-format", narFormatPlain, "NAR framing: nar, or export for nix-store --export/--import streams")
+
+	if side == narInput {
+		addNarCheckFlags(fs)
+	}
+
+	if side == narOutput {
+		fs.StringVar(&o.info.storePath, "store-path", "", "store path recorded in the export envelope")
+		fs.Var((*stringList)(&o.info.references), "reference", "reference recorded in the export envelope (repeatable)")
+		fs.StringVar(&o.info.deriver, "deriver", "", "deriver recorded in the export envelope")
+	}
+
+	return o
+}
+
+// wrapInput strips the export envelope from in. The returned function must
+// be called once the NAR has been read completely, and stores the metadata
+// from the export trailer in export unless it is nil. Each input has its
+// own, as the inputs of -jobs are read at once with the same options.
+func (o *narFormatOptions) wrapInput(in io.Reader, export *exportInfo) (func() error, error) {
+	switch o.format {
+	case narFormatPlain:
+		return func() error { return nil }, nil
+	case narFormatExport:
+		more, err := wire.ReadUint64(in)
+		if err != nil {
+			return nil, fmt.Errorf("reading export stream: %w", err)
+		}
+
+		switch more {
+		case 0:
+			return nil, fmt.Errorf("export stream contains no store paths")
+		case 1:
+		default:
+			return nil, fmt.Errorf("input is not a nix-store export stream")
+		}
+
+		return func() error {
+			info, err := readExportTrailer(in)
+			if err != nil {
+				return err
+			}
+
+			if export != nil {
+				*export = *info
+			}
+
+			more, err := wire.ReadUint64(in)
+			if err != nil {
+				return fmt.Errorf("reading export stream: %w", err)
+			}
+
+			if more != 0 {
+				return fmt.Errorf("export stream contains more than one store path")
+			}
+
+			return nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported NAR format %q", o.format)
+	}
+}
+
+// wrapOutput writes the export envelope around the NAR written to out. The
+// returned function must be called after the NAR has been written.
+func (o *narFormatOptions) wrapOutput(out io.Writer) (func() error, error) {
+	switch o.format {
+	case narFormatPlain:
+		return func() error { return nil }, nil
+	case narFormatExport:
+		if err := o.info.validate(); err != nil {
+			return nil, err
+		}
+
+		if err := wire.WriteUint64(out, 1); err != nil {
+			return nil, err
+		}
+
+		return func() error {
+			if err := writeExportTrailer(out, &o.info); err != nil {
+				return err
+			}
+
+			return wire.WriteUint64(out, 0)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported NAR format %q", o.format)
+	}
+}
+
+func (info *exportInfo) validate() error {
+	if info.storePath == "" {
+		return fmt.Errorf("export format requires -store-path")
+	}
+
+	paths := append([]string{info.storePath}, info.references...)
+	if info.deriver != "" {
+		paths = append(paths, info.deriver)
+	}
+
+	for _, p := range paths {
+		if _, err := storepath.FromAbsolutePath(p); err != nil {
+			return fmt.Errorf("invalid store path %q: %w", p, err)
+		}
+	}
+
+	return nil
+}
+
+func readExportTrailer(r io.Reader) (*exportInfo, error) {
+	magic, err := wire.ReadUint64(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading export magic: %w", err)
+	}
+
+	if magic != exportMagic {
+		return nil, fmt.Errorf("invalid export magic %#x", magic)
+	}
+
+	info := &exportInfo{}
+
+	if info.storePath, err = wire.ReadString(r, exportStringMax); err != nil {
+		return nil, fmt.Errorf("reading export store path: %w", err)
+	}
+
+	n, err := wire.ReadUint64(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading export references: %w", err)
+	}
+
+	for i := uint64(0); i < n; i++ {
+		ref, err := wire.ReadString(r, exportStringMax)
+		if err != nil {
+			return nil, fmt.Errorf("reading export references: %w", err)
+		}
+
+		info.references = append(info.references, ref)
+	}
+
+	if info.deriver, err = wire.ReadString(r, exportStringMax); err != nil {
+		return nil, fmt.Errorf("reading export deriver: %w", err)
+	}
+
+	// Legacy signatures are no longer written by Nix; skip one if present.
+	hasSig, err := wire.ReadUint64(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading export signature flag: %w", err)
+	}
+
+	if hasSig != 0 {
+		if _, err := wire.ReadString(r, exportStringMax); err != nil {
+			return nil, fmt.Errorf("reading export signature: %w", err)
+		}
+	}
+
+	return info, nil
+}
+
+func writeExportTrailer(w io.Writer, info *exportInfo) error {
+	if err := wire.WriteUint64(w, exportMagic); err != nil {
+		return err
+	}
+
+	if err := wire.WriteString(w, info.storePath); err != nil {
+		return err
+	}
+
+	if err := wire.WriteUint64(w, uint64(len(info.references))); err != nil {
+		return err
+	}
+
+	for _, ref := range info.references {
+		if err := wire.WriteString(w, ref); err != nil {
+			return err
+		}
+	}
+
+	if err := wire.WriteString(w, info.deriver); err != nil {
+		return err
+	}
+
+	return wire.WriteUint64(w, 0)
+}
+
+// stringList is a flag.Value collecting repeated string flags.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
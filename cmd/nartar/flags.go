@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// addIOFlags registers -i/--input and -o/--output on fs.
+func addIOFlags(fs *flag.FlagSet, inDefault, inUsage, outDefault, outUsage string) (input, output *string) {
+	input = fs.String("input", inDefault, inUsage)
+	fs.StringVar(input, "i", inDefault, "shorthand for -input")
+	output = fs.String("output", outDefault, outUsage)
+	fs.StringVar(output, "o", outDefault, "shorthand for -output")
+
+	return input, output
+}
+
+// addDirectoryFlag registers -C/--directory, which every command accepts. As
+// in tar, the directory is changed as soon as the flag is parsed, so it
+// applies to all input and output paths and to files read by later flags.
+func addDirectoryFlag(fs *flag.FlagSet) {
+	chdir := func(dir string) error {
+		if err := os.Chdir(dir); err != nil {
+			return fmt.Errorf("changing directory: %w", err)
+		}
+
+		return nil
+	}
+
+	fs.Func("directory", "change to this directory before opening any file", chdir)
+	fs.Func("C", "shorthand for -directory", chdir)
+}
+
+// parseFlags parses args with fs, allowing flags to follow positional
+// arguments as in "nar2tar in.nar out.tar --tar-format pax", and returns the
+// positional arguments. Arguments after "--" are never taken as flags.
+//
+// -h prints the flags of the command. An unknown flag is reported with the
+// closest defined one.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+
+	addDirectoryFlag(fs)
+	addOutputPolicyFlags(fs)
+	addVerbosityFlags(fs)
+	addProgressFlag(fs)
+	addStatsFlag(fs)
+	addWarningFlag(fs)
+	addBufferSizeFlag(fs)
+	addReadAheadFlag(fs)
+	addThreadsFlag(fs)
+	addProfileFlags(fs)
+
+	// Errors are returned to the caller instead of being printed by fs.
+	fs.SetOutput(io.Discard)
+
+	if err := applyConfig(fs); err != nil {
+		return nil, err
+	}
+
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, flagError(fs, err)
+		}
+
+		rest := fs.Args()
+		if len(rest) == 0 {
+			break
+		}
+
+		// flag consumes a "--" terminator and stops; everything after it is
+		// positional.
+		if i := len(args) - len(rest); i > 0 && args[i-1] == "--" {
+			positional = append(positional, rest...)
+			break
+		}
+
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+
+	if err := applySourceDateEpoch(fs); err != nil {
+		return nil, err
+	}
+
+	return positional, nil
+}
+
+// parseIOArgs parses args with fs and takes positional arguments as the
+// values of whichever of the -i and -o flags were not given, in that order.
+func parseIOArgs(fs *flag.FlagSet, args []string) error {
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for _, name := range []string{"input", "output"} {
+		if len(positional) == 0 || set[name] || set[name[:1]] {
+			continue
+		}
+
+		if err := fs.Set(name, positional[0]); err != nil {
+			return err
+		}
+
+		positional = positional[1:]
+	}
+
+	if len(positional) > 0 {
+		return fmt.Errorf("unexpected argument %q", positional[0])
+	}
+
+	return nil
+}
+
+func flagError(fs *flag.FlagSet, err error) error {
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintf(os.Stderr, "Usage of nartar %s:\n", fs.Name())
+		fs.SetOutput(os.Stderr)
+		fs.PrintDefaults()
+
+		return err
+	}
+
+	name, ok := strings.CutPrefix(err.Error(), "flag provided but not defined: -")
+	if !ok {
+		return err
+	}
+
+	if s := closestFlag(fs, name); s != "" {
+		return fmt.Errorf("unknown flag -%s for %s; did you mean --%s?", name, fs.Name(), s)
+	}
+
+	return fmt.Errorf("unknown flag -%s for %s; run 'nartar %s -h' for the list of flags", name, fs.Name(), fs.Name())
+}
+
+// closestFlag returns the defined flag nearest to name, or "" if none is
+// close enough to be a likely typo.
+func closestFlag(fs *flag.FlagSet, name string) string {
+	best, bestDist := "", len(name)/3+2
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if len(f.Name) < 2 {
+			return
+		}
+
+		d := editDistance(name, f.Name)
+		if len(name) >= 3 && strings.HasPrefix(f.Name, name) {
+			d = 1
+		}
+
+		if d < bestDist {
+			best, bestDist = f.Name, d
+		}
+	})
+
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+// parseByteSize parses a size in bytes, optionally with a K, M or G suffix
+// (or KiB, MiB, GiB) for powers of 1024.
+func parseByteSize(s string) (int64, error) {
+	num, mult := strings.TrimSuffix(strings.ToUpper(s), "IB"), int64(1)
+
+	for i, suffix := range []string{"K", "M", "G"} {
+		if n, ok := strings.CutSuffix(num, suffix); ok {
+			num, mult = n, 1<<(10*(i+1))
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q (use bytes, or a K, M or G suffix)", s)
+	}
+
+	return n * mult, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+)
+
+// Source tarballs, as GitHub serves them and nix flake archive and the
+// tarball fetchers of Nix read them, hold the source tree in a single
+// top-level directory, whose name Nix ignores. Version control metadata is
+// not part of the source, so .git is left out wherever it is.
+
+// addFlakeFlag registers tar2nar's -flake, which reads a source tarball as
+// Nix does: the contents of its top-level directory, without .git.
+func addFlakeFlag(fs *flag.FlagSet, opts *readOptions) {
+	fs.Var(flakeFlag{opts}, "flake", "read a source tarball as Nix does: the contents of its single top-level directory, whatever its name, without .git")
+}
+
+// flakeFlag is a switch setting up the read options for source tarballs.
+type flakeFlag struct {
+	opts *readOptions
+}
+
+func (f flakeFlag) String() string { return "false" }
+
+func (f flakeFlag) IsBoolFlag() bool { return true }
+
+func (f flakeFlag) Set(v string) error {
+	on, err := strconv.ParseBool(v)
+	if err != nil || !on {
+		return err
+	}
+
+	f.opts.topDir = true
+
+	return f.opts.paths.addPatterns(&f.opts.paths.exclude, []string{".git"})
+}
+
+// addFlakeDirFlag registers nar2tar's -flake-dir, which writes a source
+// tarball: the NAR contents in the top-level directory it names, without
+// .git.
+func addFlakeDirFlag(fs *flag.FlagSet, opts *tarOptions, root *string) {
+	fs.Func("flake-dir", "write a source tarball as GitHub and nix flake archive do: the contents in this single top-level directory, without .git", func(v string) error {
+		name, err := parseRootName(v)
+		if err != nil {
+			return err
+		}
+
+		if name == "" {
+			return fmt.Errorf("-flake-dir needs a directory name")
+		}
+
+		*root = name
+
+		return opts.paths.addPatterns(&opts.paths.exclude, []string{".git"})
+	})
+}
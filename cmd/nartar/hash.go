@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// fodSnippets are the Nix expressions hash -snippet prints, by name.
+var fodSnippets = map[string]func(w io.Writer, f *fodInfo){
+	"fetchurl":    writeFetchurlSnippet,
+	"requireFile": writeRequireFileSnippet,
+	"derivation":  writeDerivationSnippet,
+}
+
+// fodInfo is what a fixed-output derivation snippet is made of.
+type fodInfo struct {
+	name      string
+	url       string
+	recursive bool
+	hash      string
+}
+
+// runHash hashes a file as Nix hashes fixed outputs: flat, as fetchurl does,
+// or a NAR as the recursive hash of its contents. It prints the hash, SRI
+// SHA-256 unless -hash-algo and -hash-format say otherwise, or with -snippet
+// a Nix expression to paste into a package.
+func runHash(args []string) error {
+	fs := flag.NewFlagSet("hash", flag.ContinueOnError)
+	input, output := addIOFlags(fs, "-", "file to hash ('-' for stdin)", "-", "output file ('-' for stdout)")
+	mode := fs.String("mode", "flat", "flat hashes the file as it is; nar hashes a NAR, giving the recursive hash of its contents")
+	snippet := fs.String("snippet", "", "print a fetchurl, requireFile or derivation expression with the hash")
+	url := fs.String("url", "", "URL the file is fetched from, for the snippet")
+	name := fs.String("name", "", "name of the store path, for the snippet (default: the input's file name)")
+	hashOpts := addHashFlags(fs)
+	addNarCheckFlags(fs)
+	if err := parseIOArgs(fs, args); err != nil {
+		return err
+	}
+
+	if err := hashOpts.check(); err != nil {
+		return err
+	}
+
+	if *mode != "flat" && *mode != "nar" {
+		return fmt.Errorf("unsupported hash mode %q (use flat or nar)", *mode)
+	}
+
+	write, ok := fodSnippets[*snippet]
+	if *snippet != "" && !ok {
+		return fmt.Errorf("unsupported snippet %q (use fetchurl, requireFile or derivation)", *snippet)
+	}
+
+	if *snippet == "fetchurl" && *mode == "nar" {
+		return fmt.Errorf("fetchurl hashes the file flat; use -snippet requireFile or derivation with -mode nar")
+	}
+
+	in, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	h := hashOpts.new()
+
+	if *mode == "nar" {
+		_, err = copyNar(in, h)
+	} else {
+		_, err = copyContents(h, in)
+	}
+
+	if err != nil {
+		return fmt.Errorf("hashing %s: %w", *input, err)
+	}
+
+	info := &fodInfo{
+		name:      *name,
+		url:       *url,
+		recursive: *mode == "nar",
+		hash:      hashOpts.encode(h.Sum(nil)),
+	}
+
+	// Nix needs to be told the algorithm of a hash that is not SRI.
+	if write != nil && hashOpts.format != "sri" {
+		info.hash = hashOpts.algo + ":" + info.hash
+	}
+
+	if info.name == "" {
+		info.name = fodName(*input, *url, info.recursive)
+	}
+
+	out, err := openTextOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if write == nil {
+		fmt.Fprintln(out, info.hash)
+	} else {
+		write(out, info)
+	}
+
+	return out.Close()
+}
+
+// fodName is the store path name for a file: its base name, or that of its
+// URL when read from stdin, without the .nar extension of a NAR.
+func fodName(input, url string, recursive bool) string {
+	name := filepath.Base(input)
+	if isStdio(input) {
+		name = "source"
+		if i := strings.LastIndex(strings.TrimSuffix(url, "/"), "/"); i >= 0 {
+			name, _, _ = strings.Cut(strings.TrimSuffix(url, "/")[i+1:], "?")
+		}
+	}
+
+	if recursive {
+		name = strings.TrimSuffix(name, ".nar")
+	}
+
+	return name
+}
+
+func writeFetchurlSnippet(w io.Writer, f *fodInfo) {
+	fmt.Fprintf(w, "fetchurl {\n")
+	fmt.Fprintf(w, "  url = %s;\n", nixString(f.url))
+	fmt.Fprintf(w, "  hash = %s;\n", nixString(f.hash))
+	fmt.Fprintf(w, "}\n")
+}
+
+func writeRequireFileSnippet(w io.Writer, f *fodInfo) {
+	fmt.Fprintf(w, "requireFile {\n")
+	fmt.Fprintf(w, "  name = %s;\n", nixString(f.name))
+	fmt.Fprintf(w, "  url = %s;\n", nixString(f.url))
+	fmt.Fprintf(w, "  hash = %s;\n", nixString(f.hash))
+	if f.recursive {
+		fmt.Fprintf(w, "  hashMode = \"recursive\";\n")
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+func writeDerivationSnippet(w io.Writer, f *fodInfo) {
+	mode := "flat"
+	if f.recursive {
+		mode = "recursive"
+	}
+
+	fmt.Fprintf(w, "stdenvNoCC.mkDerivation {\n")
+	fmt.Fprintf(w, "  name = %s;\n", nixString(f.name))
+	fmt.Fprintf(w, "  outputHashMode = %s;\n", nixString(mode))
+	fmt.Fprintf(w, "  outputHash = %s;\n", nixString(f.hash))
+	fmt.Fprintf(w, "}\n")
+}
+
+// nixString quotes s as a Nix string literal.
+func nixString(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(s)
+
+	return `"` + s + `"`
+}
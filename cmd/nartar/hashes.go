@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"lukechampine.com/blake3"
+)
+
+// hashAlgos are the hash algorithms Nix knows, by the names it gives them.
+var hashAlgos = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// hashFormats are the encodings Nix writes hashes in. base32 is the old
+// name of nix32, Nix's own base-32 alphabet.
+var hashFormats = map[string]bool{
+	"base16": true,
+	"nix32":  true,
+	"base32": true,
+	"base64": true,
+	"sri":    true,
+}
+
+// hashOptions select the algorithm and encoding of the hashes a command
+// prints.
+type hashOptions struct {
+	algo   string
+	format string
+}
+
+func addHashFlags(fs *flag.FlagSet) *hashOptions {
+	o := &hashOptions{}
+
+	fs.StringVar(&o.algo, "hash-algo", "sha256", "hash algorithm: sha256, sha512, blake3, sha1 or md5")
+	fs.StringVar(&o.format, "hash-format", "sri", "hash encoding: sri (sha256-...), nix32, base32 (the same), base16 or base64")
+
+	return o
+}
+
+func (o *hashOptions) check() error {
+	if hashAlgos[o.algo] == nil {
+		return fmt.Errorf("unsupported hash algorithm %q (use sha256, sha512, blake3, sha1 or md5)", o.algo)
+	}
+
+	if !hashFormats[o.format] {
+		return fmt.Errorf("unsupported hash format %q (use sri, nix32, base16 or base64)", o.format)
+	}
+
+	return nil
+}
+
+func (o *hashOptions) new() hash.Hash {
+	return hashAlgos[o.algo]()
+}
+
+// encode writes sum in the chosen format: SRI with the algorithm, as
+// sha256-<base64>, and the others bare, as nix hash file prints them.
+func (o *hashOptions) encode(sum []byte) string {
+	return encodeHash(o.format, o.algo, sum)
+}
+
+func encodeHash(format, algo string, sum []byte) string {
+	switch format {
+	case "base16":
+		return hex.EncodeToString(sum)
+	case "nix32", "base32":
+		return nixbase32.EncodeToString(sum)
+	case "base64":
+		return base64.StdEncoding.EncodeToString(sum)
+	default:
+		return algo + "-" + base64.StdEncoding.EncodeToString(sum)
+	}
+}
+
+// parseHash parses a hash in any of the forms Nix accepts: SRI, such as
+// sha256-<base64>, or <algo>:<digest> or a bare digest of defaultAlgo, in
+// base16, nix32 or base64 as its length tells.
+func parseHash(s, defaultAlgo string) (algo string, sum []byte, err error) {
+	algo, digest := defaultAlgo, s
+
+	if a, d, ok := strings.Cut(s, "-"); ok && hashAlgos[a] != nil {
+		sum, err := base64.StdEncoding.DecodeString(d)
+		if err != nil || len(sum) != hashAlgos[a]().Size() {
+			return "", nil, fmt.Errorf("invalid SRI hash %q", s)
+		}
+
+		return a, sum, nil
+	}
+
+	if a, d, ok := strings.Cut(s, ":"); ok {
+		algo, digest = a, d
+	}
+
+	newHash := hashAlgos[algo]
+	if newHash == nil {
+		return "", nil, fmt.Errorf("unknown hash algorithm %q in %q", algo, s)
+	}
+
+	size := newHash().Size()
+
+	switch len(digest) {
+	case hex.EncodedLen(size):
+		sum, err = hex.DecodeString(digest)
+	case nixbase32.EncodedLen(size):
+		sum, err = nixbase32.DecodeString(digest)
+	case base64.StdEncoding.EncodedLen(size):
+		sum, err = base64.StdEncoding.DecodeString(digest)
+	default:
+		return "", nil, fmt.Errorf("%q is not a %s hash in base16, nix32 or base64", s, algo)
+	}
+
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid %s hash %q: %w", algo, s, err)
+	}
+
+	return algo, sum, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/nar/ls"
+)
+
+// narIndex is the index -index gives ls and cat for the NAR file they read,
+// as written by -write-index.
+var narIndex = ""
+
+// narIndexer builds the listing of a NAR as a conversion writes or reads
+// it, for -write-index: the NAR is passed through a pipe to copyNar, which
+// records the offset of every file.
+type narIndexer struct {
+	pw   *io.PipeWriter
+	done chan error
+	root *ls.Node
+}
+
+func newNarIndexer() *narIndexer {
+	pr, pw := io.Pipe()
+	x := &narIndexer{pw: pw, done: make(chan error, 1)}
+
+	go func() {
+		root, err := copyNar(pr, io.Discard)
+		pr.CloseWithError(err)
+
+		x.root = root
+		x.done <- err
+	}()
+
+	return x
+}
+
+func (x *narIndexer) Write(b []byte) (int, error) {
+	return x.pw.Write(b)
+}
+
+// stop ends the NAR passed to x, if the conversion has not.
+func (x *narIndexer) stop() {
+	if x != nil {
+		x.pw.Close()
+	}
+}
+
+// write writes the listing of the NAR, which has been passed to x whole, to
+// the file name.
+func (x *narIndexer) write(name string) error {
+	x.pw.Close()
+
+	if err := <-x.done; err != nil {
+		return fmt.Errorf("indexing the NAR: %w", err)
+	}
+
+	b, err := marshalListing(x.root, "")
+	if err != nil {
+		return err
+	}
+
+	out, err := openTextOutput(name)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := out.Write(b); err != nil {
+		return fmt.Errorf("writing index: %w", err)
+	}
+
+	return out.Close()
+}
+
+// checkIndexFlags rejects -write-index where the offsets it records would not
+// be those of the NAR file: in export streams and NARs -fix reorders.
+func (o *narFormatOptions) checkIndexFlags() error {
+	switch {
+	case o.index == "":
+		return nil
+	case o.format != narFormatPlain:
+		return fmt.Errorf("-write-index records offsets in a bare NAR, not in -nar-format %s", o.format)
+	case o.side == narInput && fixNar:
+		return fmt.Errorf("-write-index records offsets in the NAR as read, which -fix reorders")
+	}
+
+	return nil
+}
+
+// catIndexed copies the regular file p of the NAR file input to w, reading
+// it at the offset the index root gives without reading the rest.
+func catIndexed(input string, root *ls.Node, p string, w io.Writer) error {
+	n, err := lookupListing(root, p)
+	if err != nil {
+		return err
+	}
+
+	if n.Type != nar.TypeRegular {
+		return fmt.Errorf("not a regular file")
+	}
+
+	if isStdio(input) {
+		return fmt.Errorf("-index needs the NAR in a file, not on stdin")
+	}
+
+	f, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The index is checked against the NAR as far as it cheaply can be: the
+	// NAR must be uncompressed and the contents preceded by their length.
+	head := make([]byte, 8+len(narMagic))
+	if _, err := f.ReadAt(head, 0); err != nil || archiveFormat(head) != formatNar {
+		return fmt.Errorf("-index needs an uncompressed NAR file")
+	}
+
+	if n.NAROffset < int64(len(head)) {
+		return fmt.Errorf("the index does not match the NAR")
+	}
+
+	var length [8]byte
+	if _, err := f.ReadAt(length[:], n.NAROffset-8); err != nil || int64(binary.LittleEndian.Uint64(length[:])) != n.Size {
+		return fmt.Errorf("the index does not match the NAR")
+	}
+
+	r := io.NewSectionReader(f, n.NAROffset, n.Size)
+
+	copied, err := copyContents(w, r)
+	if err != nil {
+		return err
+	}
+
+	if copied != n.Size {
+		return fmt.Errorf("the index does not match the NAR")
+	}
+
+	return nil
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+const (
+	isoSectorSize    = 2048
+	isoSystemSectors = 16
+	isoVolumeID      = "NARTAR"
+
+	isoRecordFixedLen = 33
+	// isoRecordMaxLen is the longest a record can be: its length is a byte,
+	// and records are padded to an even length.
+	isoRecordMaxLen = 254
+	isoSUSPMaxLen   = 255
+	isoCELen        = 28
+
+	isoFlagDirectory = 0x02
+
+	rripExtID     = "RRIP_1991A"
+	rripExtDesc   = "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+	rripExtSource = "PLEASE CONTACT DISC PUBLISHER FOR SPECIFICATION SOURCE.  SEE PUBLISHER IDENTIFIER IN PRIMARY VOLUME DESCRIPTOR FOR CONTACT INFORMATION."
+)
+
+// isoEntry is a file or directory placed in the ISO image.
+type isoEntry struct {
+	node     *treeNode
+	ident    string
+	parent   *isoEntry
+	children []*isoEntry
+
+	// dirNum is the 1-based position of a directory in the path table.
+	dirNum  int
+	records []*isoRecord
+	extent  uint32
+	size    uint32
+}
+
+// isoRecord is a directory record together with its Rock Ridge entries,
+// split between the record itself and a chain of continuation areas.
+type isoRecord struct {
+	target *isoEntry
+	ident  []byte
+	inline [][]byte
+	areas  []*isoArea
+}
+
+// isoArea is a SUSP continuation area. Areas are packed into dedicated
+// sectors and never cross a sector boundary.
+type isoArea struct {
+	entries [][]byte
+	follow  *isoArea
+	sector  uint32
+	offset  uint32
+}
+
+// len is the size of the area including the CE entry chaining it to the
+// following area.
+func (a *isoArea) len() int {
+	n := isoEntriesLen(a.entries)
+	if a.follow != nil {
+		n += isoCELen
+	}
+
+	return n
+}
+
+// narToISO writes an ISO9660 image with Rock Ridge extensions carrying the
+// original names, modes and symlinks of the NAR contents.
+func narToISO(in io.Reader, out io.Writer) error {
+	root, err := readNarTree(in)
+	if err != nil {
+		return err
+	}
+
+	if root.kind != nar.TypeDirectory {
+		return fmt.Errorf("iso output requires a directory at the NAR root")
+	}
+
+	rootEntry := buildISOTree(root, nil)
+
+	// Directories are numbered in path table order: by depth, then parent,
+	// then identifier.
+	dirs := []*isoEntry{rootEntry}
+	for i := 0; i < len(dirs); i++ {
+		dirs[i].dirNum = i + 1
+
+		for _, c := range dirs[i].children {
+			if c.node.kind == nar.TypeDirectory {
+				dirs = append(dirs, c)
+			}
+		}
+	}
+
+	if len(dirs) > math.MaxUint16 {
+		return fmt.Errorf("too many directories for an iso9660 path table")
+	}
+
+	var files []*isoEntry
+
+	for _, d := range dirs {
+		d.records = isoDirRecords(d, d == rootEntry)
+
+		for _, c := range d.children {
+			if c.node.kind != nar.TypeDirectory && len(c.node.data) > 0 {
+				files = append(files, c)
+			}
+		}
+	}
+
+	// Path table entries only depend on identifiers, so the size is known
+	// before the directory extents are.
+	pathTableSize := len(isoPathTable(dirs, binary.LittleEndian))
+
+	next := uint32(isoSystemSectors + 2)
+	lPathTable := next
+	next += isoSectors(pathTableSize)
+	mPathTable := next
+	next += isoSectors(pathTableSize)
+
+	for _, d := range dirs {
+		d.extent = next
+		d.size = uint32(isoDirSize(d.records))
+		next += isoSectors(int(d.size))
+	}
+
+	// The continuation areas follow the directories, as readers going
+	// through the image in order, such as libarchive, expect.
+	ceBase := next
+	ceSector, ceOffset := ceBase, uint32(0)
+
+	for _, d := range dirs {
+		for _, r := range d.records {
+			for _, a := range r.areas {
+				size := uint32(a.len())
+				if ceOffset+size > isoSectorSize {
+					ceSector++
+					ceOffset = 0
+				}
+
+				a.sector, a.offset = ceSector, ceOffset
+				ceOffset += size
+			}
+		}
+	}
+
+	if ceOffset > 0 {
+		next = ceSector + 1
+	}
+
+	for _, f := range files {
+		if uint64(len(f.node.data)) > math.MaxUint32 {
+			return fmt.Errorf("file %q is too large for a single iso9660 extent", f.node.name)
+		}
+
+		f.extent = next
+		f.size = uint32(len(f.node.data))
+		next += isoSectors(len(f.node.data))
+	}
+
+	iw := &isoImageWriter{w: out}
+
+	iw.writeSectors(make([]byte, isoSystemSectors*isoSectorSize))
+	iw.writeSectors(isoPrimaryDescriptor(rootEntry, next, pathTableSize, lPathTable, mPathTable))
+	iw.writeSectors(isoTerminator())
+	iw.writeSectors(isoPathTable(dirs, binary.LittleEndian))
+	iw.writeSectors(isoPathTable(dirs, binary.BigEndian))
+
+	for _, d := range dirs {
+		iw.writeSectors(isoDirBytes(d.records))
+	}
+
+	if ceOffset > 0 {
+		ce := make([]byte, (ceSector-ceBase+1)*isoSectorSize)
+
+		for _, d := range dirs {
+			for _, r := range d.records {
+				for _, a := range r.areas {
+					pos := (a.sector-ceBase)*isoSectorSize + a.offset
+					copy(ce[pos:], isoSUSPBytes(a.entries, a.follow))
+				}
+			}
+		}
+
+		iw.writeSectors(ce)
+	}
+
+	for _, f := range files {
+		iw.writeSectors(f.node.data)
+	}
+
+	return iw.err
+}
+
+// buildISOTree assigns unique ISO9660 identifiers to the children of each
+// directory and sorts them in ISO9660 directory order.
+func buildISOTree(n *treeNode, parent *isoEntry) *isoEntry {
+	e := &isoEntry{node: n, parent: parent}
+
+	used := make(map[string]bool)
+
+	for _, c := range n.children {
+		child := buildISOTree(c, e)
+		child.ident = isoIdentifier(c.name, c.kind == nar.TypeDirectory, used)
+		e.children = append(e.children, child)
+	}
+
+	sort.Slice(e.children, func(i, j int) bool {
+		return e.children[i].ident < e.children[j].ident
+	})
+
+	return e
+}
+
+// isoIdentifier derives an 8.3 identifier from name using only d-characters,
+// disambiguating collisions with a numeric suffix such as _1. The real name
+// is carried in the Rock Ridge NM entry.
+func isoIdentifier(name string, dir bool, used map[string]bool) string {
+	base, ext := name, ""
+	if !dir {
+		if i := strings.LastIndexByte(name, '.'); i > 0 {
+			base, ext = name[:i], name[i+1:]
+		}
+	}
+
+	base = isoDChars(base, 8)
+	ext = isoDChars(ext, 3)
+
+	if base == "" {
+		base = "_"
+	}
+
+	for i := 0; ; i++ {
+		b := base
+		if i > 0 {
+			// The suffix is made of d-characters too, which have no
+			// separator besides _.
+			suffix := "_" + strconv.Itoa(i)
+			if len(b)+len(suffix) > 8 {
+				b = b[:8-len(suffix)]
+			}
+
+			b += suffix
+		}
+
+		ident := b
+		if !dir {
+			ident = b + "." + ext + ";1"
+		}
+
+		if !used[ident] {
+			used[ident] = true
+			return ident
+		}
+	}
+}
+
+func isoDChars(s string, max int) string {
+	var b strings.Builder
+
+	for _, r := range strings.ToUpper(s) {
+		if b.Len() == max {
+			break
+		}
+
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+
+	return b.String()
+}
+
+// isoDirRecords builds the "." and ".." records of d followed by one record
+// per child.
+func isoDirRecords(d *isoEntry, isRoot bool) []*isoRecord {
+	parent := d.parent
+	if parent == nil {
+		parent = d
+	}
+
+	var records []*isoRecord
+
+	dotEntries := [][]byte{rripPX(d)}
+	if isRoot {
+		// The SUSP indicator must be the first entry of the root "." record;
+		// the extension reference marks the image as Rock Ridge.
+		dotEntries = [][]byte{rripSP(), rripPX(d), rripER()}
+	}
+
+	dot := &isoRecord{target: d, ident: []byte{0}}
+	dot.setSUSP(dotEntries)
+	records = append(records, dot)
+
+	dotdot := &isoRecord{target: parent, ident: []byte{1}}
+	dotdot.setSUSP([][]byte{rripPX(parent)})
+	records = append(records, dotdot)
+
+	for _, c := range d.children {
+		r := &isoRecord{target: c, ident: []byte(c.ident)}
+
+		entries := [][]byte{rripPX(c)}
+		entries = append(entries, rripNM(c.node.name)...)
+
+		if c.node.kind == nar.TypeSymlink {
+			entries = append(entries, rripSL(c.node.linkTarget)...)
+		}
+
+		r.setSUSP(entries)
+		records = append(records, r)
+	}
+
+	return records
+}
+
+// setSUSP places as many entries as fit into the record itself and moves the
+// rest into a chain of continuation areas.
+func (r *isoRecord) setSUSP(entries [][]byte) {
+	r.inline, entries = isoSplitSUSP(entries, isoRecordMaxLen-r.fixedLen())
+
+	for len(entries) > 0 {
+		a := &isoArea{}
+		a.entries, entries = isoSplitSUSP(entries, isoSectorSize)
+
+		if len(r.areas) > 0 {
+			r.areas[len(r.areas)-1].follow = a
+		}
+
+		r.areas = append(r.areas, a)
+	}
+}
+
+// isoSplitSUSP returns the entries that fit into avail bytes, reserving room
+// for a CE entry when not all of them fit.
+func isoSplitSUSP(entries [][]byte, avail int) ([][]byte, [][]byte) {
+	if isoEntriesLen(entries) <= avail {
+		return entries, nil
+	}
+
+	used := 0
+	for i, e := range entries {
+		if used+len(e)+isoCELen > avail {
+			return entries[:i], entries[i:]
+		}
+
+		used += len(e)
+	}
+
+	return entries, nil
+}
+
+func (r *isoRecord) fixedLen() int {
+	return isoRecordFixedLen + len(r.ident) + (len(r.ident)+1)%2
+}
+
+func (r *isoRecord) len() int {
+	n := r.fixedLen() + isoEntriesLen(r.inline)
+	if len(r.areas) > 0 {
+		n += isoCELen
+	}
+
+	return n + n%2
+}
+
+func (r *isoRecord) bytes() []byte {
+	b := make([]byte, r.fixedLen(), r.len())
+	b[0] = byte(r.len())
+
+	putBothUint32(b[2:], r.target.extent)
+	putBothUint32(b[10:], r.target.size)
+	copy(b[18:], isoRecordDate())
+
+	if r.target.node.kind == nar.TypeDirectory {
+		b[25] = isoFlagDirectory
+	}
+
+	putBothUint16(b[28:], 1)
+	b[32] = byte(len(r.ident))
+	copy(b[33:], r.ident)
+
+	var follow *isoArea
+	if len(r.areas) > 0 {
+		follow = r.areas[0]
+	}
+
+	b = append(b, isoSUSPBytes(r.inline, follow)...)
+
+	return b[:cap(b)]
+}
+
+func isoDirSize(records []*isoRecord) int {
+	size := 0
+
+	for _, r := range records {
+		if size%isoSectorSize+r.len() > isoSectorSize {
+			size += isoSectorSize - size%isoSectorSize
+		}
+
+		size += r.len()
+	}
+
+	return int(isoSectors(size)) * isoSectorSize
+}
+
+// isoDirBytes serializes directory records; a record never crosses a sector
+// boundary.
+func isoDirBytes(records []*isoRecord) []byte {
+	var buf bytes.Buffer
+
+	for _, r := range records {
+		if buf.Len()%isoSectorSize+r.len() > isoSectorSize {
+			buf.Write(make([]byte, isoSectorSize-buf.Len()%isoSectorSize))
+		}
+
+		buf.Write(r.bytes())
+	}
+
+	return buf.Bytes()
+}
+
+func isoEntriesLen(entries [][]byte) int {
+	n := 0
+	for _, e := range entries {
+		n += len(e)
+	}
+
+	return n
+}
+
+// isoSUSPBytes concatenates entries, followed by a CE entry pointing at the
+// next continuation area if there is one.
+func isoSUSPBytes(entries [][]byte, follow *isoArea) []byte {
+	var b []byte
+	for _, e := range entries {
+		b = append(b, e...)
+	}
+
+	if follow != nil {
+		ce := suspEntry("CE", make([]byte, 24))
+		putBothUint32(ce[4:], follow.sector)
+		putBothUint32(ce[12:], follow.offset)
+		putBothUint32(ce[20:], uint32(follow.len()))
+		b = append(b, ce...)
+	}
+
+	return b
+}
+
+func suspEntry(sig string, data []byte) []byte {
+	e := make([]byte, 4, 4+len(data))
+	copy(e, sig)
+	e[2] = byte(4 + len(data))
+	e[3] = 1
+
+	return append(e, data...)
+}
+
+func rripSP() []byte {
+	return suspEntry("SP", []byte{0xbe, 0xef, 0})
+}
+
+func rripER() []byte {
+	data := []byte{byte(len(rripExtID)), byte(len(rripExtDesc)), byte(len(rripExtSource)), 1}
+	data = append(data, rripExtID...)
+	data = append(data, rripExtDesc...)
+	data = append(data, rripExtSource...)
+
+	return suspEntry("ER", data)
+}
+
+func rripPX(e *isoEntry) []byte {
+	var mode, nlink int64
+
+	switch e.node.kind {
+	case nar.TypeDirectory:
+		mode = unixModeDir | dirMode
+		nlink = 2
+
+		for _, c := range e.children {
+			if c.node.kind == nar.TypeDirectory {
+				nlink++
+			}
+		}
+	case nar.TypeSymlink:
+		mode, nlink = unixModeSymlink|symlinkMode, 1
+	default:
+		mode, nlink = unixModeRegular|pickFileMode(e.node.executable), 1
+	}
+
+	data := make([]byte, 32)
+	putBothUint32(data[0:], uint32(mode))
+	putBothUint32(data[8:], uint32(nlink))
+
+	return suspEntry("PX", data)
+}
+
+// rripNM returns the alternate name entries for name, split into several NM
+// entries with the CONTINUE flag when it does not fit into one.
+func rripNM(name string) [][]byte {
+	const maxChunk = isoSUSPMaxLen - 5
+
+	var entries [][]byte
+
+	for len(name) > maxChunk {
+		entries = append(entries, suspEntry("NM", append([]byte{1}, name[:maxChunk]...)))
+		name = name[maxChunk:]
+	}
+
+	return append(entries, suspEntry("NM", append([]byte{0}, name...)))
+}
+
+// rripSL encodes a symlink target as SL component records, split across
+// several SL entries when needed.
+func rripSL(target string) [][]byte {
+	var components [][]byte
+
+	if strings.HasPrefix(target, "/") {
+		components = append(components, []byte{0x08, 0})
+	}
+
+	for _, part := range strings.Split(strings.Trim(target, "/"), "/") {
+		switch part {
+		case "":
+			continue
+		case ".":
+			components = append(components, []byte{0x02, 0})
+		case "..":
+			components = append(components, []byte{0x04, 0})
+		default:
+			for len(part) > 0 {
+				n := len(part)
+				flags := byte(0)
+
+				if n > 248 {
+					n, flags = 248, 0x01
+				}
+
+				components = append(components, append([]byte{flags, byte(n)}, part[:n]...))
+				part = part[n:]
+			}
+		}
+	}
+
+	if len(components) == 0 {
+		components = append(components, []byte{0x02, 0})
+	}
+
+	const maxData = isoSUSPMaxLen - 5
+
+	var entries [][]byte
+
+	data := []byte{}
+
+	for _, c := range components {
+		if len(data)+len(c) > maxData {
+			entries = append(entries, suspEntry("SL", append([]byte{1}, data...)))
+			data = []byte{}
+		}
+
+		data = append(data, c...)
+	}
+
+	return append(entries, suspEntry("SL", append([]byte{0}, data...)))
+}
+
+func isoPathTable(dirs []*isoEntry, order binary.ByteOrder) []byte {
+	var buf bytes.Buffer
+
+	for _, d := range dirs {
+		ident := []byte(d.ident)
+		parent := 1
+
+		if d.parent == nil {
+			ident = []byte{0}
+		} else {
+			parent = d.parent.dirNum
+		}
+
+		e := make([]byte, 8)
+		e[0] = byte(len(ident))
+		order.PutUint32(e[2:], d.extent)
+		order.PutUint16(e[6:], uint16(parent))
+
+		buf.Write(e)
+		buf.Write(ident)
+
+		if len(ident)%2 == 1 {
+			buf.WriteByte(0)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func isoPrimaryDescriptor(root *isoEntry, sectors uint32, pathTableSize int, lPathTable, mPathTable uint32) []byte {
+	b := make([]byte, isoSectorSize)
+
+	b[0] = 1
+	copy(b[1:], "CD001")
+	b[6] = 1
+
+	copy(b[8:40], isoPadded("", 32))
+	copy(b[40:72], isoPadded(isoVolumeID, 32))
+	putBothUint32(b[80:], sectors)
+	putBothUint16(b[120:], 1)
+	putBothUint16(b[124:], 1)
+	putBothUint16(b[128:], isoSectorSize)
+	putBothUint32(b[132:], uint32(pathTableSize))
+	binary.LittleEndian.PutUint32(b[140:], lPathTable)
+	binary.BigEndian.PutUint32(b[148:], mPathTable)
+
+	rootRecord := &isoRecord{target: root, ident: []byte{0}}
+	copy(b[156:190], rootRecord.bytes())
+
+	copy(b[190:318], isoPadded("", 128))
+	copy(b[318:446], isoPadded("", 128))
+	copy(b[446:574], isoPadded("", 128))
+	copy(b[574:702], isoPadded("NARTAR", 128))
+	copy(b[702:813], isoPadded("", 111))
+
+	epoch := append([]byte("1970010100000000"), 0)
+	unset := append([]byte("0000000000000000"), 0)
+	copy(b[813:], epoch)
+	copy(b[830:], epoch)
+	copy(b[847:], unset)
+	copy(b[864:], unset)
+	b[881] = 1
+
+	return b
+}
+
+func isoTerminator() []byte {
+	b := make([]byte, isoSectorSize)
+	b[0] = 255
+	copy(b[1:], "CD001")
+	b[6] = 1
+
+	return b
+}
+
+// isoRecordDate is the directory record timestamp for the Unix epoch.
+func isoRecordDate() []byte {
+	return []byte{70, 1, 1, 0, 0, 0, 0}
+}
+
+func isoPadded(s string, n int) []byte {
+	return []byte(s + strings.Repeat(" ", n-len(s)))
+}
+
+func isoSectors(size int) uint32 {
+	return uint32((size + isoSectorSize - 1) / isoSectorSize)
+}
+
+func putBothUint16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b[0:], v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBothUint32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:], v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+// isoImageWriter writes whole sectors, remembering the first error.
+type isoImageWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (iw *isoImageWriter) writeSectors(b []byte) {
+	if iw.err != nil {
+		return
+	}
+
+	if _, iw.err = iw.w.Write(b); iw.err != nil {
+		return
+	}
+
+	if pad := int(isoSectors(len(b)))*isoSectorSize - len(b); pad > 0 {
+		_, iw.err = iw.w.Write(make([]byte, pad))
+	}
+}
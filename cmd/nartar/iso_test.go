@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// isoImage reads back the images narToISO writes, by their Rock Ridge
+// entries.
+type isoImage struct {
+	t *testing.T
+	b []byte
+
+	entries map[string]testEntry
+	nlinks  map[string]uint32
+	idents  map[string]string
+
+	// dirEnd is the end of the last directory extent, and areas the
+	// offsets of the continuation areas.
+	dirEnd int
+	areas  []int
+}
+
+func readISO(t *testing.T, b []byte) *isoImage {
+	t.Helper()
+
+	if len(b)%isoSectorSize != 0 {
+		t.Fatalf("image is %d bytes, not whole sectors", len(b))
+	}
+
+	pvd := b[isoSystemSectors*isoSectorSize:]
+	if pvd[0] != 1 || string(pvd[1:6]) != "CD001" {
+		t.Fatalf("no primary volume descriptor")
+	}
+
+	if n := binary.LittleEndian.Uint32(pvd[80:]); int(n)*isoSectorSize != len(b) {
+		t.Errorf("the volume is %d sectors, the image %d bytes", n, len(b))
+	}
+
+	img := &isoImage{
+		t:       t,
+		b:       b,
+		entries: make(map[string]testEntry),
+		nlinks:  make(map[string]uint32),
+		idents:  make(map[string]string),
+	}
+
+	root := pvd[156:190]
+	img.dir("/", binary.LittleEndian.Uint32(root[2:]), binary.LittleEndian.Uint32(root[10:]))
+
+	// Readers going through the image in order only find continuation
+	// areas after the directory records.
+	for _, a := range img.areas {
+		if a < img.dirEnd {
+			t.Errorf("continuation area at %d is before the end of the directories at %d", a, img.dirEnd)
+		}
+	}
+
+	return img
+}
+
+// dir reads the directory p, with size bytes of records at the sector
+// extent.
+func (img *isoImage) dir(p string, extent, size uint32) {
+	t := img.t
+
+	start := int(extent) * isoSectorSize
+	if end := start + int(size); end > img.dirEnd {
+		img.dirEnd = end
+	}
+
+	records := img.b[start : start+int(size)]
+
+	var idents []string
+
+	for off := 0; off < len(records); {
+		n := int(records[off])
+		if n == 0 {
+			// Records do not cross sectors: the rest of this one is empty.
+			off = (off/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+
+		r := records[off : off+n]
+		off += n
+
+		identLen := int(r[32])
+		ident := string(r[33 : 33+identLen])
+		susp := img.susp(p, r[isoRecordFixedLen+identLen+(identLen+1)%2:])
+
+		if ident == "\x00" || ident == "\x01" {
+			continue
+		}
+
+		name, child := susp.name, path.Join(p, susp.name)
+		idents = append(idents, ident)
+
+		if strings.Trim(strings.TrimSuffix(ident, ";1"), "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_.") != "" {
+			t.Errorf("%s has the identifier %q, which is not d-characters", child, ident)
+		}
+
+		if name == "" {
+			t.Errorf("%s/%s has no NM entry", p, ident)
+			continue
+		}
+
+		img.idents[child] = ident
+		img.nlinks[child] = susp.nlink
+
+		fileExtent, fileSize := binary.LittleEndian.Uint32(r[2:]), binary.LittleEndian.Uint32(r[10:])
+		isDir := r[25]&isoFlagDirectory != 0
+
+		switch susp.mode & unixModeType {
+		case unixModeDir:
+			if !isDir {
+				t.Errorf("%s has a directory mode but no directory flag", child)
+			}
+
+			img.entries[child] = testEntry{typ: nar.TypeDirectory}
+			img.dir(child, fileExtent, fileSize)
+		case unixModeSymlink:
+			img.entries[child] = testEntry{typ: nar.TypeSymlink, target: susp.target}
+		case unixModeRegular:
+			data := img.b[int(fileExtent)*isoSectorSize : int(fileExtent)*isoSectorSize+int(fileSize)]
+			img.entries[child] = testEntry{typ: nar.TypeRegular, exec: susp.mode&0o111 != 0, data: string(data)}
+		default:
+			t.Errorf("%s has mode %o", child, susp.mode)
+		}
+	}
+
+	if !sort.StringsAreSorted(idents) {
+		t.Errorf("%s: identifiers are not sorted: %q", p, idents)
+	}
+
+	seen := make(map[string]bool)
+	for _, ident := range idents {
+		if seen[ident] {
+			t.Errorf("%s: identifier %q is used twice", p, ident)
+		}
+
+		seen[ident] = true
+	}
+}
+
+// isoSUSP is what the Rock Ridge entries of a record give.
+type isoSUSP struct {
+	mode   int64
+	nlink  uint32
+	name   string
+	target string
+}
+
+// susp reads the SUSP entries in b, following continuation areas, for a
+// record in the directory p.
+func (img *isoImage) susp(p string, b []byte) isoSUSP {
+	t := img.t
+
+	var s isoSUSP
+
+	var components []string
+
+	continued := false
+
+	for len(b) >= 4 {
+		sig, n := string(b[:2]), int(b[2])
+		if n < 4 || n > len(b) {
+			t.Fatalf("%s: bad SUSP entry length %d", p, n)
+		}
+
+		data := b[4:n]
+		b = b[n:]
+
+		switch sig {
+		case "PX":
+			s.mode = int64(binary.LittleEndian.Uint32(data))
+			s.nlink = binary.LittleEndian.Uint32(data[8:])
+		case "NM":
+			s.name += string(data[1:])
+		case "SL":
+			for c := data[1:]; len(c) > 0; c = c[2+int(c[1]):] {
+				flags, text := c[0], string(c[2:2+int(c[1])])
+
+				switch {
+				case flags&0x08 != 0:
+					text = ""
+				case flags&0x04 != 0:
+					text = ".."
+				case flags&0x02 != 0:
+					text = "."
+				}
+
+				if continued {
+					components[len(components)-1] += text
+				} else {
+					components = append(components, text)
+				}
+
+				continued = flags&0x01 != 0
+			}
+		case "CE":
+			sector, offset := int(binary.LittleEndian.Uint32(data)), int(binary.LittleEndian.Uint32(data[8:]))
+			size := int(binary.LittleEndian.Uint32(data[16:]))
+
+			if offset+size > isoSectorSize {
+				t.Errorf("%s: continuation area at offset %d of %d bytes crosses a sector", p, offset, size)
+			}
+
+			start := sector*isoSectorSize + offset
+			img.areas = append(img.areas, start)
+			b = img.b[start : start+size]
+		}
+	}
+
+	if components != nil {
+		s.target = strings.Join(components, "/")
+		if s.target == "" {
+			s.target = "/"
+		}
+	}
+
+	return s
+}
+
+func TestISORoundTrip(t *testing.T) {
+	var out bytes.Buffer
+	if err := narToISO(bytes.NewReader(buildNar(t, testTree)), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	img := readISO(t, out.Bytes())
+	checkEntries(t, img.entries, withoutRoot(testTree))
+
+	nlinks := map[string]uint32{"/bin": 2, "/emptydir": 2, "/share": 3, "/share/doc": 2}
+	for p := range withoutRoot(testTree) {
+		want, ok := nlinks[p]
+		if !ok {
+			want = 1
+		}
+
+		if img.nlinks[p] != want {
+			t.Errorf("%s has %d links, want %d", p, img.nlinks[p], want)
+		}
+	}
+}
+
+func TestISOLongNamesAndTargets(t *testing.T) {
+	long := strings.Repeat("n", 255)
+	deep := strings.Repeat("../", 10) + strings.Repeat("d/", 100) + strings.Repeat("t", 300)
+
+	entries := map[string]testEntry{
+		"/":           {typ: nar.TypeDirectory},
+		"/" + long:    {typ: nar.TypeRegular, data: "long"},
+		"/abs":        {typ: nar.TypeSymlink, target: "/nix/store/x"},
+		"/deep":       {typ: nar.TypeSymlink, target: deep},
+		"/dot":        {typ: nar.TypeSymlink, target: "."},
+		"/Hello.txt":  {typ: nar.TypeRegular, data: "a"},
+		"/hello.txt":  {typ: nar.TypeRegular, data: "b"},
+		"/hello+.txt": {typ: nar.TypeRegular, data: "c"},
+		"/hello.TXT":  {typ: nar.TypeRegular, data: "d"},
+		"/sub":        {typ: nar.TypeDirectory},
+		"/sub/x":      {typ: nar.TypeRegular, exec: true, data: "e"},
+		"/SUB":        {typ: nar.TypeDirectory},
+	}
+
+	var out bytes.Buffer
+	if err := narToISO(bytes.NewReader(buildNar(t, entries)), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	img := readISO(t, out.Bytes())
+	checkEntries(t, img.entries, withoutRoot(entries))
+
+	for _, p := range []string{"/Hello.txt", "/hello.txt", "/hello+.txt", "/hello.TXT"} {
+		if ident := img.idents[p]; !strings.HasPrefix(ident, "HELLO") || !strings.HasSuffix(ident, ".TXT;1") {
+			t.Errorf("%s has the identifier %q", p, ident)
+		}
+	}
+}
+
+func TestISORecordLengths(t *testing.T) {
+	// Between them, the names fill the Rock Ridge entries that fit into a
+	// record to every length, up to the largest record.
+	entries := map[string]testEntry{
+		"/":    {typ: nar.TypeDirectory},
+		"/sub": {typ: nar.TypeDirectory},
+	}
+
+	for n := 150; n < 200; n++ {
+		entries["/sub/"+strings.Repeat("a", n)+".txt"] = testEntry{typ: nar.TypeRegular, data: fmt.Sprint(n)}
+	}
+
+	var out bytes.Buffer
+	if err := narToISO(bytes.NewReader(buildNar(t, entries)), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	checkEntries(t, readISO(t, out.Bytes()).entries, withoutRoot(entries))
+}
+
+// withoutRoot returns entries without the root, which an image does not
+// hold as an entry of its own.
+func withoutRoot(entries map[string]testEntry) map[string]testEntry {
+	m := make(map[string]testEntry, len(entries))
+	for p, e := range entries {
+		if p != "/" {
+			m[p] = e
+		}
+	}
+
+	return m
+}
+
+func TestISOIdentifier(t *testing.T) {
+	used := make(map[string]bool)
+
+	var got []string
+	for i := 0; i < 12; i++ {
+		got = append(got, isoIdentifier(fmt.Sprintf("verylongname-%d.tar.gz", i%2), false, used))
+	}
+
+	want := []string{
+		"VERYLONG.GZ;1", "VERYLO_1.GZ;1", "VERYLO_2.GZ;1", "VERYLO_3.GZ;1",
+		"VERYLO_4.GZ;1", "VERYLO_5.GZ;1", "VERYLO_6.GZ;1", "VERYLO_7.GZ;1",
+		"VERYLO_8.GZ;1", "VERYLO_9.GZ;1", "VERYL_10.GZ;1", "VERYL_11.GZ;1",
+	}
+
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+)
+
+// runKeygen writes a signing key in the format of nix key generate-secret,
+// name:base64(secret), and optionally its public key as in
+// trusted-public-keys. With -i it derives the public key of an existing
+// secret key instead of generating one.
+func runKeygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	input, output := addIOFlags(fs, "", "existing secret key file to derive -public from instead of generating one", "-", "secret key file ('-' for stdout)")
+	name := fs.String("name", "", "key name, conventionally the cache host name and a number, as in cache.example.org-1")
+	public := fs.String("public", "", "also write the public key to this file ('-' for stdout)")
+	if err := parseIOArgs(fs, args); err != nil {
+		return err
+	}
+
+	if *input != "" {
+		if *public == "" {
+			return fmt.Errorf("-i needs -public to name the public key output")
+		}
+
+		sk, err := loadSecretKey(*input)
+		if err != nil {
+			return err
+		}
+
+		return writeKeyFile(*public, sk.ToPublicKey().String(), 0o644)
+	}
+
+	if *name == "" || strings.ContainsAny(*name, ": \t\n") {
+		return fmt.Errorf("-name must give a key name without colons or spaces")
+	}
+
+	sk, pk, err := signature.GenerateKeypair(*name, rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generating key: %w", err)
+	}
+
+	if err := writeKeyFile(*output, sk.String(), 0o600); err != nil {
+		return err
+	}
+
+	if *public == "" {
+		return nil
+	}
+
+	return writeKeyFile(*public, pk.String(), 0o644)
+}
+
+// writeKeyFile writes a key and a newline to name, or to stdout for "-",
+// creating the file with the permissions perm.
+func writeKeyFile(name, key string, perm os.FileMode) error {
+	if isStdio(name) {
+		_, err := fmt.Println(key)
+		return err
+	}
+
+	f, err := createOutputFile(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Restrict an existing file before the key is in it.
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(f, key+"\n"); err != nil {
+		return fmt.Errorf("writing key: %w", err)
+	}
+
+	return f.Close()
+}
+
+// loadSecretKey reads a secret key file as written by keygen or nix key
+// generate-secret.
+func loadSecretKey(name string) (signature.SecretKey, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return signature.SecretKey{}, fmt.Errorf("reading secret key: %w", err)
+	}
+
+	sk, err := signature.LoadSecretKey(strings.TrimSpace(string(b)))
+	if err != nil {
+		return signature.SecretKey{}, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return sk, nil
+}
+
+// signNarinfo adds a signature by each of keys to ni, over the fingerprint
+// that nix store sign signs and Nix verifies against trusted-public-keys.
+func signNarinfo(ni *narinfo.NarInfo, keys []signature.SecretKey) error {
+	for _, sk := range keys {
+		sig, err := sk.Sign(nil, ni.Fingerprint())
+		if err != nil {
+			return fmt.Errorf("signing narinfo: %w", err)
+		}
+
+		ni.Signatures = append(ni.Signatures, sig)
+	}
+
+	return nil
+}
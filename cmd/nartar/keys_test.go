@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+)
+
+// The test1 key of the go-nix tests, and a narinfo from its test data, with
+// the signature by that key it holds.
+const (
+	test1SecretKey = "test1:jbX9NxZp8WB/coK8k7yLf0gNYmBbIbCrOFwgJgI7OV+0sASf4R5oFQlioSlN3bJ56uvshzr7S9Z75pcv+9hSkQ=="
+	test1PublicKey = "test1:tLAEn+EeaBUJYqEpTd2yeerr7Ic6+0vWe+aXL/vYUpE="
+
+	curlNarinfo = `StorePath: /nix/store/syd87l2rxw8cbsxmxl853h0r6pdwhwjr-curl-7.82.0-bin
+URL: nar/05ra3y72i3qjri7xskf9qj8kb29r6naqy1sqpbs3azi3xcigmj56.nar.xz
+Compression: xz
+FileHash: sha256:05ra3y72i3qjri7xskf9qj8kb29r6naqy1sqpbs3azi3xcigmj56
+FileSize: 68852
+NarHash: sha256:1b4sb93wp679q4zx9k1ignby1yna3z7c4c2ri3wphylbc2dwsys0
+NarSize: 196040
+References: 0jqd0rlxzra1rs38rdxl43yh6rxchgc6-curl-7.82.0 6w8g7njm4mck5dmjxws0z1xnrxvl81xa-glibc-2.34-115 j5jxw3iy7bbz4a57fh9g2xm2gxmyal8h-zlib-1.2.12 yxvjs9drzsphm9pcf42a4byzj1kb9m7k-openssl-1.1.1n
+Deriver: 5rwxzi7pal3qhpsyfc16gzkh939q1np6-curl-7.82.0.drv
+`
+	curlTest1Sig = "test1:519iiVLx/c4Rdt5DNt6Y2Jm6hcWE9+XY69ygiWSZCNGVcmOcyL64uVAJ3cV8vaTusIZdbTnYo9Y7vDNeTmmMBQ=="
+)
+
+func TestSignNarinfo(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test1.sec")
+	if err := os.WriteFile(name, []byte(test1SecretKey+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sk, err := loadSecretKey(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ni, err := parseNarinfo(strings.NewReader(curlNarinfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := signNarinfo(ni, []signature.SecretKey{sk}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ed25519 signatures are deterministic: the same key signing the same
+	// fingerprint gives the signature Nix made.
+	if len(ni.Signatures) != 1 || ni.Signatures[0].String() != curlTest1Sig {
+		t.Errorf("got signatures %v, want %s", ni.Signatures, curlTest1Sig)
+	}
+
+	if !strings.Contains(ni.String(), "\nSig: "+curlTest1Sig+"\n") {
+		t.Errorf("the narinfo has no Sig line:\n%s", ni)
+	}
+}
+
+func TestKeygen(t *testing.T) {
+	withoutConfig(t)
+
+	dir := t.TempDir()
+	secret, public := filepath.Join(dir, "key.sec"), filepath.Join(dir, "key.pub")
+
+	if err := runKeygen([]string{"-name", "cache.example.org-1", "-o", secret, "-public", public}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := os.Stat(secret); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("secret key file: %v, %v", fi.Mode(), err)
+	}
+
+	sk, err := loadSecretKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(pub, "cache.example.org-1:") || pub != sk.ToPublicKey().String() {
+		t.Errorf("public key %q does not match the secret key", pub)
+	}
+
+	// -i derives the public key of an existing secret key.
+	derived := filepath.Join(dir, "derived.pub")
+	if err := runKeygen([]string{"-i", secret, "-public", derived}); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := os.ReadFile(derived); err != nil || strings.TrimSpace(string(b)) != pub {
+		t.Errorf("derived public key %q (%v), want %q", b, err, pub)
+	}
+
+	keyFile := filepath.Join(dir, "test1.sec")
+	if err := os.WriteFile(keyFile, []byte(test1SecretKey), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runKeygen([]string{"-i", keyFile, "-public", filepath.Join(dir, "test1.pub")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := os.ReadFile(filepath.Join(dir, "test1.pub")); strings.TrimSpace(string(b)) != test1PublicKey {
+		t.Errorf("derived %q, want %q", b, test1PublicKey)
+	}
+
+	bad := filepath.Join(dir, "bad.sec")
+	if err := os.WriteFile(bad, []byte("test1:c2hvcnQ="), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"-o", filepath.Join(dir, "a.sec")},
+		{"-name", "a:b", "-o", filepath.Join(dir, "b.sec")},
+		{"-name", "a b", "-o", filepath.Join(dir, "c.sec")},
+		{"-i", secret},
+		{"-i", bad, "-public", filepath.Join(dir, "bad.pub")},
+	} {
+		if err := runKeygen(args); err == nil {
+			t.Errorf("keygen %q: no error", args)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+
+	// whiteoutsSquash applies whiteouts to lower layers; whiteoutsPreserve
+	// keeps the marker files as regular entries.
+	whiteoutsSquash   = "squash"
+	whiteoutsPreserve = "preserve"
+)
+
+// applyLayer reads an uncompressed layer tarball and applies it on top of
+// the entries of the lower layers. The layer is consumed completely.
+func applyLayer(r io.Reader, entries *entryTree, whiteouts string, opts *readOptions) error {
+	if whiteouts != whiteoutsSquash && whiteouts != whiteoutsPreserve {
+		return fmt.Errorf("unsupported whiteout mode %q", whiteouts)
+	}
+
+	layer := newEntryTree()
+	if err := readTarEntries(tar.NewReader(r), "", layer, opts); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+
+	// Whiteouts only hide entries of lower layers, so they are applied
+	// before the layer's own entries are merged.
+	isWhiteout := func(p string) bool {
+		return whiteouts == whiteoutsSquash && strings.HasPrefix(path.Base(p), whiteoutPrefix)
+	}
+
+	layer.walk(func(p string, e *tarEntry) error {
+		if !isWhiteout(p) {
+			return nil
+		}
+
+		dir, base := path.Split(p)
+		if base == whiteoutOpaque {
+			entries.removeBelow(dir)
+		} else {
+			entries.remove(dir+strings.TrimPrefix(base, whiteoutPrefix), true)
+		}
+
+		return nil
+	})
+
+	return layer.walk(func(p string, e *tarEntry) error {
+		if isWhiteout(p) {
+			return nil
+		}
+
+		if lower := entries.get(p); lower != nil && lower.kind == tar.TypeDir {
+			if e.kind == tar.TypeDir {
+				return nil
+			}
+
+			// A file or symlink replacing a directory hides its contents.
+			entries.removeBelow(p)
+		}
+
+		entries.set(p, e)
+
+		return nil
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// inputLimits are set by -max-entries, -max-file-size, -max-total-size and
+// -max-depth, which the commands reading archives and NARs accept, so that a
+// hostile input cannot make a server converting it run out of memory or
+// disk. A limit of 0 is no limit.
+var inputLimits struct {
+	entries   int64
+	fileSize  int64
+	totalSize int64
+	depth     int
+}
+
+// addLimitFlags registers the -max-* limits on fs, once for the commands
+// that read both archives and NARs.
+func addLimitFlags(fs *flag.FlagSet) {
+	if fs.Lookup("max-entries") != nil {
+		return
+	}
+
+	fs.Func("max-entries", "fail on an input with more than this many entries (default no limit)", func(v string) (err error) {
+		inputLimits.entries, err = parseLimit("max-entries", v)
+		return err
+	})
+	fs.Func("max-file-size", "fail on a file in the input larger than this, such as 1G (default no limit)", func(v string) (err error) {
+		inputLimits.fileSize, err = parseByteSize(v)
+		return err
+	})
+	fs.Func("max-total-size", "fail on an input whose files add up to more than this, such as 10G (default no limit)", func(v string) (err error) {
+		inputLimits.totalSize, err = parseByteSize(v)
+		return err
+	})
+	fs.Func("max-depth", "fail on an input with paths of more than this many levels, such as 3 for a/b/c (default no limit)", func(v string) error {
+		n, err := parseLimit("max-depth", v)
+		inputLimits.depth = int(n)
+
+		return err
+	})
+}
+
+func parseLimit(name, v string) (int64, error) {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("-%s must be a number", name)
+	}
+
+	return n, nil
+}
+
+// limitCounter counts the entries and file contents of an input against
+// the -max-* limits. Each archive, layer or NAR read has its own.
+type limitCounter struct {
+	entries int64
+	total   int64
+}
+
+// entry counts the entry at the NAR path p.
+func (c *limitCounter) entry(p string) error {
+	c.entries++
+
+	if limit := inputLimits.entries; limit > 0 && c.entries > limit {
+		return fmt.Errorf("%s: the input has more than %d entries, the -max-entries limit", p, limit)
+	}
+
+	if limit := inputLimits.depth; limit > 0 && p != "/" && strings.Count(p, "/") > limit {
+		return fmt.Errorf("%s: the entry is %d levels deep, more than the -max-depth limit of %d", p, strings.Count(p, "/"), limit)
+	}
+
+	return nil
+}
+
+// file counts size bytes of contents of the file at the NAR path p. It is
+// called before they are read.
+func (c *limitCounter) file(p string, size int64) error {
+	if limit := inputLimits.fileSize; limit > 0 && size > limit {
+		return fmt.Errorf("%s: the file is %d bytes, more than the -max-file-size limit of %d", p, size, limit)
+	}
+
+	c.total += size
+
+	if limit := inputLimits.totalSize; limit > 0 && c.total > limit {
+		return fmt.Errorf("%s: the files of the input add up to more than %d bytes, the -max-total-size limit", p, limit)
+	}
+
+	return nil
+}
+
+// limitedNarReader is a NAR reader whose entries are counted against the
+// -max-* limits, and their paths checked by -strict-names.
+type limitedNarReader struct {
+	*nar.Reader
+	counter limitCounter
+}
+
+func (r *limitedNarReader) Next() (*nar.Header, error) {
+	h, err := r.Reader.Next()
+	if err != nil {
+		return h, err
+	}
+
+	if err := r.counter.entry(h.Path); err != nil {
+		return nil, err
+	}
+
+	if err := checkStrictName(h.Path); err != nil {
+		return nil, err
+	}
+
+	if h.Type == nar.TypeRegular {
+		if err := r.counter.file(h.Path, h.Size); err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
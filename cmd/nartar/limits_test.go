@@ -0,0 +1,161 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"flag"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// withLimits sets the -max-* limits for the length of the test.
+func withLimits(t *testing.T, entries, fileSize, totalSize int64, depth int) {
+	saved := inputLimits
+
+	inputLimits.entries, inputLimits.fileSize, inputLimits.totalSize, inputLimits.depth = entries, fileSize, totalSize, depth
+
+	t.Cleanup(func() { inputLimits = saved })
+}
+
+func TestInputLimits(t *testing.T) {
+	// Five entries, or six with the root a NAR always has, three levels
+	// deep, with 18 bytes of files of at most 10.
+	tarball := buildTar(t,
+		tarMember{name: "a", kind: tar.TypeReg, data: "aaa"},
+		tarMember{name: "d/", kind: tar.TypeDir},
+		tarMember{name: "d/b", kind: tar.TypeReg, data: strings.Repeat("b", 10)},
+		tarMember{name: "d/e/", kind: tar.TypeDir},
+		tarMember{name: "d/e/f", kind: tar.TypeReg, data: "fffff"},
+	)
+
+	narball := buildNar(t, map[string]testEntry{
+		"/":      {typ: nar.TypeDirectory},
+		"/a":     {typ: nar.TypeRegular, data: "aaa"},
+		"/d":     {typ: nar.TypeDirectory},
+		"/d/b":   {typ: nar.TypeRegular, data: strings.Repeat("b", 10)},
+		"/d/e":   {typ: nar.TypeDirectory},
+		"/d/e/f": {typ: nar.TypeRegular, data: "fffff"},
+	})
+
+	convert := map[string]func() error{
+		"tar2nar": func() error {
+			return tarToNar(bytes.NewReader(tarball), io.Discard, "", paxIgnore, "", false, testReadOptions(t))
+		},
+		"nar2tar": func() error {
+			return narToTarRoot(bytes.NewReader(narball), io.Discard, "-", testTarOptions(t))
+		},
+	}
+
+	tests := []struct {
+		desc                string
+		entries             int64
+		fileSize, totalSize int64
+		depth               int
+		err                 map[string]string
+	}{
+		{desc: "no limits"},
+		{desc: "entries at the limit", entries: 6},
+		{
+			desc:    "entries over the limit",
+			entries: 5,
+			err:     map[string]string{"nar2tar": "/d/e/f: the input has more than 5 entries, the -max-entries limit"},
+		},
+		{
+			desc:    "entries well over the limit",
+			entries: 4,
+			err: map[string]string{
+				"tar2nar": "/d/e/f: the input has more than 4 entries",
+				"nar2tar": "/d/e: the input has more than 4 entries",
+			},
+		},
+		{desc: "file size at the limit", fileSize: 10},
+		{
+			desc:     "file size over the limit",
+			fileSize: 9,
+			err: map[string]string{
+				"tar2nar": "/d/b: the file is 10 bytes, more than the -max-file-size limit of 9",
+				"nar2tar": "/d/b: the file is 10 bytes, more than the -max-file-size limit of 9",
+			},
+		},
+		{desc: "total size at the limit", totalSize: 18},
+		{
+			desc:      "total size over the limit",
+			totalSize: 17,
+			err: map[string]string{
+				"tar2nar": "/d/e/f: the files of the input add up to more than 17 bytes, the -max-total-size limit",
+				"nar2tar": "/d/e/f: the files of the input add up to more than 17 bytes, the -max-total-size limit",
+			},
+		},
+		{desc: "depth at the limit", depth: 3},
+		{
+			desc:  "depth over the limit",
+			depth: 2,
+			err: map[string]string{
+				"tar2nar": "/d/e/f: the entry is 3 levels deep, more than the -max-depth limit of 2",
+				"nar2tar": "/d/e/f: the entry is 3 levels deep, more than the -max-depth limit of 2",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, cmd := range []string{"tar2nar", "nar2tar"} {
+			t.Run(tt.desc+"/"+cmd, func(t *testing.T) {
+				withLimits(t, tt.entries, tt.fileSize, tt.totalSize, tt.depth)
+
+				err := convert[cmd]()
+
+				if want := tt.err[cmd]; want == "" {
+					if err != nil {
+						t.Errorf("%s: %v", tt.desc, err)
+					}
+				} else if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("%s: got error %v, want %q", tt.desc, err, want)
+				}
+			})
+		}
+	}
+}
+
+func TestLimitFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		want [4]int64
+		err  string
+	}{
+		{},
+		{
+			args: []string{"-max-entries", "100", "-max-file-size", "1K", "-max-total-size", "2GiB", "-max-depth", "8"},
+			want: [4]int64{100, 1 << 10, 2 << 30, 8},
+		},
+		{args: []string{"-max-entries", "-1"}, err: "-max-entries must be a number"},
+		{args: []string{"-max-depth", "deep"}, err: "-max-depth must be a number"},
+		{args: []string{"-max-file-size", "1T"}, err: `invalid size "1T"`},
+	}
+
+	for _, tt := range tests {
+		withLimits(t, 0, 0, 0, 0)
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+
+		addLimitFlags(fs)
+		addLimitFlags(fs)
+
+		err := fs.Parse(tt.args)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.args, err, tt.err)
+			}
+
+			continue
+		}
+
+		got := [4]int64{inputLimits.entries, inputLimits.fileSize, inputLimits.totalSize, int64(inputLimits.depth)}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %v (%v), want %v", tt.args, got, err, tt.want)
+		}
+	}
+}
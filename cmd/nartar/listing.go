@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/nar/ls"
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/storepath"
+)
+
+// listingBuilder builds the listing of a NAR from its headers, in the .ls
+// format of cache.nixos.org: the tree of its files with their type, size,
+// executable bit and the offset of their contents in the NAR.
+type listingBuilder struct {
+	root *ls.Node
+	dirs map[string]*ls.Node
+	slab entrySlab
+}
+
+func newListingBuilder() *listingBuilder {
+	return &listingBuilder{dirs: make(map[string]*ls.Node)}
+}
+
+// add adds the entry hdr, whose contents if any start at offset in the NAR.
+func (b *listingBuilder) add(hdr *nar.Header, offset int64) {
+	n := b.slab.listingNode(ls.Node{Type: hdr.Type})
+
+	switch hdr.Type {
+	case nar.TypeRegular:
+		n.Size = hdr.Size
+		n.Executable = hdr.Executable
+		n.NAROffset = offset
+	case nar.TypeSymlink:
+		n.LinkTarget = hdr.LinkTarget
+	case nar.TypeDirectory:
+		n.Entries = make(map[string]*ls.Node)
+		b.dirs[hdr.Path] = n
+	}
+
+	if hdr.Path == "/" {
+		b.root = n
+		return
+	}
+
+	if dir := b.dirs[path.Dir(hdr.Path)]; dir != nil {
+		dir.Entries[path.Base(hdr.Path)] = n
+	}
+}
+
+// marshalListing returns the listing file of root, compressed with "br" or
+// not at all, with the fields and key order Nix writes.
+func marshalListing(root *ls.Node, compression string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := io.WriteCloser(nopWriteCloser{Writer: &buf})
+	if compression == "br" {
+		w = brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	if err := enc.Encode(map[string]interface{}{"version": 1, "root": listingJSON(root)}); err != nil {
+		return nil, fmt.Errorf("writing listing: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("writing listing: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// listingJSON returns n as JSON values, which encoding/json writes with
+// sorted keys as Nix does.
+func listingJSON(n *ls.Node) map[string]interface{} {
+	m := map[string]interface{}{"type": n.Type}
+
+	switch n.Type {
+	case nar.TypeRegular:
+		m["size"] = n.Size
+		m["narOffset"] = n.NAROffset
+		if n.Executable {
+			m["executable"] = true
+		}
+	case nar.TypeSymlink:
+		m["target"] = n.LinkTarget
+	case nar.TypeDirectory:
+		entries := make(map[string]interface{}, len(n.Entries))
+		for name, e := range n.Entries {
+			entries[name] = listingJSON(e)
+		}
+
+		m["entries"] = entries
+	}
+
+	return m
+}
+
+// readListing reads the listing of a NAR from r, which holds the NAR itself,
+// possibly compressed, or a listing file, brotli-compressed or not.
+func readListing(r io.Reader) (*ls.Node, error) {
+	br := bufio.NewReader(r)
+
+	head, err := br.Peek(8 + len(narMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case archiveFormat(head) == formatNar:
+		return copyNar(br, io.Discard)
+	case len(bytes.TrimSpace(head)) > 0 && bytes.TrimSpace(head)[0] == '{':
+		return parseListing(br)
+	case bytes.HasPrefix(head, gzipMagic), bytes.HasPrefix(head, xzMagic), bytes.HasPrefix(head, zstdMagic), bytes.HasPrefix(head, bzip2Magic):
+		zr, err := decompress(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+
+		return copyNar(zr, io.Discard)
+	default:
+		// Brotli has no magic number to recognize it by.
+		return parseListing(brotli.NewReader(br))
+	}
+}
+
+func parseListing(r io.Reader) (*ls.Node, error) {
+	root, err := ls.ParseLS(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading listing: %w", err)
+	}
+
+	return &root.Root, nil
+}
+
+// lookupListing returns the node at the NAR path p in root.
+func lookupListing(root *ls.Node, p string) (*ls.Node, error) {
+	n := root
+
+	for _, elem := range strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/") {
+		if elem == "" {
+			continue
+		}
+
+		if n.Type != nar.TypeDirectory {
+			return nil, fmt.Errorf("not a directory")
+		}
+
+		if n = n.Entries[elem]; n == nil {
+			return nil, fmt.Errorf("no such file or directory")
+		}
+	}
+
+	return n, nil
+}
+
+// narSource is the NAR that ls and cat look into: an input file, or a store
+// path in a binary cache.
+type narSource struct {
+	input string
+	cache binaryCache
+	hash  string
+
+	// prefix is prepended to the NAR paths printed: the store path if the
+	// NAR comes from a cache, "." otherwise, as nix nar ls does.
+	prefix string
+}
+
+// name returns the NAR path p as printed.
+func (s *narSource) name(p string) string {
+	if p == "/" {
+		return s.prefix
+	}
+
+	return s.prefix + p
+}
+
+func addNarSourceFlags(fs *flag.FlagSet) (input, from *string, auth *cacheAuthOptions) {
+	input = fs.String("input", "", "NAR file, possibly compressed, or .ls listing ('-' for stdin)")
+	fs.StringVar(input, "i", "", "shorthand for -input")
+	from = fs.String("from", "", "binary cache to look in, for a store path: an http://, https:// or s3:// URL or a directory")
+	auth = addCacheAuthFlags(fs)
+	fs.StringVar(&narIndex, "index", "", "listing of the -i NAR file written by -write-index, to read files at the offsets it gives without reading the NAR up to them")
+	fs.BoolVar(&mmapInput, "mmap", false, "memory-map an uncompressed NAR file, reading its listing from the headers alone and files from the mapping")
+
+	return input, from, auth
+}
+
+// openNarSource returns the NAR named by -i or -from, and the path in it
+// that arg names: a path in the NAR with -i, a store path followed by the
+// path in it with -from.
+func openNarSource(input, from string, auth *cacheAuthOptions, arg string) (*narSource, string, error) {
+	switch {
+	case input != "" && from != "":
+		return nil, "", fmt.Errorf("-i and -from cannot be combined")
+	case narIndex != "" && input == "":
+		return nil, "", fmt.Errorf("-index needs the NAR file it indexes as -i")
+	case input != "":
+		return &narSource{input: input, prefix: "."}, path.Clean("/" + arg), nil
+	case from == "":
+		return nil, "", fmt.Errorf("-i or -from must name the NAR to read")
+	}
+
+	rest, ok := strings.CutPrefix(arg, storepath.StoreDir+"/")
+	if !ok {
+		return nil, "", fmt.Errorf("%q is not in %s", arg, storepath.StoreDir)
+	}
+
+	base, sub, _ := strings.Cut(rest, "/")
+
+	hash, _, err := parseStorePathArg(storepath.StoreDir + "/" + base)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cache, err := openBinaryCache(from, auth)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &narSource{cache: cache, hash: hash, prefix: storepath.StoreDir + "/" + base}, path.Clean("/" + sub), nil
+}
+
+// listing returns the listing of the NAR: from the .ls file of a binary
+// cache if it has one, or else read from the NAR, with the narinfo of a NAR
+// read from a cache.
+func (s *narSource) listing() (*ls.Node, *narinfo.NarInfo, error) {
+	if s.cache == nil && narIndex != "" {
+		f, err := os.Open(narIndex)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+
+		root, err := readListing(f)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", narIndex, err)
+		}
+
+		return root, nil, nil
+	}
+
+	if s.cache == nil {
+		m, err := mapNar(s.input)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if m != nil {
+			defer m.close()
+
+			root, err := m.listing()
+			return root, nil, err
+		}
+
+		in, err := openInput(s.input)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer in.Close()
+
+		root, err := readListing(in)
+		return root, nil, err
+	}
+
+	if r, err := s.cache.get(s.hash + ".ls"); err == nil {
+		defer r.Close()
+
+		root, err := readListing(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s.ls: %w", s.hash, err)
+		}
+
+		return root, nil, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	ni, err := fetchNarinfo(s.cache, s.hash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var root *ls.Node
+
+	err = fetchNar(s.cache, ni, func(r io.Reader) error {
+		var err error
+		root, err = copyNar(r, io.Discard)
+
+		return err
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", ni.StorePath, err)
+	}
+
+	return root, ni, nil
+}
+
+// runLs lists the files of a NAR as nix store ls does, from its listing
+// when a binary cache has one, so that the NAR need not be downloaded.
+func runLs(args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	input, from, auth := addNarSourceFlags(fs)
+	long := fs.Bool("l", false, "show the type, permissions and size of each file")
+	recursive := fs.Bool("R", false, "list subdirectories recursively")
+	asJSON := fs.Bool("json", false, "print the listing of the path in the .ls JSON format")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) > 1 {
+		return fmt.Errorf("ls takes at most one path")
+	}
+
+	arg := ""
+	if len(positional) == 1 {
+		arg = positional[0]
+	}
+
+	src, p, err := openNarSource(*input, *from, auth, arg)
+	if err != nil {
+		return err
+	}
+
+	root, _, err := src.listing()
+	if err != nil {
+		return err
+	}
+
+	n, err := lookupListing(root, p)
+	if err != nil {
+		return fmt.Errorf("%s: %w", src.name(p), err)
+	}
+
+	if *asJSON {
+		b, err := marshalListing(n, "")
+		if err != nil {
+			return err
+		}
+
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+
+	name := src.name(p)
+
+	if n.Type != nar.TypeDirectory {
+		printListingEntry(name, n, *long)
+		return nil
+	}
+
+	printListingDir(name, n, *long, *recursive)
+
+	return nil
+}
+
+func printListingDir(name string, dir *ls.Node, long, recursive bool) {
+	names := make([]string, 0, len(dir.Entries))
+	for entry := range dir.Entries {
+		names = append(names, entry)
+	}
+	sort.Strings(names)
+
+	for _, entry := range names {
+		n := dir.Entries[entry]
+		p := name + "/" + entry
+
+		printListingEntry(p, n, long)
+
+		if recursive && n.Type == nar.TypeDirectory {
+			printListingDir(p, n, long, recursive)
+		}
+	}
+}
+
+// printListingEntry prints a file as nix store ls does, with -l in the
+// format of ls -l with the modes a store path has.
+func printListingEntry(name string, n *ls.Node, long bool) {
+	if !long {
+		fmt.Println(name)
+		return
+	}
+
+	switch n.Type {
+	case nar.TypeRegular:
+		mode := "-r--r--r--"
+		if n.Executable {
+			mode = "-r-xr-xr-x"
+		}
+
+		fmt.Printf("%s %20d %s\n", mode, n.Size, name)
+	case nar.TypeSymlink:
+		fmt.Printf("%s %20d %s -> %s\n", "lrwxrwxrwx", 0, name, n.LinkTarget)
+	default:
+		fmt.Printf("%s %20d %s\n", "dr-xr-xr-x", 0, name)
+	}
+}
+
+// runCat prints a file of a NAR. From a binary cache whose NAR is not
+// compressed, the listing tells where the file is and only it is
+// downloaded; otherwise the NAR is read up to the file.
+func runCat(args []string) error {
+	fs := flag.NewFlagSet("cat", flag.ContinueOnError)
+	input, from, auth := addNarSourceFlags(fs)
+	output := fs.String("output", "-", "output file ('-' for stdout)")
+	fs.StringVar(output, "o", "-", "shorthand for -output")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 1 {
+		return fmt.Errorf("cat needs the path of one file")
+	}
+
+	src, p, err := openNarSource(*input, *from, auth, positional[0])
+	if err != nil {
+		return err
+	}
+
+	out, err := openTextOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if src.cache == nil && narIndex != "" {
+		root, _, err := src.listing()
+		if err != nil {
+			return err
+		}
+
+		if err := catIndexed(src.input, root, p, out); err != nil {
+			return fmt.Errorf("%s: %w", src.name(p), err)
+		}
+
+		return out.Close()
+	}
+
+	if src.cache == nil {
+		m, err := mapNar(src.input)
+		if err != nil {
+			return err
+		}
+
+		if m != nil {
+			defer m.close()
+
+			if err := m.cat(p, out); err != nil {
+				return fmt.Errorf("%s: %w", src.name(p), err)
+			}
+
+			return out.Close()
+		}
+
+		in, err := openInput(src.input)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		if err := catNarFile(in, p, out); err != nil {
+			return fmt.Errorf("%s: %w", src.name(p), err)
+		}
+
+		return out.Close()
+	}
+
+	if err := src.catFromCache(p, out); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// catFromCache copies the file p of the NAR in a binary cache to w.
+func (s *narSource) catFromCache(p string, w io.Writer) error {
+	root, ni, err := s.listing()
+	if err != nil {
+		return err
+	}
+
+	n, err := lookupListing(root, p)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.name(p), err)
+	}
+
+	if n.Type != nar.TypeRegular {
+		return fmt.Errorf("%s: not a regular file", s.name(p))
+	}
+
+	if ni == nil {
+		if ni, err = fetchNarinfo(s.cache, s.hash); err != nil {
+			return err
+		}
+	}
+
+	if ni.Compression == "none" || ni.Compression == "" {
+		r, err := s.cache.getRange(ni.URL, n.NAROffset, n.Size)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		_, err = copyContents(w, r)
+		return err
+	}
+
+	err = fetchNar(s.cache, ni, func(r io.Reader) error {
+		return catNarFile(r, p, w)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.name(p), err)
+	}
+
+	return nil
+}
+
+// catNarFile copies the regular file p of the NAR read from r to w.
+func catNarFile(r io.Reader, p string, w io.Writer) error {
+	nr, err := newNarReader(r)
+	if err != nil {
+		return fmt.Errorf("reading NAR: %w", err)
+	}
+	defer nr.Close()
+
+	for {
+		hdr, err := nr.Next()
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("no such file or directory")
+		}
+
+		if err != nil {
+			return fmt.Errorf("reading NAR: %w", err)
+		}
+
+		if hdr.Path != p {
+			continue
+		}
+
+		if hdr.Type != nar.TypeRegular {
+			return fmt.Errorf("not a regular file")
+		}
+
+		_, err = copyContents(w, nr)
+		return err
+	}
+}
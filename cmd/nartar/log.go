@@ -0,0 +1,111 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// verbosity is set by -v and -q, which every command accepts: below zero
+// warnings are suppressed, above zero every entry is logged as it is read.
+var verbosity = 0
+
+func addVerbosityFlags(fs *flag.FlagSet) {
+	for _, f := range []struct {
+		name, usage string
+		level       int
+	}{
+		{"verbose", "log every entry to stderr as it is converted", 1},
+		{"v", "shorthand for -verbose", 1},
+		{"quiet", "suppress warnings", -1},
+		{"q", "shorthand for -quiet", -1},
+	} {
+		fs.Var(verbosityFlag(f.level), f.name, f.usage)
+	}
+}
+
+// verbosityFlag is a switch selecting the verbosity it holds.
+type verbosityFlag int
+
+func (f verbosityFlag) String() string { return "false" }
+
+func (f verbosityFlag) IsBoolFlag() bool { return true }
+
+func (f verbosityFlag) Set(v string) error {
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+
+	if on {
+		verbosity = int(f)
+	}
+
+	return nil
+}
+
+// logEntry logs an input entry with -v: its kind, name, and size for regular
+// files or target for links. Entries are counted by kind for -stats.
+func logEntry(kind, name string, size int64, target string) {
+	stats.mu.Lock()
+	stats.entries[kind]++
+	stats.mu.Unlock()
+
+	if verbosity < 1 {
+		return
+	}
+
+	switch {
+	case target != "":
+		fmt.Fprintf(os.Stderr, "%s %s -> %s\n", kind, name, target)
+	case kind == "regular":
+		fmt.Fprintf(os.Stderr, "%s %s (%d bytes)\n", kind, name, size)
+	default:
+		fmt.Fprintf(os.Stderr, "%s %s\n", kind, name)
+	}
+}
+
+// logDuplicate logs with -v that the archive holds p more than once, and
+// which of its entries is kept.
+func logDuplicate(p, kept string) {
+	if verbosity < 1 {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "duplicate %s: keeping the %s entry\n", p, kept)
+}
+
+// logSymlinkRewrite logs with -v that -symlink-policy rewrote the target
+// of the symlink p to what it names.
+func logSymlinkRewrite(p, target, rewritten string) {
+	if verbosity < 1 {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "symlink %s: rewrote target %q to %s\n", p, target, rewritten)
+}
+
+func tarEntryKind(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		return "regular"
+	case tar.TypeDir:
+		return "directory"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return tarSpecialKind(typeflag)
+	default:
+		return fmt.Sprintf("type %q", typeflag)
+	}
+}
+
+func logNarEntry(hdr *nar.Header) {
+	logEntry(string(hdr.Type), hdr.Path, hdr.Size, hdr.LinkTarget)
+}
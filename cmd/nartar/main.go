@@ -2,6 +2,8 @@ package main
 
 import (
 	"archive/tar"
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,7 +11,6 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"sort"
 	"strings"
 	"time"
 
@@ -23,292 +24,1840 @@ const (
 	symlinkMode  int64 = 0o777
 )
 
+// File type bits of a Unix st_mode, as stored by cpio and filesystem images.
+const (
+	unixModeType    int64 = 0o170000
+	unixModeDir     int64 = 0o040000
+	unixModeRegular int64 = 0o100000
+	unixModeSymlink int64 = 0o120000
+	unixModeChar    int64 = 0o020000
+	unixModeBlock   int64 = 0o060000
+	unixModeFifo    int64 = 0o010000
+	unixModeSocket  int64 = 0o140000
+)
+
+// tarRootName is the default top-level tar member that holds the NAR contents.
+const tarRootName = "-"
+
 var zeroTime = time.Unix(0, 0)
 
-type tarEntry struct {
-	path       string
-	kind       byte
-	linkTarget string
-	data       []byte
+// tarOptions controls how tar output is written.
+type tarOptions struct {
+	format    tar.Format
+	sidecar   *sidecar
+	sparse    bool
+	hardlinks bool
+	mtime     time.Time
+	modes     modeMap
+
+	// Ownership written for every entry; the names are left empty unless
+	// given.
+	uid, gid     int
+	uname, gname string
+	numericOwner bool
+
+	// singleFile names the member a NAR with a regular file at its root is
+	// written as, in place of the root name, if set.
+	singleFile string
+
+	// paths rewrites NAR paths before they are mapped to tar names.
+	paths *pathMap
+
+	// conflicts resolves tar names written by more than one input.
+	conflicts *mergeSet
+
+	// symlinks is the -symlink-policy for the symlinks written, and utf8
+	// the -invalid-utf8 policy for the names and targets.
+	symlinks *symlinkPolicy
+	utf8     *utf8Policy
+}
+
+// forOutput returns a copy of o for a conversion of its own, writing a NAR
+// holding a single file as singleFile.
+func (o *tarOptions) forOutput(singleFile string) *tarOptions {
+	c := *o
+	c.singleFile = singleFile
+	c.paths = o.paths.clone()
+
+	return &c
+}
+
+// addTarOptionFlags registers the tar output flags on fs.
+func addTarOptionFlags(fs *flag.FlagSet) *tarOptions {
+	o := &tarOptions{
+		mtime:    zeroTime,
+		modes:    defaultModes,
+		symlinks: addSymlinkPolicyFlag(fs),
+		utf8:     addUTF8PolicyFlag(fs),
+	}
+
+	fs.Func("tar-format", "tar output format: ustar, pax or gnu (default picks the simplest that fits each entry)", func(v string) error {
+		switch v {
+		case "auto":
+			o.format = tar.FormatUnknown
+		case "ustar":
+			o.format = tar.FormatUSTAR
+		case "pax":
+			o.format = tar.FormatPAX
+		case "gnu":
+			o.format = tar.FormatGNU
+		default:
+			return fmt.Errorf("unsupported tar format %q", v)
+		}
+
+		return nil
+	})
+
+	addMtimeFlag(fs, &o.mtime)
+	addModeFlags(fs, &o.modes)
+
+	fs.Func("owner", "owner of all entries as NAME, UID or NAME:UID (default uid 0 without a name)", func(v string) error {
+		return parseOwner(v, &o.uname, &o.uid)
+	})
+
+	fs.Func("group", "group of all entries as NAME, GID or NAME:GID (default gid 0 without a name)", func(v string) error {
+		return parseOwner(v, &o.gname, &o.gid)
+	})
+
+	fs.BoolVar(&o.numericOwner, "numeric-owner", false, "write only numeric ids, without user and group names")
+	fs.BoolVar(&o.hardlinks, "hardlinks", false, "write files identical to an earlier one as hard links to it")
+	fs.BoolVar(&o.sparse, "sparse", false, "store long runs of zeros in files as holes, using PAX sparse entries")
+
+	fs.Func("sidecar", "restore PAX records and mtimes from a sidecar written by tar2nar", func(v string) error {
+		s, err := readSidecar(v)
+		if err != nil {
+			return err
+		}
+
+		o.sidecar = s
+
+		return nil
+	})
+
+	addRewriteFlag(fs)
+	addStrictNamesFlag(fs)
+
+	return o
+}
+
+// Handling of device, FIFO and socket entries, which a NAR cannot hold.
+const (
+	specialError = "error"
+	specialSkip  = "skip"
+	specialEmpty = "empty"
+)
+
+// Ways of deciding the NAR executable flag of a file read from an archive.
+const (
+	executableMode    = "mode"
+	executableShebang = "shebang"
+	executableELF     = "elf"
+	executableAll     = "all"
+	executableNone    = "none"
+)
+
+// readOptions controls how archive entries are turned into NAR entries.
+type readOptions struct {
+	special    string
+	executable string
+
+	// topDir reads the contents of a tarball's single top-level directory,
+	// whatever its name, as -flake does.
+	topDir bool
+
+	// paths rewrites the NAR paths of archive entries.
+	paths *pathMap
+
+	// archive is the seekable tarball being read, if it is one.
+	archive *seekableTar
+
+	// assumeSorted writes the entries of a tarball to the NAR as they are
+	// read, as -assume-sorted does.
+	assumeSorted bool
+
+	// duplicates is the -duplicates policy for a path the archive holds
+	// more than once.
+	duplicates string
+
+	// symlinks is the -symlink-policy for the symlinks read, and utf8 the
+	// -invalid-utf8 policy for the paths and targets.
+	symlinks *symlinkPolicy
+	utf8     *utf8Policy
+}
+
+// addReadOptionFlags registers the archive input flags on fs.
+func addReadOptionFlags(fs *flag.FlagSet) *readOptions {
+	o := &readOptions{
+		special:    specialError,
+		executable: executableMode,
+		duplicates: conflictLast,
+		symlinks:   addSymlinkPolicyFlag(fs),
+		utf8:       addUTF8PolicyFlag(fs),
+	}
+
+	fs.Func("special", "device, FIFO and socket entries: error (default), skip, or empty to store an empty file", func(v string) error {
+		switch v {
+		case specialError, specialSkip, specialEmpty:
+			o.special = v
+			return nil
+		default:
+			return fmt.Errorf("unsupported -special mode %q", v)
+		}
+	})
+
+	fs.Func("executable-policy", "how files are marked executable: mode (default) uses the x bits; shebang and elf also mark #! scripts or ELF binaries, all does both, none marks nothing", func(v string) error {
+		switch v {
+		case executableMode, executableShebang, executableELF, executableAll, executableNone:
+			o.executable = v
+			return nil
+		default:
+			return fmt.Errorf("unsupported -executable-policy %q", v)
+		}
+	})
+
+	fs.Func("duplicates", "a path the archive holds more than once: last (default) keeps the last entry, first the first, error fails", func(v string) error {
+		switch v {
+		case conflictError, conflictFirst, conflictLast:
+			o.duplicates = v
+			return nil
+		default:
+			return fmt.Errorf("unsupported -duplicates policy %q", v)
+		}
+	})
+
+	addReferenceFlags(fs)
+	addRewriteFlag(fs)
+	addSpoolFlags(fs)
+	addLimitFlags(fs)
+	addStrictNamesFlag(fs)
+
+	return o
+}
+
+// isExecutable applies the -executable-policy to a file with the given
+// contents, whose mode in the archive has any x bit set if modeExec is set.
+func (o *readOptions) isExecutable(modeExec bool, data []byte) bool {
+	shebang := bytes.HasPrefix(data, []byte("#!"))
+	elf := bytes.HasPrefix(data, []byte("\x7fELF"))
+
+	switch o.executable {
+	case executableNone:
+		return false
+	case executableShebang:
+		return modeExec || shebang
+	case executableELF:
+		return modeExec || elf
+	case executableAll:
+		return modeExec || shebang || elf
+	default:
+		return modeExec
+	}
+}
+
+// addEntry stores e at the NAR path p of entries, applying the -duplicates
+// policy if the archive had an entry of the same kind there already.
+// Duplicates are logged with -v. An entry below one that is not a directory,
+// one that is not a directory with entries below it, or a path that is both a
+// directory and not one, is an error, as a NAR cannot hold it.
+func (o *readOptions) addEntry(entries *entryTree, p string, e *tarEntry) error {
+	if dir, above := entries.fileAbove(p); above != nil {
+		return fmt.Errorf("%s is below %s, which is a %s entry in the archive, not a directory", p, dir, tarEntryKind(above.kind))
+	}
+
+	duplicate := entries.has(p)
+
+	if duplicate {
+		if err := checkKindChange(p, entries.get(p).kind, e.kind); err != nil {
+			return err
+		}
+
+		switch o.duplicates {
+		case conflictError:
+			return fmt.Errorf("%s is in the archive more than once; use -duplicates first or last to pick one", p)
+		case conflictFirst:
+			logDuplicate(p, "first")
+			return nil
+		}
+	}
+
+	if e.kind != tar.TypeDir && entries.hasBelow(p) {
+		return fmt.Errorf("%s is a %s entry in the archive, but there are entries below it as if it were a directory", p, tarEntryKind(e.kind))
+	}
+
+	if duplicate {
+		logDuplicate(p, "last")
+	}
+
+	entries.set(p, e)
+
+	return nil
+}
+
+// checkKindChange fails for a path the archive holds first as a directory and
+// then as something else, or the other way around. Whichever entry a
+// -duplicates policy kept, the other would be silently lost.
+func checkKindChange(p string, was, is byte) error {
+	if (was == tar.TypeDir) == (is == tar.TypeDir) {
+		return nil
+	}
+
+	return fmt.Errorf("%s is both a %s and a %s entry in the archive", p, tarEntryKind(was), tarEntryKind(is))
+}
+
+// archivePath is normalizeArchivePath, with the path checked by
+// -strict-names and the -invalid-utf8 policy applied to it.
+func (o *readOptions) archivePath(name, root string) (string, bool, error) {
+	p, skip, err := normalizeArchivePath(name, root)
+	if err != nil || skip {
+		return p, skip, err
+	}
+
+	if err := checkStrictName(p); err != nil {
+		return "", false, err
+	}
+
+	p, err = o.utf8.apply(p)
+
+	return p, false, err
+}
+
+// symlinkTarget applies the -invalid-utf8 and -symlink-policy policies to
+// the target of the symlink at p. It returns the target to store, or file
+// set if the symlink is to be stored as an empty file.
+func (o *readOptions) symlinkTarget(p, target string) (string, bool, error) {
+	target, err := o.utf8.apply(target)
+	if err != nil {
+		return "", false, fmt.Errorf("symlink %s: %w", p, err)
+	}
+
+	return o.symlinks.apply(p, target)
+}
+
+// symlinkEntry returns the entry of the symlink at p pointing at target, as
+// the -invalid-utf8 and -symlink-policy policies have it.
+func (o *readOptions) symlinkEntry(slab *entrySlab, p, target string) (*tarEntry, error) {
+	target, file, err := o.symlinkTarget(p, target)
+	if err != nil {
+		return nil, err
+	}
+
+	if file {
+		return slab.entry(tarEntry{kind: tar.TypeReg}), nil
+	}
+
+	return slab.entry(tarEntry{kind: tar.TypeSymlink, linkTarget: target}), nil
+}
+
+// specialEntry applies the -special policy to the entry name, described as
+// kind, which would be stored at p. It returns the entry to store, if any.
+func (o *readOptions) specialEntry(name, kind, p string) (*tarEntry, error) {
+	switch o.special {
+	case specialSkip:
+		return nil, warnCategory(warnSkippedSpecial, "skipping %s %q", kind, name)
+	case specialEmpty:
+		e := &tarEntry{path: p, kind: tar.TypeReg}
+		return e, warnCategory(warnSkippedSpecial, "storing %s %q as an empty file", kind, name)
+	default:
+		return nil, fmt.Errorf("unsupported %s %q (use -special skip or empty)", kind, name)
+	}
+}
+
+// paxRecords returns the PAX records to restore for the NAR path p.
+func (o *tarOptions) paxRecords(p string) map[string]string {
+	if o.sidecar == nil || o.sidecar.Entries[p] == nil {
+		return nil
+	}
+
+	return o.sidecar.Entries[p].PAX
+}
+
+// modTime returns the mtime to write for the NAR path p: the original one
+// if the sidecar records it, or the -mtime timestamp.
+func (o *tarOptions) modTime(p string) time.Time {
+	if o.sidecar != nil && o.sidecar.Entries[p] != nil && !o.sidecar.Entries[p].mtime.IsZero() {
+		return o.sidecar.Entries[p].mtime
+	}
+
+	return o.mtime
+}
+
+type tarEntry struct {
+	// path is the NAR path of the entry, which an entryTree holds instead
+	// while the entry is stored in it.
+	path       string
+	kind       byte
+	executable bool
+	linkTarget string
+	data       []byte
+
+	// A regular file not held in data has its size bytes at offset in src:
+	// the spool file, or the tarball itself when it is seekable. Read with
+	// -assume-sorted from a stream, they are still to be read from r.
+	src    io.ReaderAt
+	offset int64
+	size   int64
+	r      io.Reader
+
+	// held is the file whose contents data holds, while they count against
+	// -max-memory.
+	held *heldFile
+
+	// pax holds PAX records that the NAR cannot represent.
+	pax map[string]string
+
+	// mtime is the modification time of the archive entry, if it has one.
+	mtime time.Time
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+	}
+
+	switch os.Args[1] {
+	case "nar2tar":
+		if err := runNarToTar(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "tar2nar":
+		if err := runTarToNar(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "nar2cpio":
+		if err := runNarToCpio(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "cpio2nar":
+		if err := runCpioToNar(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "deb2nar":
+		if err := runDebToNar(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "rpm2nar":
+		if err := runRPMToNar(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "7z2nar":
+		if err := runSevenZipToNar(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "nar2erofs":
+		if err := runNarToErofs(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "nar2iso":
+		if err := runNarToISO(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "nar2layer":
+		if err := runNarToLayer(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "nar2oci":
+		if err := runNarToOCI(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "oci2nar":
+		if err := runOCIToNar(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "docker2nar":
+		if err := runDockerToNar(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "nar2bundle":
+		if err := runNarToBundle(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "bundle2nar":
+		if err := runBundleToNar(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "nar2narinfo":
+		if err := runNarToNarinfo(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "push":
+		if err := runPush(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "pull":
+		if err := runPull(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "import":
+		if err := runImport(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "nar2chunks":
+		if err := runNarToChunks(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "chunks2nar":
+		if err := runChunksToNar(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "nar2castore":
+		if err := runNarToCastore(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "castore2nar":
+		if err := runCastoreToNar(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "hash":
+		if err := runHash(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "ls":
+		if err := runLs(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "cat":
+		if err := runCat(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "keygen":
+		if err := runKeygen(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "verify":
+		if err := runVerify(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "convert":
+		if err := runConvert(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "bench":
+		if err := runBench(os.Args[2:]); err != nil {
+			exitErr(err)
+		}
+	case "-h", "--help", "help":
+		printUsage()
+	default:
+		exitErr(fmt.Errorf("unknown command %q", os.Args[1]))
+	}
+
+	fileSpool.remove()
+
+	if err := writeReferences(); err != nil {
+		exitErr(err)
+	}
+
+	if err := commitCAOutputs(); err != nil {
+		exitErr(err)
+	}
+
+	stopProfiling()
+	printStats(os.Args[1])
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "  nartar nar2tar -i input.nar [-i input.nar...] -o output.tar [-flake-dir NAME]\n")
+	fmt.Fprintf(os.Stderr, "  nartar tar2nar -i input.tar [-i input.tar...] -o output.nar [-flake]\n")
+	fmt.Fprintf(os.Stderr, "  nartar nar2cpio -i input.nar -o output.cpio\n")
+	fmt.Fprintf(os.Stderr, "  nartar cpio2nar -i input.cpio -o output.nar\n")
+	fmt.Fprintf(os.Stderr, "  nartar deb2nar -i input.deb -o output.nar\n")
+	fmt.Fprintf(os.Stderr, "  nartar rpm2nar -i input.rpm -o output.nar\n")
+	fmt.Fprintf(os.Stderr, "  nartar 7z2nar -i input.7z -o output.nar\n")
+	fmt.Fprintf(os.Stderr, "  nartar nar2erofs -i input.nar -o output.erofs\n")
+	fmt.Fprintf(os.Stderr, "  nartar nar2iso -i input.nar -o output.iso\n")
+	fmt.Fprintf(os.Stderr, "  nartar nar2layer -i input.nar -o layer.tar.gz [-compression gzip|zstd|none] [-descriptor layer.json]\n")
+	fmt.Fprintf(os.Stderr, "  nartar nar2oci -i input.nar -o layout-dir [-ref latest] [-compression gzip|zstd|none]\n")
+	fmt.Fprintf(os.Stderr, "  nartar oci2nar -i layout-dir -o output.nar [-ref latest] [-layer N] [-whiteouts squash|preserve]\n")
+	fmt.Fprintf(os.Stderr, "  nartar docker2nar -i image.tar -o output.nar [-image repo:tag] [-layer N] [-whiteouts squash|preserve]\n")
+	fmt.Fprintf(os.Stderr, "  nartar nar2bundle -o bundle.tar [-nar-format nar|export] input.nar...\n")
+	fmt.Fprintf(os.Stderr, "  nartar bundle2nar -i bundle.tar -o output-dir [-nar-format nar|export]\n")
+	fmt.Fprintf(os.Stderr, "  nartar nar2narinfo -i input.nar -o cache-dir -store-path /nix/store/... [-compression xz|zstd|none] [-sign-key secret.key]\n")
+	fmt.Fprintf(os.Stderr, "  nartar push -i input.nar -o https://cache.example.org|attic+https://attic.example.org/cache|s3://bucket -store-path /nix/store/... [-token TOKEN] [-header 'Name: value']\n")
+	fmt.Fprintf(os.Stderr, "  nartar pull -from https://cache.example.org -o output.nar [-format nar|tar] [-public-key FILE] /nix/store/...\n")
+	fmt.Fprintf(os.Stderr, "  nartar import -i input.nar -store-path /nix/store/... [-nar-format nar|export] [-socket PATH] [-repair]\n")
+	fmt.Fprintf(os.Stderr, "  nartar ls [-l] [-R] [-json] -i input.nar|listing.ls [path] | -from CACHE /nix/store/...[/path]\n")
+	fmt.Fprintf(os.Stderr, "  nartar cat -i input.nar [-index input.ls] path | -from CACHE /nix/store/.../path\n")
+	fmt.Fprintf(os.Stderr, "  nartar nar2chunks -i input.nar -store chunk-dir -o index.json [-chunk-size 64K]\n")
+	fmt.Fprintf(os.Stderr, "  nartar chunks2nar -i index.json -store chunk-dir -o output.nar\n")
+	fmt.Fprintf(os.Stderr, "  nartar nar2castore -i input.nar -o castore-dir [-root-node node.pb]\n")
+	fmt.Fprintf(os.Stderr, "  nartar castore2nar -i castore-dir -root b3:... | -root-node node.pb -o output.nar\n")
+	fmt.Fprintf(os.Stderr, "  nartar hash -i input [-mode flat|nar] [-hash-algo sha256|sha512|blake3] [-hash-format sri|nix32|base16|base64] [-snippet fetchurl|requireFile|derivation] [-url URL] [-name NAME]\n")
+	fmt.Fprintf(os.Stderr, "  nartar keygen -name cache.example.org-1 -o secret.key [-public public.key]\n")
+	fmt.Fprintf(os.Stderr, "  nartar verify [-trusted-public-keys KEYS] [-public-key FILE] [-nix-conf FILE] [-min-sigs N] file.narinfo...\n")
+	fmt.Fprintf(os.Stderr, "  nartar convert -i input -o output (NAR to tar, or tar, cpio, deb or rpm to NAR, detected from the input)\n")
+	fmt.Fprintf(os.Stderr, "  nartar bench [-files N] [-min-size 1K] [-max-size 256K] [-sizes log|uniform] [-directions nar2tar,...] [-compression none,gzip,...] [-format text|json]\n")
+	fmt.Fprintf(os.Stderr, "Use '-' for stdin/stdout. Timestamps are normalized to the Unix epoch, or to --mtime @seconds|date\n")
+	fmt.Fprintf(os.Stderr, "for the commands writing tar or cpio, which default to $SOURCE_DATE_EPOCH when it is set.\n")
+	fmt.Fprintf(os.Stderr, "-i and -o may also be given as --input and --output, or as arguments: nartar nar2tar input.nar output.tar\n")
+	fmt.Fprintf(os.Stderr, "-C dir (or --directory dir) changes to dir before any file is opened.\n")
+	fmt.Fprintf(os.Stderr, "-v (--verbose) logs every entry to stderr as it is read; -q (--quiet) suppresses warnings.\n")
+	fmt.Fprintf(os.Stderr, "--warning=[no-|error:]CATEGORY shows, hides or fails on skipped-special, ignored-pax, long-path-upgraded, case-hack, nar-fixed or all.\n")
+	fmt.Fprintf(os.Stderr, "A progress bar is shown on a terminal for inputs of known size; --no-progress hides it.\n")
+	fmt.Fprintf(os.Stderr, "--stats prints a summary of entries, bytes, ratio, time and throughput at the end; --stats=json as JSON.\n")
+	fmt.Fprintf(os.Stderr, "Existing output files are not overwritten without --force; --no-clobber skips them instead.\n")
+	fmt.Fprintf(os.Stderr, "--ca-name names outputs after their SHA-256, -o nar/.nar.zst giving nar/<hash>.nar.zst, and prints the names.\n")
+	fmt.Fprintf(os.Stderr, "--expected-narhash and --expected-filehash fail a conversion, deleting its output, unless the NAR or output file has that hash.\n")
+	fmt.Fprintf(os.Stderr, "On a terminal nartar asks before overwriting one; -y (--yes) overwrites without asking.\n")
+	fmt.Fprintf(os.Stderr, "--write-index FILE writes the .ls listing of the NAR converted, with file offsets, for cat -index.\n")
+	fmt.Fprintf(os.Stderr, "--write-hashes FILE writes the NarHash, NarSize, FileHash and FileSize of a conversion, computed as it runs.\n")
+	fmt.Fprintf(os.Stderr, "Flag defaults are read from ~/.config/nartar/config.toml, or the file named by $NARTAR_CONFIG.\n")
+	fmt.Fprintf(os.Stderr, "They may also be set as NARTAR_<FLAG> variables, such as NARTAR_TAR_FORMAT=pax, overriding the file.\n")
+	fmt.Fprintf(os.Stderr, "Every flag may be written with one or two dashes; 'nartar <command> -h' lists the flags of a command.\n")
+	fmt.Fprintf(os.Stderr, "Commands writing tar accept -tar-format ustar|pax|gnu, -sparse, -hardlinks, and -sidecar to restore PAX records and mtimes;\n")
+	fmt.Fprintf(os.Stderr, "They also accept --owner and --group NAME, ID or NAME:ID, and --numeric-owner.\n")
+	fmt.Fprintf(os.Stderr, "Commands writing tar or cpio accept --dir-mode, --file-mode and --exec-mode in octal.\n")
+	fmt.Fprintf(os.Stderr, "Commands reading archives accept -special error|skip|empty for device, FIFO and socket entries,\n")
+	fmt.Fprintf(os.Stderr, "and tar2nar, cpio2nar, deb2nar, rpm2nar and 7z2nar accept --executable-policy mode|shebang|elf|all|none.\n")
+	fmt.Fprintf(os.Stderr, "They also accept --duplicates last|first|error for a path the archive holds more than once.\n")
+	fmt.Fprintf(os.Stderr, "Commands reading archives or writing tar accept --symlink-policy preserve|reject|rewrite, or\n")
+	fmt.Fprintf(os.Stderr, "absolute=,escaping=,empty= pairs of them, for absolute, escaping and empty symlink targets,\n")
+	fmt.Fprintf(os.Stderr, "and --invalid-utf8 pass|reject|escape for paths and symlink targets that are not valid UTF-8.\n")
+	fmt.Fprintf(os.Stderr, "Commands reading archives or NARs or writing tar accept --strict-names to reject paths with control characters.\n")
+	fmt.Fprintf(os.Stderr, "Commands writing NARs accept --references FILE to list the store paths the files refer to,\n")
+	fmt.Fprintf(os.Stderr, "limited to the hash parts of the paths in --reference-candidates FILE if given.\n")
+	fmt.Fprintf(os.Stderr, "Commands reading NARs accept --strict to reject duplicate, unsorted, empty or invalid entry names.\n")
+	fmt.Fprintf(os.Stderr, "--fix instead accepts NARs with unsorted directories and converts them as if sorted.\n")
+	fmt.Fprintf(os.Stderr, "Commands reading archives or NARs accept --max-entries N, --max-file-size SIZE, --max-total-size SIZE\n")
+	fmt.Fprintf(os.Stderr, "and --max-depth N to fail on inputs beyond those limits.\n")
+	fmt.Fprintf(os.Stderr, "Commands writing NARs or tar accept --rewrite OLD=NEW to replace a store path or hash part\n")
+	fmt.Fprintf(os.Stderr, "with another of the same length in file contents and symlink targets.\n")
+	fmt.Fprintf(os.Stderr, "nar2tar and tar2nar accept --strip-components N to drop leading path elements of the NAR paths,\n")
+	fmt.Fprintf(os.Stderr, "--prefix dir to place all entries below dir, --root-name to replace the '-' top-level member ('' for none),\n")
+	fmt.Fprintf(os.Stderr, "--exclude/--include patterns, or --exclude-from/--include-from files of them, to filter entries,\n")
+	fmt.Fprintf(os.Stderr, "--case-hack to strip (nar2tar) or add (tar2nar) the ~nix~case~hack~N suffixes of macOS NARs,\n")
+	fmt.Fprintf(os.Stderr, "and --transform s,old,new,[gi] or old=new to rewrite paths. nar2tar --append adds to an existing tar,\n")
+	fmt.Fprintf(os.Stderr, "and nar2tar --to-command CMD pipes every file to CMD with TAR_FILENAME, TAR_SIZE, ... set instead.\n")
+	fmt.Fprintf(os.Stderr, "nar2tar --assert-deterministic fails unless the tar is in NAR order with fixed mtimes, modes and owners.\n")
+	fmt.Fprintf(os.Stderr, "nar2tar and tar2nar take several inputs, each placed in a directory named after it; --conflict error|first|last\n")
+	fmt.Fprintf(os.Stderr, "decides which of them wins when a path is found in more than one.\n")
+	fmt.Fprintf(os.Stderr, "Commands converting one input accept --output-template to convert several inputs each to their own output,\n")
+	fmt.Fprintf(os.Stderr, "named with {dir}, {base}, {name}, {ext} and {hash}: --output-template 'out/{dir}/{name}.tar'.\n")
+	fmt.Fprintf(os.Stderr, "tar2nar --resume continues a NAR an interrupted run left, from the checkpoint kept in <output>.resume.\n")
+	fmt.Fprintf(os.Stderr, "tar2nar accepts -pax report and -sidecar to keep the PAX records a NAR cannot hold, and with\n")
+	fmt.Fprintf(os.Stderr, "-preserve-mtime the entry mtimes, which nar2tar -sidecar writes back.\n")
+	fmt.Fprintf(os.Stderr, "Commands reading NARs take --decompress to read gzip, bzip2, xz, zstd or lzma compressed ones.\n")
+	fmt.Fprintf(os.Stderr, "Add -nar-format export to read or write nix-store --export streams instead of bare NARs;\n")
+	fmt.Fprintf(os.Stderr, "writing one requires -store-path and accepts -reference (repeatable) and -deriver.\n")
+	os.Exit(2)
+}
+
+func runNarToTar(args []string) error {
+	fs := flag.NewFlagSet("nar2tar", flag.ContinueOnError)
+	opts := addTarOptionFlags(fs)
+	opts.paths = addPathMapFlags(fs)
+	root := addRootNameFlag(fs)
+	addFlakeDirFlag(fs, opts, root)
+	singleFile := addSingleFileNameFlag(fs, root)
+	appendTar := fs.Bool("append", false, "add the entries to the end of an existing output tar instead of replacing it")
+	toCommand := fs.String("to-command", "", "pipe each regular file to this shell command instead of writing a tar")
+
+	open := func(name string) (io.WriteCloser, error) {
+		switch {
+		case *toCommand != "":
+			return nopWriteCloser{Writer: io.Discard}, nil
+		case *appendTar:
+			return openTarForAppend(name)
+		default:
+			return openOutput(name)
+		}
+	}
+
+	conflict := addConflictFlag(fs)
+	deterministic := fs.Bool("assert-deterministic", false, "read the tar back as it is written and fail unless it is in NAR order with fixed mtimes, modes and owners")
+
+	// check runs write, with the tar checked by -assert-deterministic.
+	check := func(out io.Writer, roots []string, write func(io.Writer) error) error {
+		if !*deterministic {
+			return write(out)
+		}
+
+		return assertDeterministic(out, roots, opts, write)
+	}
+
+	errToCommand := fmt.Errorf("-assert-deterministic checks the tar output, which -to-command does not write")
+
+	convert := func(in io.Reader, out io.Writer, output string) error {
+		if *toCommand != "" && *deterministic {
+			return errToCommand
+		}
+
+		// Batch conversions may run at once, so each has its own options.
+		opts := opts.forOutput(singleFile(output))
+
+		if *toCommand != "" {
+			return narToCommand(in, *toCommand, *root, opts)
+		}
+
+		return check(out, []string{*root}, func(w io.Writer) error {
+			return narToTarRoot(in, w, *root, opts)
+		})
+	}
+
+	return runMultiConversion(fs, args, narInput, open, convert, func(inputs []string, narFormat *narFormatOptions, out io.Writer) error {
+		if *toCommand != "" && *deterministic {
+			return errToCommand
+		}
+
+		if *toCommand != "" {
+			return narsToCommand(inputs, narFormat, *toCommand, *root, opts)
+		}
+
+		var roots []string
+		for _, name := range inputs {
+			if prefix, err := inputPrefix(name); err == nil {
+				roots = append(roots, path.Join(*root, prefix))
+			}
+		}
+
+		return check(out, roots, func(w io.Writer) error {
+			return narsToTar(inputs, narFormat, w, *root, *conflict, opts)
+		})
+	})
+}
+
+func runTarToNar(args []string) error {
+	fs := flag.NewFlagSet("tar2nar", flag.ContinueOnError)
+	opts := addReadOptionFlags(fs)
+	opts.paths = addPathMapFlags(fs)
+	root := addRootNameFlag(fs)
+	addFlakeFlag(fs, opts)
+	pax := fs.String("pax", paxIgnore, "PAX records the NAR cannot hold: ignore, or report them on stderr")
+	sidecarName := fs.String("sidecar", "", "write PAX records the NAR cannot hold to this JSON file")
+	preserveMtime := fs.Bool("preserve-mtime", false, "also record the mtime of every entry in the -sidecar file")
+	conflict := addConflictFlag(fs)
+	fs.BoolVar(&opts.assumeSorted, "assume-sorted", false, "write entries to the NAR as they are read, for tarballs already in NAR order such as nar2tar and tar --sort=name write; an entry out of order is an error")
+
+	resume := fs.Bool("resume", false, "continue the output NAR where an interrupted run of the same conversion stopped, from the checkpoint it keeps in <output>.resume")
+
+	open := func(name string) (io.WriteCloser, error) {
+		if *resume {
+			return openResumableOutput(name)
+		}
+
+		return openOutput(name)
+	}
+
+	// checkResume rejects -resume where the NAR does not go straight to
+	// the output file, or where the entries written are not all the
+	// conversion produces.
+	checkResume := func(out io.Writer) error {
+		switch {
+		case !*resume:
+			return nil
+		case opts.assumeSorted:
+			return fmt.Errorf("-resume cannot be combined with -assume-sorted")
+		case referenceOutput != "":
+			return fmt.Errorf("-resume cannot be combined with -references, which scans the whole NAR")
+		case resumeOutput(out) == nil:
+			return fmt.Errorf("-resume writes the NAR straight to the output file, which -nar-format export, -expected-narhash, -expected-filehash, -write-index and -write-hashes do not")
+		}
+
+		return nil
+	}
+
+	convert := func(in io.Reader, out io.Writer, _ string) error {
+		if err := checkResume(out); err != nil {
+			return err
+		}
+
+		return tarToNar(in, out, *root, *pax, *sidecarName, *preserveMtime, opts)
+	}
+
+	return runMultiConversion(fs, args, narOutput, open, convert, func(inputs []string, _ *narFormatOptions, out io.Writer) error {
+		if err := checkResume(out); err != nil {
+			return err
+		}
+
+		return tarsToNar(inputs, out, *root, *conflict, *pax, *sidecarName, *preserveMtime, opts)
+	})
+}
+
+func runNarToCpio(args []string) error {
+	fs := flag.NewFlagSet("nar2cpio", flag.ContinueOnError)
+	mtime := zeroTime
+	addMtimeFlag(fs, &mtime)
+	modes := defaultModes
+	addModeFlags(fs, &modes)
+
+	return runConversion(fs, args, narInput, func(in io.Reader, out io.Writer) error {
+		return narToCpio(in, out, mtime, modes)
+	})
+}
+
+func runCpioToNar(args []string) error {
+	fs := flag.NewFlagSet("cpio2nar", flag.ContinueOnError)
+	opts := addReadOptionFlags(fs)
+
+	return runConversion(fs, args, narOutput, func(in io.Reader, out io.Writer) error {
+		return cpioToNar(in, out, opts)
+	})
+}
+
+func runDebToNar(args []string) error {
+	fs := flag.NewFlagSet("deb2nar", flag.ContinueOnError)
+	opts := addReadOptionFlags(fs)
+
+	return runConversion(fs, args, narOutput, func(in io.Reader, out io.Writer) error {
+		return debToNar(in, out, opts)
+	})
+}
+
+func runRPMToNar(args []string) error {
+	fs := flag.NewFlagSet("rpm2nar", flag.ContinueOnError)
+	opts := addReadOptionFlags(fs)
+
+	return runConversion(fs, args, narOutput, func(in io.Reader, out io.Writer) error {
+		return rpmToNar(in, out, opts)
+	})
+}
+
+func runSevenZipToNar(args []string) error {
+	fs := flag.NewFlagSet("7z2nar", flag.ContinueOnError)
+	opts := addReadOptionFlags(fs)
+
+	return runConversion(fs, args, narOutput, func(in io.Reader, out io.Writer) error {
+		f, cleanup, err := seekableInput(in)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		return sevenZipToNar(f, out, opts)
+	})
+}
+
+func runNarToErofs(args []string) error {
+	return runConversion(flag.NewFlagSet("nar2erofs", flag.ContinueOnError), args, narInput, narToErofs)
+}
+
+func runNarToISO(args []string) error {
+	return runConversion(flag.NewFlagSet("nar2iso", flag.ContinueOnError), args, narInput, narToISO)
+}
+
+func runNarToLayer(args []string) error {
+	fs := flag.NewFlagSet("nar2layer", flag.ContinueOnError)
+	compression := fs.String("compression", "gzip", "layer compression (gzip, zstd or none)")
+	descriptor := fs.String("descriptor", "-", "file receiving the layer descriptor and DiffID as JSON ('-' for stdout)")
+	opts := addTarOptionFlags(fs)
+
+	return runConversion(fs, args, narInput, func(in io.Reader, out io.Writer) error {
+		if isStdio(*descriptor) && isStdio(fs.Lookup("o").Value.String()) {
+			return fmt.Errorf("-descriptor must name a file when the layer is written to stdout")
+		}
+
+		layer, err := narToOCILayer(in, out, *compression, opts)
+		if err != nil {
+			return err
+		}
+
+		d, err := openTextOutput(*descriptor)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+
+		if err := writeJSON(d, layer); err != nil {
+			return err
+		}
+
+		return d.Close()
+	})
+}
+
+func runNarToOCI(args []string) error {
+	fs := flag.NewFlagSet("nar2oci", flag.ContinueOnError)
+	input, output := addIOFlags(fs, "-", "input NAR file ('-' for stdin)", "", "output OCI image layout directory")
+	compression := fs.String("compression", "gzip", "layer compression (gzip, zstd or none)")
+	ref := fs.String("ref", "latest", "tag recorded in index.json")
+	arch := fs.String("arch", "amd64", "image architecture")
+	goos := fs.String("os", "linux", "image operating system")
+	opts := addTarOptionFlags(fs)
+	narFormat := addNarFormatFlags(fs, narInput)
+	if err := parseIOArgs(fs, args); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return fmt.Errorf("-o must name the output layout directory")
+	}
+
+	in, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	finish, err := narFormat.wrapInput(in, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := narToOCILayout(in, *output, *compression, *ref, *arch, *goos, opts); err != nil {
+		return err
+	}
+
+	return finish()
+}
+
+func runOCIToNar(args []string) error {
+	fs := flag.NewFlagSet("oci2nar", flag.ContinueOnError)
+	input, output := addIOFlags(fs, "", "input OCI image layout directory", "-", "output NAR file ('-' for stdout)")
+	ref := fs.String("ref", "", "tag of the image to convert (required if the layout holds several)")
+	layer := fs.Int("layer", -1, "convert only this layer (0-based) instead of squashing all layers")
+	whiteouts := fs.String("whiteouts", whiteoutsSquash, "whiteout handling: squash applies .wh. markers, preserve keeps them as files")
+	opts := addReadOptionFlags(fs)
+	narFormat := addNarFormatFlags(fs, narOutput)
+	if err := parseIOArgs(fs, args); err != nil {
+		return err
+	}
+
+	if *input == "" {
+		return fmt.Errorf("-i must name the input layout directory")
+	}
+
+	out, err := openOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	finish, err := narFormat.wrapOutput(out)
+	if err != nil {
+		return err
+	}
+
+	if err := ociLayoutToNar(*input, *ref, *layer, *whiteouts, opts, out); err != nil {
+		return err
+	}
+
+	return finish()
+}
+
+func runDockerToNar(args []string) error {
+	fs := flag.NewFlagSet("docker2nar", flag.ContinueOnError)
+	image := fs.String("image", "", "repo:tag of the image to convert (required if the archive holds several)")
+	layer := fs.Int("layer", -1, "convert only this layer (0-based) instead of squashing all layers")
+	whiteouts := fs.String("whiteouts", whiteoutsSquash, "whiteout handling: squash applies .wh. markers, preserve keeps them as files")
+	opts := addReadOptionFlags(fs)
+
+	return runConversion(fs, args, narOutput, func(in io.Reader, out io.Writer) error {
+		f, cleanup, err := seekableInput(in)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		return dockerToNar(f, *image, *layer, *whiteouts, opts, out)
+	})
+}
+
+func runNarToBundle(args []string) error {
+	fs := flag.NewFlagSet("nar2bundle", flag.ContinueOnError)
+	output := fs.String("output", "-", "output bundle tar ('-' for stdout)")
+	fs.StringVar(output, "o", "-", "shorthand for -output")
+	format := fs.String("nar-format", narFormatPlain, "input framing: nar for <hash>-<name>.nar files, export for nix-store --export streams")
+	opts := addTarOptionFlags(fs)
+	addNarCheckFlags(fs)
+
+	var known map[string]*bundlePath
+
+	fs.Func("registration", "read the references, deriver and NAR hash of store paths from this nix-store --dump-db output", func(name string) error {
+		in, err := openInput(name)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		if known, err = readRegistration(in); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		return nil
+	})
+	registration := fs.String("write-registration", "", "write the store paths as nix-store --register-validity --hash-given reads them to this file")
+	inputs, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(inputs) == 0 {
+		return fmt.Errorf("nar2bundle needs at least one input")
+	}
+
+	out, err := openOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	return narsToBundle(inputs, *format, out, opts, known, *registration)
+}
+
+func runBundleToNar(args []string) error {
+	fs := flag.NewFlagSet("bundle2nar", flag.ContinueOnError)
+	input, output := addIOFlags(fs, "-", "input bundle tar ('-' for stdin)", "", "output directory, or export stream with -nar-format export")
+	format := fs.String("nar-format", narFormatPlain, "output framing: nar writes one file per store path, export a nix-store --import stream")
+	opts := addReadOptionFlags(fs)
+	registration := fs.String("write-registration", "", "write the store paths as nix-store --register-validity --hash-given reads them to this file")
+	if err := parseIOArgs(fs, args); err != nil {
+		return err
+	}
+
+	in, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return bundleToNars(in, *output, *format, opts, *registration)
+}
+
+// runConversion adds the -i and -o flags to fs, parses args and runs convert
+// on the opened input and output. The input and output may also be given as
+// positional arguments, and several inputs converted with -output-template.
+// side tells which of them is the NAR, for the -nar-format framing options.
+func runConversion(fs *flag.FlagSet, args []string, side narSide, convert func(io.Reader, io.Writer) error) error {
+	return runMultiConversion(fs, args, side, openOutput, func(in io.Reader, out io.Writer, _ string) error {
+		return convert(in, out)
+	}, nil)
+}
+
+// convertFile opens input and output, with the NAR framing of narFormat on
+// side, and runs convert on them and the output name.
+func convertFile(input, output string, side narSide, narFormat *narFormatOptions, open func(string) (io.WriteCloser, error), convert func(io.Reader, io.Writer, string) error) error {
+	in, err := openInput(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := open(output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var finish func() error
+
+	var sums *conversionSums
+	if narFormat.sums != "" {
+		sums = newConversionSums()
+	}
+
+	w := sums.hashFile(narFormat.expect.output(out))
+	narIn, narOut := io.Reader(in), w
+
+	if side == narInput {
+		finish, err = narFormat.wrapInput(in, nil)
+		narIn = sums.hashInput(narFormat.expect.narInput(in))
+	} else {
+		finish, err = narFormat.wrapOutput(w)
+		narOut = sums.hashNar(narFormat.expect.narOutput(w))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var index *narIndexer
+
+	if narFormat.index != "" {
+		index = newNarIndexer()
+		defer index.stop()
+
+		if side == narInput {
+			narIn = io.TeeReader(narIn, index)
+		} else {
+			narOut = io.MultiWriter(narOut, index)
+		}
+	}
+
+	if err := convert(narIn, narOut, output); err != nil {
+		return err
+	}
+
+	if err := finish(); err != nil {
+		return err
+	}
+
+	if index != nil {
+		if err := index.write(narFormat.index); err != nil {
+			return err
+		}
+	}
+
+	if err := narFormat.expect.verify(output); err != nil {
+		return err
+	}
+
+	if sums != nil {
+		return sums.write(narFormat.sums)
+	}
+
+	return nil
+}
+
+func isStdio(name string) bool {
+	return name == "" || name == "-"
+}
+
+// openInput opens an input file, or stdin for "-". Inputs of known size show
+// a progress bar on a terminal. With -decompress compressed inputs are
+// decompressed.
+func openInput(name string) (io.ReadCloser, error) {
+	r, err := openRawInput(name)
+	if err != nil || !decompressInput {
+		return r, err
+	}
+
+	zr, err := decompress(r)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return decompressedInput{ReadCloser: zr, raw: r}, nil
+}
+
+func openRawInput(name string) (io.ReadCloser, error) {
+	if isStdio(name) {
+		return withProgress(readAheadInput(os.Stdin), nil, inputRemaining(os.Stdin)), nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return withProgress(readAheadInput(f), f, inputRemaining(f)), nil
+}
+
+// inputRemaining returns the number of bytes left in f if it is a regular
+// file, or -1.
+func inputRemaining(f *os.File) int64 {
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return -1
+	}
+
+	off, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return -1
+	}
+
+	return fi.Size() - off
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (n nopWriteCloser) Close() error { return nil }
+
+// narToTarRoot converts a NAR into a tarball with its contents below root.
+func narToTarRoot(in io.Reader, out io.Writer, root string, opts *tarOptions) error {
+	tw := tar.NewWriter(out)
+	defer tw.Close()
+
+	if err := writeNarToTar(in, out, tw, root, false, opts); err != nil {
+		return err
+	}
+
+	if err := opts.paths.checkSubpaths(); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// writeNarToTar adds the contents of a NAR to tw below root. With keepRoot
+// the NAR root itself is written as root even if it is a directory or symlink.
+// out is the writer underneath tw, used for headers archive/tar cannot write.
+func writeNarToTar(in io.Reader, out io.Writer, tw *tar.Writer, root string, keepRoot bool, opts *tarOptions) error {
+	if opts.sparse && (opts.format == tar.FormatUSTAR || opts.format == tar.FormatGNU) {
+		return fmt.Errorf("-sparse needs the pax tar format")
+	}
+
+	nr, err := newNarReader(in)
+	if err != nil {
+		return fmt.Errorf("opening nar: %w", err)
+	}
+	defer nr.Close()
+
+	links := make(map[tarLinkKey]string)
+	seen := make(map[string]string)
+
+	for _, dir := range opts.paths.prefixParents() {
+		name, _, err := tarPathForNarHeader(&nar.Header{Path: dir, Type: nar.TypeDirectory}, root)
+		if err != nil {
+			return err
+		}
+
+		if ok, err := opts.conflicts.add(name, true); err != nil || !ok {
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := writeTarDir(tw, name, nil, opts.mtime, opts); err != nil {
+			return err
+		}
+	}
+
+	for {
+		hdr, err := nr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("reading nar header: %w", err)
+		}
+
+		logNarEntry(hdr)
+
+		unhacked, err := opts.paths.unhack(hdr.Path, seen)
+		if err != nil {
+			return err
+		}
+
+		mapped, ok := opts.paths.apply(unhacked)
+		if !ok {
+			continue
+		}
+
+		mappedHdr := *hdr
+		mappedHdr.Path = mapped
+
+		name, skip := opts.singleFile, false
+		if keepRoot || mapped != "/" || hdr.Type != nar.TypeRegular || opts.singleFile == "" {
+			name, skip, err = tarPathForNarHeader(&mappedHdr, root)
+			if err != nil {
+				return err
+			}
+		}
+
+		if keepRoot && hdr.Path == "/" {
+			name, skip = root, false
+		}
+
+		if skip {
+			continue
+		}
+
+		if err := checkStrictName(name); err != nil {
+			return err
+		}
+
+		if name, err = opts.utf8.apply(name); err != nil {
+			return err
+		}
+
+		if ok, err := opts.conflicts.add(name, hdr.Type == nar.TypeDirectory); err != nil || !ok {
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		switch hdr.Type {
+		case nar.TypeDirectory:
+			if err := writeTarDir(tw, name, opts.paxRecords(hdr.Path), opts.modTime(hdr.Path), opts); err != nil {
+				return err
+			}
+		case nar.TypeSymlink:
+			target, err := opts.utf8.apply(filepath.ToSlash(rewriteString(hdr.LinkTarget)))
+			if err != nil {
+				return fmt.Errorf("symlink %s: %w", mapped, err)
+			}
+
+			target, file, err := opts.symlinks.apply(mapped, target)
+			if err != nil {
+				return err
+			}
+
+			th := &tar.Header{
+				Name:       name,
+				Mode:       symlinkMode,
+				Linkname:   target,
+				ModTime:    opts.modTime(hdr.Path),
+				Typeflag:   tar.TypeSymlink,
+				PAXRecords: opts.paxRecords(hdr.Path),
+			}
+
+			if file {
+				th.Mode, th.Linkname, th.Typeflag = opts.modes.forFile(false), "", tar.TypeReg
+			}
+
+			if err := opts.setFormat(th); err != nil {
+				return err
+			}
+
+			if err := tw.WriteHeader(th); err != nil {
+				return fmt.Errorf("writing tar symlink header: %w", err)
+			}
+		case nar.TypeRegular:
+			th := &tar.Header{
+				Name:       name,
+				Mode:       opts.modes.forFile(hdr.Executable),
+				Size:       hdr.Size,
+				ModTime:    opts.modTime(hdr.Path),
+				Typeflag:   tar.TypeReg,
+				PAXRecords: opts.paxRecords(hdr.Path),
+			}
+
+			if err := opts.setFormat(th); err != nil {
+				return err
+			}
+
+			content := newRewriteReader(nr)
+
+			if opts.hardlinks || (opts.sparse && hdr.Size >= sparseMinHole) {
+				if err := writeBufferedTarFile(tw, out, th, content, hdr.Executable, opts, links); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if err := tw.WriteHeader(th); err != nil {
+				return fmt.Errorf("writing tar file header: %w", err)
+			}
+
+			if _, err := copyContentsN(tw, content, hdr.Size); err != nil {
+				return fmt.Errorf("copying file content: %w", err)
+			}
+		default:
+			return fmt.Errorf("unsupported nar node type %q", hdr.Type)
+		}
+	}
+
+	return nil
+}
+
+func writeTarDir(tw *tar.Writer, name string, pax map[string]string, mtime time.Time, opts *tarOptions) error {
+	if !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+
+	th := &tar.Header{
+		Name:       name,
+		Mode:       opts.modes.dir,
+		ModTime:    mtime,
+		Typeflag:   tar.TypeDir,
+		PAXRecords: pax,
+	}
+
+	if err := opts.setFormat(th); err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(th); err != nil {
+		return fmt.Errorf("writing tar dir header: %w", err)
+	}
+
+	return nil
+}
+
+// tarLinkKey identifies files that can share a tar hard link: the same
+// contents and the same executable bit.
+type tarLinkKey struct {
+	sum        [sha256.Size]byte
 	executable bool
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		printUsage()
-	}
+// writeBufferedTarFile writes a regular file whose contents have to be seen
+// before its header: as a hard link to an identical earlier file, or as a
+// sparse entry. links maps the files written so far to their tar names.
+func writeBufferedTarFile(tw *tar.Writer, out io.Writer, th *tar.Header, r io.Reader, executable bool, opts *tarOptions, links map[tarLinkKey]string) error {
+	return withScratch(r, th.Size, func(data []byte) error {
+		return writeTarFileData(tw, out, th, data, executable, opts, links)
+	})
+}
 
-	switch os.Args[1] {
-	case "nar2tar":
-		if err := runNarToTar(os.Args[2:]); err != nil {
-			exitErr(err)
+// writeTarFileData writes a regular file with the contents data for
+// writeBufferedTarFile.
+func writeTarFileData(tw *tar.Writer, out io.Writer, th *tar.Header, data []byte, executable bool, opts *tarOptions, links map[tarLinkKey]string) error {
+	if opts.hardlinks && len(data) > 0 {
+		key := tarLinkKey{sum: sha256.Sum256(data), executable: executable}
+
+		if first, ok := links[key]; ok {
+			lh := &tar.Header{
+				Name:     th.Name,
+				Mode:     th.Mode,
+				Linkname: first,
+				ModTime:  th.ModTime,
+				Typeflag: tar.TypeLink,
+			}
+
+			if err := opts.setFormat(lh); err != nil {
+				return err
+			}
+
+			if err := tw.WriteHeader(lh); err != nil {
+				return fmt.Errorf("writing tar hard link header: %w", err)
+			}
+
+			return nil
 		}
-	case "tar2nar":
-		if err := runTarToNar(os.Args[2:]); err != nil {
-			exitErr(err)
+
+		links[key] = th.Name
+	}
+
+	if opts.sparse {
+		if frags := sparseFragments(data); frags != nil {
+			if err := writeSparseEntry(tw, out, th, data, frags); err != nil {
+				return fmt.Errorf("writing sparse tar entry: %w", err)
+			}
+
+			return nil
 		}
-	case "-h", "--help", "help":
-		printUsage()
-	default:
-		exitErr(fmt.Errorf("unknown command %q", os.Args[1]))
 	}
-}
 
-func printUsage() {
-	fmt.Fprintf(os.Stderr, "Usage:\n")
-	fmt.Fprintf(os.Stderr, "  nartar nar2tar -i input.nar -o output.tar\n")
-	fmt.Fprintf(os.Stderr, "  nartar tar2nar -i input.tar -o output.nar\n")
-	fmt.Fprintf(os.Stderr, "Use '-' for stdin/stdout. Timestamps are normalized to the Unix epoch.\n")
-	os.Exit(2)
+	if err := tw.WriteHeader(th); err != nil {
+		return fmt.Errorf("writing tar file header: %w", err)
+	}
+
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("copying file content: %w", err)
+	}
+
+	return nil
 }
 
-func runNarToTar(args []string) error {
-	fs := flag.NewFlagSet("nar2tar", flag.ContinueOnError)
-	input := fs.String("i", "-", "input NAR file ('-' for stdin)")
-	output := fs.String("o", "-", "output tar file ('-' for stdout)")
-	fs.SetOutput(io.Discard)
-	if err := fs.Parse(args); err != nil {
-		return err
+// tarToNar converts the members of a tarball below root, as produced by
+// nar2tar, into a NAR. PAX records without a place in the NAR are reported or
+// written to sidecarName as requested, along with the entry mtimes if
+// preserveMtime is set.
+func tarToNar(in io.Reader, out io.Writer, root string, pax string, sidecarName string, preserveMtime bool, opts *readOptions) error {
+	if pax != paxIgnore && pax != paxReport {
+		return fmt.Errorf("unsupported -pax mode %q", pax)
 	}
 
-	in, err := openInput(*input)
-	if err != nil {
-		return err
+	if preserveMtime && sidecarName == "" {
+		return fmt.Errorf("-preserve-mtime needs a -sidecar file to record the mtimes in")
 	}
-	defer in.Close()
 
-	out, err := openOutput(*output)
-	if err != nil {
-		return err
+	entries := newEntryTree()
+
+	// The archive read and the subpaths found are this conversion's, as
+	// batch conversions may run at once.
+	o := *opts
+	o.paths = opts.paths.clone()
+	opts = &o
+
+	tr := tar.NewReader(in)
+	if opts.archive = openSeekableTar(in); opts.archive != nil {
+		tr = tar.NewReader(opts.archive)
 	}
-	defer out.Close()
 
-	return narToTar(in, out)
-}
+	if opts.assumeSorted {
+		return streamTarToNar(tr, out, root, pax, sidecarName, preserveMtime, opts)
+	}
 
-func runTarToNar(args []string) error {
-	fs := flag.NewFlagSet("tar2nar", flag.ContinueOnError)
-	input := fs.String("i", "-", "input tar file ('-' for stdin)")
-	output := fs.String("o", "-", "output NAR file ('-' for stdout)")
-	fs.SetOutput(io.Discard)
-	if err := fs.Parse(args); err != nil {
+	if err := readTarEntries(tr, root, entries, opts); err != nil {
 		return err
 	}
 
-	in, err := openInput(*input)
-	if err != nil {
+	if err := opts.paths.checkSubpaths(); err != nil {
 		return err
 	}
-	defer in.Close()
 
-	out, err := openOutput(*output)
+	entries, err := opts.paths.addCaseHack(entries)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
 
-	return tarToNar(in, out)
+	return writeTarEntriesToNar(entries, out, pax, sidecarName, preserveMtime)
 }
 
-func openInput(name string) (io.ReadCloser, error) {
-	if name == "" || name == "-" {
-		return io.NopCloser(os.Stdin), nil
+// writeTarEntriesToNar writes the entries read from tarballs as a NAR, with
+// their PAX records and mtimes handled as for tarToNar.
+func writeTarEntriesToNar(entries *entryTree, out io.Writer, pax string, sidecarName string, preserveMtime bool) error {
+	if err := handleTarMetadata(entries, pax, sidecarName, preserveMtime); err != nil {
+		return err
 	}
 
-	return os.Open(name)
+	return writeNarEntries(entries, out)
 }
 
-type nopWriteCloser struct {
-	io.Writer
-}
+// handleTarMetadata reports the PAX records of entries or writes them and
+// the mtimes to the sidecar, as -pax, -sidecar and -preserve-mtime ask.
+func handleTarMetadata(entries *entryTree, pax string, sidecarName string, preserveMtime bool) error {
+	if pax == paxReport {
+		reportPAXRecords(os.Stderr, entries)
+	} else if sidecarName == "" {
+		if err := warnDroppedPAXRecords(entries); err != nil {
+			return err
+		}
+	}
 
-func (n nopWriteCloser) Close() error { return nil }
+	if sidecarName != "" {
+		s := newSidecar()
+		entries.walk(func(p string, e *tarEntry) error {
+			if len(e.pax) > 0 {
+				s.entry(p).PAX = e.pax
+			}
+
+			if preserveMtime && !e.mtime.IsZero() {
+				s.entry(p).Mtime = e.mtime.UTC().Format(time.RFC3339Nano)
+			}
 
-func openOutput(name string) (io.WriteCloser, error) {
-	if name == "" || name == "-" {
-		return nopWriteCloser{Writer: os.Stdout}, nil
+			return nil
+		})
+
+		if err := writeSidecar(sidecarName, s); err != nil {
+			return err
+		}
 	}
 
-	return os.Create(name)
+	return nil
 }
 
-func narToTar(in io.Reader, out io.Writer) error {
-	nr, err := nar.NewReader(in)
-	if err != nil {
-		return fmt.Errorf("opening nar: %w", err)
+// readTarEntries collects the tar members below root into entries.
+func readTarEntries(tr *tar.Reader, root string, entries *entryTree, opts *readOptions) error {
+	// Hard links are looked up in entries when the archive paths are kept,
+	// rather than the entries being held by their archive path as well.
+	var stored func(string) *tarEntry
+	if opts.paths.keepsPaths() {
+		stored = entries.get
 	}
-	defer nr.Close()
 
-	tw := tar.NewWriter(out)
-	defer tw.Close()
+	return scanTarEntries(tr, root, opts, stored, func(e *tarEntry) error {
+		return opts.addEntry(entries, e.path, e)
+	})
+}
+
+// scanTarEntries passes the tar members below root to add, in archive
+// order, with their NAR paths. add may store the entries it is passed in an
+// entryTree, which takes their paths. If stored is not nil, add stores the
+// entries it is passed by their archive path, and stored returns them.
+func scanTarEntries(tr *tar.Reader, root string, opts *readOptions, stored func(string) *tarEntry, add func(*tarEntry) error) error {
+	// Records from global PAX headers apply to all following entries.
+	var global map[string]string
+
+	// seen holds the entries read so far by their path in the archive, which
+	// hard links refer to before any -strip-components or -prefix, unless
+	// stored has them.
+	seen := newEntryTree()
+
+	// The entries of the archive are allocated together.
+	var slab entrySlab
+
+	// A tar of nothing but one regular file outside root, as nar2tar writes
+	// for a NAR holding a single file given another name, is that file.
+	var lone *tarEntry
+	members := 0
+
+	var counter limitCounter
+
+	// The root of a source tarball is its first top-level directory.
+	if opts.topDir {
+		root = ""
+	}
 
 	for {
-		hdr, err := nr.Next()
+		th, err := tr.Next()
 		if errors.Is(err, io.EOF) {
 			break
 		}
 
 		if err != nil {
-			return fmt.Errorf("reading nar header: %w", err)
+			return fmt.Errorf("reading tar: %w", err)
 		}
 
-		name, skip := tarPathForNarHeader(hdr)
-		if skip {
+		if th.Typeflag == tar.TypeXGlobalHeader {
+			for k, v := range extraPAXRecords(th.PAXRecords) {
+				if global == nil {
+					global = make(map[string]string)
+				}
+
+				global[k] = v
+			}
+
 			continue
 		}
 
-		switch hdr.Type {
-		case nar.TypeDirectory:
-			if !strings.HasSuffix(name, "/") {
-				name += "/"
-			}
+		logEntry(tarEntryKind(th.Typeflag), th.Name, th.Size, th.Linkname)
+		members++
 
-			th := &tar.Header{
-				Name:     name,
-				Mode:     dirMode,
-				ModTime:  zeroTime,
-				Typeflag: tar.TypeDir,
+		if opts.topDir {
+			top, rest, _ := strings.Cut(strings.Trim(strings.TrimPrefix(filepath.ToSlash(th.Name), "./"), "/"), "/")
+			if top == "" || top == "." {
+				continue
 			}
 
-			if err := tw.WriteHeader(th); err != nil {
-				return fmt.Errorf("writing tar dir header: %w", err)
-			}
-		case nar.TypeSymlink:
-			th := &tar.Header{
-				Name:     name,
-				Mode:     symlinkMode,
-				Linkname: filepath.ToSlash(hdr.LinkTarget),
-				ModTime:  zeroTime,
-				Typeflag: tar.TypeSymlink,
+			if root == "" {
+				root = top
 			}
 
-			if err := tw.WriteHeader(th); err != nil {
-				return fmt.Errorf("writing tar symlink header: %w", err)
-			}
-		case nar.TypeRegular:
-			th := &tar.Header{
-				Name:     name,
-				Mode:     pickFileMode(hdr.Executable),
-				Size:     hdr.Size,
-				ModTime:  zeroTime,
-				Typeflag: tar.TypeReg,
+			if top != root {
+				return fmt.Errorf("source tarball has more than one top-level entry: %q and %q", root, top)
 			}
 
-			if err := tw.WriteHeader(th); err != nil {
-				return fmt.Errorf("writing tar file header: %w", err)
+			if rest == "" && th.Typeflag != tar.TypeDir {
+				return fmt.Errorf("source tarball has %q at the top level instead of a directory", th.Name)
 			}
+		}
 
-			if _, err := io.CopyN(tw, nr, hdr.Size); err != nil {
-				return fmt.Errorf("copying file content: %w", err)
-			}
-		default:
-			return fmt.Errorf("unsupported nar node type %q", hdr.Type)
+		p, skip, err := opts.archivePath(th.Name, root)
+		if err != nil {
+			return fmt.Errorf("invalid tar entry path %q: %w", th.Name, err)
 		}
-	}
 
-	return tw.Close()
-}
+		if skip {
+			if members == 1 && root != "" && isSingleFileMember(th) {
+				if err := counter.file("/", th.Size); err != nil {
+					return err
+				}
+
+				lone = &tarEntry{
+					kind:  tar.TypeReg,
+					pax:   mergePAXRecords(global, extraPAXRecords(th.PAXRecords)),
+					mtime: th.ModTime,
+				}
+
+				head, err := opts.readFile(lone, tr, th)
+
+				// The file is only added once the end of the tarball shows
+				// it is alone, so it cannot be streamed.
+				if err == nil && lone.r != nil {
+					head, err = fileSpool.read(lone, lone.r, lone.size)
+					lone.r = nil
+				}
+
+				if err != nil {
+					return fmt.Errorf("reading tar file %q: %w", th.Name, err)
+				}
+
+				lone.executable = opts.isExecutable(th.FileInfo().Mode()&0o111 != 0, head)
+			}
 
-func tarToNar(in io.Reader, out io.Writer) error {
-	tr := tar.NewReader(in)
+			continue
+		}
 
-	entries := make(map[string]*tarEntry)
+		archivePath := p
 
-	for {
-		th, err := tr.Next()
-		if errors.Is(err, io.EOF) {
-			break
-		}
+		p, keep := opts.paths.apply(archivePath)
 
-		if err != nil {
-			return fmt.Errorf("reading tar: %w", err)
+		if err := counter.entry(p); err != nil {
+			return err
 		}
 
-		p, skip, err := normalizeTarPath(th.Name)
-		if err != nil {
-			return fmt.Errorf("invalid tar entry path %q: %w", th.Name, err)
-		}
+		isFile := th.Typeflag == tar.TypeReg || th.Typeflag == tar.TypeRegA ||
+			th.Typeflag == tar.TypeGNUSparse || th.Typeflag == tar.TypeLink
 
-		if skip {
+		// Filtered out files are still read, as hard links may point at them.
+		if !keep && !isFile {
 			continue
 		}
 
-		ensureParentDirs(p, entries)
+		pax := mergePAXRecords(global, extraPAXRecords(th.PAXRecords))
+
+		var entry *tarEntry
 
 		switch th.Typeflag {
 		case tar.TypeDir:
-			entries[p] = &tarEntry{path: p, kind: tar.TypeDir}
+			entry = slab.entry(tarEntry{path: p, kind: tar.TypeDir, pax: pax, mtime: th.ModTime})
 		case tar.TypeSymlink:
-			entries[p] = &tarEntry{
+			target, file, err := opts.symlinkTarget(p, filepath.ToSlash(th.Linkname))
+			if err != nil {
+				return err
+			}
+
+			entry = slab.entry(tarEntry{
 				path:       p,
 				kind:       tar.TypeSymlink,
-				linkTarget: filepath.ToSlash(th.Linkname),
+				linkTarget: target,
+				pax:        pax,
+				mtime:      th.ModTime,
+			})
+
+			if file {
+				entry.kind = tar.TypeReg
 			}
-		case tar.TypeReg, tar.TypeRegA:
-			data, err := io.ReadAll(tr)
+		case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+			// archive/tar expands the holes of GNU and PAX sparse files to
+			// zeros, which is how the NAR has to store them.
+			if err := counter.file(p, th.Size); err != nil {
+				return err
+			}
+
+			entry = slab.entry(tarEntry{path: p, kind: tar.TypeReg, pax: pax, mtime: th.ModTime})
+
+			head, err := opts.readFile(entry, tr, th)
 			if err != nil {
 				return fmt.Errorf("reading tar file %q: %w", th.Name, err)
 			}
 
-			executable := th.FileInfo().Mode()&0o111 != 0
+			entry.executable = opts.isExecutable(th.FileInfo().Mode()&0o111 != 0, head)
+		case tar.TypeLink:
+			// NARs have no hard links, so the link becomes a copy of the
+			// file it points at, which must appear earlier in the stream.
+			target, skip, err := opts.archivePath(th.Linkname, root)
+			if err != nil || skip {
+				return fmt.Errorf("tar hard link %q points outside the archive root: %q", th.Name, th.Linkname)
+			}
+
+			linked := seen.get(target)
+			if linked == nil && stored != nil {
+				linked = stored(target)
+			}
+			if linked == nil {
+				return fmt.Errorf("tar hard link %q points to %q, which was not seen before it", th.Name, th.Linkname)
+			}
 
-			entries[p] = &tarEntry{
-				path:       p,
-				kind:       tar.TypeReg,
-				data:       data,
-				executable: executable,
+			if linked.kind == tar.TypeDir {
+				return fmt.Errorf("tar hard link %q points to directory %q", th.Name, th.Linkname)
+			}
+
+			if linked.r != nil {
+				return fmt.Errorf("tar hard link %q cannot copy %q, which was streamed; with -assume-sorted, read the tarball from a file", th.Name, th.Linkname)
+			}
+
+			// The copy takes as much room in the NAR as the file.
+			size := linked.size
+			if linked.data != nil {
+				size = int64(len(linked.data))
 			}
-		case tar.TypeXHeader, tar.TypeXGlobalHeader, tar.TypeGNULongLink, tar.TypeGNULongName:
+
+			if err := counter.file(p, size); err != nil {
+				return err
+			}
+
+			entry = fileSpool.link(linked)
+			entry.path = p
+			entry.pax = mergePAXRecords(linked.pax, pax)
+			entry.mtime = th.ModTime
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if entry, err = opts.specialEntry(th.Name, tarSpecialKind(th.Typeflag), p); err != nil {
+				return err
+			}
+		case tar.TypeXHeader, tar.TypeGNULongLink, tar.TypeGNULongName:
 			// Ignore extended headers we don't need for NAR data.
 		default:
 			return fmt.Errorf("unsupported tar entry %q with type %v", th.Name, th.Typeflag)
 		}
-	}
 
-	rootEntry := entries["/"]
+		if entry == nil {
+			continue
+		}
+
+		if keep {
+			if err := add(entry); err != nil {
+				return err
+			}
+		}
 
-	paths := make([]string, 0, len(entries))
-	for p := range entries {
-		if p != "/" {
-			paths = append(paths, p)
+		if !keep || stored == nil {
+			seen.set(archivePath, entry)
 		}
 	}
-	sort.Strings(paths)
 
-	nw, err := nar.NewWriter(out)
-	if err != nil {
-		return fmt.Errorf("creating nar writer: %w", err)
+	if lone != nil && members == 1 {
+		if p, keep := opts.paths.apply("/"); keep {
+			lone.path = p
+			return add(lone)
+		}
 	}
 
-	if rootEntry != nil {
-		if rootEntry.kind != tar.TypeDir && len(paths) > 0 {
-			return fmt.Errorf("root file with additional entries is not supported")
-		}
+	return nil
+}
 
-		if err := writeNarEntry(nw, rootEntry); err != nil {
-			return fmt.Errorf("writing nar root: %w", err)
-		}
-	} else {
-		if err := nw.WriteHeader(&nar.Header{Path: "/", Type: nar.TypeDirectory}); err != nil {
-			return fmt.Errorf("writing nar root: %w", err)
+// isSingleFileMember reports whether th is a regular file at the top of the
+// tarball, which a tar holding nothing else is read as a NAR of.
+func isSingleFileMember(th *tar.Header) bool {
+	switch th.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+	default:
+		return false
+	}
+
+	name := strings.Trim(strings.TrimPrefix(filepath.ToSlash(th.Name), "./"), "/")
+
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// writeNarEntries writes the collected entries as a NAR in canonical order.
+// A missing root entry is written as an empty directory.
+func writeNarEntries(entries *entryTree, out io.Writer) error {
+	if root := entries.get("/"); root == nil {
+		entries.set("/", &tarEntry{kind: tar.TypeDir})
+	} else if root.kind != tar.TypeDir && len(entries.root.children) > 0 {
+		return fmt.Errorf("root file with additional entries is not supported")
+	}
+
+	// With -resume the entries the NAR file holds are replayed, and a
+	// checkpoint is recorded as the others are written.
+	resume := resumeOutput(out)
+	done := 0
+
+	if resume != nil {
+		var err error
+		if done, err = resume.begin(narEntriesDigest(entries)); err != nil {
+			return err
 		}
 	}
 
-	for _, p := range paths {
-		entry := entries[p]
-		if entry == nil {
-			continue
+	nw, err := newNarFile(out)
+	if err != nil {
+		return err
+	}
+
+	i := 0
+
+	err = entries.walk(func(p string, entry *tarEntry) error {
+		i++
+
+		if i <= done {
+			if err := replayNarEntry(nw, entry); err != nil {
+				return fmt.Errorf("replaying nar for %q: %w", p, err)
+			}
+
+			if i == done {
+				return resume.resumed()
+			}
+
+			return nil
 		}
 
 		if err := writeNarEntry(nw, entry); err != nil {
+			if p == "/" {
+				return fmt.Errorf("writing nar root: %w", err)
+			}
+
 			return fmt.Errorf("writing nar for %q: %w", p, err)
 		}
+
+		if resume != nil {
+			return resume.checkpoint(i)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := nw.Close(); err != nil {
+		return err
+	}
+
+	if resume != nil {
+		return resume.finish()
 	}
 
-	return nw.Close()
+	return nil
 }
 
-func normalizeTarPath(name string) (string, bool, error) {
+// normalizeArchivePath maps an archive member name to a NAR path. Only
+// members below root are imported; an empty root maps the whole archive,
+// with "." becoming the NAR root directory.
+func normalizeArchivePath(name string, root string) (string, bool, error) {
 	name = filepath.ToSlash(name)
 
 	if strings.Contains(name, "\x00") {
@@ -318,16 +1867,23 @@ func normalizeTarPath(name string) (string, bool, error) {
 	name = strings.TrimPrefix(name, "./")
 
 	trimmed := strings.TrimPrefix(name, "/")
-	if trimmed == "" || trimmed == "." {
-		return "", true, nil
-	}
 
-	if !strings.HasPrefix(trimmed, "-") {
-		return "", true, nil
+	if root != "" {
+		if trimmed == "" || trimmed == "." {
+			return "", true, nil
+		}
+
+		if trimmed != root && !strings.HasPrefix(trimmed, root+"/") {
+			return "", true, nil
+		}
+
+		trimmed = strings.TrimPrefix(trimmed, root)
+		trimmed = strings.TrimPrefix(trimmed, "/")
 	}
 
-	trimmed = strings.TrimPrefix(trimmed, "-")
-	trimmed = strings.TrimPrefix(trimmed, "/")
+	if trimmed == "." {
+		trimmed = ""
+	}
 
 	clean := path.Clean("/" + trimmed)
 
@@ -342,17 +1898,6 @@ func normalizeTarPath(name string) (string, bool, error) {
 	return clean, false, nil
 }
 
-func ensureParentDirs(p string, entries map[string]*tarEntry) {
-	dir := path.Dir(p)
-	for dir != "/" && dir != "." {
-		if _, ok := entries[dir]; !ok {
-			entries[dir] = &tarEntry{path: dir, kind: tar.TypeDir}
-		}
-
-		dir = path.Dir(dir)
-	}
-}
-
 func pickFileMode(exec bool) int64 {
 	if exec {
 		return execFileMode
@@ -361,36 +1906,47 @@ func pickFileMode(exec bool) int64 {
 	return fileMode
 }
 
-func tarPathForNarHeader(hdr *nar.Header) (string, bool) {
+// tarPathForNarHeader maps a NAR path to a tar member name below root. An
+// empty root places the NAR contents at the top level of the tarball.
+func tarPathForNarHeader(hdr *nar.Header, root string) (string, bool, error) {
 	p := filepath.ToSlash(hdr.Path)
 
 	if p == "/" {
 		if hdr.Type == nar.TypeRegular {
-			return "-", false
+			if root == "" {
+				return "", false, fmt.Errorf("a NAR with a file at its root needs a root name or -single-file-name")
+			}
+
+			return root, false, nil
 		}
 
-		return "", true
+		return "", true, nil
 	}
 
 	trimmed := strings.TrimPrefix(p, "/")
 	if trimmed == "" {
-		return "", true
+		return "", true, nil
 	}
 
-	return path.Join("-", trimmed), false
+	return path.Join(root, trimmed), false, nil
 }
 
-func writeNarEntry(nw *nar.Writer, entry *tarEntry) error {
+func writeNarEntry(nw *narFile, entry *tarEntry) error {
 	switch entry.kind {
 	case tar.TypeDir:
 		return nw.WriteHeader(&nar.Header{Path: entry.path, Type: nar.TypeDirectory})
 	case tar.TypeSymlink:
+		entry.linkTarget = rewriteString(entry.linkTarget)
+		referenceScan.scanEntry([]byte(entry.linkTarget))
+
 		return nw.WriteHeader(&nar.Header{
 			Path:       entry.path,
 			Type:       nar.TypeSymlink,
 			LinkTarget: entry.linkTarget,
 		})
 	case tar.TypeReg:
+		fileSpool.release(entry)
+
 		h := &nar.Header{
 			Path:       entry.path,
 			Type:       nar.TypeRegular,
@@ -398,10 +1954,21 @@ func writeNarEntry(nw *nar.Writer, entry *tarEntry) error {
 			Executable: entry.executable,
 		}
 
+		if entry.src != nil || entry.r != nil {
+			h.Size = entry.size
+		}
+
 		if err := nw.WriteHeader(h); err != nil {
 			return err
 		}
 
+		if entry.src != nil || entry.r != nil {
+			return writeEntryContents(nw, entry)
+		}
+
+		entry.data = rewriteStorePaths(entry.data)
+		referenceScan.scanEntry(entry.data)
+
 		_, err := nw.Write(entry.data)
 		return err
 	default:
@@ -409,7 +1976,42 @@ func writeNarEntry(nw *nar.Writer, entry *tarEntry) error {
 	}
 }
 
+func tarSpecialKind(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeChar:
+		return "character device"
+	case tar.TypeBlock:
+		return "block device"
+	default:
+		return "FIFO"
+	}
+}
+
+// warnf reports a problem that did not stop the conversion.
+func warnf(format string, args ...interface{}) {
+	if verbosity < 0 {
+		return
+	}
+
+	clearProgress()
+	fmt.Fprintf(os.Stderr, "warning: "+format+"\n", args...)
+}
+
 func exitErr(err error) {
+	removeCAOutputs()
+	fileSpool.remove()
+	stopProfiling()
+
+	// -h has printed the flags of the command already.
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+
+	if errors.Is(err, errNoClobber) {
+		warnf("%v", err)
+		os.Exit(0)
+	}
+
 	fmt.Fprintf(os.Stderr, "error: %v\n", err)
 	os.Exit(1)
 }
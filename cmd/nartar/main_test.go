@@ -0,0 +1,211 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"flag"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// tarMember is a member of the tarballs the tests build, with its contents.
+type tarMember struct {
+	name string
+	kind byte
+	data string
+}
+
+// buildTar returns a tarball of members, in order. The data of a symlink or
+// hard link is its target.
+func buildTar(t *testing.T, members ...tarMember) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+
+	tw := tar.NewWriter(&b)
+
+	for _, m := range members {
+		th := &tar.Header{Name: m.name, Typeflag: m.kind, Mode: 0o644}
+
+		switch m.kind {
+		case tar.TypeDir:
+			th.Mode = 0o755
+		case tar.TypeSymlink, tar.TypeLink:
+			th.Linkname = m.data
+		default:
+			th.Size = int64(len(m.data))
+		}
+
+		if err := tw.WriteHeader(th); err != nil {
+			t.Fatal(err)
+		}
+
+		if th.Size > 0 {
+			if _, err := tw.Write([]byte(m.data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+func TestTarDuplicates(t *testing.T) {
+	dir := func(name string) tarMember { return tarMember{name: name, kind: tar.TypeDir} }
+	file := func(name, data string) tarMember { return tarMember{name: name, kind: tar.TypeReg, data: data} }
+	link := func(name, target string) tarMember { return tarMember{name: name, kind: tar.TypeSymlink, data: target} }
+
+	root := testEntry{typ: nar.TypeDirectory}
+
+	tests := []struct {
+		desc       string
+		members    []tarMember
+		duplicates string
+		sorted     bool
+		want       map[string]testEntry
+		err        string
+	}{
+		{
+			desc:       "last file kept",
+			members:    []tarMember{file("a", "1"), file("a", "2")},
+			duplicates: conflictLast,
+			want:       map[string]testEntry{"/": root, "/a": {typ: nar.TypeRegular, data: "2"}},
+		},
+		{
+			desc:       "first file kept",
+			members:    []tarMember{file("a", "1"), file("a", "2")},
+			duplicates: conflictFirst,
+			want:       map[string]testEntry{"/": root, "/a": {typ: nar.TypeRegular, data: "1"}},
+		},
+		{
+			desc:       "file replaced by a symlink",
+			members:    []tarMember{file("a", "1"), link("a", "b")},
+			duplicates: conflictLast,
+			want:       map[string]testEntry{"/": root, "/a": {typ: nar.TypeSymlink, target: "b"}},
+		},
+		{
+			desc:       "repeated directory",
+			members:    []tarMember{dir("a/"), file("a/b", "1"), dir("a/")},
+			duplicates: conflictLast,
+			want:       map[string]testEntry{"/": root, "/a": {typ: nar.TypeDirectory}, "/a/b": {typ: nar.TypeRegular, data: "1"}},
+		},
+		{
+			desc:       "duplicates refused",
+			members:    []tarMember{file("a", "1"), file("a", "2")},
+			duplicates: conflictError,
+			err:        "more than once",
+		},
+		{
+			desc:       "directory then file, keeping the last",
+			members:    []tarMember{dir("a/"), file("a", "1")},
+			duplicates: conflictLast,
+			err:        "/a is both a directory and a regular entry",
+		},
+		{
+			desc:       "directory then file, keeping the first",
+			members:    []tarMember{dir("a/"), file("a", "1")},
+			duplicates: conflictFirst,
+			err:        "/a is both a directory and a regular entry",
+		},
+		{
+			desc:       "symlink then directory",
+			members:    []tarMember{link("a", "b"), dir("a/")},
+			duplicates: conflictLast,
+			err:        "/a is both a symlink and a directory entry",
+		},
+		{
+			desc:       "file then entry below it",
+			members:    []tarMember{file("a", "1"), file("a/b", "2")},
+			duplicates: conflictLast,
+			err:        "/a/b is below /a",
+		},
+		{
+			desc:       "entry below a path, then a file there",
+			members:    []tarMember{file("a/b", "1"), file("a", "2")},
+			duplicates: conflictLast,
+			err:        "entries below it",
+		},
+		{
+			desc:       "sorted, first file kept",
+			members:    []tarMember{file("a", "1"), file("a", "2")},
+			duplicates: conflictFirst,
+			sorted:     true,
+			want:       map[string]testEntry{"/": root, "/a": {typ: nar.TypeRegular, data: "1"}},
+		},
+		{
+			desc:       "sorted, directory then file",
+			members:    []tarMember{dir("a/"), file("a", "1")},
+			duplicates: conflictFirst,
+			sorted:     true,
+			err:        "/a is both a directory and a regular entry",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			opts := testReadOptions(t)
+			opts.duplicates = tt.duplicates
+			opts.assumeSorted = tt.sorted
+
+			var out bytes.Buffer
+
+			err := tarToNar(bytes.NewReader(buildTar(t, tt.members...)), &out, "", paxIgnore, "", false, opts)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want an error with %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkEntries(t, readNar(t, out.Bytes()), tt.want)
+		})
+	}
+}
+
+func TestDuplicatesFlag(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+		err  string
+	}{
+		{want: conflictLast},
+		{args: []string{"-duplicates", "first"}, want: conflictFirst},
+		{args: []string{"-duplicates", "error"}, want: conflictError},
+		{args: []string{"-duplicates", "last"}, want: conflictLast},
+		{args: []string{"-duplicates", "rename"}, err: `unsupported -duplicates policy "rename"`},
+	}
+
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+
+		opts := addReadOptionFlags(fs)
+
+		err := fs.Parse(tt.args)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.args, err, tt.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", tt.args, err)
+		} else if opts.duplicates != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.args, opts.duplicates, tt.want)
+		}
+	}
+}
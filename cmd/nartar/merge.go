@@ -0,0 +1,432 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// How entries at the same path in several inputs are resolved.
+const (
+	conflictError = "error"
+	conflictFirst = "first"
+	conflictLast  = "last"
+)
+
+// inputExtensions are dropped from input file names to name the directory
+// that holds their contents when several inputs are combined.
+var inputExtensions = map[string]bool{
+	".nar": true, ".tar": true, ".tgz": true, ".gz": true, ".xz": true,
+	".zst": true, ".bz2": true, ".lz4": true,
+}
+
+func addConflictFlag(fs *flag.FlagSet) *string {
+	policy := conflictError
+
+	fs.Func("conflict", "with several inputs, what to do with a path found in more than one: error, first or last", func(v string) error {
+		switch v {
+		case conflictError, conflictFirst, conflictLast:
+			policy = v
+			return nil
+		default:
+			return fmt.Errorf("unsupported conflict policy %q", v)
+		}
+	})
+
+	return &policy
+}
+
+// runMultiConversion is runConversion, with open in place of openOutput, for
+// commands that may accept several inputs, given as repeated -i flags or
+// positional arguments, of which the last is the output unless -o is given. A
+// single input is passed to convert; several are passed to convertAll by
+// name, with the NAR framing options for it to apply to each. Commands
+// without convertAll take a single input.
+//
+// With -output-template every argument is an input, and each is converted on
+// its own to the output the template names, -jobs of them at once. convert is
+// also given the name of the output.
+func runMultiConversion(fs *flag.FlagSet, args []string, side narSide, open func(string) (io.WriteCloser, error), convert func(io.Reader, io.Writer, string) error, convertAll func([]string, *narFormatOptions, io.Writer) error) error {
+	var inputs stringList
+
+	fs.Var(&inputs, "input", "input file ('-' for stdin; repeatable)")
+	fs.Var(&inputs, "i", "shorthand for -input")
+	output := fs.String("output", "-", "output file ('-' for stdout)")
+	fs.StringVar(output, "o", "-", "shorthand for -output")
+	narFormat := addNarFormatFlags(fs, side)
+	narFormat.expect = addExpectedHashFlags(fs, true)
+	fs.StringVar(&narFormat.index, "write-index", "", "also write the .ls listing of the NAR, with the offset of every file in it, to this file for cat -index")
+	fs.StringVar(&narFormat.sums, "write-hashes", "", "also write the hash and size of the NAR and of the output file, as narinfo lines, to this file")
+
+	var template *outputTemplate
+
+	fs.Func("output-template", "convert each input to its own output named by this template, e.g. out/{dir}/{name}.tar", func(v string) (err error) {
+		template, err = parseOutputTemplate(v)
+		return err
+	})
+
+	jobs := 1
+
+	fs.Func("jobs", "with -output-template, convert this many inputs at once (default 1)", func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("-jobs must be a positive number")
+		}
+
+		jobs = n
+
+		return nil
+	})
+
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if err := narFormat.checkIndexFlags(); err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if set["jobs"] && template == nil {
+		return fmt.Errorf("-jobs needs -output-template")
+	}
+
+	if template != nil {
+		if set["output"] || set["o"] {
+			return fmt.Errorf("-o cannot be combined with -output-template")
+		}
+
+		inputs = append(inputs, positional...)
+		if len(inputs) == 0 {
+			return fmt.Errorf("-output-template needs input files")
+		}
+
+		if narFormat.expect.any() {
+			return fmt.Errorf("-expected-narhash and -expected-filehash check a single output, not -output-template")
+		}
+
+		if narFormat.index != "" {
+			return fmt.Errorf("-write-index indexes a single NAR, not -output-template")
+		}
+
+		if narFormat.sums != "" {
+			return fmt.Errorf("-write-hashes hashes a single output, not -output-template")
+		}
+
+		return convertBatch(inputs, template, jobs, side, narFormat, open, convert)
+	}
+
+	if !set["output"] && !set["o"] && len(positional) > 0 && (len(positional) > 1 || len(inputs) > 0) {
+		*output = positional[len(positional)-1]
+		positional = positional[:len(positional)-1]
+	}
+
+	inputs = append(inputs, positional...)
+
+	if len(inputs) <= 1 {
+		input := "-"
+		if len(inputs) == 1 {
+			input = inputs[0]
+		}
+
+		return convertFile(input, *output, side, narFormat, open, convert)
+	}
+
+	if convertAll == nil {
+		return fmt.Errorf("%s converts a single input; use -output-template to convert several", fs.Name())
+	}
+
+	for _, name := range inputs {
+		if isStdio(name) {
+			return fmt.Errorf("stdin cannot be one of several inputs")
+		}
+	}
+
+	if side == narInput && narFormat.expect.nar != nil {
+		return fmt.Errorf("-expected-narhash checks a single input NAR")
+	}
+
+	if side == narInput && narFormat.index != "" {
+		return fmt.Errorf("-write-index indexes a single input NAR")
+	}
+
+	if side == narInput && narFormat.sums != "" {
+		return fmt.Errorf("-write-hashes hashes a single input NAR")
+	}
+
+	out, err := open(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var sums *conversionSums
+	if narFormat.sums != "" {
+		sums = newConversionSums()
+	}
+
+	finish := func() error { return nil }
+	w := sums.hashFile(narFormat.expect.output(out))
+
+	if side == narOutput {
+		if finish, err = narFormat.wrapOutput(w); err != nil {
+			return err
+		}
+
+		w = sums.hashNar(narFormat.expect.narOutput(w))
+	}
+
+	var index *narIndexer
+
+	if narFormat.index != "" {
+		index = newNarIndexer()
+		defer index.stop()
+
+		w = io.MultiWriter(w, index)
+	}
+
+	if err := convertAll(inputs, narFormat, w); err != nil {
+		return err
+	}
+
+	if err := finish(); err != nil {
+		return err
+	}
+
+	if index != nil {
+		if err := index.write(narFormat.index); err != nil {
+			return err
+		}
+	}
+
+	if err := narFormat.expect.verify(*output); err != nil {
+		return err
+	}
+
+	if sums != nil {
+		return sums.write(narFormat.sums)
+	}
+
+	return nil
+}
+
+// forEachInput opens the inputs in turn and calls fn with each. narFormat, if
+// not nil, strips the NAR framing of every input.
+func forEachInput(names []string, narFormat *narFormatOptions, fn func(name string, in io.Reader) error) error {
+	for _, name := range names {
+		if err := convertInput(name, narFormat, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func convertInput(name string, narFormat *narFormatOptions, fn func(name string, in io.Reader) error) error {
+	in, err := openInput(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	finish := func() error { return nil }
+
+	if narFormat != nil {
+		if finish, err = narFormat.wrapInput(in, nil); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if err := fn(name, in); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	return finish()
+}
+
+// inputPrefix names the directory holding the contents of an input when
+// several are combined: its file name without archive extensions, so
+// foo.tar.zst becomes foo.
+func inputPrefix(name string) (string, error) {
+	base := filepath.Base(name)
+	for inputExtensions[filepath.Ext(base)] {
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+
+	if base == "" || base == "." || base == ".." || base == string(filepath.Separator) {
+		return "", fmt.Errorf("cannot derive a directory name from input %q", name)
+	}
+
+	return base, nil
+}
+
+// mergeSet tracks the paths written from several inputs and resolves the
+// conflicts between them. Directories found in more than one input are
+// merged; a directory never replaces a non-directory or the other way round,
+// except that with the first policy the later one is dropped along with its
+// contents. A nil mergeSet accepts every path.
+type mergeSet struct {
+	policy  string
+	dirs    map[string]bool // whether the path written is a directory
+	dropped map[string]bool // directories whose contents are skipped
+}
+
+func newMergeSet(policy string) *mergeSet {
+	return &mergeSet{
+		policy:  policy,
+		dirs:    make(map[string]bool),
+		dropped: make(map[string]bool),
+	}
+}
+
+// add reports whether an entry at p should be written.
+func (m *mergeSet) add(p string, dir bool) (bool, error) {
+	if m == nil {
+		return true, nil
+	}
+
+	p = strings.TrimSuffix(p, "/")
+
+	for d := path.Dir(p); d != "/" && d != "."; d = path.Dir(d) {
+		if m.dropped[d] {
+			return false, nil
+		}
+	}
+
+	wasDir, ok := m.dirs[p]
+	if !ok {
+		m.dirs[p] = dir
+		return true, nil
+	}
+
+	if wasDir && dir {
+		return false, nil
+	}
+
+	switch m.policy {
+	case conflictFirst:
+		if dir {
+			m.dropped[p] = true
+		}
+
+		return false, nil
+	case conflictLast:
+		if wasDir != dir {
+			return false, fmt.Errorf("%s is a directory in one input and not in another", p)
+		}
+
+		return true, nil
+	default:
+		return false, fmt.Errorf("%s is found in more than one input; use -conflict first or last to pick one", p)
+	}
+}
+
+// narsToTar writes several NARs into one tarball, each below a directory
+// named after its input inside root.
+func narsToTar(names []string, narFormat *narFormatOptions, out io.Writer, root string, conflict string, opts *tarOptions) error {
+	tw := tar.NewWriter(out)
+	defer tw.Close()
+
+	merged := *opts
+	merged.conflicts = newMergeSet(conflict)
+
+	err := forEachInput(names, narFormat, func(name string, in io.Reader) error {
+		prefix, err := inputPrefix(name)
+		if err != nil {
+			return err
+		}
+
+		return writeNarToTar(in, out, tw, path.Join(root, prefix), true, &merged)
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// narsToCommand is narToCommand for several NARs, each below a directory
+// named after its input inside root.
+func narsToCommand(names []string, narFormat *narFormatOptions, command string, root string, opts *tarOptions) error {
+	return forEachInput(names, narFormat, func(name string, in io.Reader) error {
+		prefix, err := inputPrefix(name)
+		if err != nil {
+			return err
+		}
+
+		return narToCommand(in, command, path.Join(root, prefix), opts)
+	})
+}
+
+// tarsToNar combines several tarballs into one NAR, with the members below
+// root of each placed in a directory named after its input.
+func tarsToNar(names []string, out io.Writer, root string, conflict string, pax string, sidecarName string, preserveMtime bool, opts *readOptions) error {
+	if pax != paxIgnore && pax != paxReport {
+		return fmt.Errorf("unsupported -pax mode %q", pax)
+	}
+
+	if preserveMtime && sidecarName == "" {
+		return fmt.Errorf("-preserve-mtime needs a -sidecar file to record the mtimes in")
+	}
+
+	if opts.assumeSorted {
+		return fmt.Errorf("-assume-sorted converts a single tarball")
+	}
+
+	entries := newEntryTree()
+	m := newMergeSet(conflict)
+
+	err := forEachInput(names, nil, func(name string, in io.Reader) error {
+		prefix, err := inputPrefix(name)
+		if err != nil {
+			return err
+		}
+
+		src := newEntryTree()
+		if err := readTarEntries(tar.NewReader(in), root, src, opts); err != nil {
+			return err
+		}
+
+		return mergeEntries(entries, src, "/"+prefix, m)
+	})
+	if err != nil {
+		return err
+	}
+
+	entries, err = opts.paths.addCaseHack(entries)
+	if err != nil {
+		return err
+	}
+
+	return writeTarEntriesToNar(entries, out, pax, sidecarName, preserveMtime)
+}
+
+// mergeEntries moves the entries of src below prefix in dst.
+func mergeEntries(dst, src *entryTree, prefix string, m *mergeSet) error {
+	if src.get("/") == nil {
+		src.set("/", &tarEntry{kind: tar.TypeDir})
+	}
+
+	return src.walk(func(p string, e *tarEntry) error {
+		p = path.Join(prefix, p)
+
+		ok, err := m.add(p, e.kind == tar.TypeDir)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			dst.set(p, e)
+		}
+
+		return nil
+	})
+}
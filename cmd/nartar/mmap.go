@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/nar/ls"
+)
+
+// mmapInput is set by -mmap, which ls and cat accept: an uncompressed NAR
+// file is then memory-mapped, its listing read from the headers alone and
+// file contents served straight from the mapping.
+var mmapInput = false
+
+// mappedNar is a NAR file mapped into memory.
+type mappedNar struct {
+	b []byte
+}
+
+// mapNar maps the NAR file name into memory. It returns nil, to read the
+// file as usual, if -mmap is not given, the file is not a regular file
+// holding an uncompressed NAR, or the system cannot map it.
+func mapNar(name string) (*mappedNar, error) {
+	if !mmapInput {
+		return nil, nil
+	}
+
+	f := os.Stdin
+	if !isStdio(name) {
+		var err error
+		if f, err = os.Open(name); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.Mode().IsRegular() || fi.Size() < int64(8+len(narMagic)) || int64(int(fi.Size())) != fi.Size() {
+		return nil, nil
+	}
+
+	b, err := mapFile(f, int(fi.Size()))
+	if err != nil {
+		return nil, nil
+	}
+
+	if archiveFormat(b) != formatNar {
+		unmapFile(b)
+		return nil, nil
+	}
+
+	return &mappedNar{b: b}, nil
+}
+
+func (m *mappedNar) close() {
+	unmapFile(m.b)
+}
+
+// listing returns the listing of the NAR, read from its headers: the file
+// contents are skipped over, not read. The bytes scanned count for -stats,
+// skipped or not, as they do when a seekable tarball is read.
+func (m *mappedNar) listing() (*ls.Node, error) {
+	s := &narScanner{b: m.b}
+	b := newListingBuilder()
+
+	defer func() { atomic.AddInt64(&stats.bytesIn, s.off) }()
+
+	if err := s.expect(narMagic); err != nil {
+		return nil, err
+	}
+
+	if err := s.node("/", b); err != nil {
+		return nil, fmt.Errorf("reading NAR: %w", err)
+	}
+
+	return b.root, nil
+}
+
+// cat writes the contents of the file p to w from the mapping. They have
+// been counted for -stats with the rest of the NAR by the listing.
+func (m *mappedNar) cat(p string, w io.Writer) error {
+	root, err := m.listing()
+	if err != nil {
+		return err
+	}
+
+	n, err := lookupListing(root, p)
+	if err != nil {
+		return err
+	}
+
+	if n.Type != nar.TypeRegular {
+		return fmt.Errorf("not a regular file")
+	}
+
+	_, err = w.Write(m.b[n.NAROffset : n.NAROffset+n.Size])
+
+	return err
+}
+
+// narScanner reads the fields of a NAR held in memory.
+type narScanner struct {
+	b   []byte
+	off int64
+}
+
+// field returns the next field, a length followed by as many bytes padded
+// to a multiple of eight.
+func (s *narScanner) field() ([]byte, error) {
+	if int64(len(s.b))-s.off < 8 {
+		return nil, fmt.Errorf("unexpected end of NAR at offset %d", s.off)
+	}
+
+	n := binary.LittleEndian.Uint64(s.b[s.off:])
+	start := s.off + 8
+	left := uint64(int64(len(s.b)) - start)
+
+	if n > left || (n+7)&^7 > left {
+		return nil, fmt.Errorf("field of %d bytes at offset %d runs past the end of the NAR", n, s.off)
+	}
+
+	s.off = start + int64((n+7)&^7)
+
+	return s.b[start : start+int64(n)], nil
+}
+
+func (s *narScanner) token() (string, error) {
+	b, err := s.field()
+	return string(b), err
+}
+
+func (s *narScanner) expect(want string) error {
+	off := s.off
+
+	got, err := s.token()
+	if err != nil {
+		return err
+	}
+
+	if got != want {
+		return fmt.Errorf("expected %q at offset %d, found %q", want, off, got)
+	}
+
+	return nil
+}
+
+// node reads the node at the NAR path p and the nodes below it into b.
+func (s *narScanner) node(p string, b *listingBuilder) error {
+	if err := s.expect("("); err != nil {
+		return err
+	}
+
+	if err := s.expect("type"); err != nil {
+		return err
+	}
+
+	kind, err := s.token()
+	if err != nil {
+		return err
+	}
+
+	hdr := &nar.Header{Path: p}
+
+	switch kind {
+	case "regular":
+		hdr.Type = nar.TypeRegular
+
+		tok, err := s.token()
+		if err != nil {
+			return err
+		}
+
+		if tok == "executable" {
+			hdr.Executable = true
+
+			if err := s.expect(""); err != nil {
+				return err
+			}
+
+			if tok, err = s.token(); err != nil {
+				return err
+			}
+		}
+
+		if tok != "contents" {
+			return fmt.Errorf("expected \"contents\" in %s, found %q", p, tok)
+		}
+
+		// The contents follow their length.
+		offset := s.off + 8
+
+		contents, err := s.field()
+		if err != nil {
+			return err
+		}
+
+		hdr.Size = int64(len(contents))
+		b.add(hdr, offset)
+	case "symlink":
+		hdr.Type = nar.TypeSymlink
+
+		if err := s.expect("target"); err != nil {
+			return err
+		}
+
+		if hdr.LinkTarget, err = s.token(); err != nil {
+			return err
+		}
+
+		b.add(hdr, 0)
+	case "directory":
+		hdr.Type = nar.TypeDirectory
+		b.add(hdr, 0)
+
+		return s.entries(p, b)
+	default:
+		return fmt.Errorf("unknown node type %q in %s", kind, p)
+	}
+
+	return s.expect(")")
+}
+
+// entries reads the entries of the directory p, up to its closing ")".
+func (s *narScanner) entries(p string, b *listingBuilder) error {
+	last := ""
+
+	for {
+		tok, err := s.token()
+		if err != nil {
+			return err
+		}
+
+		if tok == ")" {
+			return nil
+		}
+
+		if tok != "entry" {
+			return fmt.Errorf("expected \"entry\" in %s, found %q", p, tok)
+		}
+
+		if err := s.expect("("); err != nil {
+			return err
+		}
+
+		if err := s.expect("name"); err != nil {
+			return err
+		}
+
+		name, err := s.token()
+		if err != nil {
+			return err
+		}
+
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+			return fmt.Errorf("invalid entry name %q in %s", name, p)
+		}
+
+		if last != "" && name <= last {
+			return fmt.Errorf("entry %q in %s is not after %q", name, p, last)
+		}
+
+		last = name
+
+		if err := s.expect("node"); err != nil {
+			return err
+		}
+
+		if err := s.node(path.Join(p, name), b); err != nil {
+			return err
+		}
+
+		if err := s.expect(")"); err != nil {
+			return err
+		}
+	}
+}
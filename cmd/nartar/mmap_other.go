@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Systems without mmap read the NAR as usual.
+func mapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("memory mapping is not supported")
+}
+
+func unmapFile(b []byte) {}
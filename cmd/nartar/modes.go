@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+)
+
+// modeMap holds the permission bits written for NAR entries, which carry no
+// permissions besides the executable flag.
+type modeMap struct {
+	dir  int64
+	file int64
+	exec int64 // -1 derives it from file
+}
+
+var defaultModes = modeMap{dir: dirMode, file: fileMode, exec: -1}
+
+// addModeFlags registers the permission flags on fs.
+func addModeFlags(fs *flag.FlagSet, m *modeMap) {
+	fs.Func("dir-mode", "octal permissions of directories (default 0555)", func(v string) error {
+		return parseMode(v, &m.dir)
+	})
+
+	fs.Func("file-mode", "octal permissions of regular files (default 0444)", func(v string) error {
+		return parseMode(v, &m.file)
+	})
+
+	fs.Func("exec-mode", "octal permissions of executable files (default -file-mode with x added where r is set)", func(v string) error {
+		return parseMode(v, &m.exec)
+	})
+}
+
+func parseMode(v string, mode *int64) error {
+	n, err := strconv.ParseInt(v, 8, 64)
+	if err != nil || n < 0 || n > 0o7777 {
+		return fmt.Errorf("invalid octal mode %q", v)
+	}
+
+	*mode = n
+
+	return nil
+}
+
+// forFile returns the permissions of a regular file.
+func (m modeMap) forFile(executable bool) int64 {
+	if !executable {
+		return m.file
+	}
+
+	if m.exec >= 0 {
+		return m.exec
+	}
+
+	return m.file | (m.file&0o444)>>2
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mtimeLayouts are the date formats accepted by -mtime besides @seconds.
+// Dates without a zone are taken as UTC.
+var mtimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// addMtimeFlag registers -mtime, which sets the timestamp written for every
+// entry. Without the flag, t keeps its value, the Unix epoch by default, unless
+// parseFlags sets it from SOURCE_DATE_EPOCH.
+func addMtimeFlag(fs *flag.FlagSet, t *time.Time) {
+	fs.Func("mtime", "timestamp for all entries, as @seconds or a date like 2024-01-02 or 2024-01-02T15:04:05Z (default $SOURCE_DATE_EPOCH, or the Unix epoch)", func(v string) error {
+		parsed, err := parseMtime(v)
+		if err != nil {
+			return err
+		}
+
+		*t = parsed
+
+		return nil
+	})
+}
+
+// applySourceDateEpoch sets -mtime from SOURCE_DATE_EPOCH when fs has the flag
+// and it was given neither on the command line nor by the config file or
+// NARTAR_MTIME.
+func applySourceDateEpoch(fs *flag.FlagSet) error {
+	v := os.Getenv("SOURCE_DATE_EPOCH")
+	if v == "" || fs.Lookup("mtime") == nil {
+		return nil
+	}
+
+	set := false
+	fs.Visit(func(f *flag.Flag) { set = set || f.Name == "mtime" })
+
+	if set {
+		return nil
+	}
+
+	// As the reproducible builds specification asks, a malformed value is an
+	// error rather than silently ignored.
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("SOURCE_DATE_EPOCH %q is not a non-negative number of seconds", v)
+	}
+
+	return fs.Set("mtime", "@"+strconv.FormatInt(n, 10))
+}
+
+func parseMtime(v string) (time.Time, error) {
+	if secs, ok := strings.CutPrefix(v, "@"); ok {
+		n, err := strconv.ParseInt(secs, 10, 64)
+		if err != nil || n < 0 {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q: want non-negative @seconds", v)
+		}
+
+		return time.Unix(n, 0).UTC(), nil
+	}
+
+	for _, layout := range mtimeLayouts {
+		t, err := time.Parse(layout, v)
+		if err != nil {
+			continue
+		}
+
+		if t.Before(zeroTime) {
+			return time.Time{}, fmt.Errorf("timestamp %q is before the Unix epoch", v)
+		}
+
+		return t.Truncate(time.Second).UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid timestamp %q: want @seconds or a date like 2024-01-02T15:04:05Z", v)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestSourceDateEpoch(t *testing.T) {
+	withoutConfig(t)
+
+	tests := []struct {
+		desc  string
+		epoch string
+		env   string
+		args  []string
+		want  int64
+		err   bool
+		help  bool
+	}{
+		{desc: "unset", want: 0},
+		{desc: "from SOURCE_DATE_EPOCH", epoch: "86400", want: 86400},
+		{desc: "-mtime wins", epoch: "86400", args: []string{"-mtime", "@5"}, want: 5},
+		{desc: "NARTAR_MTIME wins", epoch: "86400", env: "@7", want: 7},
+		{desc: "malformed", epoch: "abc", err: true},
+		{desc: "negative", epoch: "-1", err: true},
+		{desc: "malformed but unused", epoch: "abc", args: []string{"-mtime", "@5"}, want: 5},
+		{desc: "malformed with -h", epoch: "abc", args: []string{"-h"}, help: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Setenv("SOURCE_DATE_EPOCH", tt.epoch)
+			t.Setenv("NARTAR_MTIME", tt.env)
+
+			fs := flag.NewFlagSet("nar2cpio", flag.ContinueOnError)
+			mtime := zeroTime
+			addMtimeFlag(fs, &mtime)
+
+			_, err := parseFlags(fs, tt.args)
+
+			switch {
+			case tt.help:
+				if !errors.Is(err, flag.ErrHelp) {
+					t.Errorf("got %v, want the help", err)
+				}
+			case tt.err:
+				if err == nil {
+					t.Errorf("no error, mtime %v", mtime)
+				}
+			case err != nil:
+				t.Error(err)
+			case !mtime.Equal(time.Unix(tt.want, 0)):
+				t.Errorf("mtime %v, want %v", mtime, time.Unix(tt.want, 0).UTC())
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// testEntry is a NAR entry as the round-trip tests compare them.
+type testEntry struct {
+	typ    nar.NodeType
+	exec   bool
+	data   string
+	target string
+}
+
+// testTree is the NAR the round-trip tests convert: an empty file, an
+// executable, symlinks, an empty directory and two identical files, which
+// must stay apart.
+var testTree = map[string]testEntry{
+	"/":                    {typ: nar.TypeDirectory},
+	"/bin":                 {typ: nar.TypeDirectory},
+	"/bin/hello":           {typ: nar.TypeRegular, exec: true, data: "#!/bin/sh\necho hello\n"},
+	"/bin/hi":              {typ: nar.TypeSymlink, target: "hello"},
+	"/empty":               {typ: nar.TypeRegular},
+	"/emptydir":            {typ: nar.TypeDirectory},
+	"/share":               {typ: nar.TypeDirectory},
+	"/share/doc":           {typ: nar.TypeDirectory},
+	"/share/doc/README":    {typ: nar.TypeRegular, data: "hello, world\n"},
+	"/share/doc/README.md": {typ: nar.TypeRegular, data: "hello, world\n"},
+	"/share/doc/up":        {typ: nar.TypeSymlink, target: "../../bin/hello"},
+}
+
+// narOrder sorts paths in the order a NAR holds them: depth first, with the
+// entries of a directory by name.
+func narOrder(paths []string) {
+	sort.Slice(paths, func(i, j int) bool {
+		a, b := strings.Split(paths[i], "/"), strings.Split(paths[j], "/")
+
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+
+		return len(a) < len(b)
+	})
+}
+
+// buildNar returns the NAR holding entries.
+func buildNar(t *testing.T, entries map[string]testEntry) []byte {
+	t.Helper()
+
+	paths := make([]string, 0, len(entries))
+	for p := range entries {
+		paths = append(paths, p)
+	}
+
+	narOrder(paths)
+
+	var b bytes.Buffer
+
+	nw, err := nar.NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range paths {
+		e := entries[p]
+
+		h := &nar.Header{Path: p, Type: e.typ, Executable: e.exec, LinkTarget: e.target}
+		if e.typ == nar.TypeRegular {
+			h.Size = int64(len(e.data))
+		}
+
+		if err := nw.WriteHeader(h); err != nil {
+			t.Fatalf("writing %s: %v", p, err)
+		}
+
+		if _, err := io.WriteString(nw, e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := nw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+// readNar returns the entries of the NAR in b.
+func readNar(t *testing.T, b []byte) map[string]testEntry {
+	t.Helper()
+
+	nr, err := nar.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nr.Close()
+
+	entries := make(map[string]testEntry)
+
+	for {
+		h, err := nr.Next()
+		if errors.Is(err, io.EOF) {
+			return entries
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := io.ReadAll(nr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries[h.Path] = testEntry{typ: h.Type, exec: h.Executable, data: string(data), target: h.LinkTarget}
+	}
+}
+
+// checkEntries fails t where got differs from want.
+func checkEntries(t *testing.T, got, want map[string]testEntry) {
+	t.Helper()
+
+	for p, w := range want {
+		g, ok := got[p]
+		switch {
+		case !ok:
+			t.Errorf("%s is missing", p)
+		case g != w:
+			t.Errorf("%s is %+v, want %+v", p, g, w)
+		}
+	}
+
+	for p := range got {
+		if _, ok := want[p]; !ok {
+			t.Errorf("unexpected entry %s", p)
+		}
+	}
+}
+
+// testReadOptions returns the read options the commands have by default.
+func testReadOptions(t *testing.T) *readOptions {
+	t.Helper()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts := addReadOptionFlags(fs)
+
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return opts
+}
+
+// withoutConfig keeps the config file of whoever runs the tests out of the
+// flags parseFlags sets.
+func withoutConfig(t *testing.T) {
+	saved := loadedConfig
+	loadedConfig = &config{commands: make(map[string][]configEntry)}
+
+	t.Cleanup(func() { loadedConfig = saved })
+}
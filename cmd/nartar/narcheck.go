@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/wire"
+)
+
+const (
+	// narNameMax and narTargetMax bound the strings of a NAR, as in go-nix.
+	narNameMax   = 255
+	narTargetMax = 4096
+)
+
+// strictNar and fixNar are set by -strict and -fix on the commands reading
+// NARs. With -strict they reject malformed NARs instead of converting
+// whatever they can make of them; with -fix they sort unsorted directories.
+// decompressInput is set by -decompress, which decompresses their inputs.
+var (
+	strictNar       = false
+	fixNar          = false
+	decompressInput = false
+)
+
+// strictNames is set by -strict-names, which the commands reading archives
+// or NARs and writing tar accept, to reject paths holding newlines or other
+// control characters that could mislead the scripts and logs they end up in.
+var strictNames = false
+
+func addStrictNamesFlag(fs *flag.FlagSet) {
+	if fs.Lookup("strict-names") != nil {
+		return
+	}
+
+	fs.BoolVar(&strictNames, "strict-names", false, "reject paths holding newlines, tabs or other control characters")
+}
+
+func addNarCheckFlags(fs *flag.FlagSet) {
+	if fs.Lookup("strict") != nil {
+		return
+	}
+
+	fs.BoolVar(&strictNar, "strict", false, "reject NARs with unsorted or duplicate directory entries, or empty names or names with slashes")
+	fs.BoolVar(&fixNar, "fix", false, "accept NARs with unsorted directory entries and convert them as if sorted, reporting each directory fixed")
+	fs.BoolVar(&decompressInput, "decompress", false, "decompress inputs compressed with gzip, bzip2, xz, zstd or lzma")
+
+	addLimitFlags(fs)
+	addStrictNamesFlag(fs)
+}
+
+// newNarReader opens a NAR reader on r, which -strict or -fix check first.
+// Its entries are held to the -max-* limits.
+func newNarReader(r io.Reader) (*limitedNarReader, error) {
+	cr := checkedNar(r)
+
+	nr, err := nar.NewReader(cr)
+	if nn := notNar(err); nn != nil {
+		return nil, nn
+	}
+
+	if c, ok := cr.(*narChecker); ok && err != nil && c.err != nil {
+		// -fix only writes the NAR once it has read all of it.
+		return nil, c.err
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &limitedNarReader{Reader: nr}, nil
+}
+
+// narChecker reads a NAR as checked or fixed by -strict or -fix. err is the
+// reason the NAR was rejected, set before the reader fails.
+type narChecker struct {
+	*io.PipeReader
+	err error
+}
+
+// checkedNar returns r as it is, or with -strict a reader of the same NAR
+// that fails as soon as the NAR turns out to be malformed, or with -fix a
+// reader of the NAR made canonical. Like a NAR reader it reads r up to the
+// end of the NAR only. Input that is not a NAR fails with a notNarError.
+func checkedNar(r io.Reader) io.Reader {
+	r = &narSniffer{r: r}
+
+	if !strictNar && !fixNar {
+		return r
+	}
+
+	pr, pw := io.Pipe()
+	c := &narChecker{PipeReader: pr}
+
+	go func() {
+		switch {
+		case strictNar && fixNar:
+			c.err = fmt.Errorf("-strict and -fix cannot be combined")
+		case fixNar:
+			c.err = fixNarTo(r, pw)
+		default:
+			if err := checkNar(io.TeeReader(r, pw), nil); err != nil {
+				c.err = fmt.Errorf("-strict: %w", err)
+			}
+		}
+
+		pw.CloseWithError(c.err)
+	}()
+
+	return c
+}
+
+// rawNarNode is a node of a NAR read into memory for -fix.
+type rawNarNode struct {
+	typ        nar.NodeType
+	executable bool
+	contents   []byte
+	target     string
+	entries    []rawNarEntry
+}
+
+type rawNarEntry struct {
+	name string
+	node *rawNarNode
+}
+
+// fixNarTo reads a NAR from r into memory and writes it to w with the
+// entries of every directory sorted, reporting the directories it sorted.
+func fixNarTo(r io.Reader, w io.Writer) error {
+	root := &rawNarNode{}
+	if err := checkNar(r, root); err != nil {
+		return fmt.Errorf("-fix: %w", err)
+	}
+
+	nw, err := nar.NewWriter(w)
+	if err != nil {
+		return err
+	}
+
+	if err := writeRawNarNode(nw, "/", root); err != nil {
+		return err
+	}
+
+	return nw.Close()
+}
+
+func writeRawNarNode(nw *nar.Writer, p string, n *rawNarNode) error {
+	h := &nar.Header{Path: p, Type: n.typ, Executable: n.executable, LinkTarget: n.target}
+	if n.typ == nar.TypeRegular {
+		h.Size = int64(len(n.contents))
+	}
+
+	if err := nw.WriteHeader(h); err != nil {
+		return err
+	}
+
+	if _, err := nw.Write(n.contents); err != nil {
+		return err
+	}
+
+	for _, e := range n.entries {
+		if err := writeRawNarNode(nw, path.Join(p, e.name), e.node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkNar reads a NAR from r, checking that it is canonical in the ways
+// that the NAR reader lets pass: each directory lists its entries once, in
+// sorted order, under names that are valid file names. Given a root node,
+// it reads the NAR into it instead, sorting unsorted directories.
+func checkNar(r io.Reader, root *rawNarNode) error {
+	if err := expectNarToken(r, narMagic); err != nil {
+		return err
+	}
+
+	return checkNarNode(r, "/", root)
+}
+
+// checkNarNode reads the node at p, into n unless it is nil.
+func checkNarNode(r io.Reader, p string, n *rawNarNode) error {
+	if n == nil {
+		n = &rawNarNode{}
+	}
+
+	if err := expectNarToken(r, "("); err != nil {
+		return err
+	}
+
+	if err := expectNarToken(r, "type"); err != nil {
+		return err
+	}
+
+	typ, err := readNarToken(r, narNameMax)
+	if err != nil {
+		return err
+	}
+
+	n.typ = nar.NodeType(typ)
+
+	switch n.typ {
+	case nar.TypeRegular:
+		tok, err := readNarToken(r, narNameMax)
+		if err != nil {
+			return err
+		}
+
+		if tok == "executable" {
+			if err := expectNarToken(r, ""); err != nil {
+				return err
+			}
+
+			if tok, err = readNarToken(r, narNameMax); err != nil {
+				return err
+			}
+
+			n.executable = true
+		}
+
+		if tok != "contents" {
+			return fmt.Errorf("%s: expected contents, found %q", p, tok)
+		}
+
+		if err := readNarContents(r, p, n, fixNar); err != nil {
+			return err
+		}
+	case nar.TypeSymlink:
+		if err := expectNarToken(r, "target"); err != nil {
+			return err
+		}
+
+		if n.target, err = readNarToken(r, narTargetMax); err != nil {
+			return err
+		}
+	case nar.TypeDirectory:
+		var prev string
+		sorted := true
+
+		for first := true; ; first = false {
+			tok, err := readNarToken(r, narNameMax)
+			if err != nil {
+				return err
+			}
+
+			if tok == ")" {
+				if !sorted {
+					sort.Slice(n.entries, func(i, j int) bool { return n.entries[i].name < n.entries[j].name })
+
+					for i := 1; i < len(n.entries); i++ {
+						if n.entries[i].name == n.entries[i-1].name {
+							return fmt.Errorf("%s: duplicate entry %q", p, n.entries[i].name)
+						}
+					}
+
+					return warnCategory(warnNarFixed, "sorted the entries of %s", p)
+				}
+
+				return nil
+			}
+
+			if tok != "entry" {
+				return fmt.Errorf("%s: expected entry, found %q", p, tok)
+			}
+
+			for _, want := range []string{"(", "name"} {
+				if err := expectNarToken(r, want); err != nil {
+					return err
+				}
+			}
+
+			name, err := readNarToken(r, narNameMax)
+			if err != nil {
+				return err
+			}
+
+			if err := checkNarName(name); err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+
+			switch {
+			case !first && name == prev:
+				return fmt.Errorf("%s: duplicate entry %q", p, name)
+			case !first && name < prev && !fixNar:
+				return fmt.Errorf("%s: entry %q comes after %q, out of sorted order", p, name, prev)
+			case !first && name < prev:
+				sorted = false
+			}
+
+			prev = name
+
+			if err := expectNarToken(r, "node"); err != nil {
+				return err
+			}
+
+			var child *rawNarNode
+			if fixNar {
+				child = &rawNarNode{}
+				n.entries = append(n.entries, rawNarEntry{name: name, node: child})
+			}
+
+			if err := checkNarNode(r, path.Join(p, name), child); err != nil {
+				return err
+			}
+
+			if err := expectNarToken(r, ")"); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s: unknown node type %q", p, typ)
+	}
+
+	return expectNarToken(r, ")")
+}
+
+// readNarContents reads the contents of the regular file at p, into n if
+// keep is set.
+func readNarContents(r io.Reader, p string, n *rawNarNode, keep bool) error {
+	_, contents, err := wire.ReadBytes(r)
+	if err != nil {
+		return fmt.Errorf("%s: reading contents: %w", p, err)
+	}
+
+	dst := io.Discard
+
+	var buf bytes.Buffer
+	if keep {
+		dst = &buf
+	}
+
+	if _, err := copyContents(dst, contents); err != nil {
+		return fmt.Errorf("%s: reading contents: %w", p, err)
+	}
+
+	if err := contents.Close(); err != nil {
+		return fmt.Errorf("%s: reading contents: %w", p, err)
+	}
+
+	n.contents = buf.Bytes()
+
+	return nil
+}
+
+// checkStrictName rejects the path p if it holds a control character and
+// -strict-names is set.
+func checkStrictName(p string) error {
+	if !strictNames {
+		return nil
+	}
+
+	for _, r := range p {
+		if r < 0x20 || (r >= 0x7f && r < 0xa0) {
+			return fmt.Errorf("%q contains the control character %U; it is rejected with -strict-names", p, r)
+		}
+	}
+
+	return nil
+}
+
+// checkNarName rejects the names that Nix refuses to unpack.
+func checkNarName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("empty entry name")
+	case name == "." || name == "..":
+		return fmt.Errorf("invalid entry name %q", name)
+	case strings.ContainsAny(name, "/\x00"):
+		return fmt.Errorf("entry name %q contains a slash or NUL", name)
+	}
+
+	return nil
+}
+
+func readNarToken(r io.Reader, max uint64) (string, error) {
+	s, err := wire.ReadString(r, max)
+	if err != nil {
+		return "", fmt.Errorf("reading NAR: %w", err)
+	}
+
+	return s, nil
+}
+
+func expectNarToken(r io.Reader, want string) error {
+	got, err := readNarToken(r, narTargetMax)
+	if err != nil {
+		return err
+	}
+
+	if got != want {
+		return fmt.Errorf("expected %q in NAR, found %q", want, got)
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// narHeaderLen is the length of the magic a NAR starts with: the string
+// "nix-archive-1" in the wire format, with its length and padding.
+const narHeaderLen = 24
+
+// compressionTools name the compressions decompress recognizes, by magic,
+// with the command that undoes them.
+var compressionTools = []struct {
+	magic   []byte
+	article string
+	name    string
+	tool    string
+}{
+	{gzipMagic, "a", "gzip", "gzip -d"},
+	{bzip2Magic, "a", "bzip2", "bzip2 -d"},
+	{xzMagic, "an", "xz", "xz -d"},
+	{zstdMagic, "a", "zstd", "zstd -d"},
+	{lzmaMagic, "an", "lzma", "lzma -d"},
+}
+
+// notNarError reports an input that is not a NAR, saying what it looks
+// like instead.
+type notNarError struct {
+	msg string
+}
+
+func (e *notNarError) Error() string {
+	return e.msg
+}
+
+// notNar returns the notNarError in err, which says all there is to say
+// about a NAR that failed to open.
+func notNar(err error) error {
+	var nn *notNarError
+	if errors.As(err, &nn) {
+		return nn
+	}
+
+	return nil
+}
+
+// narSniffer passes a NAR on once it has checked its magic, and otherwise
+// fails with a notNarError. It reads no more of a NAR than the magic, so
+// that an export stream's trailer is left after it.
+type narSniffer struct {
+	r       io.Reader
+	checked bool
+}
+
+func (s *narSniffer) Read(p []byte) (int, error) {
+	if !s.checked {
+		s.checked = true
+
+		head := make([]byte, narHeaderLen)
+		n, err := io.ReadFull(s.r, head)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, err
+		}
+
+		if n < narHeaderLen || !isNarHeader(head) {
+			// Anything but a NAR may be read further, to tell what it is.
+			more := make([]byte, sniffLen-n)
+			m, _ := io.ReadFull(s.r, more)
+
+			return 0, &notNarError{msg: describeNotNar(append(head[:n], more[:m]...))}
+		}
+
+		s.r = io.MultiReader(bytes.NewReader(head), s.r)
+	}
+
+	return s.r.Read(p)
+}
+
+func isNarHeader(head []byte) bool {
+	return archiveFormat(head) == formatNar
+}
+
+// describeNotNar says what the input starting with head looks like, and
+// what to do with it, when a NAR was expected.
+func describeNotNar(head []byte) string {
+	if len(head) == 0 {
+		return "input is empty, not a NAR"
+	}
+
+	for _, c := range compressionTools {
+		if !bytes.HasPrefix(head, c.magic) {
+			continue
+		}
+
+		what := c.name + "-compressed data"
+		if inner := decompressedHead(head); inner != "" {
+			what = c.article + " " + c.name + "-compressed " + inner
+		}
+
+		return fmt.Sprintf("input is not a NAR but looks like %s; use --decompress or pipe it through %s", what, c.tool)
+	}
+
+	if len(head) >= 8+narHeaderLen && binary.LittleEndian.Uint64(head) == 1 && isNarHeader(head[8:]) {
+		return "input is not a NAR but looks like a nix-store --export stream; use -nar-format export"
+	}
+
+	switch archiveFormat(head) {
+	case formatTar:
+		return "input is not a NAR but looks like a tar archive; use tar2nar to make a NAR of it"
+	case formatCpio:
+		return "input is not a NAR but looks like a cpio archive; use cpio2nar to make a NAR of it"
+	case formatDeb:
+		return "input is not a NAR but looks like a deb package; use deb2nar to make a NAR of it"
+	case formatRPM:
+		return "input is not a NAR but looks like an rpm package; use rpm2nar to make a NAR of it"
+	}
+
+	if len(head) >= 8+len(narMagic) && binary.LittleEndian.Uint64(head) == uint64(len(narMagic)) && bytes.HasPrefix(head[8:], []byte("nix-archive-")) {
+		version, _, _ := strings.Cut(string(head[8:8+len(narMagic)]), "\x00")
+		return fmt.Sprintf("unsupported NAR version %q (only %q is known)", version, narMagic)
+	}
+
+	if bytes.HasPrefix(head, []byte("StorePath: ")) {
+		return "input is not a NAR but a narinfo; the NAR is at its URL, or use pull"
+	}
+
+	if len(head) > 16 {
+		head = head[:16]
+	}
+
+	return fmt.Sprintf("input is not a NAR: it starts with %q instead of the NAR magic", head)
+}
+
+// decompressedHead returns what the compressed data starting with head
+// holds, as far as the start of it tells, or "".
+func decompressedHead(head []byte) string {
+	zr, err := decompress(bytes.NewReader(head))
+	if err != nil {
+		return ""
+	}
+	defer zr.Close()
+
+	inner := make([]byte, sniffLen)
+	n, _ := io.ReadFull(zr, inner)
+
+	switch {
+	case n >= narHeaderLen && isNarHeader(inner):
+		return "NAR"
+	case n >= 8+narHeaderLen && binary.LittleEndian.Uint64(inner) == 1 && isNarHeader(inner[8:]):
+		return "nix-store --export stream"
+	case archiveFormat(inner[:n]) == formatTar:
+		return "tar archive"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/nar/ls"
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/nix-community/go-nix/pkg/nixhash"
+	"github.com/nix-community/go-nix/pkg/storepath"
+)
+
+// narinfoExtensions are the file extensions Nix gives compressed NARs in a
+// binary cache.
+var narinfoExtensions = map[string]string{
+	"none": "",
+	"xz":   ".xz",
+	"zstd": ".zst",
+}
+
+// narinfoOptions describe the store path of a NAR added to a binary cache.
+type narinfoOptions struct {
+	info        exportInfo
+	compression string
+	scan        bool
+	keyFiles    stringList
+	keys        []signature.SecretKey
+	candidates  map[string]string
+	listing     bool
+	expect      *expectedHashes
+}
+
+// addNarinfoFlags registers the flags of the commands adding a NAR to a
+// binary cache.
+func addNarinfoFlags(fs *flag.FlagSet) *narinfoOptions {
+	opts := addPathInfoFlags(fs)
+
+	fs.StringVar(&opts.compression, "compression", "xz", "NAR compression: xz, zstd or none")
+	fs.BoolVar(&opts.listing, "write-listing", false, "also write the brotli-compressed file listing <hash>.ls, which ls and cat read instead of the NAR")
+	opts.expect = addExpectedHashFlags(fs, true)
+
+	return opts
+}
+
+// addPathInfoFlags registers the flags describing the store path of a NAR:
+// its name, references, deriver and signatures.
+func addPathInfoFlags(fs *flag.FlagSet) *narinfoOptions {
+	opts := &narinfoOptions{}
+
+	fs.StringVar(&opts.info.storePath, "store-path", "", "store path the NAR is the contents of (taken from an export stream if not given)")
+	fs.Var((*stringList)(&opts.info.references), "reference", "store path referenced by the NAR in addition to those found in it (repeatable)")
+	fs.StringVar(&opts.info.deriver, "deriver", "", "deriver of the store path")
+	fs.BoolVar(&opts.scan, "scan-references", true, "find the references by scanning the NAR for store paths")
+	fs.Func("reference-candidates", "only look for the hash parts of the store paths listed in this file, as Nix does", func(name string) error {
+		var err error
+		opts.candidates, err = readCandidates(name)
+		return err
+	})
+	fs.Var(&opts.keyFiles, "sign-key", "sign the store path with the secret key in this file (repeatable)")
+
+	return opts
+}
+
+// loadKeys loads the secret keys named by -sign-key.
+func (opts *narinfoOptions) loadKeys() error {
+	for _, name := range opts.keyFiles {
+		sk, err := loadSecretKey(name)
+		if err != nil {
+			return err
+		}
+
+		opts.keys = append(opts.keys, sk)
+	}
+
+	return nil
+}
+
+// pathInfo returns the narinfo of the NAR with the given references found in
+// it, from the flags and else from an export stream's trailer. Only the hashes
+// and sizes, and the signatures over them, are left to fill in.
+func (opts *narinfoOptions) pathInfo(found []string, export *exportInfo) (*narinfo.NarInfo, error) {
+	info := opts.info
+	if info.storePath == "" {
+		info.storePath = export.storePath
+	}
+
+	if info.deriver == "" {
+		info.deriver = export.deriver
+	}
+
+	if info.storePath == "" {
+		return nil, fmt.Errorf("export stream has no store path; use -store-path")
+	}
+
+	refs := append(append(found, export.references...), info.references...)
+
+	return newNarinfo(info.storePath, refs, info.deriver)
+}
+
+func runNarToNarinfo(args []string) error {
+	fs := flag.NewFlagSet("nar2narinfo", flag.ContinueOnError)
+	input, output := addIOFlags(fs, "-", "input NAR file ('-' for stdin)", "", "binary cache directory to write the NAR and narinfo into")
+	narFormat := addNarFormatFlags(fs, narInput)
+	opts := addNarinfoFlags(fs)
+	if err := parseIOArgs(fs, args); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		return fmt.Errorf("-o must name the binary cache directory")
+	}
+
+	return addNarToCache(*input, narFormat, &localCache{dir: *output}, opts)
+}
+
+// addNarToCache adds the NAR in the file input to cache.
+func addNarToCache(input string, narFormat *narFormatOptions, cache binaryCache, opts *narinfoOptions) error {
+	if opts.info.storePath == "" && narFormat.format != narFormatExport {
+		return fmt.Errorf("%s requires -store-path", os.Args[1])
+	}
+
+	if err := opts.loadKeys(); err != nil {
+		return err
+	}
+
+	in, err := openInput(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var export exportInfo
+
+	finish, err := narFormat.wrapInput(in, &export)
+	if err != nil {
+		return err
+	}
+
+	return narToNarinfo(in, finish, &export, cache, opts)
+}
+
+// narToNarinfo compresses the NAR read from in and stores it in cache with
+// the narinfo describing it. The NAR is read once: its hash and size, the
+// hash and size of the compressed file and the references are all computed
+// as it streams through. finish is called after the NAR, and may fill in the
+// store path, references and deriver from an export stream.
+func narToNarinfo(in io.Reader, finish func() error, export *exportInfo, cache binaryCache, opts *narinfoOptions) error {
+	ext, ok := narinfoExtensions[opts.compression]
+	if !ok {
+		return fmt.Errorf("unsupported narinfo compression %q (use xz, zstd or none)", opts.compression)
+	}
+
+	spool, err := cache.spoolDir()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(spool, ".nar-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	fileHash := sha256.New()
+	file := &countingWriter{w: opts.expect.output(io.MultiWriter(tmp, fileHash))}
+
+	cw, err := compressWriter(file, opts.compression)
+	if err != nil {
+		return err
+	}
+
+	narHash := sha256.New()
+	narSize := &countingWriter{w: io.MultiWriter(cw, narHash)}
+	scanner := newRefScanner()
+	scanner.candidates = opts.candidates
+
+	sinks := opts.expect.narOutput(narSize)
+	if opts.scan {
+		sinks = io.MultiWriter(sinks, scanner)
+	}
+
+	// Reading the NAR through its parser checks it and stops at its end,
+	// where an export stream continues with its trailer.
+	listing, err := copyNar(in, sinks)
+	if err != nil {
+		return err
+	}
+
+	if err := cw.Close(); err != nil {
+		return fmt.Errorf("compressing NAR: %w", err)
+	}
+
+	// Nothing is added to the cache unless it has the expected hashes.
+	if err := opts.expect.verify(""); err != nil {
+		return err
+	}
+
+	// Binary caches are served as they are, so the NAR is world-readable.
+	if err := tmp.Chmod(0o644); err != nil {
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := finish(); err != nil {
+		return err
+	}
+
+	ni, err := opts.pathInfo(scanner.references(), export)
+	if err != nil {
+		return err
+	}
+
+	fileDigest := nixbase32.EncodeToString(fileHash.Sum(nil))
+
+	ni.URL = "nar/" + fileDigest + ".nar" + ext
+	ni.Compression = opts.compression
+	ni.FileHash = nixhash.MustNewHashWithEncoding(nixhash.SHA256, fileHash.Sum(nil), nixhash.NixBase32, true)
+	ni.FileSize = uint64(file.n)
+	ni.NarHash = nixhash.MustNewHashWithEncoding(nixhash.SHA256, narHash.Sum(nil), nixhash.NixBase32, true)
+	ni.NarSize = uint64(narSize.n)
+
+	if err := signNarinfo(ni, opts.keys); err != nil {
+		return err
+	}
+
+	if err := ni.Check(); err != nil {
+		return err
+	}
+
+	sp, _ := storepath.FromAbsolutePath(ni.StorePath)
+	name := nixbase32.EncodeToString(sp.Digest) + ".narinfo"
+
+	if skip, err := cache.has(name); err != nil || skip {
+		return err
+	}
+
+	// The NAR goes first, so that the narinfo never points to a missing one.
+	if err := cache.putNar(tmp.Name(), ni.URL); err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&stats.bytesOut, file.n)
+
+	if opts.listing {
+		b, err := marshalListing(listing, "br")
+		if err != nil {
+			return err
+		}
+
+		lsName := strings.TrimSuffix(name, ".narinfo") + ".ls"
+		if err := cache.putFile(lsName, b, "application/json", "br"); err != nil {
+			return err
+		}
+	}
+
+	return cache.putFile(name, []byte(ni.String()), "text/x-nix-narinfo", "")
+}
+
+// newNarinfo returns a narinfo for storePath with the given references, in
+// the sorted base name form of narinfo files, and deriver.
+func newNarinfo(storePath string, refs []string, deriver string) (*narinfo.NarInfo, error) {
+	if _, err := storepath.FromAbsolutePath(storePath); err != nil {
+		return nil, fmt.Errorf("invalid store path %q: %w", storePath, err)
+	}
+
+	ni := &narinfo.NarInfo{StorePath: storePath}
+	seen := make(map[string]bool)
+
+	for _, r := range refs {
+		sp, err := storepath.FromAbsolutePath(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reference %q: %w", r, err)
+		}
+
+		if !seen[sp.String()] {
+			seen[sp.String()] = true
+			ni.References = append(ni.References, sp.String())
+		}
+	}
+
+	sort.Strings(ni.References)
+
+	if deriver != "" {
+		sp, err := storepath.FromAbsolutePath(deriver)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deriver %q: %w", deriver, err)
+		}
+
+		ni.Deriver = sp.String()
+	}
+
+	return ni, nil
+}
+
+// copyNar reads a whole NAR from r, checking its structure, and copies it to
+// w as -fix leaves it. It returns the listing of the NAR as written to w.
+func copyNar(r io.Reader, w io.Writer) (*ls.Node, error) {
+	cr := &countingReader{r: io.TeeReader(checkedNar(r), w)}
+
+	nr, err := nar.NewReader(cr)
+	if nn := notNar(err); nn != nil {
+		return nil, nn
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading NAR: %w", err)
+	}
+	defer nr.Close()
+
+	limited := &limitedNarReader{Reader: nr}
+	listing := newListingBuilder()
+
+	for {
+		hdr, err := limited.Next()
+		if errors.Is(err, io.EOF) {
+			return listing.root, nil
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("reading NAR: %w", err)
+		}
+
+		// The NAR reader stops at the contents of a file, which it reads
+		// no further than asked.
+		listing.add(hdr, cr.n)
+
+		if _, err := io.Copy(io.Discard, nr); err != nil {
+			return nil, fmt.Errorf("reading NAR: %w", err)
+		}
+	}
+}
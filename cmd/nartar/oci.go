@@ -0,0 +1,440 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	ociLayerMediaType    = "application/vnd.oci.image.layer.v1.tar"
+	ociConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexMediaType    = "application/vnd.oci.image.index.v1+json"
+
+	dockerManifestMediaType     = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+	ociLayoutVersion     = "1.0.0"
+)
+
+var ociDigestPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// ociDescriptor is an OCI content descriptor.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociLayer describes a layer blob: its descriptor and the digest of the
+// uncompressed tar, which image configs list as the DiffID.
+type ociLayer struct {
+	Descriptor ociDescriptor `json:"descriptor"`
+	DiffID     string        `json:"diffID"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociImageConfig struct {
+	Architecture string         `json:"architecture"`
+	OS           string         `json:"os"`
+	Config       struct{}       `json:"config"`
+	RootFS       ociImageRootFS `json:"rootfs"`
+	History      []ociHistory   `json:"history,omitempty"`
+}
+
+type ociImageRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type ociHistory struct {
+	CreatedBy string `json:"created_by,omitempty"`
+}
+
+type ociLayoutMarker struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// ociLayerMediaTypeFor returns the layer media type for a compression.
+func ociLayerMediaTypeFor(compression string) (string, error) {
+	switch compression {
+	case "", "none":
+		return ociLayerMediaType, nil
+	case "gzip", "zstd":
+		return ociLayerMediaType + "+" + compression, nil
+	default:
+		return "", fmt.Errorf("unsupported layer compression %q", compression)
+	}
+}
+
+// narToOCILayer converts a NAR into a tar layer blob compressed with the given
+// algorithm and returns its descriptor and DiffID.
+func narToOCILayer(in io.Reader, out io.Writer, compression string, opts *tarOptions) (*ociLayer, error) {
+	mediaType, err := ociLayerMediaTypeFor(compression)
+	if err != nil {
+		return nil, err
+	}
+
+	blobHash := sha256.New()
+	blob := &countingWriter{w: io.MultiWriter(out, blobHash)}
+
+	cw, err := compressWriter(blob, compression)
+	if err != nil {
+		return nil, err
+	}
+
+	diffHash := sha256.New()
+
+	// Layers hold the NAR contents at the image root.
+	if err := narToTarRoot(in, io.MultiWriter(cw, diffHash), "", opts); err != nil {
+		return nil, err
+	}
+
+	if err := cw.Close(); err != nil {
+		return nil, fmt.Errorf("compressing layer: %w", err)
+	}
+
+	return &ociLayer{
+		Descriptor: ociDescriptor{
+			MediaType: mediaType,
+			Digest:    ociDigest(blobHash),
+			Size:      blob.n,
+		},
+		DiffID: ociDigest(diffHash),
+	}, nil
+}
+
+func ociDigest(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+func ociBytesDigest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+
+	return n, err
+}
+
+// narToOCILayout writes a single-layer image for the NAR into the OCI image
+// layout directory dir. An existing index.json is kept, replacing any
+// manifest previously tagged with ref.
+func narToOCILayout(in io.Reader, dir, compression, ref, arch, goos string, opts *tarOptions) error {
+	blobs := filepath.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobs, 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(blobs, ".layer-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	layer, err := narToOCILayer(in, tmp, compression, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), ociBlobPath(dir, layer.Descriptor.Digest)); err != nil {
+		return err
+	}
+
+	config := ociImageConfig{
+		Architecture: arch,
+		OS:           goos,
+		RootFS:       ociImageRootFS{Type: "layers", DiffIDs: []string{layer.DiffID}},
+		History:      []ociHistory{{CreatedBy: "nartar nar2oci"}},
+	}
+
+	configDesc, err := writeOCIBlob(dir, ociConfigMediaType, config)
+	if err != nil {
+		return err
+	}
+
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        *configDesc,
+		Layers:        []ociDescriptor{layer.Descriptor},
+	}
+
+	manifestDesc, err := writeOCIBlob(dir, ociManifestMediaType, manifest)
+	if err != nil {
+		return err
+	}
+
+	if ref != "" {
+		manifestDesc.Annotations = map[string]string{ociRefNameAnnotation: ref}
+	}
+
+	index := &ociIndex{SchemaVersion: 2, MediaType: ociIndexMediaType}
+
+	existing, err := readOCIIndex(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if existing != nil {
+		for _, m := range existing.Manifests {
+			if ref == "" || m.Annotations[ociRefNameAnnotation] != ref {
+				index.Manifests = append(index.Manifests, m)
+			}
+		}
+	}
+
+	index.Manifests = append(index.Manifests, *manifestDesc)
+
+	if err := writeJSONFile(filepath.Join(dir, "oci-layout"), ociLayoutMarker{ImageLayoutVersion: ociLayoutVersion}); err != nil {
+		return err
+	}
+
+	return writeJSONFile(filepath.Join(dir, "index.json"), index)
+}
+
+// ociLayoutToNar converts the image tagged ref in the OCI layout dir into a
+// NAR. All layers are applied in order unless layer selects a single one.
+func ociLayoutToNar(dir, ref string, layer int, whiteouts string, opts *readOptions, out io.Writer) error {
+	index, err := readOCIIndex(dir)
+	if err != nil {
+		return fmt.Errorf("reading oci index: %w", err)
+	}
+
+	manifestDesc, err := selectOCIManifest(dir, index, ref)
+	if err != nil {
+		return err
+	}
+
+	var manifest ociManifest
+	if err := readOCIBlobJSON(dir, *manifestDesc, &manifest); err != nil {
+		return fmt.Errorf("reading manifest: %w", err)
+	}
+
+	layers := manifest.Layers
+	if layer >= 0 {
+		if layer >= len(layers) {
+			return fmt.Errorf("image has %d layers, cannot select layer %d", len(layers), layer)
+		}
+
+		layers = layers[layer : layer+1]
+	}
+
+	entries := newEntryTree()
+
+	for _, l := range layers {
+		if err := applyOCILayer(dir, l, entries, whiteouts, opts); err != nil {
+			return fmt.Errorf("applying layer %s: %w", l.Digest, err)
+		}
+	}
+
+	return writeNarEntries(entries, out)
+}
+
+// applyOCILayer reads a layer blob into entries, verifying its digest.
+func applyOCILayer(dir string, desc ociDescriptor, entries *entryTree, whiteouts string, opts *readOptions) error {
+	f, err := openOCIBlob(dir, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	blob := io.TeeReader(f, h)
+
+	r, err := decompress(blob)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := applyLayer(r, entries, whiteouts, opts); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(io.Discard, blob); err != nil {
+		return err
+	}
+
+	if got := ociDigest(h); got != desc.Digest {
+		return fmt.Errorf("digest mismatch: got %s", got)
+	}
+
+	return nil
+}
+
+// selectOCIManifest finds the image manifest tagged ref, descending into
+// nested indexes. Without a ref the index must contain a single image.
+func selectOCIManifest(dir string, index *ociIndex, ref string) (*ociDescriptor, error) {
+	var candidates []ociDescriptor
+
+	var collect func(idx *ociIndex, tagged bool) error
+	collect = func(idx *ociIndex, tagged bool) error {
+		for _, m := range idx.Manifests {
+			match := tagged || ref == "" || m.Annotations[ociRefNameAnnotation] == ref
+
+			switch m.MediaType {
+			case ociIndexMediaType, dockerManifestListMediaType:
+				var nested ociIndex
+				if err := readOCIBlobJSON(dir, m, &nested); err != nil {
+					return fmt.Errorf("reading nested index: %w", err)
+				}
+
+				if err := collect(&nested, match && ref != ""); err != nil {
+					return err
+				}
+			case ociManifestMediaType, dockerManifestMediaType, "":
+				if match {
+					candidates = append(candidates, m)
+				}
+			}
+		}
+
+		return nil
+	}
+
+	if err := collect(index, false); err != nil {
+		return nil, err
+	}
+
+	switch len(candidates) {
+	case 0:
+		if ref != "" {
+			return nil, fmt.Errorf("no image tagged %q in layout", ref)
+		}
+
+		return nil, fmt.Errorf("no image manifests in layout")
+	case 1:
+		return &candidates[0], nil
+	default:
+		var refs []string
+		for _, c := range candidates {
+			if name := c.Annotations[ociRefNameAnnotation]; name != "" {
+				refs = append(refs, name)
+			}
+		}
+
+		return nil, fmt.Errorf("layout contains %d images, select one with -ref (tags: %s)", len(candidates), strings.Join(refs, ", "))
+	}
+}
+
+func readOCIIndex(dir string) (*ociIndex, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var index ociIndex
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, err
+	}
+
+	return &index, nil
+}
+
+func readOCIBlobJSON(dir string, desc ociDescriptor, v interface{}) error {
+	f, err := openOCIBlob(dir, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	if got := ociBytesDigest(b); got != desc.Digest {
+		return fmt.Errorf("blob %s has digest %s", desc.Digest, got)
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+func openOCIBlob(dir, digest string) (*os.File, error) {
+	if !ociDigestPattern.MatchString(digest) {
+		return nil, fmt.Errorf("unsupported blob digest %q", digest)
+	}
+
+	return os.Open(ociBlobPath(dir, digest))
+}
+
+func ociBlobPath(dir, digest string) string {
+	return filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// writeOCIBlob stores v as a compact JSON blob and returns its descriptor.
+func writeOCIBlob(dir, mediaType string, v interface{}) (*ociDescriptor, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := &ociDescriptor{
+		MediaType: mediaType,
+		Digest:    ociBytesDigest(b),
+		Size:      int64(len(b)),
+	}
+
+	if err := os.WriteFile(ociBlobPath(dir, desc.Digest), b, 0o644); err != nil {
+		return nil, err
+	}
+
+	return desc, nil
+}
+
+func writeJSONFile(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(name, b, 0o644)
+}
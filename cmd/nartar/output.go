@@ -0,0 +1,224 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// What to do with output files that already exist.
+const (
+	clobberRefuse = iota
+	clobberForce
+	clobberSkip
+)
+
+// clobber is set by -force and -no-clobber, which every command accepts. Like
+// -C it applies to the whole invocation, so it is kept here rather than in
+// the options of each command.
+var clobber = clobberRefuse
+
+// assumeYes is set by -y, which overwrites existing output files without
+// asking.
+var assumeYes = false
+
+// errNoClobber reports an output left alone because of -no-clobber. It ends
+// the command without failing it.
+var errNoClobber = errors.New("not overwriting existing output")
+
+func addOutputPolicyFlags(fs *flag.FlagSet) {
+	fs.Var(clobberFlag(clobberForce), "force", "overwrite existing output files and write archives to a terminal")
+	fs.Var(clobberFlag(clobberSkip), "no-clobber", "leave existing output files alone and exit successfully")
+	fs.BoolVar(&assumeYes, "yes", false, "overwrite existing output files without asking")
+	fs.BoolVar(&assumeYes, "y", false, "shorthand for -yes")
+	fs.BoolVar(&caName, "ca-name", false, "name output files after the SHA-256 of their contents, keeping the directory and extensions of -o, and print their names")
+}
+
+// clobberFlag is a switch selecting the clobber policy it holds.
+type clobberFlag int
+
+func (f clobberFlag) String() string { return "false" }
+
+func (f clobberFlag) IsBoolFlag() bool { return true }
+
+func (f clobberFlag) Set(v string) error {
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+
+	if on {
+		clobber = int(f)
+	}
+
+	return nil
+}
+
+// createOutputFile creates the file name, which must not exist as a regular
+// file unless -force or -y is given or the user agrees to overwrite it when
+// asked on the terminal. Devices, FIFOs and the like are written to as they
+// are.
+func createOutputFile(name string) (*os.File, error) {
+	if fi, err := os.Stat(name); err == nil && fi.Mode().IsRegular() {
+		switch {
+		case clobber == clobberSkip:
+			return nil, fmt.Errorf("%w %s", errNoClobber, name)
+		case clobber == clobberForce || assumeYes:
+		default:
+			asked, yes := confirmOverwrite(name)
+			if !asked {
+				return nil, fmt.Errorf("%s already exists; use --force to overwrite it or --no-clobber to keep it", name)
+			}
+
+			if !yes {
+				return nil, fmt.Errorf("%w %s", errNoClobber, name)
+			}
+		}
+	}
+
+	return os.Create(name)
+}
+
+// confirmOverwrite asks whether to overwrite name, as cp -i does, with the
+// question on stderr and the answer read from the controlling terminal, so
+// that stdin may carry the input. It reports that it did not ask if there is
+// no terminal.
+func confirmOverwrite(name string) (asked, yes bool) {
+	if !isTerminal(os.Stderr) {
+		return false, false
+	}
+
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return false, false
+	}
+	defer tty.Close()
+
+	clearProgress()
+	fmt.Fprintf(os.Stderr, "nartar: overwrite %s? [y/N] ", name)
+
+	answer, _ := bufio.NewReader(tty).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return true, answer == "y" || answer == "yes"
+}
+
+// openOutput opens an archive output file, or stdout for "-" unless it is a
+// terminal.
+func openOutput(name string) (io.WriteCloser, error) {
+	if isStdio(name) {
+		if clobber != clobberForce && isTerminal(os.Stdout) {
+			return nil, fmt.Errorf("refusing to write binary output to a terminal; redirect stdout, use -o, or use --force")
+		}
+
+		if caName {
+			return nil, fmt.Errorf("-ca-name needs an output file or directory, not stdout")
+		}
+
+		return countingOutput{nopWriteCloser{Writer: os.Stdout}}, nil
+	}
+
+	if caName {
+		c, err := openCAOutput(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return countingOutput{c}, nil
+	}
+
+	f, err := createOutputFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return countingOutput{f}, nil
+}
+
+// openTextOutput is openOutput for text such as JSON, which may go to a
+// terminal.
+func openTextOutput(name string) (io.WriteCloser, error) {
+	if isStdio(name) {
+		return nopWriteCloser{Writer: os.Stdout}, nil
+	}
+
+	return createOutputFile(name)
+}
+
+// isTerminal reports whether f is a character device other than /dev/null,
+// which is as close as the standard library gets to isatty.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	null, err := os.Stat(os.DevNull)
+
+	return err != nil || !os.SameFile(fi, null)
+}
+
+// openTarForAppend opens the tar file name for adding entries: the file is
+// cut at its end-of-archive marker and positioned there, so that a tar
+// writer continues the archive. A missing file is created.
+func openTarForAppend(name string) (io.WriteCloser, error) {
+	if isStdio(name) {
+		return nil, fmt.Errorf("-append needs an output file")
+	}
+
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o666)
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := tarArchiveEnd(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading %s to append to it: %w", name, err)
+	}
+
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return countingOutput{f}, nil
+}
+
+// tarArchiveEnd returns the offset of the end-of-archive marker of the tar
+// in r, which is where new entries go.
+func tarArchiveEnd(r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
+
+	var end int64
+
+	for {
+		if _, err := tr.Next(); err != nil {
+			if errors.Is(err, io.EOF) {
+				return end, nil
+			}
+
+			return 0, err
+		}
+
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return 0, err
+		}
+
+		// archive/tar reads the data of an entry exactly; its padding is
+		// only skipped by the next call to Next.
+		end = cr.n + tarPad(cr.n)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressThreads is set by -threads, which every command accepts. With
+// more than one, gzip and zstd output is compressed in blocks on that many
+// goroutines while the conversion goes on.
+var compressThreads = 1
+
+// parallelBlockSize is the size of the blocks compressed independently.
+// The output depends on it, but not on the number of threads.
+const parallelBlockSize = 1 << 20
+
+// gzipWindow is how much of the previous block a gzip block may refer to.
+const gzipWindow = 32 << 10
+
+func addThreadsFlag(fs *flag.FlagSet) {
+	fs.Func("threads", "compress gzip and zstd output in blocks on this many threads; the output differs from -threads 1 (default 1)", func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("-threads must be a positive number")
+		}
+
+		compressThreads = n
+
+		return nil
+	})
+}
+
+// blockResult is a compressed block, or the error compressing it.
+type blockResult struct {
+	b   []byte
+	err error
+}
+
+// parallelWriter compresses what is written to it in blocks, each on its own
+// goroutine, and writes the compressed blocks to w in order. At most threads
+// blocks are in flight, so a slow output holds the conversion back rather
+// than filling memory.
+type parallelWriter struct {
+	w io.Writer
+
+	// encode compresses the block in, given the input before it in dict;
+	// last is set for the final block.
+	encode func(in, dict []byte, last bool) ([]byte, error)
+
+	// emptyLast writes a final block even when there is no input left.
+	emptyLast bool
+
+	buf    []byte
+	dict   []byte
+	blocks int
+
+	queue  chan chan blockResult
+	done   chan error
+	closed bool
+	err    error
+}
+
+func newParallelWriter(w io.Writer, encode func(in, dict []byte, last bool) ([]byte, error)) *parallelWriter {
+	p := &parallelWriter{
+		w:      w,
+		encode: encode,
+		buf:    make([]byte, 0, parallelBlockSize),
+		queue:  make(chan chan blockResult, compressThreads),
+		done:   make(chan error, 1),
+	}
+
+	go func(queue chan chan blockResult) {
+		var err error
+
+		for out := range queue {
+			r := <-out
+			if err == nil {
+				err = r.err
+			}
+
+			if err == nil {
+				_, err = p.w.Write(r.b)
+			}
+		}
+
+		p.done <- err
+	}(p.queue)
+
+	return p
+}
+
+func (p *parallelWriter) Write(b []byte) (int, error) {
+	n := len(b)
+
+	for len(b) > 0 {
+		m := copy(p.buf[len(p.buf):cap(p.buf)], b)
+		p.buf = p.buf[:len(p.buf)+m]
+		b = b[m:]
+
+		if len(p.buf) == cap(p.buf) {
+			p.submit(false)
+		}
+	}
+
+	return n, nil
+}
+
+// submit hands the current block to a goroutine and starts a new one.
+func (p *parallelWriter) submit(last bool) {
+	in, dict := p.buf, p.dict
+	out := make(chan blockResult, 1)
+	p.queue <- out
+
+	go func() {
+		b, err := p.encode(in, dict, last)
+		out <- blockResult{b: b, err: err}
+	}()
+
+	if len(in) > gzipWindow {
+		p.dict = in[len(in)-gzipWindow:]
+	} else {
+		p.dict = in
+	}
+
+	p.buf = make([]byte, 0, parallelBlockSize)
+	p.blocks++
+}
+
+// Close compresses what is left and waits for all blocks to be written.
+func (p *parallelWriter) Close() error {
+	if p.closed {
+		return p.err
+	}
+
+	if len(p.buf) > 0 || p.blocks == 0 || p.emptyLast {
+		p.submit(true)
+	}
+
+	close(p.queue)
+	p.closed = true
+	p.err = <-p.done
+
+	return p.err
+}
+
+// parallelGzipWriter is a gzip stream made of deflate blocks compressed in
+// parallel, as pigz writes it: each block may refer back into the one
+// before it and ends with a sync flush, so that the next one can follow it.
+type parallelGzipWriter struct {
+	*parallelWriter
+	crc  uint32
+	size uint32
+}
+
+func newParallelGzipWriter(w io.Writer) (io.WriteCloser, error) {
+	// The header of compress/gzip: no name, no timestamp, unknown OS.
+	if _, err := w.Write([]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 0xff}); err != nil {
+		return nil, err
+	}
+
+	g := &parallelGzipWriter{}
+	g.parallelWriter = newParallelWriter(w, func(in, dict []byte, last bool) ([]byte, error) {
+		var b bytes.Buffer
+
+		fw, err := flate.NewWriterDict(&b, flate.DefaultCompression, dict)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := fw.Write(in); err != nil {
+			return nil, err
+		}
+
+		if last {
+			err = fw.Close()
+		} else {
+			err = fw.Flush()
+		}
+
+		return b.Bytes(), err
+	})
+	g.emptyLast = true
+
+	return g, nil
+}
+
+func (g *parallelGzipWriter) Write(b []byte) (int, error) {
+	g.crc = crc32.Update(g.crc, crc32.IEEETable, b)
+	g.size += uint32(len(b))
+
+	return g.parallelWriter.Write(b)
+}
+
+func (g *parallelGzipWriter) Close() error {
+	if g.closed {
+		return g.err
+	}
+
+	if err := g.parallelWriter.Close(); err != nil {
+		return err
+	}
+
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], g.crc)
+	binary.LittleEndian.PutUint32(trailer[4:], g.size)
+
+	_, err := g.w.Write(trailer[:])
+
+	return err
+}
+
+// newParallelZstdWriter writes a zstd stream as a sequence of frames, one
+// for each block, which decode to the concatenation of the blocks.
+func newParallelZstdWriter(w io.Writer) (io.WriteCloser, error) {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(compressThreads))
+	if err != nil {
+		return nil, err
+	}
+
+	return newParallelWriter(w, func(in, _ []byte, _ bool) ([]byte, error) {
+		return enc.EncodeAll(in, nil), nil
+	}), nil
+}
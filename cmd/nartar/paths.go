@@ -0,0 +1,512 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pathMap rewrites NAR paths while converting, so that archives can be
+// reshaped without a separate re-packing step. A nil pathMap keeps paths as
+// they are.
+type pathMap struct {
+	// subpaths are the subtrees to convert, as cleaned absolute paths; with
+	// reroot their contents are placed at the root.
+	subpaths []string
+	reroot   bool
+	found    map[string]bool
+
+	strip  int
+	prefix string // cleaned absolute path, or "" for none
+
+	exclude []string
+	include []string
+
+	transforms []pathTransform
+
+	// caseHack strips or adds Nix's case hack suffixes.
+	caseHack bool
+}
+
+// pathTransform rewrites a path relative to the NAR root.
+type pathTransform func(string) string
+
+// addPathMapFlags registers the path rewriting flags on fs.
+func addPathMapFlags(fs *flag.FlagSet) *pathMap {
+	m := &pathMap{}
+
+	fs.Func("subpath", "convert only this subtree of the NAR, such as /share/doc, and the directories above it (repeatable)", func(v string) error {
+		for _, elem := range strings.Split(v, "/") {
+			if elem == ".." {
+				return fmt.Errorf("subpath %q must not contain '..'", v)
+			}
+		}
+
+		m.subpaths = append(m.subpaths, path.Clean("/"+v))
+
+		return nil
+	})
+
+	fs.BoolVar(&m.reroot, "reroot", false, "convert the contents of the -subpath subtrees at the root, without the directories above them")
+
+	fs.Func("strip-components", "drop this many leading path elements from every entry, skipping entries that are not deeper", func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("not a non-negative number: %q", v)
+		}
+
+		m.strip = n
+
+		return nil
+	})
+
+	fs.Func("prefix", "place all entries below this directory, creating its parents", func(v string) error {
+		for _, elem := range strings.Split(v, "/") {
+			if elem == ".." {
+				return fmt.Errorf("prefix %q must not contain '..'", v)
+			}
+		}
+
+		m.prefix = path.Clean("/" + v)
+		if m.prefix == "/" {
+			m.prefix = ""
+		}
+
+		return nil
+	})
+
+	fs.Func("exclude", "skip entries matching this pattern, and their contents (repeatable)", func(v string) error {
+		return m.addPatterns(&m.exclude, []string{v})
+	})
+
+	fs.Func("include", "convert only entries matching this pattern, and their contents (repeatable)", func(v string) error {
+		return m.addPatterns(&m.include, []string{v})
+	})
+
+	fs.Func("exclude-from", "read -exclude patterns from this file, one per line (repeatable)", func(v string) error {
+		return m.addPatternFile(&m.exclude, v)
+	})
+
+	fs.Func("include-from", "read -include patterns from this file, one per line (repeatable)", func(v string) error {
+		return m.addPatternFile(&m.include, v)
+	})
+
+	fs.Func("transform", "rewrite paths with a sed expression s,old,new,[gi] or a prefix mapping old=new (repeatable)", func(v string) error {
+		t, err := parseTransform(v)
+		if err != nil {
+			return err
+		}
+
+		m.transforms = append(m.transforms, t)
+
+		return nil
+	})
+
+	fs.BoolVar(&m.caseHack, "case-hack", false, "strip Nix's ~nix~case~hack~N suffixes when reading a NAR, or add them to names differing only in case when writing one")
+
+	return m
+}
+
+func (m *pathMap) addPatterns(list *[]string, patterns []string) error {
+	for _, pat := range patterns {
+		if len(pat) > 1 {
+			pat = strings.TrimSuffix(pat, "/")
+		}
+
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pat, err)
+		}
+
+		*list = append(*list, pat)
+	}
+
+	return nil
+}
+
+// addPatternFile reads patterns from a file holding one per line. Blank lines
+// and lines starting with '#' are ignored.
+func (m *pathMap) addPatternFile(list *[]string, name string) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	var patterns []string
+
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		patterns = append(patterns, line)
+	}
+
+	if err := m.addPatterns(list, patterns); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	return nil
+}
+
+// apply maps the NAR path p, reporting false if the entry is dropped.
+// Filters see the original path, then leading elements are stripped, the
+// transforms applied and the prefix added.
+func (m *pathMap) apply(p string) (string, bool) {
+	if m == nil {
+		return p, true
+	}
+
+	if len(m.subpaths) > 0 {
+		var ok bool
+		if p, ok = m.selectSubpath(p); !ok {
+			return "", false
+		}
+	}
+
+	if p != "/" {
+		if matchPatterns(m.exclude, p) {
+			return "", false
+		}
+
+		if len(m.include) > 0 && !matchPatterns(m.include, p) {
+			return "", false
+		}
+	}
+
+	if m.strip > 0 {
+		parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+		if p == "/" || len(parts) <= m.strip {
+			return "", false
+		}
+
+		p = "/" + strings.Join(parts[m.strip:], "/")
+	}
+
+	if p != "/" && len(m.transforms) > 0 {
+		rel := strings.TrimPrefix(p, "/")
+		for _, t := range m.transforms {
+			rel = t(rel)
+		}
+
+		p = path.Clean("/" + rel)
+	}
+
+	if m.prefix != "" {
+		p = path.Join(m.prefix, p)
+	}
+
+	return p, true
+}
+
+// keepsPaths reports whether apply returns the paths it keeps unchanged.
+func (m *pathMap) keepsPaths() bool {
+	return m == nil || (!m.reroot && m.strip == 0 && len(m.transforms) == 0 && m.prefix == "")
+}
+
+// selectSubpath keeps p if it is in one of the -subpath subtrees or a
+// directory above one, rerooting it with -reroot.
+func (m *pathMap) selectSubpath(p string) (string, bool) {
+	for _, sub := range m.subpaths {
+		switch {
+		case p == sub:
+			if m.found == nil {
+				m.found = make(map[string]bool)
+			}
+
+			m.found[sub] = true
+		case sub == "/" || strings.HasPrefix(p, sub+"/"):
+		case !m.reroot && (p == "/" || strings.HasPrefix(sub, p+"/")):
+			return p, true
+		default:
+			continue
+		}
+
+		if m.reroot {
+			return path.Clean("/" + strings.TrimPrefix(p, sub)), true
+		}
+
+		return p, true
+	}
+
+	return "", false
+}
+
+// clone returns a copy of m for a conversion of its own, recording the
+// subpaths it finds apart from the conversions running alongside it.
+func (m *pathMap) clone() *pathMap {
+	if m == nil {
+		return nil
+	}
+
+	c := *m
+	c.found = nil
+
+	return &c
+}
+
+// checkSubpaths fails if one of the -subpath subtrees was not seen since the
+// last check.
+func (m *pathMap) checkSubpaths() error {
+	if m == nil {
+		return nil
+	}
+
+	found := m.found
+	m.found = nil
+
+	for _, sub := range m.subpaths {
+		if !found[sub] {
+			return fmt.Errorf("subpath %s is not in the archive", sub)
+		}
+	}
+
+	return nil
+}
+
+// prefixParents returns the directories above the prefix, outermost first,
+// which have to be created when writing an archive.
+func (m *pathMap) prefixParents() []string {
+	if m == nil || m.prefix == "" {
+		return nil
+	}
+
+	var dirs []string
+	for dir := path.Dir(m.prefix); dir != "/"; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+
+	return dirs
+}
+
+// addRootNameFlag registers -root-name, the top-level tar member holding the
+// NAR contents. An empty name puts the contents at the top of the tarball.
+func addRootNameFlag(fs *flag.FlagSet) *string {
+	root := tarRootName
+
+	fs.Func("root-name", "top-level tar member holding the NAR contents (default \"-\"; \"\" for none)", func(v string) (err error) {
+		root, err = parseRootName(v)
+		return err
+	})
+
+	return &root
+}
+
+// parseRootName cleans the name of a top-level tar member, "" for none.
+func parseRootName(v string) (string, error) {
+	v = strings.Trim(strings.TrimPrefix(v, "./"), "/")
+
+	for _, elem := range strings.Split(v, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("root name %q must not contain '..'", v)
+		}
+	}
+
+	if v != "" {
+		v = path.Clean(v)
+	}
+
+	if v == "." {
+		v = ""
+	}
+
+	return v, nil
+}
+
+// addSingleFileNameFlag registers -single-file-name, the member a NAR with a
+// regular file at its root becomes. It returns a function giving the name
+// for an output: the one given, or else, with the default root name, the
+// output file's name without its archive extensions.
+func addSingleFileNameFlag(fs *flag.FlagSet, root *string) func(output string) string {
+	var name string
+
+	fs.Func("single-file-name", "tar member name for a NAR holding a single file (default: the output file name without .tar, or the root name)", func(v string) error {
+		v = strings.Trim(strings.TrimPrefix(v, "./"), "/")
+		if v == "" || v == "." || v == ".." || strings.Contains(v, "/") {
+			return fmt.Errorf("single file name %q must be a plain file name", v)
+		}
+
+		name = v
+
+		return nil
+	})
+
+	return func(output string) string {
+		if name != "" || *root != tarRootName || output == "" || output == "-" {
+			return name
+		}
+
+		if base, err := inputPrefix(output); err == nil {
+			return base
+		}
+
+		return ""
+	}
+}
+
+// matchPatterns reports whether p or one of its parent directories matches
+// one of patterns. As in tar, a pattern starting with '/' is anchored at the
+// root; others may match any trailing run of path elements, so "*.a" and
+// "doc" match at any depth.
+func matchPatterns(patterns []string, p string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+
+	elems := strings.Split(strings.TrimPrefix(p, "/"), "/")
+
+	for _, pat := range patterns {
+		anchored := strings.HasPrefix(pat, "/")
+		pat = strings.TrimPrefix(pat, "/")
+
+		for end := 1; end <= len(elems); end++ {
+			for start := 0; start < end; start++ {
+				if anchored && start > 0 {
+					break
+				}
+
+				if ok, _ := path.Match(pat, strings.Join(elems[start:end], "/")); ok {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// parseTransform parses a -transform expression: either a sed substitution
+// s<d>regexp<d>replacement<d>[flags] with any delimiter d, where \1 to \9 and
+// & in the replacement refer to the match and the flags are g (replace all
+// matches) and i (ignore case), or a prefix mapping old=new that replaces the
+// leading path elements old. The regexp uses Go syntax, so groups are written
+// (...) rather than sed's \(...\).
+func parseTransform(expr string) (pathTransform, error) {
+	if len(expr) < 2 || expr[0] != 's' || isWordByte(expr[1]) {
+		old, repl, ok := strings.Cut(expr, "=")
+		if !ok {
+			return nil, fmt.Errorf("transform %q is neither s,old,new, nor old=new", expr)
+		}
+
+		old = strings.Trim(old, "/")
+		repl = strings.Trim(repl, "/")
+
+		return func(p string) string {
+			switch {
+			case old == "":
+				return path.Join(repl, p)
+			case p == old:
+				return repl
+			case strings.HasPrefix(p, old+"/"):
+				return path.Join(repl, p[len(old)+1:])
+			default:
+				return p
+			}
+		}, nil
+	}
+
+	parts, err := splitSedExpr(expr[2:], expr[1])
+	if err != nil || len(parts) != 3 {
+		return nil, fmt.Errorf("transform %q is not a sed expression s%cold%cnew%c[flags]", expr, expr[1], expr[1], expr[1])
+	}
+
+	pattern, global := parts[0], false
+
+	for _, f := range parts[2] {
+		switch f {
+		case 'g':
+			global = true
+		case 'i':
+			pattern = "(?i)" + pattern
+		default:
+			return nil, fmt.Errorf("unsupported flag %q in transform %q", f, expr)
+		}
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("transform %q: %w", expr, err)
+	}
+
+	repl := sedReplacement(parts[1])
+
+	return func(p string) string {
+		if global {
+			return re.ReplaceAllString(p, repl)
+		}
+
+		loc := re.FindStringSubmatchIndex(p)
+		if loc == nil {
+			return p
+		}
+
+		return p[:loc[0]] + string(re.ExpandString(nil, repl, p, loc)) + p[loc[1]:]
+	}, nil
+}
+
+// splitSedExpr splits the rest of a sed expression at unescaped delimiters.
+// An escaped delimiter stands for itself.
+func splitSedExpr(s string, delim byte) ([]string, error) {
+	var (
+		parts []string
+		cur   strings.Builder
+	)
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == delim:
+			cur.WriteByte(delim)
+			i++
+		case s[i] == '\\' && i+1 < len(s):
+			cur.WriteString(s[i : i+2])
+			i++
+		case s[i] == delim:
+			parts = append(parts, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteByte(s[i])
+		}
+	}
+
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("expected three delimiters")
+	}
+
+	return append(parts, cur.String()), nil
+}
+
+// sedReplacement converts a sed replacement to the template syntax of
+// regexp.Expand.
+func sedReplacement(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '$':
+			b.WriteString("$$")
+		case c == '&':
+			b.WriteString("${0}")
+		case c == '\\' && i+1 < len(s):
+			i++
+			if s[i] >= '0' && s[i] <= '9' {
+				b.WriteString("${" + s[i:i+1] + "}")
+			} else if s[i] == '$' {
+				b.WriteString("$$")
+			} else {
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"archive/tar"
+	"sort"
+	"strings"
+)
+
+// entryIndexSize is the number of entries from which a directory of an
+// entryTree indexes its entries by name instead of searching them.
+const entryIndexSize = 32
+
+// entryTree holds the entries read from an archive by their NAR path, as a
+// tree of path components: the path of a directory is stored once for all
+// the entries below it rather than in each of theirs, so that archives of
+// millions of members do not take gigabytes of paths. An entry stored in the
+// tree has no path of its own; walk gives it back while it is visited.
+//
+// Setting an entry creates the directories above it that are missing, as
+// archives need not list them.
+type entryTree struct {
+	root entryNode
+	slab entrySlab
+}
+
+// entryNode is a path component of an entryTree, with the entry at its path
+// if there is one.
+type entryNode struct {
+	name     string
+	entry    *tarEntry
+	children []*entryNode
+
+	// implicit is set while the entry is a directory made up for the
+	// entries below it, which the archive did not list.
+	implicit bool
+
+	// sorted is set while children are in NAR order, and index holds them
+	// by name once there are entryIndexSize of them.
+	sorted bool
+	index  map[string]*entryNode
+}
+
+func newEntryTree() *entryTree {
+	return &entryTree{}
+}
+
+// get returns the entry at the NAR path p, or nil.
+func (t *entryTree) get(p string) *tarEntry {
+	if n := t.node(p, false); n != nil {
+		return n.entry
+	}
+
+	return nil
+}
+
+// has reports whether an entry was set at the NAR path p, rather than made
+// up as the directory above another.
+func (t *entryTree) has(p string) bool {
+	n := t.node(p, false)
+	return n != nil && n.entry != nil && !n.implicit
+}
+
+// hasBelow reports whether there are entries below the NAR path p.
+func (t *entryTree) hasBelow(p string) bool {
+	n := t.node(p, false)
+	return n != nil && len(n.children) > 0
+}
+
+// fileAbove returns the entry above the NAR path p that is not a directory,
+// and its path, if there is one.
+func (t *entryTree) fileAbove(p string) (string, *tarEntry) {
+	n, dir := &t.root, "/"
+
+	for rest := strings.TrimPrefix(p, "/"); rest != "" && n != nil; {
+		if n.entry != nil && n.entry.kind != tar.TypeDir {
+			return dir, n.entry
+		}
+
+		name, next, found := strings.Cut(rest, "/")
+		if !found {
+			break
+		}
+
+		n, dir, rest = n.child(name), p[:len(p)-len(next)-1], next
+	}
+
+	return "", nil
+}
+
+// set stores e at the NAR path p, in place of any entry there.
+func (t *entryTree) set(p string, e *tarEntry) {
+	e.path = ""
+
+	n := t.node(p, true)
+	n.entry, n.implicit = e, false
+}
+
+// remove removes the entry at the NAR path p, and the entries below it if
+// subtree is set.
+func (t *entryTree) remove(p string, subtree bool) {
+	parent := &t.root
+	n := parent
+
+	for rest := strings.TrimPrefix(p, "/"); rest != "" && n != nil; {
+		var name string
+		name, rest, _ = strings.Cut(rest, "/")
+
+		parent, n = n, n.child(name)
+	}
+
+	if n == nil {
+		return
+	}
+
+	n.entry = nil
+
+	if subtree {
+		n.children, n.index = nil, nil
+	}
+
+	if len(n.children) == 0 && n != &t.root {
+		parent.removeChild(n)
+	}
+}
+
+// removeBelow removes the entries below the NAR path p, keeping p itself.
+func (t *entryTree) removeBelow(p string) {
+	if n := t.node(p, false); n != nil {
+		n.children, n.index = nil, nil
+	}
+}
+
+// walk calls fn with the entries of t and their paths in NAR order: a
+// directory before its contents, and the contents of a directory sorted by
+// name. fn must not change t.
+func (t *entryTree) walk(fn func(p string, e *tarEntry) error) error {
+	return t.root.walk("/", fn)
+}
+
+// node returns the node of the NAR path p, created with the directories
+// above it if create is set, or nil.
+func (t *entryTree) node(p string, create bool) *entryNode {
+	n := &t.root
+
+	for rest := strings.TrimPrefix(p, "/"); rest != ""; {
+		var name string
+		name, rest, _ = strings.Cut(rest, "/")
+
+		c := n.child(name)
+		if c == nil {
+			if !create {
+				return nil
+			}
+
+			// The name is copied, not to keep the whole path alive.
+			c = t.slab.node(entryNode{name: strings.Clone(name)})
+			n.addChild(c)
+		}
+
+		if rest != "" && create && c.entry == nil {
+			c.entry, c.implicit = t.slab.entry(tarEntry{kind: tar.TypeDir}), true
+		}
+
+		n = c
+	}
+
+	return n
+}
+
+func (n *entryNode) child(name string) *entryNode {
+	if n.index != nil {
+		return n.index[name]
+	}
+
+	// Archives mostly list the entries of a directory one after another,
+	// so the last one is the likeliest.
+	for i := len(n.children) - 1; i >= 0; i-- {
+		if n.children[i].name == name {
+			return n.children[i]
+		}
+	}
+
+	return nil
+}
+
+func (n *entryNode) addChild(c *entryNode) {
+	if len(n.children) == 0 {
+		n.sorted = true
+	} else if n.sorted && n.children[len(n.children)-1].name > c.name {
+		n.sorted = false
+	}
+
+	n.children = append(n.children, c)
+
+	switch {
+	case n.index != nil:
+		n.index[c.name] = c
+	case len(n.children) >= entryIndexSize:
+		n.index = make(map[string]*entryNode, len(n.children))
+		for _, c := range n.children {
+			n.index[c.name] = c
+		}
+	}
+}
+
+func (n *entryNode) removeChild(c *entryNode) {
+	for i, d := range n.children {
+		if d == c {
+			n.children = append(n.children[:i], n.children[i+1:]...)
+			break
+		}
+	}
+
+	if n.index != nil {
+		delete(n.index, c.name)
+	}
+}
+
+func (n *entryNode) walk(p string, fn func(p string, e *tarEntry) error) error {
+	if e := n.entry; e != nil {
+		e.path = p
+		err := fn(p, e)
+		e.path = ""
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if !n.sorted {
+		sort.Slice(n.children, func(i, j int) bool { return n.children[i].name < n.children[j].name })
+		n.sorted = true
+	}
+
+	if p == "/" {
+		p = ""
+	}
+
+	for _, c := range n.children {
+		if err := c.walk(p+"/"+c.name, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
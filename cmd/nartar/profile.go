@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	httppprof "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// profiling holds what -cpuprofile, -memprofile and -trace, which every
+// command accepts, write once the command ends, for conversions that are
+// slow in the field to be looked into with go tool pprof and go tool trace.
+var profiling struct {
+	cpu   *os.File
+	trace *os.File
+	mem   string
+}
+
+func addProfileFlags(fs *flag.FlagSet) {
+	fs.Func("pprof", "serve the net/http/pprof endpoints under /debug/pprof/ on this address, such as localhost:6060, while the command runs", func(addr string) error {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", httppprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+
+		go http.Serve(ln, mux)
+
+		return nil
+	})
+
+	fs.Func("cpuprofile", "write a CPU profile of the command to this file", func(name string) error {
+		if profiling.cpu != nil {
+			return fmt.Errorf("-cpuprofile is given twice")
+		}
+
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return err
+		}
+
+		profiling.cpu = f
+
+		return nil
+	})
+
+	fs.StringVar(&profiling.mem, "memprofile", "", "write a heap profile to this file when the command ends")
+
+	fs.Func("trace", "write an execution trace of the command to this file", func(name string) error {
+		if profiling.trace != nil {
+			return fmt.Errorf("-trace is given twice")
+		}
+
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			return err
+		}
+
+		profiling.trace = f
+
+		return nil
+	})
+}
+
+// stopProfiling finishes the profiles and the trace once the command is done
+// or has failed.
+func stopProfiling() {
+	if profiling.cpu != nil {
+		pprof.StopCPUProfile()
+		profiling.cpu.Close()
+		profiling.cpu = nil
+	}
+
+	if profiling.trace != nil {
+		trace.Stop()
+		profiling.trace.Close()
+		profiling.trace = nil
+	}
+
+	if profiling.mem != "" {
+		name := profiling.mem
+		profiling.mem = ""
+
+		f, err := os.Create(name)
+		if err != nil {
+			warnf("-memprofile: %v", err)
+			return
+		}
+		defer f.Close()
+
+		// The profile shows the heap as of the last collection.
+		runtime.GC()
+
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			warnf("-memprofile: %v", err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const progressInterval = 200 * time.Millisecond
+
+// progress is cleared by -no-progress, which every command accepts. The bar is
+// only drawn when stderr is a terminal and neither -v nor -q is given.
+var progress = true
+
+// activeProgress is the bar currently drawn on stderr, which warnings clear
+// before they are printed.
+var activeProgress *progressReader
+
+func addProgressFlag(fs *flag.FlagSet) {
+	fs.Var(progressFlag{}, "no-progress", "do not show a progress bar on stderr")
+}
+
+// progressFlag is the switch behind -no-progress.
+type progressFlag struct{}
+
+func (progressFlag) String() string { return "false" }
+
+func (progressFlag) IsBoolFlag() bool { return true }
+
+func (progressFlag) Set(v string) error {
+	off, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+
+	progress = !off
+
+	return nil
+}
+
+func progressEnabled() bool {
+	return progress && verbosity == 0 && isTerminal(os.Stderr)
+}
+
+// progressReader counts the bytes read from an input for -stats. If shown,
+// it reports how much of an input of known size has been read, with the
+// throughput, on a single stderr line that is redrawn at most every
+// progressInterval.
+type progressReader struct {
+	r      io.Reader
+	closer io.Closer
+	size   int64
+	n      int64
+	show   bool
+	start  time.Time
+	last   time.Time
+	drawn  bool
+}
+
+// withProgress wraps an input of size bytes, or -1 if unknown, with a
+// progress bar that is shown if it should be. closer, if not nil, is closed
+// with the returned reader.
+func withProgress(r io.Reader, closer io.Closer, size int64) *progressReader {
+	now := time.Now()
+
+	return &progressReader{
+		r:      r,
+		closer: closer,
+		size:   size,
+		show:   size > 0 && progressEnabled(),
+		start:  now,
+		last:   now,
+	}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	atomic.AddInt64(&stats.bytesIn, int64(n))
+
+	if !p.show {
+		return n, err
+	}
+
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.draw(now)
+	}
+
+	return n, err
+}
+
+func (p *progressReader) draw(now time.Time) {
+	pct := int64(100)
+	if p.n < p.size {
+		pct = p.n * 100 / p.size
+	}
+
+	rate := float64(p.n)
+	if d := now.Sub(p.start).Seconds(); d > 0 {
+		rate /= d
+	}
+
+	fmt.Fprintf(os.Stderr, "\r%3d%% %s / %s  %s/s\033[K", pct, formatBytes(float64(p.n)), formatBytes(float64(p.size)), formatBytes(rate))
+
+	p.drawn = true
+	activeProgress = p
+}
+
+// clear erases the bar so that other output starts on an empty line. It is
+// drawn again on the next update.
+func (p *progressReader) clear() {
+	if p.drawn {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		p.drawn = false
+	}
+}
+
+// Close draws the final state of a bar that has been shown and moves to the
+// next line.
+func (p *progressReader) Close() error {
+	if p.last != p.start {
+		p.draw(time.Now())
+		fmt.Fprintln(os.Stderr)
+	}
+
+	if activeProgress == p {
+		activeProgress = nil
+	}
+
+	if p.closer == nil {
+		return nil
+	}
+
+	return p.closer.Close()
+}
+
+// clearProgress erases the progress bar, if one is shown.
+func clearProgress() {
+	if activeProgress != nil {
+		activeProgress.clear()
+	}
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
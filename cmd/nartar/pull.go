@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/nix-community/go-nix/pkg/nixhash"
+	"github.com/nix-community/go-nix/pkg/storepath"
+)
+
+// runPull fetches a store path from a binary cache, as Nix substitutes it,
+// and writes its NAR or a tar of its contents.
+func runPull(args []string) error {
+	fs := flag.NewFlagSet("pull", flag.ContinueOnError)
+	from := fs.String("from", "", "binary cache to download from: an http://, https://, attic+https:// or s3:// URL or a directory")
+	output := fs.String("output", "-", "output file ('-' for stdout)")
+	fs.StringVar(output, "o", "-", "shorthand for -output")
+	format := fs.String("format", "nar", "output format: nar or tar")
+	opts := addTarOptionFlags(fs)
+	root := addRootNameFlag(fs)
+	singleFile := addSingleFileNameFlag(fs, root)
+	trust := addTrustFlags(fs)
+	auth := addCacheAuthFlags(fs)
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) != 1 {
+		return fmt.Errorf("pull needs one store path or hash part")
+	}
+
+	if *from == "" {
+		return fmt.Errorf("-from must name the binary cache")
+	}
+
+	if *format != "nar" && *format != "tar" {
+		return fmt.Errorf("unsupported output format %q (use nar or tar)", *format)
+	}
+
+	storeHash, storePath, err := parseStorePathArg(positional[0])
+	if err != nil {
+		return err
+	}
+
+	cache, err := openBinaryCache(*from, auth)
+	if err != nil {
+		return err
+	}
+
+	ni, err := fetchNarinfo(cache, storeHash)
+	if err != nil {
+		return err
+	}
+
+	if storePath != "" && ni.StorePath != storePath {
+		return fmt.Errorf("the narinfo for %s is for %s", storePath, ni.StorePath)
+	}
+
+	if len(trust.keys) > 0 {
+		if _, err := trust.verify(ni); err != nil {
+			return err
+		}
+	}
+
+	// A single file written to stdout is named as in the store.
+	opts.singleFile = singleFile(*output)
+	if opts.singleFile == "" && *root == tarRootName {
+		if sp, err := storepath.FromAbsolutePath(ni.StorePath); err == nil {
+			opts.singleFile = sp.Name
+		}
+	}
+
+	out, err := openOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	err = fetchNar(cache, ni, func(nar io.Reader) error {
+		if *format == "tar" {
+			return narToTarRoot(nar, out, *root, opts)
+		}
+
+		_, err := copyContents(out, nar)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", ni.StorePath, err)
+	}
+
+	return out.Close()
+}
+
+// parseStorePathArg returns the hash part of a store path, or of a hash part
+// given as it is, and the store path if given.
+func parseStorePathArg(s string) (storeHash, storePath string, err error) {
+	if len(s) == storeHashLen && isStoreHash([]byte(s)) {
+		return s, "", nil
+	}
+
+	sp, err := storepath.FromAbsolutePath(s)
+	if err != nil {
+		return "", "", fmt.Errorf("%q is neither a store path nor the hash part of one", s)
+	}
+
+	return nixbase32.EncodeToString(sp.Digest), sp.Absolute(), nil
+}
+
+// fetchNarinfo downloads and parses the narinfo of the store path with the
+// hash part storeHash.
+func fetchNarinfo(cache binaryCache, storeHash string) (*narinfo.NarInfo, error) {
+	r, err := cache.get(storeHash + ".narinfo")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s is not in the binary cache", storeHash)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	ni, err := parseNarinfo(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s.narinfo: %w", storeHash, err)
+	}
+
+	if !strings.HasPrefix(ni.StorePath, storepath.StoreDir+"/"+storeHash+"-") {
+		return nil, fmt.Errorf("%s.narinfo is for %s", storeHash, ni.StorePath)
+	}
+
+	return ni, nil
+}
+
+// fetchNar downloads the NAR of ni and passes it decompressed to use, which
+// must read all of it. The file hash and size and the NAR hash and size are
+// checked as it streams through, so that use may have seen a corrupt NAR
+// when fetchNar fails.
+func fetchNar(cache binaryCache, ni *narinfo.NarInfo, use func(io.Reader) error) error {
+	r, err := cache.get(ni.URL)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	file, err := newHashCheck("file", ni.FileHash, ni.FileSize)
+	if err != nil {
+		return err
+	}
+
+	zr, err := decompress(io.TeeReader(r, file))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	nar, err := newHashCheck("NAR", ni.NarHash, ni.NarSize)
+	if err != nil {
+		return err
+	}
+
+	if err := use(io.TeeReader(zr, nar)); err != nil {
+		return err
+	}
+
+	// Whatever use left of the NAR, and of the file after it, still counts.
+	if _, err := copyContents(nar, zr); err != nil {
+		return err
+	}
+
+	if _, err := copyContents(file, r); err != nil {
+		return err
+	}
+
+	if err := file.check(); err != nil {
+		return err
+	}
+
+	return nar.check()
+}
+
+// hashCheck is a writer checking that what is written has the hash and size
+// a narinfo records, or that were expected. A nil hash or zero size is not
+// checked.
+type hashCheck struct {
+	what string
+	algo string
+	want []byte
+	size uint64
+	h    hash.Hash
+	n    uint64
+}
+
+func newHashCheck(what string, want *nixhash.HashWithEncoding, size uint64) (*hashCheck, error) {
+	if want == nil {
+		return &hashCheck{what: what, size: size}, nil
+	}
+
+	return newDigestCheck(what, want.Algo().String(), want.Digest(), size)
+}
+
+// newDigestCheck is newHashCheck for the digest want of the algorithm algo,
+// which may be one Nix knows but go-nix does not.
+func newDigestCheck(what, algo string, want []byte, size uint64) (*hashCheck, error) {
+	newHash := hashAlgos[algo]
+	if newHash == nil {
+		return nil, fmt.Errorf("unsupported %s hash algorithm %s", what, algo)
+	}
+
+	return &hashCheck{what: what, algo: algo, want: want, size: size, h: newHash()}, nil
+}
+
+func (c *hashCheck) Write(b []byte) (int, error) {
+	if c.h != nil {
+		c.h.Write(b)
+	}
+
+	c.n += uint64(len(b))
+
+	return len(b), nil
+}
+
+func (c *hashCheck) check() error {
+	if c.size != 0 && c.n != c.size {
+		return fmt.Errorf("%s size mismatch: got %d bytes, expected %d", c.what, c.n, c.size)
+	}
+
+	if c.h == nil {
+		return nil
+	}
+
+	got := c.h.Sum(nil)
+	if !bytes.Equal(got, c.want) {
+		return fmt.Errorf("%[1]s hash mismatch: got %[2]s:%[3]s, expected %[2]s:%[4]s", c.what, c.algo, nixbase32.EncodeToString(got), nixbase32.EncodeToString(c.want))
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// limitRate is set by -limit-rate, which the commands talking to binary
+// caches accept: the bytes per second each of downloads and uploads may
+// take, or 0 for no limit.
+var limitRate int64
+
+// rateBurst is how far ahead of the limit a transfer may run after it has
+// been idle, so that short requests are not slowed down by the limit.
+const rateBurst = 100 * time.Millisecond
+
+// downloads and uploads share the -limit-rate budget of their direction
+// across every request the command makes.
+var (
+	downloadLimit = &rateLimiter{}
+	uploadLimit   = &rateLimiter{}
+)
+
+func addLimitRateFlag(fs *flag.FlagSet) {
+	fs.Func("limit-rate", "limit downloads from and uploads to the cache to this many bytes per second each, such as 10M", func(v string) error {
+		n, err := parseByteSize(v)
+		if err != nil {
+			return err
+		}
+
+		if n <= 0 {
+			return fmt.Errorf("-limit-rate must be a positive size")
+		}
+
+		limitRate = n
+
+		return nil
+	})
+}
+
+// rateLimiter spaces out the bytes transferred to limitRate per second.
+type rateLimiter struct {
+	mu sync.Mutex
+
+	// next is when the bytes transferred so far will have taken their
+	// share of the limit.
+	next time.Time
+}
+
+// wait sleeps for as long as n more bytes take at limitRate.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+
+	now := time.Now()
+	if l.next.Before(now.Add(-rateBurst)) {
+		l.next = now.Add(-rateBurst)
+	}
+
+	l.next = l.next.Add(time.Duration(float64(n) / float64(limitRate) * float64(time.Second)))
+	d := l.next.Sub(now)
+
+	l.mu.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// limitedReader reads from r no faster than limit allows.
+type limitedReader struct {
+	r     io.Reader
+	limit *rateLimiter
+}
+
+// limitReader returns r, limited by limit if -limit-rate is given.
+func limitReader(r io.Reader, limit *rateLimiter) io.Reader {
+	if limitRate == 0 || r == nil {
+		return r
+	}
+
+	return &limitedReader{r: r, limit: limit}
+}
+
+func (l *limitedReader) Read(b []byte) (int, error) {
+	// Reads are kept to a tenth of a second of the limit, for the
+	// transfer to proceed evenly rather than in bursts.
+	if chunk := limitRate / 10; chunk > 0 && int64(len(b)) > chunk {
+		b = b[:chunk]
+	}
+
+	n, err := l.r.Read(b)
+	l.limit.wait(n)
+
+	return n, err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// readAhead is set by -read-ahead, which every command accepts: how much of
+// a pipe, stdin or a download is read ahead of the conversion, or 0 to read
+// them only as the conversion asks.
+var readAhead int64 = 1 << 20
+
+// readAheadBlock is the most a single read ahead takes from the input.
+const readAheadBlock = 64 << 10
+
+func addReadAheadFlag(fs *flag.FlagSet) {
+	fs.Func("read-ahead", "read pipes, stdin and downloads this far ahead of the conversion, such as 8M, or 0 not to (default 1M)", func(v string) error {
+		n, err := parseByteSize(v)
+		if err != nil {
+			return err
+		}
+
+		if n < 0 || n > 1<<30 {
+			return fmt.Errorf("-read-ahead must be between 0 and 1G")
+		}
+
+		readAhead = n
+
+		return nil
+	})
+}
+
+// readAheadInput returns f, read ahead unless it is a regular file, which
+// is read at once and may be read in place.
+func readAheadInput(f *os.File) io.Reader {
+	if fi, err := f.Stat(); err != nil || fi.Mode().IsRegular() {
+		return f
+	}
+
+	return newReadAheadReader(f)
+}
+
+// readAheadChunk is what the goroutine of a readAheadReader has read, and
+// the error that ended it if any.
+type readAheadChunk struct {
+	b   []byte
+	err error
+}
+
+// readAheadReader reads its input on a goroutine, up to readAhead bytes
+// ahead of what is read from it, so that the many small reads of NAR and
+// tar parsing do not each wait on a slow pipe or connection.
+type readAheadReader struct {
+	chunks chan readAheadChunk
+	free   chan []byte
+	done   chan struct{}
+	once   sync.Once
+
+	buf []byte
+	cur []byte
+	err error
+}
+
+// newReadAheadReader starts reading r ahead, or returns r if -read-ahead is
+// 0.
+func newReadAheadReader(r io.Reader) io.Reader {
+	if readAhead == 0 {
+		return r
+	}
+
+	n := int(readAhead / readAheadBlock)
+	if n < 2 {
+		n = 2
+	}
+
+	ra := &readAheadReader{
+		chunks: make(chan readAheadChunk, n),
+		free:   make(chan []byte, n+1),
+		done:   make(chan struct{}),
+	}
+
+	go ra.fill(r)
+
+	return ra
+}
+
+func (ra *readAheadReader) fill(r io.Reader) {
+	for {
+		var b []byte
+
+		select {
+		case b = <-ra.free:
+		default:
+			b = make([]byte, readAheadBlock)
+		}
+
+		n, err := r.Read(b)
+
+		select {
+		case ra.chunks <- readAheadChunk{b: b[:n], err: err}:
+		case <-ra.done:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (ra *readAheadReader) Read(b []byte) (int, error) {
+	for len(ra.cur) == 0 {
+		if ra.buf != nil {
+			select {
+			case ra.free <- ra.buf[:cap(ra.buf)]:
+			default:
+			}
+
+			ra.buf = nil
+		}
+
+		if ra.err != nil {
+			return 0, ra.err
+		}
+
+		c := <-ra.chunks
+		ra.buf, ra.cur, ra.err = c.b, c.b, c.err
+	}
+
+	n := copy(b, ra.cur)
+	ra.cur = ra.cur[n:]
+
+	return n, nil
+}
+
+// stop ends the reading ahead, once nothing more is to be read.
+func (ra *readAheadReader) stop() {
+	ra.once.Do(func() { close(ra.done) })
+}
+
+// readAheadBody is a download read ahead. Closing it stops the reading
+// ahead and closes the download.
+type readAheadBody struct {
+	io.Reader
+	body io.Closer
+}
+
+// newReadAheadBody reads the download body ahead.
+func newReadAheadBody(body io.ReadCloser) io.ReadCloser {
+	if readAhead == 0 {
+		return body
+	}
+
+	return readAheadBody{Reader: newReadAheadReader(body), body: body}
+}
+
+func (b readAheadBody) Close() error {
+	b.Reader.(*readAheadReader).stop()
+
+	return b.body.Close()
+}
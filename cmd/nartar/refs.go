@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/nix-community/go-nix/pkg/storepath"
+)
+
+const (
+	// storeHashLen is the length of the nixbase32 hash of a store path name.
+	storeHashLen = 32
+
+	// storeNameMax is the longest name a store path may have after its hash.
+	storeNameMax = 211
+)
+
+var storePrefix = []byte(storepath.StoreDir + "/")
+
+// refScanner collects the store paths mentioned in the bytes written to it:
+// the store directory followed by a hash, a dash and a name. Given
+// candidates, it looks for their hash parts alone instead, as Nix does, which
+// also finds references stored without the store directory. A path split
+// across writes is still found, as the end of each write is kept until the
+// next one.
+type refScanner struct {
+	found map[string]bool
+	tail  []byte
+
+	// mu guards found, which the scanners of batch conversions running at
+	// once share.
+	mu *sync.Mutex
+
+	// candidates maps the hash parts of the paths looked for to the paths.
+	candidates map[string]string
+}
+
+// referenceScan scans the files written by the commands writing NARs for
+// -references, which names the file to list the references in.
+var (
+	referenceScan   = newRefScanner()
+	referenceOutput = ""
+)
+
+// addReferenceFlags registers -references and -reference-candidates, for the
+// commands writing NARs.
+func addReferenceFlags(fs *flag.FlagSet) {
+	fs.StringVar(&referenceOutput, "references", "", "write the store paths found in file contents and symlink targets to this file, one per line")
+	fs.Func("reference-candidates", "only look for the hash parts of the store paths listed in this file, as Nix does", func(name string) error {
+		candidates, err := readCandidates(name)
+		if err != nil {
+			return err
+		}
+
+		referenceScan.candidates = candidates
+		return nil
+	})
+}
+
+// readCandidates reads a file of store paths, one per line, as printed by
+// nix-store -qR, into a map from their hash parts.
+func readCandidates(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("reading reference candidates: %w", err)
+	}
+	defer f.Close()
+
+	candidates := make(map[string]string)
+	sc := bufio.NewScanner(f)
+
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+
+		sp, err := storepath.FromAbsolutePath(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid store path %q: %w", name, lineNo, line, err)
+		}
+
+		candidates[nixbase32.EncodeToString(sp.Digest)] = sp.Absolute()
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading reference candidates: %w", err)
+	}
+
+	return candidates, nil
+}
+
+// scanEntry scans the contents or link target of a single file, which a
+// path does not run across.
+func (s *refScanner) scanEntry(data []byte) {
+	if referenceOutput != "" {
+		s.scan(data, true)
+	}
+}
+
+// writeReferences writes the references found to the -references file once
+// the command is done.
+func writeReferences() error {
+	if referenceOutput == "" {
+		return nil
+	}
+
+	out, err := openTextOutput(referenceOutput)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	for _, p := range referenceScan.references() {
+		if _, err := io.WriteString(out, p+"\n"); err != nil {
+			return fmt.Errorf("writing references: %w", err)
+		}
+	}
+
+	return out.Close()
+}
+
+// fileScanner returns a scanner for the contents of a single file written
+// to it in pieces, recording what it finds with s once flushed.
+func (s *refScanner) fileScanner() *refScanner {
+	return &refScanner{found: s.found, mu: s.mu, candidates: s.candidates}
+}
+
+// flush scans the end of the file a fileScanner was written.
+func (s *refScanner) flush() {
+	s.scan(s.tail, true)
+	s.tail = nil
+}
+
+func newRefScanner() *refScanner {
+	return &refScanner{found: make(map[string]bool), mu: &sync.Mutex{}}
+}
+
+func (s *refScanner) Write(b []byte) (int, error) {
+	data := append(s.tail, b...)
+	s.scan(data, false)
+
+	// Keep enough to complete any path starting in the last bytes.
+	keep := len(storePrefix) + storeHashLen + 1 + storeNameMax
+	if len(data) > keep {
+		data = data[len(data)-keep:]
+	}
+
+	s.tail = append(s.tail[:0:0], data...)
+
+	return len(b), nil
+}
+
+// scan records the store paths in data. Unless final, a path running up to
+// the end of data is left for the next write to complete.
+func (s *refScanner) scan(data []byte, final bool) {
+	if s.candidates != nil {
+		s.scanHashes(data)
+		return
+	}
+
+	for i := 0; ; {
+		j := bytes.Index(data[i:], storePrefix)
+		if j < 0 {
+			return
+		}
+
+		start := i + j + len(storePrefix)
+		i = start
+
+		end := start + storeHashLen
+		if end >= len(data) {
+			if final {
+				return
+			}
+
+			continue
+		}
+
+		if !isStoreHash(data[start:end]) || data[end] != '-' {
+			continue
+		}
+
+		name := end + 1
+		for name < len(data) && name-end-1 < storeNameMax && isStoreNameByte(data[name]) {
+			name++
+		}
+
+		if name == len(data) && !final {
+			continue
+		}
+
+		if sp, err := storepath.FromString(string(data[start:name])); err == nil {
+			s.record(sp.Absolute())
+		}
+	}
+}
+
+// scanHashes records the candidates whose hash parts occur in data. Like
+// Nix, it skips ahead past any byte that cannot be part of a hash.
+func (s *refScanner) scanHashes(data []byte) {
+	for i := 0; i+storeHashLen <= len(data); {
+		j := i + storeHashLen - 1
+		for j >= i && nixbase32.Is(data[j]) {
+			j--
+		}
+
+		if j >= i {
+			i = j + 1
+			continue
+		}
+
+		if p, ok := s.candidates[string(data[i:i+storeHashLen])]; ok {
+			s.record(p)
+		}
+
+		i++
+	}
+}
+
+func (s *refScanner) record(p string) {
+	s.mu.Lock()
+	s.found[p] = true
+	s.mu.Unlock()
+}
+
+// references returns the store paths found, sorted.
+func (s *refScanner) references() []string {
+	s.scan(s.tail, true)
+
+	refs := make([]string, 0, len(s.found))
+	for p := range s.found {
+		refs = append(refs, p)
+	}
+	sort.Strings(refs)
+
+	return refs
+}
+
+func isStoreHash(b []byte) bool {
+	for _, c := range b {
+		if !nixbase32.Is(c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isStoreNameByte(c byte) bool {
+	return isWordByte(c) || c == '+' || c == '-' || c == '.' || c == '?' || c == '='
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/nixhash"
+	"github.com/nix-community/go-nix/pkg/storepath"
+)
+
+// readRegistration reads store path registrations in the format of
+// nix-store --register-validity and --dump-db: for each path, the path, its
+// NAR hash in hex and NAR size if given, its deriver or an empty line, the
+// number of references and the references, each on its own line. Paths are
+// keyed by their absolute store path.
+func readRegistration(r io.Reader) (map[string]*bundlePath, error) {
+	sc := bufio.NewScanner(r)
+	lineNo := 0
+
+	next := func(what string) (string, error) {
+		if !sc.Scan() {
+			if err := sc.Err(); err != nil {
+				return "", err
+			}
+
+			return "", fmt.Errorf("line %d: missing %s", lineNo+1, what)
+		}
+		lineNo++
+
+		return sc.Text(), nil
+	}
+
+	paths := make(map[string]*bundlePath)
+
+	for sc.Scan() {
+		lineNo++
+
+		p := sc.Text()
+		if p == "" {
+			continue
+		}
+
+		if _, err := storepath.FromAbsolutePath(p); err != nil {
+			return nil, fmt.Errorf("line %d: invalid store path %q: %w", lineNo, p, err)
+		}
+
+		bp := &bundlePath{Path: p}
+
+		line, err := next("deriver")
+		if err != nil {
+			return nil, err
+		}
+
+		// The hash and size are only there with --hash-given, and the
+		// deriver, if any, is a store path where the hash would be.
+		if line != "" && !strings.HasPrefix(line, "/") {
+			sha256 := nixhash.SHA256
+
+			h, err := nixhash.ParseAny(line, &sha256)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid NAR hash %q: %w", lineNo, line, err)
+			}
+
+			bp.NarHash = narHashString(h.Digest())
+
+			if line, err = next("NAR size"); err != nil {
+				return nil, err
+			}
+
+			if bp.NarSize, err = strconv.ParseInt(line, 10, 64); err != nil {
+				return nil, fmt.Errorf("line %d: invalid NAR size %q", lineNo, line)
+			}
+
+			if line, err = next("deriver"); err != nil {
+				return nil, err
+			}
+		}
+
+		bp.Deriver = line
+
+		if line, err = next("reference count"); err != nil {
+			return nil, err
+		}
+
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("line %d: invalid reference count %q", lineNo, line)
+		}
+
+		bp.References = []string{}
+
+		for i := 0; i < n; i++ {
+			ref, err := next("reference")
+			if err != nil {
+				return nil, err
+			}
+
+			if _, err := storepath.FromAbsolutePath(ref); err != nil {
+				return nil, fmt.Errorf("line %d: invalid reference %q: %w", lineNo, ref, err)
+			}
+
+			bp.References = append(bp.References, ref)
+		}
+
+		paths[p] = bp
+	}
+
+	return paths, sc.Err()
+}
+
+// writeRegistration writes the store paths of a bundle as
+// nix-store --register-validity --hash-given reads them, so that paths
+// unpacked into a store can be registered offline.
+func writeRegistration(w io.Writer, paths []bundlePath) error {
+	bw := bufio.NewWriter(w)
+
+	for _, bp := range paths {
+		h, err := nixhash.ParseAny(bp.NarHash, nil)
+		if err != nil {
+			return fmt.Errorf("invalid NAR hash %q for %s: %w", bp.NarHash, bp.Path, err)
+		}
+
+		fmt.Fprintf(bw, "%s\n%s\n%d\n%s\n%d\n", bp.Path, h.Format(nixhash.Base16, false), bp.NarSize, bp.Deriver, len(bp.References))
+
+		for _, ref := range bp.References {
+			fmt.Fprintf(bw, "%s\n", ref)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// writeRegistrationFile writes the registration of paths to the file name.
+func writeRegistrationFile(name string, paths []bundlePath) error {
+	out, err := openTextOutput(name)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := writeRegistration(out, paths); err != nil {
+		return fmt.Errorf("writing registration: %w", err)
+	}
+
+	return out.Close()
+}
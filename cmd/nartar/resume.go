@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// resumeInterval is how often -resume records a checkpoint.
+const resumeInterval = 5 * time.Second
+
+// resumeCheckpoint is the file -resume keeps next to a NAR being written,
+// as <output>.resume: the NAR file holds the first Done entries, in Offset
+// bytes whose SHA-256 is Prefix, of the entries whose digest is Entries. It
+// is written as soon as the output is created, so that a run interrupted
+// before its first entry can be resumed too.
+type resumeCheckpoint struct {
+	Entries string `json:"entries"`
+	Done    int    `json:"done"`
+	Offset  int64  `json:"offset"`
+	Prefix  string `json:"prefix"`
+}
+
+// resumableOutput is a NAR output file written with -resume. The entries
+// an interrupted run wrote are written again to the NAR writer to bring it
+// to where the run stopped, and only hashed, to check that they are the
+// bytes the NAR file holds; the NAR file is then continued from its
+// checkpoint.
+type resumableOutput struct {
+	f    *os.File
+	name string
+
+	saved  *resumeCheckpoint
+	digest string
+	last   time.Time
+
+	// prefix is the hash of the first hashed bytes of the NAR. The bytes
+	// written are read back from the file to be hashed at a checkpoint, as
+	// file contents may be copied into it by the kernel.
+	prefix hash.Hash
+	hashed int64
+
+	// replaying is set while the entries of the checkpoint are written
+	// again, with the bytes they take counted in replayed.
+	replaying bool
+	replayed  int64
+}
+
+// openResumableOutput opens the NAR output file name for -resume: as it
+// was left if it has a checkpoint, or created as openOutput does.
+func openResumableOutput(name string) (io.WriteCloser, error) {
+	if isStdio(name) || caName {
+		return nil, fmt.Errorf("-resume needs an output file")
+	}
+
+	r := &resumableOutput{name: name + ".resume", prefix: sha256.New()}
+
+	b, err := os.ReadFile(r.name)
+	if errors.Is(err, os.ErrNotExist) {
+		if r.f, err = createOutputFile(name); err != nil {
+			return nil, err
+		}
+
+		if err := r.save(resumeCheckpoint{}); err != nil {
+			r.f.Close()
+			return nil, err
+		}
+
+		return countingOutput{r}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.saved = &resumeCheckpoint{}
+	if err := json.Unmarshal(b, r.saved); err != nil {
+		return nil, fmt.Errorf("%s: %w", r.name, err)
+	}
+
+	if r.f, err = os.OpenFile(name, os.O_RDWR, 0); err != nil {
+		return nil, err
+	}
+
+	return countingOutput{r}, nil
+}
+
+// resumeOutput returns the -resume output out writes to, or nil.
+func resumeOutput(out io.Writer) *resumableOutput {
+	if c, ok := out.(countingOutput); ok {
+		out = c.WriteCloser
+	}
+
+	r, _ := out.(*resumableOutput)
+
+	return r
+}
+
+func (r *resumableOutput) Write(b []byte) (int, error) {
+	if r.replaying {
+		r.prefix.Write(b)
+		r.replayed += int64(len(b))
+		r.hashed += int64(len(b))
+
+		return len(b), nil
+	}
+
+	return r.f.Write(b)
+}
+
+func (r *resumableOutput) Close() error {
+	return r.f.Close()
+}
+
+// begin starts writing the NAR of the entries with the given digest, and
+// returns the number of them the NAR file already holds, to be replayed.
+func (r *resumableOutput) begin(digest string) (int, error) {
+	r.digest = digest
+	r.last = time.Now()
+
+	if r.saved == nil {
+		return 0, nil
+	}
+
+	if r.saved.Done > 0 && r.saved.Entries != digest {
+		return 0, fmt.Errorf("the input differs from the one %s was recorded for; remove it to start over", r.name)
+	}
+
+	fi, err := r.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if fi.Size() < r.saved.Offset {
+		return 0, fmt.Errorf("the output is shorter than %s records; remove it to start over", r.name)
+	}
+
+	if err := r.f.Truncate(r.saved.Offset); err != nil {
+		return 0, err
+	}
+
+	if _, err := r.f.Seek(r.saved.Offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	if r.saved.Done == 0 {
+		return 0, nil
+	}
+
+	if verbosity >= 0 {
+		clearProgress()
+		fmt.Fprintf(os.Stderr, "resuming after %d entries, at byte %d of the output\n", r.saved.Done, r.saved.Offset)
+	}
+
+	r.replaying = true
+
+	return r.saved.Done, nil
+}
+
+// resumed ends the replay of the entries of the checkpoint, which must
+// have given the bytes the NAR file holds.
+func (r *resumableOutput) resumed() error {
+	r.replaying = false
+
+	if r.replayed != r.saved.Offset {
+		return fmt.Errorf("the entries of %s take %d bytes of NAR, not %d; remove it to start over", r.name, r.replayed, r.saved.Offset)
+	}
+
+	if hex.EncodeToString(r.prefix.Sum(nil)) != r.saved.Prefix {
+		return fmt.Errorf("the contents of the first %d entries differ from those %s was recorded for; remove it to start over", r.saved.Done, r.name)
+	}
+
+	return nil
+}
+
+// checkpoint records that the NAR file holds done entries, if the last
+// checkpoint is resumeInterval old. The file is synced first, so that the
+// checkpoint never runs ahead of it.
+func (r *resumableOutput) checkpoint(done int) error {
+	if time.Since(r.last) < resumeInterval {
+		return nil
+	}
+
+	r.last = time.Now()
+
+	offset, err := r.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	if err := r.f.Sync(); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(r.prefix, io.NewSectionReader(r.f, r.hashed, offset-r.hashed)); err != nil {
+		return fmt.Errorf("hashing the output: %w", err)
+	}
+
+	r.hashed = offset
+
+	return r.save(resumeCheckpoint{Entries: r.digest, Done: done, Offset: offset, Prefix: hex.EncodeToString(r.prefix.Sum(nil))})
+}
+
+// save replaces the checkpoint file with cp.
+func (r *resumableOutput) save(cp resumeCheckpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	tmp := r.name + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+
+	if err := os.Rename(tmp, r.name); err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// finish removes the checkpoint of the NAR written whole.
+func (r *resumableOutput) finish() error {
+	if err := os.Remove(r.name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// narEntriesDigest returns a digest of the entries, in the order they are
+// written, by what decides the bytes of the NAR but their contents: their
+// paths, types, sizes, executable bits and symlink targets. The contents
+// are checked as the entries are replayed.
+func narEntriesDigest(entries *entryTree) string {
+	h := sha256.New()
+
+	entries.walk(func(p string, e *tarEntry) error {
+		size := int64(len(e.data))
+		if e.src != nil || e.r != nil {
+			size = e.size
+		}
+
+		fmt.Fprintf(h, "%q %d %d %t %q\n", p, e.kind, size, e.executable, e.linkTarget)
+
+		return nil
+	})
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// replayNarEntry writes the entry again to bring the NAR writer past it.
+// Its contents are not copied into the NAR file by the kernel, as nothing
+// is written to the file but hashed.
+func replayNarEntry(nw *narFile, e *tarEntry) error {
+	direct := nw.direct
+	nw.direct = nil
+
+	defer func() { nw.direct = direct }()
+
+	return writeNarEntry(nw, e)
+}
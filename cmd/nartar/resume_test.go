@@ -0,0 +1,279 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// quiet silences the messages of the test, such as where a run resumes.
+func quiet(t *testing.T) {
+	saved := verbosity
+	verbosity = -1
+
+	t.Cleanup(func() { verbosity = saved })
+}
+
+// resumeEntries returns the entries of a tarball of members, as tar2nar
+// collects them.
+func resumeEntries(t *testing.T, members ...tarMember) *entryTree {
+	t.Helper()
+
+	entries := newEntryTree()
+	if err := readTarEntries(tar.NewReader(bytes.NewReader(buildTar(t, members...))), "", entries, testReadOptions(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	return entries
+}
+
+// interruptNar writes the first done entries to the -resume output name
+// and records a checkpoint after them, then leaves the output with extra
+// bytes, as a run stopped while writing the next entry would.
+func interruptNar(t *testing.T, name string, entries *entryTree, done int, extra string) {
+	t.Helper()
+
+	if entries.get("/") == nil {
+		entries.set("/", &tarEntry{kind: tar.TypeDir})
+	}
+
+	out, err := openResumableOutput(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := resumeOutput(out)
+	if _, err := r.begin(narEntriesDigest(entries)); err != nil {
+		t.Fatal(err)
+	}
+
+	nw, err := newNarFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := 0
+
+	err = entries.walk(func(p string, e *tarEntry) error {
+		if i++; i > done {
+			return nil
+		}
+
+		if err := writeNarEntry(nw, e); err != nil {
+			return err
+		}
+
+		// A checkpoint is due.
+		r.last = time.Time{}
+
+		return r.checkpoint(i)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.f.WriteString(extra); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// resumeNar writes the entries to the -resume output name, as a run
+// resuming an interrupted one does.
+func resumeNar(t *testing.T, name string, entries *entryTree) error {
+	t.Helper()
+
+	out, err := openResumableOutput(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	return writeNarEntries(entries, out)
+}
+
+func TestResume(t *testing.T) {
+	quiet(t)
+
+	members := []tarMember{
+		{name: "a", kind: tar.TypeReg, data: "first file"},
+		{name: "b", kind: tar.TypeDir},
+		{name: "b/c", kind: tar.TypeReg, data: strings.Repeat("c", 1000)},
+		{name: "b/d", kind: tar.TypeSymlink, data: "../a"},
+		{name: "e", kind: tar.TypeReg, data: "last file"},
+	}
+
+	var want bytes.Buffer
+	if err := writeNarEntries(resumeEntries(t, members...), &want); err != nil {
+		t.Fatal(err)
+	}
+
+	// The root and all five members.
+	const count = 6
+
+	for done := 0; done <= count; done++ {
+		for _, extra := range []string{"", "part of the next entry"} {
+			name := filepath.Join(t.TempDir(), "out.nar")
+
+			interruptNar(t, name, resumeEntries(t, members...), done, extra)
+
+			if err := resumeNar(t, name, resumeEntries(t, members...)); err != nil {
+				t.Fatalf("resuming after %d entries: %v", done, err)
+			}
+
+			got, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, want.Bytes()) {
+				t.Errorf("resuming after %d entries with %d bytes more: the NAR differs", done, len(extra))
+			}
+
+			if _, err := os.Stat(name + ".resume"); !os.IsNotExist(err) {
+				t.Errorf("resuming after %d entries: the checkpoint is left: %v", done, err)
+			}
+		}
+	}
+
+	checkEntries(t, readNar(t, want.Bytes()), map[string]testEntry{
+		"/":    {typ: nar.TypeDirectory},
+		"/a":   {typ: nar.TypeRegular, data: "first file"},
+		"/b":   {typ: nar.TypeDirectory},
+		"/b/c": {typ: nar.TypeRegular, data: strings.Repeat("c", 1000)},
+		"/b/d": {typ: nar.TypeSymlink, target: "../a"},
+		"/e":   {typ: nar.TypeRegular, data: "last file"},
+	})
+}
+
+func TestResumeErrors(t *testing.T) {
+	quiet(t)
+
+	members := []tarMember{
+		{name: "a", kind: tar.TypeReg, data: "first file"},
+		{name: "b", kind: tar.TypeReg, data: "second file"},
+		{name: "c", kind: tar.TypeReg, data: "third file"},
+	}
+
+	changed := func(i int, m tarMember) []tarMember {
+		ms := append([]tarMember(nil), members...)
+		ms[i] = m
+
+		return ms
+	}
+
+	tests := []struct {
+		desc    string
+		resumed []tarMember
+		cut     int64
+		err     string
+	}{
+		{
+			desc:    "a file added",
+			resumed: append(append([]tarMember(nil), members...), tarMember{name: "d", kind: tar.TypeReg}),
+			err:     "the input differs",
+		},
+		{
+			desc:    "a file resized",
+			resumed: changed(0, tarMember{name: "a", kind: tar.TypeReg, data: "first"}),
+			err:     "the input differs",
+		},
+		{
+			desc:    "a file changed",
+			resumed: changed(0, tarMember{name: "a", kind: tar.TypeReg, data: "FIRST file"}),
+			err:     "the contents of the first 2 entries differ",
+		},
+		{
+			desc:    "a file after the checkpoint changed",
+			resumed: changed(2, tarMember{name: "c", kind: tar.TypeReg, data: "THIRD file"}),
+		},
+		{
+			desc:    "output cut short",
+			resumed: members,
+			cut:     1,
+			err:     "the output is shorter",
+		},
+	}
+
+	for _, tt := range tests {
+		name := filepath.Join(t.TempDir(), "out.nar")
+
+		interruptNar(t, name, resumeEntries(t, members...), 2, "")
+
+		if tt.cut > 0 {
+			fi, err := os.Stat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Truncate(name, fi.Size()-tt.cut); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := resumeNar(t, name, resumeEntries(t, tt.resumed...))
+
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.desc, err)
+			}
+
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.desc, err, tt.err)
+		}
+
+		// The checkpoint is kept for the run to be started over.
+		if _, err := os.Stat(name + ".resume"); err != nil {
+			t.Errorf("%s: %v", tt.desc, err)
+		}
+	}
+}
+
+func TestResumeFlag(t *testing.T) {
+	withoutConfig(t)
+
+	dir := t.TempDir()
+
+	in := filepath.Join(dir, "in.tar")
+	if err := os.WriteFile(in, buildTar(t, tarMember{name: "a", kind: tar.TypeReg, data: "a"}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc string
+		args []string
+		err  string
+	}{
+		{desc: "to a file", args: []string{in, filepath.Join(dir, "out.nar")}},
+		{desc: "to stdout", args: []string{in, "-"}, err: "-resume needs an output file"},
+		{desc: "with -assume-sorted", args: []string{"-assume-sorted", in, filepath.Join(dir, "sorted.nar")}, err: "cannot be combined with -assume-sorted"},
+	}
+
+	for _, tt := range tests {
+		err := runTarToNar(append([]string{"-resume", "-root-name", ""}, tt.args...))
+
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.desc, err)
+			}
+
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.desc, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/storepath"
+)
+
+// storeRewrite replaces a store path, or the hash part of one, with another
+// of the same length, so that offsets in binaries stay valid.
+type storeRewrite struct {
+	from, to []byte
+}
+
+// storeRewrites are set by -rewrite and applied to the contents and link
+// targets of every file converted, in the order given.
+var storeRewrites []storeRewrite
+
+// addRewriteFlag registers -rewrite on the commands converting files, once
+// for commands such as convert that have both the reading and the writing
+// flags.
+func addRewriteFlag(fs *flag.FlagSet) {
+	if fs.Lookup("rewrite") != nil {
+		return
+	}
+
+	fs.Func("rewrite", "OLD=NEW replaces a store path or hash part with another of the same length in file contents and symlink targets (repeatable)", func(v string) error {
+		from, to, ok := strings.Cut(v, "=")
+		if !ok {
+			return fmt.Errorf("expected OLD=NEW")
+		}
+
+		for _, s := range []string{from, to} {
+			if err := validateRewrite(s); err != nil {
+				return err
+			}
+		}
+
+		if len(from) != len(to) {
+			return fmt.Errorf("%s and %s differ in length, which would corrupt binaries", from, to)
+		}
+
+		storeRewrites = append(storeRewrites, storeRewrite{from: []byte(from), to: []byte(to)})
+
+		return nil
+	})
+}
+
+// validateRewrite checks that s is a store path or the hash part of one.
+func validateRewrite(s string) error {
+	if len(s) == storeHashLen && isStoreHash([]byte(s)) {
+		return nil
+	}
+
+	if _, err := storepath.FromAbsolutePath(s); err != nil {
+		return fmt.Errorf("%q is neither a store path nor the hash part of one", s)
+	}
+
+	return nil
+}
+
+// rewriteStorePaths applies the -rewrite replacements to b in place.
+func rewriteStorePaths(b []byte) []byte {
+	for _, rw := range storeRewrites {
+		for i := 0; ; {
+			j := bytes.Index(b[i:], rw.from)
+			if j < 0 {
+				break
+			}
+
+			copy(b[i+j:], rw.to)
+			i += j + len(rw.to)
+		}
+	}
+
+	return b
+}
+
+// rewriteString applies the -rewrite replacements to s.
+func rewriteString(s string) string {
+	if len(storeRewrites) == 0 {
+		return s
+	}
+
+	return string(rewriteStorePaths([]byte(s)))
+}
+
+// rewriteReader applies the -rewrite replacements to a stream. It holds back
+// the last bytes read until more follow, so that a path split across reads
+// is still replaced.
+type rewriteReader struct {
+	r       io.Reader
+	pending []byte
+	ready   int
+	err     error
+}
+
+// newRewriteReader returns r with the -rewrite replacements applied, or r
+// itself if there are none.
+func newRewriteReader(r io.Reader) io.Reader {
+	if len(storeRewrites) == 0 {
+		return r
+	}
+
+	return &rewriteReader{r: r}
+}
+
+func (rr *rewriteReader) Read(b []byte) (int, error) {
+	for rr.ready == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+
+		chunk := copyBuffers.Get().(*[]byte)
+		n, err := rr.r.Read(*chunk)
+		rr.pending = rewriteStorePaths(append(rr.pending, (*chunk)[:n]...))
+		copyBuffers.Put(chunk)
+		rr.err = err
+
+		rr.ready = len(rr.pending)
+		if err == nil {
+			rr.ready -= rewriteOverlap() - 1
+		}
+
+		if rr.ready < 0 {
+			rr.ready = 0
+		}
+	}
+
+	n := copy(b, rr.pending[:rr.ready])
+	rr.pending = rr.pending[n:]
+	rr.ready -= n
+
+	return n, nil
+}
+
+// rewriteOverlap is the length of the longest path replaced.
+func rewriteOverlap() int {
+	n := 1
+	for _, rw := range storeRewrites {
+		if len(rw.from) > n {
+			n = len(rw.from)
+		}
+	}
+
+	return n
+}
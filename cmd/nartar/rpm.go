@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	rpmLeadMagic   = "\xed\xab\xee\xdb"
+	rpmLeadSize    = 96
+	rpmHeaderMagic = "\x8e\xad\xe8\x01"
+
+	// rpmMaxHeader bounds the header store held in memory.
+	rpmMaxHeader = 256 << 20
+
+	rpmTagPayloadFormat = 1124
+	rpmTypeString       = 6
+)
+
+// rpmHeader is a parsed RPM header structure: an index of tags pointing
+// into a data store.
+type rpmHeader struct {
+	index []byte
+	store []byte
+}
+
+// readRPMHeader reads a header structure. The signature header is followed by
+// padding to an 8-byte boundary, which pad skips.
+func readRPMHeader(r io.Reader, pad bool) (*rpmHeader, error) {
+	var intro [16]byte
+	if _, err := io.ReadFull(r, intro[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	if string(intro[:4]) != rpmHeaderMagic {
+		return nil, fmt.Errorf("invalid rpm header magic")
+	}
+
+	entries := binary.BigEndian.Uint32(intro[8:])
+	size := binary.BigEndian.Uint32(intro[12:])
+
+	if uint64(entries)*16+uint64(size) > rpmMaxHeader {
+		return nil, fmt.Errorf("rpm header too large")
+	}
+
+	b := make([]byte, int(entries)*16+int(size))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	if pad {
+		if _, err := io.CopyN(io.Discard, r, int64((8-len(b)%8)%8)); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+
+	return &rpmHeader{index: b[:entries*16], store: b[entries*16:]}, nil
+}
+
+// stringTag returns the value of a string tag, or "" if it is not present.
+func (h *rpmHeader) stringTag(tag uint32) (string, error) {
+	for i := 0; i < len(h.index); i += 16 {
+		e := h.index[i : i+16]
+		if binary.BigEndian.Uint32(e) != tag {
+			continue
+		}
+
+		if binary.BigEndian.Uint32(e[4:]) != rpmTypeString {
+			return "", fmt.Errorf("rpm tag %d is not a string", tag)
+		}
+
+		off := binary.BigEndian.Uint32(e[8:])
+		if off >= uint32(len(h.store)) {
+			return "", fmt.Errorf("rpm tag %d points outside the header", tag)
+		}
+
+		s := h.store[off:]
+		if end := bytes.IndexByte(s, 0); end >= 0 {
+			s = s[:end]
+		}
+
+		return string(s), nil
+	}
+
+	return "", nil
+}
+
+// rpmToNar converts the payload of an RPM package into a NAR whose root
+// directory is the payload root, so ./usr/bin/foo maps to /usr/bin/foo.
+func rpmToNar(in io.Reader, out io.Writer, opts *readOptions) error {
+	var lead [rpmLeadSize]byte
+	if _, err := io.ReadFull(in, lead[:]); err != nil {
+		return fmt.Errorf("reading rpm lead: %w", unexpectedEOF(err))
+	}
+
+	if string(lead[:4]) != rpmLeadMagic {
+		return fmt.Errorf("not an rpm package")
+	}
+
+	if _, err := readRPMHeader(in, true); err != nil {
+		return fmt.Errorf("reading rpm signature: %w", err)
+	}
+
+	h, err := readRPMHeader(in, false)
+	if err != nil {
+		return fmt.Errorf("reading rpm header: %w", err)
+	}
+
+	format, err := h.stringTag(rpmTagPayloadFormat)
+	if err != nil {
+		return fmt.Errorf("reading rpm header: %w", err)
+	}
+
+	if format != "" && format != "cpio" {
+		return fmt.Errorf("unsupported rpm payload format %q", format)
+	}
+
+	payload, err := decompress(in)
+	if err != nil {
+		return fmt.Errorf("opening rpm payload: %w", err)
+	}
+	defer payload.Close()
+
+	entries := newEntryTree()
+	if err := readCpioEntries(payload, entries, opts); err != nil {
+		return fmt.Errorf("reading rpm payload: %w", err)
+	}
+
+	return writeNarEntries(entries, out)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Credentials are the AWS credentials requests to S3 are signed with.
+type s3Credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// openS3Cache returns the binary cache in the S3 bucket of an s3://BUCKET
+// URL, with the parameters Nix accepts: region (default $AWS_REGION, or
+// us-east-1), profile (default $AWS_PROFILE, or default) naming the
+// credentials in ~/.aws/credentials when $AWS_ACCESS_KEY_ID is not set, and
+// endpoint and scheme for S3-compatible stores such as MinIO.
+func openS3Cache(u *url.URL) (binaryCache, error) {
+	bucket := u.Host
+	if bucket == "" {
+		return nil, fmt.Errorf("s3:// URL %q has no bucket", u)
+	}
+
+	q := u.Query()
+
+	region := firstNonEmpty(q.Get("region"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	profile := firstNonEmpty(q.Get("profile"), os.Getenv("AWS_PROFILE"), "default")
+	scheme := firstNonEmpty(q.Get("scheme"), "https")
+
+	creds, err := loadS3Credentials(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Buckets on AWS are addressed by host name; other endpoints get the
+	// bucket in the path, which is all that most of them support.
+	base := &url.URL{Scheme: scheme, Host: bucket + ".s3." + region + ".amazonaws.com"}
+
+	if endpoint := q.Get("endpoint"); endpoint != "" {
+		if !strings.Contains(endpoint, "://") {
+			endpoint = scheme + "://" + endpoint
+		}
+
+		e, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 endpoint %q: %w", q.Get("endpoint"), err)
+		}
+
+		base = &url.URL{Scheme: e.Scheme, Host: e.Host, Path: strings.TrimSuffix(e.Path, "/") + "/" + bucket}
+	}
+
+	if prefix := strings.Trim(u.Path, "/"); prefix != "" {
+		base.Path += "/" + prefix
+	}
+
+	return &httpCache{
+		base:    base,
+		headers: make(http.Header),
+		client:  http.DefaultClient,
+		sign: func(req *http.Request) error {
+			signS3Request(req, creds, region, time.Now())
+			return nil
+		},
+	}, nil
+}
+
+// loadS3Credentials returns the credentials in $AWS_ACCESS_KEY_ID,
+// $AWS_SECRET_ACCESS_KEY and $AWS_SESSION_TOKEN, or else those of profile in
+// the shared credentials file.
+func loadS3Credentials(profile string) (s3Credentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return s3Credentials{
+			accessKey:    id,
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	name := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if name == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return s3Credentials{}, fmt.Errorf("no AWS credentials: set $AWS_ACCESS_KEY_ID or $AWS_SHARED_CREDENTIALS_FILE")
+		}
+
+		name = filepath.Join(home, ".aws", "credentials")
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("reading AWS credentials: %w", err)
+	}
+	defer f.Close()
+
+	var creds s3Credentials
+	var section string
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		case section != profile:
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, "=")
+		value = strings.TrimSpace(value)
+
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.accessKey = value
+		case "aws_secret_access_key":
+			creds.secretKey = value
+		case "aws_session_token":
+			creds.sessionToken = value
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return s3Credentials{}, fmt.Errorf("reading AWS credentials: %w", err)
+	}
+
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return s3Credentials{}, fmt.Errorf("%s has no credentials for profile %q", name, profile)
+	}
+
+	return creds, nil
+}
+
+// signS3Request signs req for S3 with AWS Signature Version 4. Unless req
+// has an X-Amz-Content-Sha256 header already, the body is sent unsigned,
+// which S3 allows, so that uploads are not read twice.
+//
+// The path and query are sent escaped as they are signed: S3 checks the
+// signature against the request as received, and Go leaves characters such
+// as + and : unescaped in paths where the canonical request escapes them.
+func signS3Request(req *http.Request, creds s3Credentials, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	scope := day + "/" + region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	payload := req.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		payload = "UNSIGNED-PAYLOAD"
+		req.Header.Set("X-Amz-Content-Sha256", payload)
+	}
+
+	if req.URL.Path != "" {
+		req.URL.RawPath = s3Escape(req.URL.Path, false)
+	}
+
+	req.URL.RawQuery = s3CanonicalQuery(req.URL.Query())
+
+	canonicalURI := req.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	// The host and the x-amz-* headers are signed, which is what S3 requires.
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := []byte("AWS4" + creds.secretKey)
+	for _, part := range []string{day, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+// s3Escape escapes s as in a canonical request: every byte but the
+// unreserved characters of RFC 3986, and the slashes of a path unless
+// slashes is set.
+func s3Escape(s string, slashes bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && !slashes:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// s3CanonicalQuery returns the query q as in a canonical request: the
+// escaped parameters sorted by name and then value, with an empty value
+// written as name=.
+func s3CanonicalQuery(q url.Values) string {
+	var params [][2]string
+
+	for k, values := range q {
+		for _, v := range values {
+			params = append(params, [2]string{s3Escape(k, true), s3Escape(v, true)})
+		}
+	}
+
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+
+		return params[i][1] < params[j][1]
+	})
+
+	encoded := make([]string, len(params))
+	for i, p := range params {
+		encoded[i] = p[0] + "=" + p[1]
+	}
+
+	return strings.Join(encoded, "&")
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
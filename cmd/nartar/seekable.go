@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// seekableTar is a tarball in a regular file. Only its headers are read
+// while the entries are collected, as the contents of its files are read
+// back from it when the NAR is written, in NAR order, so that they are
+// neither held in memory nor spooled.
+type seekableTar struct {
+	pr *progressReader
+	f  *os.File
+
+	// pos is the offset in f of the next byte the tar reader reads.
+	pos int64
+
+	// unread is how many of the bytes the tar reader is still to skip are
+	// file contents read back through an inputFile, and counted then.
+	unread int64
+}
+
+// inputFile is the input file as the source of the contents of its
+// entries. The bytes read from it count for -stats.
+type inputFile struct {
+	*os.File
+}
+
+func (f inputFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(b, off)
+	atomic.AddInt64(&stats.bytesIn, int64(n))
+
+	return n, err
+}
+
+// openSeekableTar returns the input in as a seekableTar if it is a regular
+// file read as it is, or nil.
+func openSeekableTar(in io.Reader) *seekableTar {
+	pr, ok := in.(*progressReader)
+	if !ok {
+		return nil
+	}
+
+	f, ok := pr.r.(*os.File)
+	if !ok {
+		return nil
+	}
+
+	if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+
+	return &seekableTar{pr: pr, f: f, pos: pos}
+}
+
+// Read reads headers, and the last byte of each file's contents, which the
+// tar reader reads after seeking past the others. Those bytes are taken
+// back off the count, as they count when the contents are read back.
+func (s *seekableTar) Read(b []byte) (int, error) {
+	n, err := s.pr.Read(b)
+	s.pos += int64(n)
+	atomic.AddInt64(&stats.bytesIn, -s.later(int64(n)))
+
+	return n, err
+}
+
+// Seek lets the tar reader skip the contents of the files. The bytes
+// skipped count as read, but for the file contents, which count when they
+// are read back.
+func (s *seekableTar) Seek(offset int64, whence int) (int64, error) {
+	pos, err := s.f.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+
+	skipped := pos - s.pos
+	s.pr.n += skipped
+	atomic.AddInt64(&stats.bytesIn, skipped-s.later(skipped))
+	s.pos = pos
+
+	return pos, nil
+}
+
+// later returns how many of the n bytes just passed over are file contents
+// counted when they are read back.
+func (s *seekableTar) later(n int64) int64 {
+	if n > s.unread {
+		n = s.unread
+	}
+
+	s.unread -= n
+
+	return n
+}
+
+// readFile reads the contents of the tar file e with the header th from tr.
+// Reading a seekable tarball, it only notes where they are, unless the file
+// is sparse and its contents are not stored in one piece, and leaves the
+// tar reader to skip them; with -assume-sorted, it leaves them to be
+// streamed. It returns the first bytes of the contents, for the executable
+// policy.
+func (o *readOptions) readFile(e *tarEntry, tr *tar.Reader, th *tar.Header) ([]byte, error) {
+	seekable := o.archive != nil && !isSparse(th)
+	if !seekable && !o.assumeSorted {
+		return fileSpool.read(e, tr, th.Size)
+	}
+
+	e.size = th.Size
+
+	head := make([]byte, spoolHeadSize)
+	if th.Size < spoolHeadSize {
+		head = head[:th.Size]
+	}
+
+	if seekable {
+		// The first bytes are looked at where they are, as they count
+		// with the rest when the contents are read back.
+		e.src, e.offset = inputFile{o.archive.f}, o.archive.pos
+		o.archive.unread += th.Size
+
+		if _, err := o.archive.f.ReadAt(head, o.archive.pos); err != nil {
+			return nil, err
+		}
+
+		return head, nil
+	}
+
+	if _, err := io.ReadFull(tr, head); err != nil {
+		return nil, err
+	}
+
+	e.r = io.MultiReader(bytes.NewReader(head), tr)
+
+	return head, nil
+}
+
+// isSparse reports whether th is a GNU or PAX sparse file.
+func isSparse(th *tar.Header) bool {
+	if th.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+
+	for k := range th.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,1107 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+const (
+	sevenZipSignature  = "7z\xbc\xaf\x27\x1c"
+	sevenZipHeaderSize = 32
+
+	// sevenZipMaxHeader bounds the (decoded) header held in memory.
+	sevenZipMaxHeader = 64 << 20
+)
+
+// 7z header property IDs.
+const (
+	szIDEnd                   = 0x00
+	szIDHeader                = 0x01
+	szIDArchiveProperties     = 0x02
+	szIDAdditionalStreamsInfo = 0x03
+	szIDMainStreamsInfo       = 0x04
+	szIDFilesInfo             = 0x05
+	szIDPackInfo              = 0x06
+	szIDUnpackInfo            = 0x07
+	szIDSubStreamsInfo        = 0x08
+	szIDSize                  = 0x09
+	szIDCRC                   = 0x0a
+	szIDFolder                = 0x0b
+	szIDCodersUnpackSize      = 0x0c
+	szIDNumUnpackStream       = 0x0d
+	szIDEmptyStream           = 0x0e
+	szIDEmptyFile             = 0x0f
+	szIDName                  = 0x11
+	szIDWinAttributes         = 0x15
+	szIDEncodedHeader         = 0x17
+	szIDDummy                 = 0x19
+)
+
+// 7z coder IDs nartar can decode.
+const (
+	szMethodCopy  = "\x00"
+	szMethodLZMA  = "\x03\x01\x01"
+	szMethodLZMA2 = "\x21"
+	szMethodBCJ   = "\x03\x03\x01\x03"
+)
+
+const (
+	szAttrDirectory     = 0x10
+	szAttrUnixExtension = 0x8000
+)
+
+type szCoder struct {
+	method   string
+	numIn    int
+	numOut   int
+	props    []byte
+	firstIn  int
+	firstOut int
+}
+
+type szBindPair struct {
+	in, out int
+}
+
+// szFolder is a 7z "folder": a graph of coders turning one or more packed
+// streams into a single unpacked stream, which may hold several files.
+type szFolder struct {
+	coders      []szCoder
+	bindPairs   []szBindPair
+	packed      []int
+	unpackSizes []uint64
+	crc         uint32
+	hasCRC      bool
+
+	firstPack int
+}
+
+type szStreamsInfo struct {
+	packPos   uint64
+	packSizes []uint64
+	folders   []*szFolder
+
+	// subSizes and subCRCs describe the files inside each folder.
+	subSizes  [][]uint64
+	subCRCs   [][]uint32
+	subHasCRC [][]bool
+}
+
+type szFile struct {
+	name      string
+	hasStream bool
+	isDir     bool
+	attrib    uint32
+	hasAttrib bool
+}
+
+// szHeaderReader decodes the structures of a 7z header. Errors are sticky;
+// once one occurs all reads return zero values.
+type szHeaderReader struct {
+	b   []byte
+	err error
+}
+
+func (r *szHeaderReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *szHeaderReader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if n > uint64(len(r.b)) {
+		r.fail(fmt.Errorf("truncated 7z header"))
+		return nil
+	}
+
+	b := r.b[:n]
+	r.b = r.b[n:]
+
+	return b
+}
+
+func (r *szHeaderReader) byte() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+
+	return b[0]
+}
+
+func (r *szHeaderReader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint32(b)
+}
+
+// number reads a 7z variable-length integer: the count of leading one bits
+// in the first byte gives the number of extra little-endian bytes.
+func (r *szHeaderReader) number() uint64 {
+	first := r.byte()
+
+	var v uint64
+
+	mask := byte(0x80)
+	for i := 0; i < 8; i++ {
+		if first&mask == 0 {
+			return v | uint64(first&(mask-1))<<(8*i)
+		}
+
+		v |= uint64(r.byte()) << (8 * i)
+		mask >>= 1
+	}
+
+	return v
+}
+
+// count reads a number used as an element count and checks that it is
+// plausible for the remaining header size.
+func (r *szHeaderReader) count() int {
+	n := r.number()
+	if n > uint64(len(r.b))+1 {
+		r.fail(fmt.Errorf("invalid 7z header count %d", n))
+		return 0
+	}
+
+	return int(n)
+}
+
+func (r *szHeaderReader) bitVector(n int) []bool {
+	v := make([]bool, n)
+
+	var b byte
+	for i := range v {
+		if i%8 == 0 {
+			b = r.byte()
+		}
+
+		v[i] = b&(0x80>>(i%8)) != 0
+	}
+
+	return v
+}
+
+// definedVector reads the "all defined" byte followed, if it is zero, by a
+// bit vector of defined items.
+func (r *szHeaderReader) definedVector(n int) []bool {
+	if r.byte() == 0 {
+		return r.bitVector(n)
+	}
+
+	v := make([]bool, n)
+	for i := range v {
+		v[i] = true
+	}
+
+	return v
+}
+
+func (r *szHeaderReader) digests(n int) ([]bool, []uint32) {
+	defined := r.definedVector(n)
+	crcs := make([]uint32, n)
+
+	for i := range crcs {
+		if defined[i] {
+			crcs[i] = r.uint32()
+		}
+	}
+
+	return defined, crcs
+}
+
+func (r *szHeaderReader) expect(id byte) {
+	if got := r.byte(); got != id && r.err == nil {
+		r.fail(fmt.Errorf("unexpected 7z header property %#x, want %#x", got, id))
+	}
+}
+
+func (r *szHeaderReader) streamsInfo() *szStreamsInfo {
+	si := &szStreamsInfo{}
+
+	id := r.byte()
+
+	if id == szIDPackInfo {
+		si.packPos = r.number()
+		si.packSizes = make([]uint64, r.count())
+
+		for id = r.byte(); id != szIDEnd && r.err == nil; id = r.byte() {
+			switch id {
+			case szIDSize:
+				for i := range si.packSizes {
+					si.packSizes[i] = r.number()
+				}
+			case szIDCRC:
+				r.digests(len(si.packSizes))
+			default:
+				r.fail(fmt.Errorf("unexpected 7z pack info property %#x", id))
+			}
+		}
+
+		id = r.byte()
+	}
+
+	if id == szIDUnpackInfo {
+		r.expect(szIDFolder)
+
+		si.folders = make([]*szFolder, r.count())
+
+		if r.byte() != 0 {
+			r.fail(fmt.Errorf("external 7z folders are not supported"))
+		}
+
+		pack := 0
+		for i := range si.folders {
+			f := r.folder()
+			if f == nil {
+				return nil
+			}
+
+			f.firstPack = pack
+			pack += len(f.packed)
+			si.folders[i] = f
+		}
+
+		r.expect(szIDCodersUnpackSize)
+
+		for _, f := range si.folders {
+			for i := range f.unpackSizes {
+				f.unpackSizes[i] = r.number()
+			}
+		}
+
+		for id = r.byte(); id != szIDEnd && r.err == nil; id = r.byte() {
+			if id != szIDCRC {
+				r.fail(fmt.Errorf("unexpected 7z unpack info property %#x", id))
+				break
+			}
+
+			defined, crcs := r.digests(len(si.folders))
+			for i, f := range si.folders {
+				f.hasCRC, f.crc = defined[i], crcs[i]
+			}
+		}
+
+		if pack > len(si.packSizes) {
+			r.fail(fmt.Errorf("7z folders use %d packed streams, archive has %d", pack, len(si.packSizes)))
+		}
+
+		id = r.byte()
+	}
+
+	// Without substream information every folder holds a single file.
+	si.subSizes = make([][]uint64, len(si.folders))
+	si.subCRCs = make([][]uint32, len(si.folders))
+	si.subHasCRC = make([][]bool, len(si.folders))
+
+	counts := make([]int, len(si.folders))
+	for i := range counts {
+		counts[i] = 1
+	}
+
+	if id == szIDSubStreamsInfo {
+		id = r.byte()
+
+		if id == szIDNumUnpackStream {
+			for i := range counts {
+				counts[i] = r.count()
+			}
+
+			id = r.byte()
+		}
+
+		for i, f := range si.folders {
+			if counts[i] == 0 {
+				continue
+			}
+
+			total := f.unpackSize()
+			sum := uint64(0)
+
+			for j := 0; j < counts[i]-1; j++ {
+				size := uint64(0)
+				if id == szIDSize {
+					size = r.number()
+				}
+
+				si.subSizes[i] = append(si.subSizes[i], size)
+				sum += size
+			}
+
+			if sum > total {
+				r.fail(fmt.Errorf("7z substream sizes exceed their folder"))
+				return nil
+			}
+
+			si.subSizes[i] = append(si.subSizes[i], total-sum)
+		}
+
+		if id == szIDSize {
+			id = r.byte()
+		}
+
+		// Folders holding exactly one file with a known CRC reuse it;
+		// all other files get their CRCs listed here.
+		unknown := 0
+		for i, f := range si.folders {
+			if counts[i] != 1 || !f.hasCRC {
+				unknown += counts[i]
+			}
+		}
+
+		for ; id != szIDEnd && r.err == nil; id = r.byte() {
+			if id != szIDCRC {
+				r.fail(fmt.Errorf("unexpected 7z substreams property %#x", id))
+				break
+			}
+
+			defined, crcs := r.digests(unknown)
+
+			k := 0
+			for i, f := range si.folders {
+				if counts[i] == 1 && f.hasCRC {
+					continue
+				}
+
+				si.subHasCRC[i] = defined[k : k+counts[i]]
+				si.subCRCs[i] = crcs[k : k+counts[i]]
+				k += counts[i]
+			}
+		}
+
+		id = r.byte()
+	} else {
+		for i, f := range si.folders {
+			si.subSizes[i] = []uint64{f.unpackSize()}
+		}
+	}
+
+	for i, f := range si.folders {
+		switch {
+		case si.subCRCs[i] != nil:
+		case counts[i] == 1:
+			si.subHasCRC[i] = []bool{f.hasCRC}
+			si.subCRCs[i] = []uint32{f.crc}
+		default:
+			si.subHasCRC[i] = make([]bool, counts[i])
+			si.subCRCs[i] = make([]uint32, counts[i])
+		}
+	}
+
+	if id != szIDEnd {
+		r.fail(fmt.Errorf("unexpected 7z streams info property %#x", id))
+	}
+
+	if r.err != nil {
+		return nil
+	}
+
+	return si
+}
+
+func (r *szHeaderReader) folder() *szFolder {
+	f := &szFolder{}
+
+	numCoders := r.count()
+	if numCoders == 0 && r.err == nil {
+		r.fail(fmt.Errorf("7z folder without coders"))
+	}
+
+	numIn, numOut := 0, 0
+
+	for i := 0; i < numCoders && r.err == nil; i++ {
+		flags := r.byte()
+		if flags&0x80 != 0 {
+			r.fail(fmt.Errorf("alternative 7z coder methods are not supported"))
+			break
+		}
+
+		c := szCoder{method: string(r.bytes(uint64(flags & 0x0f))), numIn: 1, numOut: 1}
+
+		if flags&0x10 != 0 {
+			c.numIn = r.count()
+			c.numOut = r.count()
+		}
+
+		if flags&0x20 != 0 {
+			c.props = r.bytes(r.number())
+		}
+
+		c.firstIn, c.firstOut = numIn, numOut
+		numIn += c.numIn
+		numOut += c.numOut
+
+		f.coders = append(f.coders, c)
+	}
+
+	if numOut == 0 {
+		r.fail(fmt.Errorf("7z folder without output streams"))
+		return nil
+	}
+
+	for i := 0; i < numOut-1 && r.err == nil; i++ {
+		f.bindPairs = append(f.bindPairs, szBindPair{in: int(r.number()), out: int(r.number())})
+	}
+
+	numPacked := numIn - len(f.bindPairs)
+	if numPacked < 1 {
+		r.fail(fmt.Errorf("7z folder without packed streams"))
+		return nil
+	}
+
+	if numPacked == 1 {
+		for i := 0; i < numIn; i++ {
+			if f.bindPairForIn(i) < 0 {
+				f.packed = append(f.packed, i)
+				break
+			}
+		}
+	} else {
+		for i := 0; i < numPacked; i++ {
+			f.packed = append(f.packed, int(r.number()))
+		}
+	}
+
+	f.unpackSizes = make([]uint64, numOut)
+
+	if r.err != nil {
+		return nil
+	}
+
+	return f
+}
+
+func (f *szFolder) bindPairForIn(in int) int {
+	for i, bp := range f.bindPairs {
+		if bp.in == in {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// mainOut returns the output stream that is not consumed by another coder.
+func (f *szFolder) mainOut() int {
+	for out := range f.unpackSizes {
+		bound := false
+		for _, bp := range f.bindPairs {
+			if bp.out == out {
+				bound = true
+			}
+		}
+
+		if !bound {
+			return out
+		}
+	}
+
+	return 0
+}
+
+func (f *szFolder) unpackSize() uint64 {
+	if len(f.unpackSizes) == 0 {
+		return 0
+	}
+
+	return f.unpackSizes[f.mainOut()]
+}
+
+// reader returns the decoded contents of the folder; packs are the folder's
+// packed streams in order.
+func (f *szFolder) reader(packs []io.Reader) (io.Reader, error) {
+	return f.outReader(f.mainOut(), packs, 0)
+}
+
+func (f *szFolder) outReader(out int, packs []io.Reader, depth int) (io.Reader, error) {
+	if depth > len(f.coders) {
+		return nil, fmt.Errorf("7z coder graph has a cycle")
+	}
+
+	for _, c := range f.coders {
+		if out < c.firstOut || out >= c.firstOut+c.numOut {
+			continue
+		}
+
+		if c.numIn != 1 || c.numOut != 1 {
+			return nil, fmt.Errorf("unsupported 7z coder %x with %d inputs", c.method, c.numIn)
+		}
+
+		var src io.Reader
+
+		if bp := f.bindPairForIn(c.firstIn); bp >= 0 {
+			var err error
+			if src, err = f.outReader(f.bindPairs[bp].out, packs, depth+1); err != nil {
+				return nil, err
+			}
+		} else {
+			for k, in := range f.packed {
+				if in == c.firstIn {
+					src = packs[k]
+				}
+			}
+
+			if src == nil {
+				return nil, fmt.Errorf("7z coder input %d is not connected", c.firstIn)
+			}
+		}
+
+		return szDecoder(c, src, f.unpackSizes[out])
+	}
+
+	return nil, fmt.Errorf("7z folder has no coder for stream %d", out)
+}
+
+func szDecoder(c szCoder, src io.Reader, size uint64) (io.Reader, error) {
+	var r io.Reader
+
+	switch c.method {
+	case szMethodCopy:
+		r = src
+	case szMethodLZMA:
+		if len(c.props) != 5 {
+			return nil, fmt.Errorf("invalid 7z LZMA properties")
+		}
+
+		// 7z keeps the LZMA properties in the header; rebuild the
+		// classic .lzma header in front of the raw stream.
+		hdr := make([]byte, 13)
+		copy(hdr, c.props)
+		binary.LittleEndian.PutUint64(hdr[5:], size)
+
+		lr, err := lzma.NewReader(io.MultiReader(bytes.NewReader(hdr), src))
+		if err != nil {
+			return nil, fmt.Errorf("opening 7z LZMA stream: %w", err)
+		}
+
+		r = lr
+	case szMethodLZMA2:
+		if len(c.props) != 1 || c.props[0] > 40 {
+			return nil, fmt.Errorf("invalid 7z LZMA2 properties")
+		}
+
+		dictCap := int64(0xffffffff)
+		if p := c.props[0]; p < 40 {
+			dictCap = int64(2|p&1) << (p/2 + 11)
+		}
+
+		if dictCap > lzma.MaxDictCap {
+			dictCap = lzma.MaxDictCap
+		}
+
+		lr, err := lzma.Reader2Config{DictCap: int(dictCap)}.NewReader2(src)
+		if err != nil {
+			return nil, fmt.Errorf("opening 7z LZMA2 stream: %w", err)
+		}
+
+		r = lr
+	case szMethodBCJ:
+		r = newBCJReader(src)
+	default:
+		return nil, fmt.Errorf("unsupported 7z compression method %x", c.method)
+	}
+
+	return io.LimitReader(r, int64(size)), nil
+}
+
+func (r *szHeaderReader) filesInfo() []szFile {
+	files := make([]szFile, r.count())
+
+	var emptyStream, emptyFile []bool
+
+	for r.err == nil {
+		id := r.byte()
+		if id == szIDEnd {
+			break
+		}
+
+		data := &szHeaderReader{b: r.bytes(r.number())}
+
+		switch id {
+		case szIDEmptyStream:
+			emptyStream = data.bitVector(len(files))
+		case szIDEmptyFile:
+			n := 0
+			for _, e := range emptyStream {
+				if e {
+					n++
+				}
+			}
+
+			emptyFile = data.bitVector(n)
+		case szIDName:
+			if data.byte() != 0 {
+				r.fail(fmt.Errorf("external 7z names are not supported"))
+				break
+			}
+
+			for i := range files {
+				files[i].name = data.utf16String()
+			}
+		case szIDWinAttributes:
+			defined := data.definedVector(len(files))
+			if data.byte() != 0 {
+				r.fail(fmt.Errorf("external 7z attributes are not supported"))
+				break
+			}
+
+			for i := range files {
+				if defined[i] {
+					files[i].attrib = data.uint32()
+					files[i].hasAttrib = true
+				}
+			}
+		default:
+			// Timestamps, anti items, padding and the like.
+			continue
+		}
+
+		r.fail(data.err)
+	}
+
+	k := 0
+	for i := range files {
+		files[i].hasStream = true
+
+		if i < len(emptyStream) && emptyStream[i] {
+			files[i].hasStream = false
+			files[i].isDir = k >= len(emptyFile) || !emptyFile[k]
+			k++
+		}
+
+		if files[i].hasAttrib && files[i].attrib&szAttrDirectory != 0 {
+			files[i].isDir = true
+		}
+	}
+
+	return files
+}
+
+func (r *szHeaderReader) utf16String() string {
+	var units []uint16
+
+	for r.err == nil {
+		b := r.bytes(2)
+		if b == nil {
+			break
+		}
+
+		u := binary.LittleEndian.Uint16(b)
+		if u == 0 {
+			break
+		}
+
+		units = append(units, u)
+	}
+
+	return string(utf16.Decode(units))
+}
+
+// sevenZipArchive is an opened 7z archive.
+type sevenZipArchive struct {
+	f       *os.File
+	streams *szStreamsInfo
+	files   []szFile
+}
+
+func openSevenZip(f *os.File) (*sevenZipArchive, error) {
+	var sh [sevenZipHeaderSize]byte
+	if _, err := io.ReadFull(io.NewSectionReader(f, 0, sevenZipHeaderSize), sh[:]); err != nil {
+		return nil, fmt.Errorf("reading 7z signature header: %w", unexpectedEOF(err))
+	}
+
+	if string(sh[:6]) != sevenZipSignature {
+		return nil, fmt.Errorf("not a 7z archive")
+	}
+
+	if crc32.ChecksumIEEE(sh[12:32]) != binary.LittleEndian.Uint32(sh[8:]) {
+		return nil, fmt.Errorf("7z signature header CRC mismatch")
+	}
+
+	offset := binary.LittleEndian.Uint64(sh[12:])
+	size := binary.LittleEndian.Uint64(sh[20:])
+
+	if size > sevenZipMaxHeader || offset > 1<<62 {
+		return nil, fmt.Errorf("7z header too large")
+	}
+
+	header := make([]byte, size)
+	if _, err := f.ReadAt(header, int64(sevenZipHeaderSize+offset)); err != nil {
+		return nil, fmt.Errorf("reading 7z header: %w", unexpectedEOF(err))
+	}
+
+	if crc32.ChecksumIEEE(header) != binary.LittleEndian.Uint32(sh[28:]) {
+		return nil, fmt.Errorf("7z header CRC mismatch")
+	}
+
+	a := &sevenZipArchive{f: f}
+
+	for {
+		r := &szHeaderReader{b: header}
+
+		switch id := r.byte(); id {
+		case szIDHeader:
+			if err := a.readHeader(r); err != nil {
+				return nil, err
+			}
+
+			return a, nil
+		case szIDEncodedHeader:
+			si := r.streamsInfo()
+			if r.err != nil {
+				return nil, fmt.Errorf("reading 7z encoded header: %w", r.err)
+			}
+
+			if len(si.folders) == 0 {
+				return nil, fmt.Errorf("7z encoded header has no data")
+			}
+
+			if si.folders[0].unpackSize() > sevenZipMaxHeader {
+				return nil, fmt.Errorf("7z header too large")
+			}
+
+			fr, err := a.folderReader(si, 0)
+			if err != nil {
+				return nil, fmt.Errorf("decoding 7z header: %w", err)
+			}
+
+			if header, err = io.ReadAll(fr); err != nil {
+				return nil, fmt.Errorf("decoding 7z header: %w", err)
+			}
+
+			if uint64(len(header)) != si.folders[0].unpackSize() {
+				return nil, fmt.Errorf("decoding 7z header: %w", io.ErrUnexpectedEOF)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected 7z header type %#x", id)
+		}
+	}
+}
+
+func (a *sevenZipArchive) readHeader(r *szHeaderReader) error {
+	id := r.byte()
+
+	if id == szIDArchiveProperties {
+		for t := r.byte(); t != szIDEnd && r.err == nil; t = r.byte() {
+			r.bytes(r.number())
+		}
+
+		id = r.byte()
+	}
+
+	if id == szIDAdditionalStreamsInfo {
+		return fmt.Errorf("7z additional streams are not supported")
+	}
+
+	a.streams = &szStreamsInfo{}
+
+	if id == szIDMainStreamsInfo {
+		a.streams = r.streamsInfo()
+		id = r.byte()
+	}
+
+	if id == szIDFilesInfo {
+		a.files = r.filesInfo()
+		id = r.byte()
+	}
+
+	if r.err == nil && id != szIDEnd {
+		r.fail(fmt.Errorf("unexpected 7z header property %#x", id))
+	}
+
+	if r.err != nil {
+		return fmt.Errorf("reading 7z header: %w", r.err)
+	}
+
+	return nil
+}
+
+// folderReader returns the unpacked contents of folder i of si.
+func (a *sevenZipArchive) folderReader(si *szStreamsInfo, i int) (io.Reader, error) {
+	f := si.folders[i]
+
+	offset := int64(sevenZipHeaderSize) + int64(si.packPos)
+	for _, size := range si.packSizes[:f.firstPack] {
+		offset += int64(size)
+	}
+
+	packs := make([]io.Reader, len(f.packed))
+	for k := range packs {
+		size := int64(si.packSizes[f.firstPack+k])
+		packs[k] = io.NewSectionReader(a.f, offset, size)
+		offset += size
+	}
+
+	return f.reader(packs)
+}
+
+// sevenZipToNar converts the contents of a 7z archive into a NAR whose root
+// directory is the archive root.
+func sevenZipToNar(f *os.File, out io.Writer, opts *readOptions) error {
+	a, err := openSevenZip(f)
+	if err != nil {
+		return err
+	}
+
+	entries := newEntryTree()
+
+	var slab entrySlab
+
+	var counter limitCounter
+
+	folder, sub := 0, 0
+
+	var fr io.Reader
+
+	for _, file := range a.files {
+		name := strings.ReplaceAll(file.name, "\\", "/")
+
+		p, skip, err := opts.archivePath(name, "")
+		if err != nil {
+			return fmt.Errorf("invalid 7z entry path %q: %w", file.name, err)
+		}
+
+		var data []byte
+
+		if file.hasStream {
+			// Files with data consume the substreams of the folders in
+			// order; empty folders hold no files.
+			for folder < len(a.streams.folders) && sub >= len(a.streams.subSizes[folder]) {
+				folder++
+				sub = 0
+				fr = nil
+			}
+
+			if folder >= len(a.streams.folders) {
+				return fmt.Errorf("7z entry %q has no data stream", file.name)
+			}
+
+			if fr == nil {
+				if fr, err = a.folderReader(a.streams, folder); err != nil {
+					return fmt.Errorf("reading 7z entry %q: %w", file.name, err)
+				}
+			}
+
+			if err := counter.file(p, int64(a.streams.subSizes[folder][sub])); err != nil {
+				return err
+			}
+
+			data = make([]byte, a.streams.subSizes[folder][sub])
+			if _, err := io.ReadFull(fr, data); err != nil {
+				return fmt.Errorf("reading 7z entry %q: %w", file.name, unexpectedEOF(err))
+			}
+
+			if a.streams.subHasCRC[folder][sub] && crc32.ChecksumIEEE(data) != a.streams.subCRCs[folder][sub] {
+				return fmt.Errorf("7z entry %q CRC mismatch", file.name)
+			}
+
+			sub++
+		}
+
+		if skip {
+			continue
+		}
+
+		if err := counter.entry(p); err != nil {
+			return err
+		}
+
+		mode := int64(0)
+		if file.hasAttrib && file.attrib&szAttrUnixExtension != 0 {
+			mode = int64(file.attrib >> 16)
+		}
+
+		switch {
+		case file.isDir:
+			logEntry("directory", file.name, 0, "")
+			if err := opts.addEntry(entries, p, slab.entry(tarEntry{kind: tar.TypeDir})); err != nil {
+				return err
+			}
+		case mode&unixModeType == unixModeSymlink:
+			logEntry("symlink", file.name, 0, string(data))
+			e, err := opts.symlinkEntry(&slab, p, string(data))
+			if err != nil {
+				return err
+			}
+
+			if err := opts.addEntry(entries, p, e); err != nil {
+				return err
+			}
+		case mode&unixModeType == 0 || mode&unixModeType == unixModeRegular:
+			logEntry("regular", file.name, int64(len(data)), "")
+			if err := opts.addEntry(entries, p, slab.entry(tarEntry{
+				kind:       tar.TypeReg,
+				data:       data,
+				executable: opts.isExecutable(mode&0o111 != 0, data),
+			})); err != nil {
+				return err
+			}
+		default:
+			logEntry("special file", file.name, 0, "")
+			e, err := opts.specialEntry(file.name, "special file", p)
+			if err != nil {
+				return err
+			}
+
+			if e != nil {
+				if err := opts.addEntry(entries, p, e); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return writeNarEntries(entries, out)
+}
+
+// bcjReader undoes the 7z/xz x86 branch converter, which turns the relative
+// targets of E8/E9 call and jump instructions into absolute addresses to
+// make executables compress better.
+type bcjReader struct {
+	r        io.Reader
+	buf      []byte
+	start    int // start of decoded bytes not yet returned
+	decoded  int // end of decoded bytes
+	pos      uint32
+	prevMask uint32
+	prevPos  uint32
+	eof      bool
+}
+
+func newBCJReader(r io.Reader) *bcjReader {
+	return &bcjReader{r: r, buf: make([]byte, 0, 64<<10), prevPos: ^uint32(4)}
+}
+
+func (br *bcjReader) Read(p []byte) (int, error) {
+	for br.start == br.decoded {
+		if br.eof {
+			// The last few bytes cannot hold an instruction and are
+			// passed through unchanged.
+			if br.decoded == len(br.buf) {
+				return 0, io.EOF
+			}
+
+			br.decoded = len(br.buf)
+
+			break
+		}
+
+		copy(br.buf, br.buf[br.start:])
+		br.buf = br.buf[:len(br.buf)-br.start]
+		br.decoded -= br.start
+		br.start = 0
+
+		n, err := br.r.Read(br.buf[len(br.buf):cap(br.buf)])
+		br.buf = br.buf[:len(br.buf)+n]
+
+		if errors.Is(err, io.EOF) {
+			br.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+
+		br.decoded += br.x86(br.buf[br.decoded:])
+	}
+
+	n := copy(p, br.buf[br.start:br.decoded])
+	br.start += n
+
+	return n, nil
+}
+
+// x86 decodes the instructions in b and returns how many bytes are final.
+// It follows the x86 filter of xz/LZMA SDK.
+func (br *bcjReader) x86(b []byte) int {
+	allowed := [8]bool{true, true, true, false, true, false, false, false}
+	bitNumber := [8]uint32{0, 1, 2, 2, 3, 3, 3, 3}
+
+	test := func(b byte) bool { return b == 0 || b == 0xff }
+
+	if len(b) < 5 {
+		return 0
+	}
+
+	now := br.pos
+	prevMask, prevPos := br.prevMask, br.prevPos
+
+	if now-prevPos > 5 {
+		prevPos = now - 5
+	}
+
+	i := 0
+	for i <= len(b)-5 {
+		if b[i] != 0xe8 && b[i] != 0xe9 {
+			i++
+			continue
+		}
+
+		offset := now + uint32(i) - prevPos
+		prevPos = now + uint32(i)
+
+		if offset > 5 {
+			prevMask = 0
+		} else {
+			for k := uint32(0); k < offset; k++ {
+				prevMask &= 0x77
+				prevMask <<= 1
+			}
+		}
+
+		c := b[i+4]
+
+		if test(c) && allowed[(prevMask>>1)&7] && prevMask>>1 < 0x10 {
+			src := uint32(c)<<24 | uint32(b[i+3])<<16 | uint32(b[i+2])<<8 | uint32(b[i+1])
+
+			var dest uint32
+			for {
+				dest = src - (now + uint32(i) + 5)
+				if prevMask == 0 {
+					break
+				}
+
+				k := bitNumber[prevMask>>1]
+				if !test(byte(dest >> (24 - k*8))) {
+					break
+				}
+
+				src = dest ^ (1<<(32-k*8) - 1)
+			}
+
+			b[i+4] = ^byte((dest>>24)&1 - 1)
+			b[i+3] = byte(dest >> 16)
+			b[i+2] = byte(dest >> 8)
+			b[i+1] = byte(dest)
+			i += 5
+			prevMask = 0
+		} else {
+			i++
+			prevMask |= 1
+
+			if test(c) {
+				prevMask |= 0x10
+			}
+		}
+	}
+
+	br.prevMask, br.prevPos = prevMask, prevPos
+	br.pos += uint32(i)
+
+	return i
+}
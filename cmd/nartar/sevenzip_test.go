@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// szTestFile is an entry of the archives the 7z tests build.
+type szTestFile struct {
+	name string
+	mode int64
+	data string
+}
+
+// szTestFiles returns entries as the files of a 7z archive, without the
+// root.
+func szTestFiles(entries map[string]testEntry) []szTestFile {
+	paths := make([]string, 0, len(entries))
+	for p := range entries {
+		if p != "/" {
+			paths = append(paths, p)
+		}
+	}
+
+	sort.Strings(paths)
+
+	var files []szTestFile
+
+	for _, p := range paths {
+		e := entries[p]
+		f := szTestFile{name: strings.TrimPrefix(p, "/"), data: e.data}
+
+		switch {
+		case e.typ == nar.TypeDirectory:
+			f.mode = unixModeDir | 0o755
+		case e.typ == nar.TypeSymlink:
+			f.mode, f.data = unixModeSymlink|0o777, e.target
+		case e.exec:
+			f.mode = unixModeRegular | 0o755
+		default:
+			f.mode = unixModeRegular | 0o644
+		}
+
+		files = append(files, f)
+	}
+
+	return files
+}
+
+// szTestCoder is a coder of a folder the 7z tests build.
+type szTestCoder struct {
+	method string
+	props  []byte
+}
+
+// szEncoder packs the data of a folder. Its first coder gives the data, and
+// each coder reads from the output of the next one.
+type szEncoder func(t *testing.T, data []byte) ([]byte, []szTestCoder)
+
+func szCopy(t *testing.T, data []byte) ([]byte, []szTestCoder) {
+	return data, []szTestCoder{{method: szMethodCopy}}
+}
+
+func szLZMA(t *testing.T, data []byte) ([]byte, []szTestCoder) {
+	t.Helper()
+
+	var b bytes.Buffer
+
+	w, err := lzma.WriterConfig{DictCap: 1 << 20, SizeInHeader: true, Size: int64(len(data))}.NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 7z keeps the properties and dictionary size of the .lzma header, but
+	// not the size.
+	return b.Bytes()[13:], []szTestCoder{{method: szMethodLZMA, props: b.Bytes()[:5]}}
+}
+
+func szLZMA2(t *testing.T, data []byte) ([]byte, []szTestCoder) {
+	t.Helper()
+
+	var b bytes.Buffer
+
+	w, err := lzma.Writer2Config{DictCap: 1 << 20}.NewWriter2(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The property 16 is a 1 MiB dictionary.
+	return b.Bytes(), []szTestCoder{{method: szMethodLZMA2, props: []byte{16}}}
+}
+
+// szNumber encodes v as a 7z number: the leading one bits of the first byte
+// count the little-endian bytes that follow, and its other bits hold the
+// highest bits of v.
+func szNumber(v uint64) []byte {
+	for n := 0; n < 8; n++ {
+		if v>>(8*n) < 1<<(7-n) {
+			b := []byte{byte(uint16(0xff00)>>n) | byte(v>>(8*n))}
+			for i := 0; i < n; i++ {
+				b = append(b, byte(v>>(8*i)))
+			}
+
+			return b
+		}
+	}
+
+	return binary.LittleEndian.AppendUint64([]byte{0xff}, v)
+}
+
+func szBits(v []bool) []byte {
+	b := make([]byte, (len(v)+7)/8)
+	for i, set := range v {
+		if set {
+			b[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+
+	return b
+}
+
+// szTestFolder is a folder the 7z tests build, with its unpacked size and
+// CRC.
+type szTestFolder struct {
+	coders []szTestCoder
+	size   int
+	crc    uint32
+}
+
+// szTestStreamsInfo returns the streams info of packed streams of the given
+// sizes at packPos, holding folders. subSizes, when not nil, splits the
+// only folder into files.
+func szTestStreamsInfo(packPos int, packs []int, folders []szTestFolder, subSizes []int, subCRCs []uint32) []byte {
+	b := []byte{szIDPackInfo}
+	b = append(b, szNumber(uint64(packPos))...)
+	b = append(b, szNumber(uint64(len(packs)))...)
+
+	b = append(b, szIDSize)
+	for _, n := range packs {
+		b = append(b, szNumber(uint64(n))...)
+	}
+
+	b = append(b, szIDEnd, szIDUnpackInfo, szIDFolder)
+	b = append(b, szNumber(uint64(len(folders)))...)
+	b = append(b, 0)
+
+	for _, f := range folders {
+		b = append(b, szNumber(uint64(len(f.coders)))...)
+
+		for _, c := range f.coders {
+			flags := byte(len(c.method))
+			if c.props != nil {
+				flags |= 0x20
+			}
+
+			b = append(b, flags)
+			b = append(b, c.method...)
+
+			if c.props != nil {
+				b = append(b, szNumber(uint64(len(c.props)))...)
+				b = append(b, c.props...)
+			}
+		}
+
+		// Bind the input of each coder to the output of the next.
+		for i := 1; i < len(f.coders); i++ {
+			b = append(b, szNumber(uint64(i-1))...)
+			b = append(b, szNumber(uint64(i))...)
+		}
+	}
+
+	b = append(b, szIDCodersUnpackSize)
+	for _, f := range folders {
+		for range f.coders {
+			b = append(b, szNumber(uint64(f.size))...)
+		}
+	}
+
+	b = append(b, szIDCRC, 1)
+	for _, f := range folders {
+		b = binary.LittleEndian.AppendUint32(b, f.crc)
+	}
+
+	b = append(b, szIDEnd)
+
+	if subSizes != nil {
+		b = append(b, szIDSubStreamsInfo, szIDNumUnpackStream)
+		b = append(b, szNumber(uint64(len(subSizes)))...)
+
+		b = append(b, szIDSize)
+		for _, n := range subSizes[:len(subSizes)-1] {
+			b = append(b, szNumber(uint64(n))...)
+		}
+
+		b = append(b, szIDCRC, 1)
+		for _, crc := range subCRCs {
+			b = binary.LittleEndian.AppendUint32(b, crc)
+		}
+
+		b = append(b, szIDEnd)
+	}
+
+	return append(b, szIDEnd)
+}
+
+// build7z returns a 7z archive of files, packed by encode into one folder
+// when solid and into a folder per file otherwise, with the header itself
+// LZMA-compressed when encodeHeader.
+func build7z(t *testing.T, files []szTestFile, encode szEncoder, solid, encodeHeader bool) []byte {
+	t.Helper()
+
+	var (
+		body      []byte
+		packs     []int
+		folders   []szTestFolder
+		subSizes  []int
+		subCRCs   []uint32
+		solidData []byte
+	)
+
+	pack := func(data []byte) {
+		packed, coders := encode(t, data)
+		body = append(body, packed...)
+		packs = append(packs, len(packed))
+		folders = append(folders, szTestFolder{coders: coders, size: len(data), crc: crc32.ChecksumIEEE(data)})
+	}
+
+	var empty, emptyFile []bool
+
+	for _, f := range files {
+		hasStream := f.data != ""
+		empty = append(empty, !hasStream)
+
+		if !hasStream {
+			emptyFile = append(emptyFile, f.mode&unixModeType != unixModeDir)
+			continue
+		}
+
+		if !solid {
+			pack([]byte(f.data))
+			continue
+		}
+
+		solidData = append(solidData, f.data...)
+		subSizes = append(subSizes, len(f.data))
+		subCRCs = append(subCRCs, crc32.ChecksumIEEE([]byte(f.data)))
+	}
+
+	if solid {
+		pack(solidData)
+	}
+
+	header := []byte{szIDHeader, szIDMainStreamsInfo}
+	header = append(header, szTestStreamsInfo(0, packs, folders, subSizes, subCRCs)...)
+
+	header = append(header, szIDFilesInfo)
+	header = append(header, szNumber(uint64(len(files)))...)
+
+	property := func(id byte, data []byte) {
+		header = append(header, id)
+		header = append(header, szNumber(uint64(len(data)))...)
+		header = append(header, data...)
+	}
+
+	property(szIDEmptyStream, szBits(empty))
+	property(szIDEmptyFile, szBits(emptyFile))
+
+	names := []byte{0}
+	for _, f := range files {
+		for _, u := range utf16.Encode([]rune(f.name)) {
+			names = binary.LittleEndian.AppendUint16(names, u)
+		}
+
+		names = append(names, 0, 0)
+	}
+
+	property(szIDName, names)
+
+	attribs := []byte{1, 0}
+	for _, f := range files {
+		attrib := uint32(szAttrUnixExtension) | uint32(f.mode)<<16
+		if f.mode&unixModeType == unixModeDir {
+			attrib |= szAttrDirectory
+		}
+
+		attribs = binary.LittleEndian.AppendUint32(attribs, attrib)
+	}
+
+	property(szIDWinAttributes, attribs)
+
+	header = append(header, szIDEnd, szIDEnd)
+
+	if encodeHeader {
+		packed, coders := szLZMA(t, header)
+		folder := szTestFolder{coders: coders, size: len(header), crc: crc32.ChecksumIEEE(header)}
+
+		packPos := len(body)
+		body = append(body, packed...)
+		header = append([]byte{szIDEncodedHeader}, szTestStreamsInfo(packPos, []int{len(packed)}, []szTestFolder{folder}, nil, nil)...)
+	}
+
+	start := binary.LittleEndian.AppendUint64(nil, uint64(len(body)))
+	start = binary.LittleEndian.AppendUint64(start, uint64(len(header)))
+	start = binary.LittleEndian.AppendUint32(start, crc32.ChecksumIEEE(header))
+
+	archive := []byte(sevenZipSignature + "\x00\x04")
+	archive = binary.LittleEndian.AppendUint32(archive, crc32.ChecksumIEEE(start))
+	archive = append(archive, start...)
+	archive = append(archive, body...)
+
+	return append(archive, header...)
+}
+
+// read7z returns the entries of the NAR sevenZipToNar makes of archive.
+func read7z(t *testing.T, archive []byte) map[string]testEntry {
+	t.Helper()
+
+	name := filepath.Join(t.TempDir(), "test.7z")
+	if err := os.WriteFile(name, archive, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var out bytes.Buffer
+	if err := sevenZipToNar(f, &out, testReadOptions(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	return readNar(t, out.Bytes())
+}
+
+func TestSevenZipRoundTrip(t *testing.T) {
+	// 7z archives from Windows may separate names with backslashes.
+	files := append(szTestFiles(testTree), szTestFile{name: `share\doc\NOTES`, mode: unixModeRegular | 0o644, data: "notes\n"})
+
+	want := map[string]testEntry{"/share/doc/NOTES": {typ: nar.TypeRegular, data: "notes\n"}}
+	for p, e := range testTree {
+		want[p] = e
+	}
+
+	methods := []struct {
+		name   string
+		encode szEncoder
+	}{
+		{"copy", szCopy},
+		{"lzma", szLZMA},
+		{"lzma2", szLZMA2},
+	}
+
+	for _, m := range methods {
+		for _, solid := range []bool{false, true} {
+			for _, encodeHeader := range []bool{false, true} {
+				t.Run(fmt.Sprintf("%s/solid=%t/encoded-header=%t", m.name, solid, encodeHeader), func(t *testing.T) {
+					checkEntries(t, read7z(t, build7z(t, files, m.encode, solid, encodeHeader)), want)
+				})
+			}
+		}
+	}
+}
+
+// bcjPlain is machine-code-like data, with E8 and E9 opcodes throughout,
+// and bcjEncoded the same data through the x86 branch converter of xz.
+var (
+	bcjPlain   = bcjTestData()
+	bcjEncoded = mustDecodeHex(
+		"e9ff00909012e800e8e89012e8f91212000000e80100130000e80012ffe90b13" +
+			"e9ff1212ff9000e815ea000090e90012e91d01e9ff12e8ffe8901290909090e8" +
+			"ff00e85912ffffffe93500e9ff9090e812e890e8ff909090e86fe91200e8f290" +
+			"e900e990e800e800e812e912e9ff90e886ff00ffffffff00e9e9e90012e89012" +
+			"e81591e9ffe97213e9ff00e920911200ff90e8a990120012009012ff90001290" +
+			"120000ffff90e9ffe9ffe8e890129090e9ff1212e9e9e800121290e912e80090" +
+			"ff90900012e812ff00e8ff0090e800e8e690e8ff12e9d9eaff0090e9df01ffff" +
+			"e900e8001290e9ff12ffe8d891e800001212e8dfe99000e8ffe812e9129112ff" +
+			"ffe918ea900012ffe91f0091009000e8e812e912e9ff12e912001290ffe81212" +
+			"00e8e9e8901290ff0090e890e93113e9ffe9e99000e990e94e91ff009090e9d3" +
+			"e9e800001212ffe9000090e9620112ff120012e96a0000ffff00e800909012ff" +
+			"ffff00e9ffe890e9e990e8e8e812e8121290e8901212e864ea90ffe9690290ff" +
+			"e91514e9ffe873eaff00e88f01ff00e8ff1200e91290129090e89000ffe9a102" +
+			"ffff12909090ffe912129012e9009000121212001200e812121212121212e912" +
+			"e8aeeae800e9e80090e9e95f92e9ff9000e800e9ff9090e8009090e9c992ffff" +
+			"ffe9009012e8ff90e8d5ebe80090e8e9e80090121212e9fb0091ff12e8e81402" +
+			"900000",
+	)
+)
+
+func bcjTestData() []byte {
+	opcodes := []byte{0xe8, 0x90, 0xe9, 0x00, 0xff, 0x12}
+
+	b := make([]byte, 515)
+
+	x := uint32(1)
+	for i := range b {
+		x = (x*1103515245 + 12345) & 0x7fffffff
+		b[i] = opcodes[(x>>16)%uint32(len(opcodes))]
+	}
+
+	return b
+}
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+func TestSevenZipBCJ(t *testing.T) {
+	// The other files hold no E8 or E9 bytes, which the converter leaves
+	// alone.
+	bcj := func(t *testing.T, data []byte) ([]byte, []szTestCoder) {
+		t.Helper()
+
+		encoded := data
+		if bytes.Equal(data, bcjPlain) {
+			encoded = bcjEncoded
+		} else if bytes.IndexByte(data, 0xe8) >= 0 || bytes.IndexByte(data, 0xe9) >= 0 {
+			t.Fatalf("no BCJ encoding for %q", data)
+		}
+
+		packed, coders := szLZMA2(t, encoded)
+
+		return packed, append([]szTestCoder{{method: szMethodBCJ}}, coders...)
+	}
+
+	files := append(szTestFiles(testTree), szTestFile{name: "bin/code", mode: unixModeRegular | 0o755, data: string(bcjPlain)})
+
+	want := map[string]testEntry{"/bin/code": {typ: nar.TypeRegular, exec: true, data: string(bcjPlain)}}
+	for p, e := range testTree {
+		want[p] = e
+	}
+
+	for _, encodeHeader := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encoded-header=%t", encodeHeader), func(t *testing.T) {
+			checkEntries(t, read7z(t, build7z(t, files, bcj, false, encodeHeader)), want)
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	paxIgnore = "ignore"
+	paxReport = "report"
+)
+
+// paxBasicKeys are PAX records describing header fields. They are either
+// represented in the NAR (path, linkpath, size) or deliberately normalized,
+// and archive/tar ignores them when writing PAXRecords.
+var paxBasicKeys = map[string]bool{
+	"path":     true,
+	"linkpath": true,
+	"size":     true,
+	"uid":      true,
+	"gid":      true,
+	"uname":    true,
+	"gname":    true,
+	"mtime":    true,
+	"atime":    true,
+	"ctime":    true,
+}
+
+// sidecar holds the metadata a NAR cannot carry, keyed by NAR path, so that
+// tar2nar and nar2tar can hand it to each other alongside the NAR.
+type sidecar struct {
+	Version int                      `json:"version"`
+	Entries map[string]*sidecarEntry `json:"entries"`
+}
+
+type sidecarEntry struct {
+	PAX map[string]string `json:"pax,omitempty"`
+
+	// Mtime is the original modification time in RFC 3339 format, recorded
+	// by tar2nar -preserve-mtime.
+	Mtime string `json:"mtime,omitempty"`
+
+	mtime time.Time // parsed Mtime
+}
+
+func newSidecar() *sidecar {
+	return &sidecar{Version: 1, Entries: make(map[string]*sidecarEntry)}
+}
+
+func (s *sidecar) entry(p string) *sidecarEntry {
+	e := s.Entries[p]
+	if e == nil {
+		e = &sidecarEntry{}
+		s.Entries[p] = e
+	}
+
+	return e
+}
+
+func readSidecar(name string) (*sidecar, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSidecar()
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("parsing sidecar %s: %w", name, err)
+	}
+
+	if s.Version != 1 {
+		return nil, fmt.Errorf("unsupported sidecar version %d in %s", s.Version, name)
+	}
+
+	for p, e := range s.Entries {
+		if e == nil || e.Mtime == "" {
+			continue
+		}
+
+		if e.mtime, err = time.Parse(time.RFC3339Nano, e.Mtime); err != nil {
+			return nil, fmt.Errorf("invalid mtime for %s in %s: %w", p, name, err)
+		}
+	}
+
+	return s, nil
+}
+
+func writeSidecar(name string, s *sidecar) error {
+	f, err := createOutputFile(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := writeJSON(f, s); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// extraPAXRecords returns the records of a tar header that have no place in
+// a NAR, or nil if there are none.
+func extraPAXRecords(records map[string]string) map[string]string {
+	var extra map[string]string
+
+	for k, v := range records {
+		// Sparse maps are consumed by archive/tar when reading the data.
+		if paxBasicKeys[k] || strings.HasPrefix(k, "GNU.sparse.") {
+			continue
+		}
+
+		if extra == nil {
+			extra = make(map[string]string)
+		}
+
+		extra[k] = v
+	}
+
+	return extra
+}
+
+// mergePAXRecords returns the records of base overridden by those of local.
+func mergePAXRecords(base, local map[string]string) map[string]string {
+	if len(base) == 0 {
+		return local
+	}
+
+	merged := make(map[string]string, len(base)+len(local))
+	for k, v := range base {
+		merged[k] = v
+	}
+
+	for k, v := range local {
+		merged[k] = v
+	}
+
+	return merged
+}
+
+// reportPAXRecords lists the PAX records that tar2nar could not store in
+// the NAR.
+func reportPAXRecords(w io.Writer, entries *entryTree) {
+	entries.walk(func(p string, e *tarEntry) error {
+		if len(e.pax) > 0 {
+			fmt.Fprintf(w, "dropped PAX records for %s: %s\n", p, strings.Join(paxRecordKeys(e), ", "))
+		}
+
+		return nil
+	})
+}
+
+// warnDroppedPAXRecords reports the PAX records dropped without -pax report
+// or -sidecar as ignored-pax warnings.
+func warnDroppedPAXRecords(entries *entryTree) error {
+	return entries.walk(func(p string, e *tarEntry) error {
+		if len(e.pax) == 0 {
+			return nil
+		}
+
+		return warnCategory(warnIgnoredPAX, "dropping PAX records for %s: %s", p, strings.Join(paxRecordKeys(e), ", "))
+	})
+}
+
+func paxRecordKeys(e *tarEntry) []string {
+	keys := make([]string, 0, len(e.pax))
+	for k := range e.pax {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
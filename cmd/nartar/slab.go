@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/nix-community/go-nix/pkg/nar/ls"
+)
+
+// Slabs start with blocks of minSlabBlock records, doubling up to
+// maxSlabBlock as more are needed.
+const (
+	minSlabBlock = 16
+	maxSlabBlock = 1024
+)
+
+// entrySlab allocates the records a conversion or listing makes for every
+// entry of an archive a block at a time, instead of one by one: an archive
+// of millions of tiny entries then costs thousands of allocations rather
+// than millions, and the records of neighbouring entries lie next to each
+// other. A block is freed with the last of its records, which is in general
+// when the conversion ends.
+type entrySlab struct {
+	entries []tarEntry
+	nodes   []entryNode
+	listing []ls.Node
+}
+
+// slabBlock returns the size of the block to follow one of n records.
+func slabBlock(n int) int {
+	switch {
+	case n < minSlabBlock:
+		return minSlabBlock
+	case n >= maxSlabBlock:
+		return maxSlabBlock
+	}
+
+	return 2 * n
+}
+
+// entry returns a record holding e.
+func (s *entrySlab) entry(e tarEntry) *tarEntry {
+	if len(s.entries) == cap(s.entries) {
+		s.entries = make([]tarEntry, 0, slabBlock(cap(s.entries)))
+	}
+
+	s.entries = append(s.entries, e)
+
+	return &s.entries[len(s.entries)-1]
+}
+
+// node returns a record holding n.
+func (s *entrySlab) node(n entryNode) *entryNode {
+	if len(s.nodes) == cap(s.nodes) {
+		s.nodes = make([]entryNode, 0, slabBlock(cap(s.nodes)))
+	}
+
+	s.nodes = append(s.nodes, n)
+
+	return &s.nodes[len(s.nodes)-1]
+}
+
+// listingNode returns a record holding n.
+func (s *entrySlab) listingNode(n ls.Node) *ls.Node {
+	if len(s.listing) == cap(s.listing) {
+		s.listing = make([]ls.Node, 0, slabBlock(cap(s.listing)))
+	}
+
+	s.listing = append(s.listing, n)
+
+	return &s.listing[len(s.listing)-1]
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// streamTarToNar converts a tarball whose members are in NAR order, as
+// nar2tar and tar --sort=name write them, writing each entry to the NAR as
+// it is read instead of collecting them first. Directories the tarball
+// leaves out are written before their first entry. An entry out of order is
+// an error, as is a repeated one unless -duplicates keeps the first and it is
+// of the same kind.
+func streamTarToNar(tr *tar.Reader, out io.Writer, root string, pax string, sidecarName string, preserveMtime bool, opts *readOptions) error {
+	if opts.paths != nil && opts.paths.caseHack {
+		return fmt.Errorf("-assume-sorted cannot be combined with -case-hack, which renames entries")
+	}
+
+	nw, err := newNarFile(out)
+	if err != nil {
+		return err
+	}
+
+	// Only the entries with metadata to report or record are kept.
+	meta := newEntryTree()
+	s := &sortedNarWriter{nw: nw}
+
+	err = scanTarEntries(tr, root, opts, nil, func(e *tarEntry) error {
+		// The entry written first cannot be taken back, so only the first
+		// of a path the tarball holds more than once can be kept.
+		if e.path == s.last {
+			if err := checkKindChange(e.path, s.lastKind, e.kind); err != nil {
+				return err
+			}
+
+			if opts.duplicates != conflictFirst {
+				return fmt.Errorf("%s is in the tarball more than once; -assume-sorted can only keep the first, with -duplicates first", e.path)
+			}
+
+			logDuplicate(e.path, "first")
+
+			return nil
+		}
+
+		if len(e.pax) > 0 || (preserveMtime && !e.mtime.IsZero()) {
+			meta.set(e.path, &tarEntry{kind: e.kind, pax: e.pax, mtime: e.mtime})
+		}
+
+		return s.add(e)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := opts.paths.checkSubpaths(); err != nil {
+		return err
+	}
+
+	if s.last == "" {
+		if err := nw.WriteHeader(&nar.Header{Path: "/", Type: nar.TypeDirectory}); err != nil {
+			return fmt.Errorf("writing nar root: %w", err)
+		}
+	}
+
+	if err := handleTarMetadata(meta, pax, sidecarName, preserveMtime); err != nil {
+		return err
+	}
+
+	return nw.Close()
+}
+
+// sortedNarWriter writes entries that come in NAR order to a NAR.
+type sortedNarWriter struct {
+	nw *narFile
+
+	// last is the path of the entry written last, or empty before the root,
+	// and lastKind its kind.
+	last     string
+	lastKind byte
+}
+
+func (s *sortedNarWriter) add(e *tarEntry) error {
+	if s.last != "" && !narPathBefore(s.last, e.path) {
+		return fmt.Errorf("-assume-sorted: %s comes after %s in the tarball, but not in the NAR", e.path, s.last)
+	}
+
+	if s.last != "" && s.lastKind != tar.TypeDir && strings.HasPrefix(e.path, strings.TrimSuffix(s.last, "/")+"/") {
+		return fmt.Errorf("%s is below %s, which is a %s entry in the archive, not a directory", e.path, s.last, tarEntryKind(s.lastKind))
+	}
+
+	// The directories above e that are not above the last entry have not
+	// been written: they would have come between the two.
+	if e.path != "/" {
+		parts := strings.Split(e.path[1:], "/")
+
+		for i := range parts[:len(parts)-1] {
+			dir := "/" + strings.Join(parts[:i+1], "/")
+			if dir != s.last && !strings.HasPrefix(s.last, dir+"/") {
+				if err := s.write(&tarEntry{path: dir, kind: tar.TypeDir}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return s.write(e)
+}
+
+func (s *sortedNarWriter) write(e *tarEntry) error {
+	if s.last == "" && e.path != "/" {
+		if err := s.nw.WriteHeader(&nar.Header{Path: "/", Type: nar.TypeDirectory}); err != nil {
+			return fmt.Errorf("writing nar root: %w", err)
+		}
+	}
+
+	s.last, s.lastKind = e.path, e.kind
+
+	if err := writeNarEntry(s.nw, e); err != nil {
+		return fmt.Errorf("writing nar for %q: %w", e.path, err)
+	}
+
+	return nil
+}
+
+// narPathBefore reports whether the NAR path a comes before b in a NAR: a
+// directory before its contents, and the entries of a directory sorted by
+// name.
+func narPathBefore(a, b string) bool {
+	if a == b {
+		return false
+	}
+
+	if a == "/" {
+		return true
+	}
+
+	if b == "/" {
+		return false
+	}
+
+	as, bs := strings.Split(a[1:], "/"), strings.Split(b[1:], "/")
+
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+
+	return len(as) < len(bs)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+func TestAssumeSortedRoundTrip(t *testing.T) {
+	n := buildNar(t, testTree)
+
+	var archive bytes.Buffer
+	if err := narToTarRoot(bytes.NewReader(n), &archive, "-", testTarOptions(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testReadOptions(t)
+	opts.assumeSorted = true
+
+	var out bytes.Buffer
+	if err := tarToNar(&archive, &out, "-", paxIgnore, "", false, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// What nar2tar writes is in NAR order, and comes back as the same NAR.
+	if !bytes.Equal(out.Bytes(), n) {
+		t.Errorf("the NAR differs from the one converted:\n%v", readNar(t, out.Bytes()))
+	}
+}
+
+func TestAssumeSorted(t *testing.T) {
+	dir := func(name string) tarMember { return tarMember{name: name, kind: tar.TypeDir} }
+	file := func(name string) tarMember { return tarMember{name: name, kind: tar.TypeReg, data: name} }
+
+	root := testEntry{typ: nar.TypeDirectory}
+
+	tests := []struct {
+		desc    string
+		members []tarMember
+		want    map[string]testEntry
+		err     string
+	}{
+		{
+			desc:    "empty",
+			members: nil,
+			want:    map[string]testEntry{"/": root},
+		},
+		{
+			desc:    "directories left out",
+			members: []tarMember{file("a/b/c"), file("a/d"), file("e/f")},
+			want: map[string]testEntry{
+				"/":      root,
+				"/a":     {typ: nar.TypeDirectory},
+				"/a/b":   {typ: nar.TypeDirectory},
+				"/a/b/c": {typ: nar.TypeRegular, data: "a/b/c"},
+				"/a/d":   {typ: nar.TypeRegular, data: "a/d"},
+				"/e":     {typ: nar.TypeDirectory},
+				"/e/f":   {typ: nar.TypeRegular, data: "e/f"},
+			},
+		},
+		{
+			desc:    "directory contents before a longer name",
+			members: []tarMember{dir("a/"), file("a/x"), file("a.txt")},
+			want: map[string]testEntry{
+				"/":      root,
+				"/a":     {typ: nar.TypeDirectory},
+				"/a/x":   {typ: nar.TypeRegular, data: "a/x"},
+				"/a.txt": {typ: nar.TypeRegular, data: "a.txt"},
+			},
+		},
+		{
+			desc:    "sorted by full path",
+			members: []tarMember{file("a.txt"), file("a/x")},
+			err:     "/a/x comes after /a.txt in the tarball, but not in the NAR",
+		},
+		{
+			desc:    "out of order",
+			members: []tarMember{file("b"), file("a")},
+			err:     "/a comes after /b",
+		},
+		{
+			desc:    "below a file",
+			members: []tarMember{file("a"), file("a/b")},
+			err:     "/a/b is below /a",
+		},
+		{
+			desc:    "repeated",
+			members: []tarMember{file("a"), file("a")},
+			err:     "more than once",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			opts := testReadOptions(t)
+			opts.assumeSorted = true
+
+			var out bytes.Buffer
+
+			err := tarToNar(bytes.NewReader(buildTar(t, tt.members...)), &out, "", paxIgnore, "", false, opts)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want an error with %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkEntries(t, readNar(t, out.Bytes()), tt.want)
+		})
+	}
+}
+
+func TestNarPathBefore(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"/", "/a", true},
+		{"/a", "/", false},
+		{"/a", "/a", false},
+		{"/a", "/a/b", true},
+		{"/a/b", "/a.txt", true},
+		{"/a.txt", "/a/b", false},
+		{"/a/z", "/b", true},
+		{"/b", "/a/z", false},
+		{"/A", "/a", true},
+	}
+
+	for _, tt := range tests {
+		if got := narPathBefore(tt.a, tt.b); got != tt.want {
+			t.Errorf("narPathBefore(%q, %q) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
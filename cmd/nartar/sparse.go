@@ -0,0 +1,241 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	tarBlockSize = 512
+
+	// sparseMinHole is the shortest run of zeros stored as a hole. Shorter
+	// runs cost more in the sparse map than they save.
+	sparseMinHole = 8 * tarBlockSize
+)
+
+// sparseFragment is a run of data in a sparse file; everything between
+// fragments is a hole.
+type sparseFragment struct {
+	offset int64
+	length int64
+}
+
+// sparseFragments returns the data fragments of b, treating block-aligned
+// runs of at least sparseMinHole zero bytes as holes. It returns nil if b has
+// no such holes.
+func sparseFragments(b []byte) []sparseFragment {
+	var (
+		frags []sparseFragment
+		start int64 // start of the current data fragment
+		holes bool
+	)
+
+	size := int64(len(b))
+
+	for off := int64(0); off < size; {
+		if !isZeroBlock(b, off) {
+			off += tarBlockSize
+			continue
+		}
+
+		end := off
+		for end < size && isZeroBlock(b, end) {
+			end += tarBlockSize
+		}
+
+		if end > size {
+			end = size
+		}
+
+		if end-off >= sparseMinHole {
+			if off > start {
+				frags = append(frags, sparseFragment{offset: start, length: off - start})
+			}
+
+			start = end
+			holes = true
+		}
+
+		off = end
+	}
+
+	if !holes {
+		return nil
+	}
+
+	// A trailing hole is described by an empty fragment at the end of the
+	// file, as GNU tar does.
+	frags = append(frags, sparseFragment{offset: start, length: size - start})
+
+	return frags
+}
+
+func isZeroBlock(b []byte, off int64) bool {
+	end := off + tarBlockSize
+	if end > int64(len(b)) {
+		end = int64(len(b))
+	}
+
+	for _, c := range b[off:end] {
+		if c != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeSparseEntry writes th as a PAX 1.0 sparse file. archive/tar cannot
+// write sparse files, so the PAX header holding the GNU.sparse records is
+// written to out directly and the data, prefixed with the sparse map, goes
+// into a plain ustar entry with a placeholder name.
+func writeSparseEntry(tw *tar.Writer, out io.Writer, th *tar.Header, data []byte, frags []sparseFragment) error {
+	var sparseMap bytes.Buffer
+
+	fmt.Fprintf(&sparseMap, "%d\n", len(frags))
+
+	size := int64(0)
+	for _, f := range frags {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", f.offset, f.length)
+		size += f.length
+	}
+
+	sparseMap.Write(make([]byte, tarPad(int64(sparseMap.Len()))))
+	size += int64(sparseMap.Len())
+
+	records := [][2]string{
+		{"GNU.sparse.major", "1"},
+		{"GNU.sparse.minor", "0"},
+		{"GNU.sparse.name", th.Name},
+		{"GNU.sparse.realsize", strconv.FormatInt(int64(len(data)), 10)},
+	}
+
+	keys := make([]string, 0, len(th.PAXRecords))
+	for k := range th.PAXRecords {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		records = append(records, [2]string{k, th.PAXRecords[k]})
+	}
+
+	var pax bytes.Buffer
+	for _, r := range records {
+		pax.WriteString(paxRecord(r[0], r[1]))
+	}
+
+	placeholder := sparsePlaceholderName(th.Name)
+
+	// Finish the padding of the previous entry before writing around tw.
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	hdr := tarRawHeader(path.Join(path.Dir(placeholder), "PaxHeaders"), tar.TypeXHeader, int64(pax.Len()))
+	pax.Write(make([]byte, tarPad(int64(pax.Len()))))
+
+	if _, err := out.Write(append(hdr, pax.Bytes()...)); err != nil {
+		return err
+	}
+
+	sh := &tar.Header{
+		Name:     placeholder,
+		Mode:     th.Mode,
+		Size:     size,
+		ModTime:  th.ModTime,
+		Uid:      th.Uid,
+		Gid:      th.Gid,
+		Uname:    th.Uname,
+		Gname:    th.Gname,
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatUSTAR,
+	}
+
+	if err := tw.WriteHeader(sh); err != nil {
+		return err
+	}
+
+	if _, err := tw.Write(sparseMap.Bytes()); err != nil {
+		return err
+	}
+
+	for _, f := range frags {
+		if _, err := tw.Write(data[f.offset : f.offset+f.length]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sparsePlaceholderName returns the name of the ustar entry carrying a
+// sparse file, which is what readers without sparse support extract.
+func sparsePlaceholderName(name string) string {
+	p := path.Join(path.Dir(name), "GNUSparseFile.0", path.Base(name))
+	if len(p) <= 100 && isASCII(p) {
+		return p
+	}
+
+	return "GNUSparseFile.0/sparse"
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 || s[i] == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// paxRecord formats a PAX extended header record, whose length prefix counts
+// the whole record including itself.
+func paxRecord(k, v string) string {
+	rec := " " + k + "=" + v + "\n"
+
+	n := len(rec)
+	for n < len(strconv.Itoa(n))+len(rec) {
+		n = len(strconv.Itoa(n)) + len(rec)
+	}
+
+	return strconv.Itoa(n) + rec
+}
+
+// tarRawHeader builds a ustar header block for the entries archive/tar
+// refuses to write itself.
+func tarRawHeader(name string, typeflag byte, size int64) []byte {
+	b := make([]byte, tarBlockSize)
+
+	copy(b[0:100], name)
+	copy(b[100:108], "0000644\x00")
+	copy(b[108:116], "0000000\x00")
+	copy(b[116:124], "0000000\x00")
+	copy(b[124:136], fmt.Sprintf("%011o\x00", size))
+	copy(b[136:148], "00000000000\x00")
+	b[156] = typeflag
+	copy(b[257:263], "ustar\x00")
+	copy(b[263:265], "00")
+
+	copy(b[148:156], strings.Repeat(" ", 8))
+
+	sum := 0
+	for _, c := range b {
+		sum += int(c)
+	}
+
+	copy(b[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	return b
+}
+
+func tarPad(n int64) int64 {
+	return (tarBlockSize - n%tarBlockSize) % tarBlockSize
+}
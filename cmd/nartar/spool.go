@@ -0,0 +1,343 @@
+package main
+
+import (
+	"container/heap"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"sync"
+)
+
+// defaultSpoolThreshold is the size above which the contents of an archive
+// file are spooled to disk rather than kept in memory.
+const defaultSpoolThreshold = 32 << 20
+
+// memoryHeadroom is the memory allowed besides the file contents under
+// -max-memory, for the buffers and the entries.
+const memoryHeadroom = 32 << 20
+
+// spoolHeadSize is how much of a file is always read into memory.
+const spoolHeadSize = 16
+
+// fileSpool holds the contents of the large archive files read for a NAR
+// until they are written, as archive entries can come in any order and the
+// NAR has to be written sorted. Files up to the threshold stay in memory;
+// larger ones are appended to a temporary file.
+var fileSpool = &spooler{threshold: defaultSpoolThreshold}
+
+type spooler struct {
+	threshold int64
+	dir       string
+
+	// maxMemory, if set, caps the size of the contents held in memory:
+	// held, by the files in heldFiles. Beyond it, the largest are spilled
+	// to the spool file.
+	maxMemory int64
+	held      int64
+	heldFiles heldHeap
+
+	// f is the spool file of this run, made with the first spooled file,
+	// and end the size of what has been spooled to it. mu guards them, as
+	// batch conversions running at once spool to the same file.
+	mu  sync.Mutex
+	f   *os.File
+	end int64
+}
+
+// addSpoolFlags registers -spool-threshold and -spool-dir, for the commands
+// reading archives into NARs.
+func addSpoolFlags(fs *flag.FlagSet) {
+	fs.Func("spool-threshold", "keep files up to this size, such as 64M, in memory and spool larger ones to disk (default 32M)", func(v string) (err error) {
+		fileSpool.threshold, err = parseByteSize(v)
+		return err
+	})
+	fs.StringVar(&fileSpool.dir, "spool-dir", "", "directory to spool large files to (default the system temporary directory)")
+	fs.Func("max-memory", "keep at most this much file contents, such as 128M, in memory, spooling the largest files to disk beyond it (default no limit)", func(v string) (err error) {
+		if fileSpool.maxMemory, err = parseByteSize(v); err != nil {
+			return err
+		}
+
+		// Spilled contents are only freed by the garbage collector, which
+		// is told to keep the heap close to the limit.
+		debug.SetMemoryLimit(fileSpool.maxMemory + memoryHeadroom)
+
+		return nil
+	})
+}
+
+// read reads the size bytes of the archive file e from r, keeping them in
+// memory up to the threshold and spooling them to disk beyond it. It
+// returns the first bytes of the contents, for the executable policy.
+func (s *spooler) read(e *tarEntry, r io.Reader, size int64) ([]byte, error) {
+	// A file larger than the memory limit cannot be held either. The first
+	// bytes are always read, as the executable policy looks at them.
+	threshold := s.threshold
+	if s.maxMemory > 0 && s.maxMemory < threshold {
+		threshold = s.maxMemory
+	}
+
+	if threshold < spoolHeadSize {
+		threshold = spoolHeadSize
+	}
+
+	// Contents kept in memory are read into a slice of their size, not
+	// grown to it.
+	if size <= threshold {
+		e.data = make([]byte, size)
+		if _, err := io.ReadFull(r, e.data); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		head := e.data
+		if err := s.hold(e); err != nil {
+			return nil, err
+		}
+
+		return head, nil
+	}
+
+	head := make([]byte, spoolHeadSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.create(); err != nil {
+		return nil, err
+	}
+
+	w := io.NewOffsetWriter(s.f, s.end)
+
+	if _, err := w.Write(head); err != nil {
+		return nil, fmt.Errorf("spooling: %w", err)
+	}
+
+	n, err := copyContents(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	e.src, e.offset, e.size = s.f, s.end, int64(len(head))+n
+	s.end += e.size
+
+	return head, nil
+}
+
+// create makes the spool file if it does not exist yet.
+func (s *spooler) create() error {
+	if s.f != nil {
+		return nil
+	}
+
+	var err error
+	if s.f, err = os.CreateTemp(s.dir, "nartar-spool-"); err != nil {
+		return fmt.Errorf("spooling: %w", err)
+	}
+
+	return nil
+}
+
+// heldFile is the contents of a file held in memory under -max-memory, with
+// the entries still to write them: the file and its hard links.
+type heldFile struct {
+	data    []byte
+	entries []*tarEntry
+	index   int
+}
+
+// heldHeap orders the held files largest first.
+type heldHeap []*heldFile
+
+func (h heldHeap) Len() int { return len(h) }
+
+func (h heldHeap) Less(i, j int) bool { return len(h[i].data) > len(h[j].data) }
+
+func (h heldHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *heldHeap) Push(x interface{}) {
+	f := x.(*heldFile)
+	f.index = len(*h)
+	*h = append(*h, f)
+}
+
+func (h *heldHeap) Pop() interface{} {
+	old := *h
+	f := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return f
+}
+
+// hold counts the contents of e, just read into memory, against
+// -max-memory, and spills the largest files held to the spool file until
+// they fit again.
+func (s *spooler) hold(e *tarEntry) error {
+	if s.maxMemory == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.held = &heldFile{data: e.data, entries: []*tarEntry{e}}
+	heap.Push(&s.heldFiles, e.held)
+	s.held += int64(len(e.data))
+
+	for s.held > s.maxMemory {
+		if err := s.spill(heap.Pop(&s.heldFiles).(*heldFile)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// spill writes the held file f to the spool file, for its entries to read
+// it back from there.
+func (s *spooler) spill(f *heldFile) error {
+	if err := s.create(); err != nil {
+		return err
+	}
+
+	if _, err := s.f.WriteAt(f.data, s.end); err != nil {
+		return fmt.Errorf("spooling: %w", err)
+	}
+
+	for _, e := range f.entries {
+		e.data, e.held = nil, nil
+		e.src, e.offset, e.size = s.f, s.end, int64(len(f.data))
+	}
+
+	s.end += int64(len(f.data))
+	s.held -= int64(len(f.data))
+
+	return nil
+}
+
+// link returns a copy of the file entry e for a hard link to it, which
+// holds its contents along with it.
+func (s *spooler) link(e *tarEntry) *tarEntry {
+	if s.maxMemory == 0 {
+		c := *e
+		return &c
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := *e
+	if c.held != nil {
+		c.held.entries = append(c.held.entries, &c)
+	}
+
+	return &c
+}
+
+// linkTo makes the file entry dst, stored before the contents of its hard
+// link e were read, hold them along with e.
+func (s *spooler) linkTo(dst, e *tarEntry) {
+	if s.maxMemory > 0 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+
+	dst.data, dst.src, dst.offset, dst.size, dst.held = e.data, e.src, e.offset, e.size, e.held
+
+	if dst.held != nil {
+		dst.held.entries = append(dst.held.entries, dst)
+	}
+}
+
+// release takes the file entry e out of -max-memory once its contents are
+// to be written, so that they are no longer spilled. The file stops
+// counting when none of its entries hold it.
+func (s *spooler) release(e *tarEntry) {
+	if s.maxMemory == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := e.held
+	if f == nil {
+		return
+	}
+
+	e.held = nil
+
+	for i, held := range f.entries {
+		if held == e {
+			f.entries = append(f.entries[:i], f.entries[i+1:]...)
+			break
+		}
+	}
+
+	if len(f.entries) == 0 {
+		heap.Remove(&s.heldFiles, f.index)
+		s.held -= int64(len(f.data))
+	}
+}
+
+// remove removes the spool file once the command is done or has failed.
+func (s *spooler) remove() {
+	if s.f != nil {
+		s.f.Close()
+		os.Remove(s.f.Name())
+		s.f, s.end = nil, 0
+	}
+}
+
+// contents returns the contents of the regular file e, reading them back if
+// they are not held in memory.
+func (e *tarEntry) contents() ([]byte, error) {
+	fileSpool.release(e)
+
+	if e.src == nil {
+		return e.data, nil
+	}
+
+	return io.ReadAll(io.NewSectionReader(e.src, e.offset, e.size))
+}
+
+// writeEntryContents writes the contents of the regular file e that are
+// not held in memory, streaming them through the store path rewrites and
+// the reference scan, or having the kernel copy them if they need neither.
+func writeEntryContents(nw *narFile, e *tarEntry) error {
+	if nw.canCopyRange(e) {
+		return nw.copyRange(e)
+	}
+
+	w, sc := io.Writer(nw), (*refScanner)(nil)
+	if referenceOutput != "" {
+		sc = referenceScan.fileScanner()
+		w = io.MultiWriter(nw, sc)
+	}
+
+	r := e.r
+	if r == nil {
+		r = io.NewSectionReader(e.src, e.offset, e.size)
+	}
+
+	n, err := copyContents(w, newRewriteReader(r))
+	if err != nil {
+		return err
+	}
+
+	if n != e.size {
+		return fmt.Errorf("%s has %d bytes instead of %d: the input changed while it was converted", e.path, n, e.size)
+	}
+
+	if sc != nil {
+		sc.flush()
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// testSpool replaces the spooler for the length of the test.
+func testSpool(t *testing.T, threshold, maxMemory int64) *spooler {
+	saved := fileSpool
+	fileSpool = &spooler{threshold: threshold, dir: t.TempDir(), maxMemory: maxMemory}
+
+	t.Cleanup(func() {
+		fileSpool.remove()
+		fileSpool = saved
+	})
+
+	return fileSpool
+}
+
+func TestSpoolRoundTrip(t *testing.T) {
+	// Files of several sizes, one of them with hard links, read from a
+	// stream so that their contents are held or spooled.
+	members := []tarMember{{name: "empty", kind: tar.TypeReg}}
+	want := map[string]testEntry{"/": {typ: nar.TypeDirectory}, "/empty": {typ: nar.TypeRegular}}
+
+	for i, size := range []int{1, 15, 16, 17, 100, 1000, 5000} {
+		name := fmt.Sprintf("f%d", i)
+		data := strings.Repeat(string(rune('a'+i)), size)
+
+		members = append(members, tarMember{name: name, kind: tar.TypeReg, data: data})
+		want["/"+name] = testEntry{typ: nar.TypeRegular, data: data}
+	}
+
+	for _, link := range []string{"link1", "link2"} {
+		members = append(members, tarMember{name: link, kind: tar.TypeLink, data: "f5"})
+		want["/"+link] = want["/f5"]
+	}
+
+	tests := []struct {
+		desc                 string
+		threshold, maxMemory int64
+		spooled              bool
+	}{
+		{desc: "in memory", threshold: defaultSpoolThreshold},
+		{desc: "spooled beyond the threshold", threshold: 100, spooled: true},
+		{desc: "everything spooled", threshold: 0, spooled: true},
+		{desc: "spilled beyond -max-memory", threshold: defaultSpoolThreshold, maxMemory: 2000, spooled: true},
+		{desc: "-max-memory below the head", threshold: defaultSpoolThreshold, maxMemory: 1, spooled: true},
+		{desc: "-max-memory above the contents", threshold: defaultSpoolThreshold, maxMemory: 1 << 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			s := testSpool(t, tt.threshold, tt.maxMemory)
+
+			var out bytes.Buffer
+			if err := tarToNar(bytes.NewReader(buildTar(t, members...)), &out, "", paxIgnore, "", false, testReadOptions(t)); err != nil {
+				t.Fatal(err)
+			}
+
+			checkEntries(t, readNar(t, out.Bytes()), want)
+
+			if spooled := s.end > 0; spooled != tt.spooled {
+				t.Errorf("%d bytes spooled", s.end)
+			}
+
+			// Every file written is released from -max-memory.
+			if s.held != 0 || len(s.heldFiles) != 0 {
+				t.Errorf("%d bytes of %d files still held", s.held, len(s.heldFiles))
+			}
+		})
+	}
+}
+
+func TestSpoolSpillsLargest(t *testing.T) {
+	s := testSpool(t, defaultSpoolThreshold, 45)
+
+	read := func(data string) *tarEntry {
+		t.Helper()
+
+		e := &tarEntry{kind: tar.TypeReg}
+		if _, err := s.read(e, strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+
+		return e
+	}
+
+	small, large := read(strings.Repeat("s", 10)), read(strings.Repeat("l", 30))
+	link := s.link(large)
+
+	if s.held != 40 || s.end != 0 {
+		t.Fatalf("%d bytes held and %d spooled, want 40 and 0", s.held, s.end)
+	}
+
+	// Past the limit, the largest file goes to disk, with its hard link.
+	medium := read(strings.Repeat("m", 20))
+
+	if s.held != 30 || s.end != 30 {
+		t.Fatalf("%d bytes held and %d spooled, want 30 and 30", s.held, s.end)
+	}
+
+	for _, e := range []*tarEntry{large, link} {
+		if e.data != nil || e.src == nil {
+			t.Errorf("the large file is not spilled: %d bytes in memory", len(e.data))
+		}
+	}
+
+	for _, c := range []struct {
+		e    *tarEntry
+		want string
+	}{
+		{large, strings.Repeat("l", 30)},
+		{link, strings.Repeat("l", 30)},
+		{small, strings.Repeat("s", 10)},
+		{medium, strings.Repeat("m", 20)},
+	} {
+		got, err := c.e.contents()
+		if err != nil || string(got) != c.want {
+			t.Errorf("contents %q (%v), want %q", got, err, c.want)
+		}
+	}
+
+	if s.held != 0 || len(s.heldFiles) != 0 {
+		t.Errorf("%d bytes of %d files still held", s.held, len(s.heldFiles))
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statsFormat is set by -stats, which every command accepts: "" for no
+// summary, or text or json.
+var statsFormat = ""
+
+// stats accumulates the figures of the -stats summary: the input entries by
+// kind, as logged with -v, and the bytes read from the inputs and written to
+// the archive outputs. Batch conversions running at once count into it
+// together, so the byte counts are added to atomically and the entries
+// under mu.
+var stats = struct {
+	start    time.Time
+	mu       sync.Mutex
+	entries  map[string]int64
+	bytesIn  int64
+	bytesOut int64
+}{
+	start:   time.Now(),
+	entries: make(map[string]int64),
+}
+
+func addStatsFlag(fs *flag.FlagSet) {
+	fs.Var(statsFlag{}, "stats", "print a summary of the conversion to stderr; -stats=json prints it as JSON")
+}
+
+// statsFlag is a switch that also takes the summary format as its value.
+type statsFlag struct{}
+
+func (statsFlag) String() string { return "" }
+
+func (statsFlag) IsBoolFlag() bool { return true }
+
+func (statsFlag) Set(v string) error {
+	switch v {
+	case "true", "text":
+		statsFormat = "text"
+	case "false":
+		statsFormat = ""
+	case "json":
+		statsFormat = "json"
+	default:
+		return fmt.Errorf("unsupported stats format %q (use text or json)", v)
+	}
+
+	return nil
+}
+
+// countingOutput counts the bytes written to an archive output.
+type countingOutput struct {
+	io.WriteCloser
+}
+
+func (w countingOutput) Write(b []byte) (int, error) {
+	n, err := w.WriteCloser.Write(b)
+	atomic.AddInt64(&stats.bytesOut, int64(n))
+
+	return n, err
+}
+
+// statsSummary is the JSON form of the -stats summary.
+type statsSummary struct {
+	Command    string           `json:"command"`
+	Entries    map[string]int64 `json:"entries"`
+	BytesIn    int64            `json:"bytesIn"`
+	BytesOut   int64            `json:"bytesOut"`
+	Ratio      float64          `json:"ratio"`
+	Seconds    float64          `json:"seconds"`
+	Throughput float64          `json:"throughput"`
+}
+
+// printStats prints the -stats summary of a completed command: the entries
+// by kind, the bytes read and written with their ratio, the wall time and
+// the input throughput in bytes per second.
+func printStats(command string) {
+	if statsFormat == "" {
+		return
+	}
+
+	s := statsSummary{
+		Command:  command,
+		Entries:  stats.entries,
+		BytesIn:  stats.bytesIn,
+		BytesOut: stats.bytesOut,
+		Seconds:  time.Since(stats.start).Seconds(),
+	}
+
+	if s.BytesIn > 0 {
+		s.Ratio = float64(s.BytesOut) / float64(s.BytesIn)
+	}
+
+	if s.Seconds > 0 {
+		s.Throughput = float64(s.BytesIn) / s.Seconds
+	}
+
+	clearProgress()
+
+	if statsFormat == "json" {
+		b, err := json.Marshal(s)
+		if err != nil {
+			warnf("encoding stats: %v", err)
+			return
+		}
+
+		fmt.Fprintf(os.Stderr, "%s\n", b)
+
+		return
+	}
+
+	kinds := make([]string, 0, len(s.Entries))
+	for kind := range s.Entries {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	counts := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		counts = append(counts, fmt.Sprintf("%d %s", s.Entries[kind], kind))
+	}
+
+	if len(counts) == 0 {
+		counts = append(counts, "none")
+	}
+
+	fmt.Fprintf(os.Stderr, "entries: %s\n", strings.Join(counts, ", "))
+	fmt.Fprintf(os.Stderr, "read %s, wrote %s (ratio %.2f) in %.2fs, %s/s\n",
+		formatBytes(float64(s.BytesIn)), formatBytes(float64(s.BytesOut)), s.Ratio, s.Seconds, formatBytes(s.Throughput))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+)
+
+// conversionSums are the hashes and sizes -write-hashes records of the NAR
+// and the output file of a conversion, computed as they pass through it so
+// that neither has to be read again to hash it.
+type conversionSums struct {
+	nar  *countingWriter
+	file *countingWriter
+
+	narHash  hash.Hash
+	fileHash hash.Hash
+}
+
+func newConversionSums() *conversionSums {
+	s := &conversionSums{narHash: sha256.New(), fileHash: sha256.New()}
+	s.nar = &countingWriter{w: s.narHash}
+	s.file = &countingWriter{w: s.fileHash}
+
+	return s
+}
+
+// write writes the sums to the file name, as the NarHash, NarSize, FileHash
+// and FileSize lines of a narinfo.
+func (s *conversionSums) write(name string) error {
+	out, err := openTextOutput(name)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = fmt.Fprintf(out, "NarHash: sha256:%s\nNarSize: %d\nFileHash: sha256:%s\nFileSize: %d\n",
+		nixbase32.EncodeToString(s.narHash.Sum(nil)), s.nar.n,
+		nixbase32.EncodeToString(s.fileHash.Sum(nil)), s.file.n)
+	if err != nil {
+		return fmt.Errorf("writing hashes: %w", err)
+	}
+
+	return out.Close()
+}
+
+// hashInput returns the NAR input in, with what is read from it hashed for
+// -write-hashes.
+func (s *conversionSums) hashInput(in io.Reader) io.Reader {
+	if s == nil {
+		return in
+	}
+
+	return io.TeeReader(in, s.nar)
+}
+
+// hashNar returns the NAR output w, with what is written to it hashed for
+// -write-hashes.
+func (s *conversionSums) hashNar(w io.Writer) io.Writer {
+	if s == nil {
+		return w
+	}
+
+	return io.MultiWriter(w, s.nar)
+}
+
+// hashFile returns the output file w, with what is written to it hashed for
+// -write-hashes.
+func (s *conversionSums) hashFile(w io.Writer) io.Writer {
+	if s == nil {
+		return w
+	}
+
+	return io.MultiWriter(w, s.file)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// What -symlink-policy does with a symlink target that a naive extracting
+// tool could trip over.
+const (
+	symlinkPreserve = "preserve"
+	symlinkReject   = "reject"
+	symlinkRewrite  = "rewrite"
+)
+
+// symlinkPolicy is the -symlink-policy for each kind of symlink target that
+// does not stay inside the archive: absolute ones, relative ones climbing
+// out of the archive root, and empty ones.
+type symlinkPolicy struct {
+	absolute, escaping, empty string
+}
+
+// addSymlinkPolicyFlag registers -symlink-policy on fs, once for the
+// commands that both read and write archives.
+func addSymlinkPolicyFlag(fs *flag.FlagSet) *symlinkPolicy {
+	if f := fs.Lookup("symlink-policy"); f != nil {
+		return f.Value.(*symlinkPolicy)
+	}
+
+	p := &symlinkPolicy{absolute: symlinkPreserve, escaping: symlinkPreserve, empty: symlinkPreserve}
+	fs.Var(p, "symlink-policy", "symlink targets that are absolute, escape the archive root or are empty: preserve (default), reject or rewrite, for all of them or as absolute=,escaping=,empty= pairs; an empty target cannot be preserved in a NAR, and rewrite stores it as an empty file")
+
+	return p
+}
+
+func (p *symlinkPolicy) String() string {
+	if p == nil || p.absolute == "" {
+		return symlinkPreserve
+	}
+
+	if p.absolute == p.escaping && p.escaping == p.empty {
+		return p.absolute
+	}
+
+	return fmt.Sprintf("absolute=%s,escaping=%s,empty=%s", p.absolute, p.escaping, p.empty)
+}
+
+func (p *symlinkPolicy) Set(v string) error {
+	for _, item := range strings.Split(v, ",") {
+		kind, policy, pair := strings.Cut(item, "=")
+		if !pair {
+			policy = kind
+		}
+
+		switch policy {
+		case symlinkPreserve, symlinkReject, symlinkRewrite:
+		default:
+			return fmt.Errorf("unsupported -symlink-policy %q", policy)
+		}
+
+		switch {
+		case !pair:
+			p.absolute, p.escaping, p.empty = policy, policy, policy
+		case kind == "absolute":
+			p.absolute = policy
+		case kind == "escaping":
+			p.escaping = policy
+		case kind == "empty":
+			p.empty = policy
+		default:
+			return fmt.Errorf("unknown -symlink-policy target kind %q (use absolute, escaping or empty)", kind)
+		}
+	}
+
+	return nil
+}
+
+// apply applies the policy to the symlink at the archive path name, pointing
+// at target. It returns the target to store, or file set if an empty target
+// is rewritten, in which case the symlink is stored as an empty file. An
+// empty target cannot be preserved, as a NAR cannot hold it.
+//
+// Rewritten targets are resolved as if the archive root were the root of
+// the filesystem, so that / is the archive root and .. stops there, and
+// made relative to the symlink.
+func (p *symlinkPolicy) apply(name, target string) (string, bool, error) {
+	if p == nil {
+		return target, false, nil
+	}
+
+	var kind, policy string
+
+	switch {
+	case target == "":
+		kind, policy = "an empty target", p.empty
+	case path.IsAbs(target):
+		kind, policy = "an absolute target", p.absolute
+	case escapesRoot(name, target):
+		kind, policy = "a target outside the archive root", p.escaping
+	default:
+		return target, false, nil
+	}
+
+	switch policy {
+	case symlinkPreserve:
+		if target == "" {
+			return "", false, fmt.Errorf("symlink %s has an empty target, which a NAR cannot hold; use -symlink-policy empty=rewrite to store it as an empty file, or empty=reject to refuse empty targets explicitly", name)
+		}
+	case symlinkReject:
+		return "", false, fmt.Errorf("symlink %s has %s, %q; use -symlink-policy preserve or rewrite to convert it", name, kind, target)
+	case symlinkRewrite:
+		if target == "" {
+			logSymlinkRewrite(name, target, "an empty file")
+			return "", true, nil
+		}
+
+		dir := path.Dir(path.Join("/", name))
+
+		resolved := path.Join(dir, target)
+		if path.IsAbs(target) {
+			resolved = path.Clean(target)
+		}
+
+		rewritten := relativePath(dir, resolved)
+		logSymlinkRewrite(name, target, fmt.Sprintf("%q", rewritten))
+
+		return rewritten, false, nil
+	}
+
+	return target, false, nil
+}
+
+// escapesRoot reports whether the relative symlink target at the archive
+// path name climbs above the archive root.
+func escapesRoot(name, target string) bool {
+	depth := len(pathComponents(path.Dir(path.Join("/", name))))
+
+	for _, c := range strings.Split(target, "/") {
+		switch c {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+
+	return false
+}
+
+// relativePath returns the path of the absolute, clean path to relative to
+// the directory from.
+func relativePath(from, to string) string {
+	f, t := pathComponents(from), pathComponents(to)
+
+	i := 0
+	for i < len(f) && i < len(t) && f[i] == t[i] {
+		i++
+	}
+
+	parts := make([]string, 0, len(f)-i+len(t)-i)
+	for range f[i:] {
+		parts = append(parts, "..")
+	}
+
+	parts = append(parts, t[i:]...)
+
+	if len(parts) == 0 {
+		return "."
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// pathComponents returns the names making up the absolute, clean path p.
+func pathComponents(p string) []string {
+	if p == "/" {
+		return nil
+	}
+
+	return strings.Split(p[1:], "/")
+}
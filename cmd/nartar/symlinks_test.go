@@ -0,0 +1,92 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+func TestSymlinkPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		name   string
+		target string
+		want   string
+		file   bool
+		err    string
+	}{
+		{policy: "preserve", name: "a/l", target: "b", want: "b"},
+		{policy: "preserve", name: "a/l", target: "/etc/passwd", want: "/etc/passwd"},
+		{policy: "preserve", name: "a/l", target: "../../x", want: "../../x"},
+		{policy: "preserve", name: "a/l", target: "", err: "empty=rewrite"},
+		{policy: "reject", name: "a/l", target: "../b", want: "../b"},
+		{policy: "reject", name: "a/l", target: "/etc/passwd", err: "an absolute target"},
+		{policy: "reject", name: "a/l", target: "../../x", err: "outside the archive root"},
+		{policy: "reject", name: "a/l", target: "", err: "an empty target"},
+		{policy: "rewrite", name: "a/l", target: "/etc/passwd", want: "../etc/passwd"},
+		{policy: "rewrite", name: "a/l", target: "/a", want: "."},
+		{policy: "rewrite", name: "a/l", target: "../../../x", want: "../x"},
+		{policy: "rewrite", name: "l", target: "", file: true},
+		{policy: "absolute=reject,escaping=rewrite", name: "a/l", target: "../../x", want: "../x"},
+		{policy: "absolute=reject,escaping=rewrite", name: "a/l", target: "/x", err: "an absolute target"},
+		{policy: "empty=rewrite", name: "l", target: "/x", want: "/x"},
+		{policy: "empty=rewrite", name: "l", target: "", file: true},
+	}
+
+	for _, tt := range tests {
+		p := &symlinkPolicy{absolute: symlinkPreserve, escaping: symlinkPreserve, empty: symlinkPreserve}
+		if err := p.Set(tt.policy); err != nil {
+			t.Fatal(err)
+		}
+
+		got, file, err := p.apply(tt.name, tt.target)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: %s -> %q: got %v, want an error with %q", tt.policy, tt.name, tt.target, err, tt.err)
+			}
+
+			continue
+		}
+
+		if err != nil || got != tt.want || file != tt.file {
+			t.Errorf("%s: %s -> %q: got %q, file %t, %v; want %q, file %t", tt.policy, tt.name, tt.target, got, file, err, tt.want, tt.file)
+		}
+	}
+}
+
+func TestSymlinkPolicyFlag(t *testing.T) {
+	for _, v := range []string{"keep", "absolute=keep", "relative=reject"} {
+		var p symlinkPolicy
+		if err := p.Set(v); err == nil {
+			t.Errorf("-symlink-policy %s accepted", v)
+		}
+	}
+}
+
+func TestEmptySymlinkTarget(t *testing.T) {
+	archive := buildTar(t, tarMember{name: "d/", kind: tar.TypeDir}, tarMember{name: "d/e", kind: tar.TypeSymlink})
+
+	err := tarToNar(bytes.NewReader(archive), &bytes.Buffer{}, "", paxIgnore, "", false, testReadOptions(t))
+	if err == nil || !strings.Contains(err.Error(), "symlink /d/e has an empty target") {
+		t.Errorf("got %v, want an error about the empty target", err)
+	}
+
+	opts := testReadOptions(t)
+	if err := opts.symlinks.Set("empty=rewrite"); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := tarToNar(bytes.NewReader(archive), &out, "", paxIgnore, "", false, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	checkEntries(t, readNar(t, out.Bytes()), map[string]testEntry{
+		"/":    {typ: nar.TypeDirectory},
+		"/d":   {typ: nar.TypeDirectory},
+		"/d/e": {typ: nar.TypeRegular},
+	})
+}
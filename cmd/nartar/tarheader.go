@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Limits of the ustar header fields.
+const (
+	ustarNameSize   = 100
+	ustarPrefixSize = 155
+	ustarOwnerSize  = 32
+	ustarMaxSize    = 1<<33 - 1 // also the largest mtime
+	ustarMaxID      = 1<<21 - 1
+)
+
+// setFormat fills in the ownership of a single tar header, which may not fit
+// every format, and picks its format. By default an entry is written as
+// ustar and upgraded to PAX only when ustar cannot hold it; an explicitly
+// requested format that cannot hold the entry is an error.
+func (o *tarOptions) setFormat(th *tar.Header) error {
+	th.Uid, th.Gid = o.uid, o.gid
+	th.Uname, th.Gname = o.uname, o.gname
+
+	if o.numericOwner {
+		th.Uname, th.Gname = "", ""
+	}
+
+	reason := ustarLimitation(th)
+
+	switch o.format {
+	case tar.FormatUnknown:
+		th.Format = tar.FormatUSTAR
+		if reason != "" {
+			th.Format = tar.FormatPAX
+		}
+
+		if !ustarPathFits(th.Name) || len(th.Linkname) > ustarNameSize {
+			if err := warnCategory(warnLongPathUpgraded, "writing %q as PAX: %s", th.Name, reason); err != nil {
+				return err
+			}
+		}
+	case tar.FormatUSTAR:
+		if reason != "" {
+			return fmt.Errorf("tar entry %q cannot be written as ustar: %s; use -tar-format pax or gnu", th.Name, reason)
+		}
+
+		th.Format = tar.FormatUSTAR
+	case tar.FormatGNU:
+		if len(th.PAXRecords) > 0 {
+			return fmt.Errorf("tar entry %q has PAX records, which the gnu format cannot hold; use -tar-format pax", th.Name)
+		}
+
+		th.Format = tar.FormatGNU
+	default:
+		th.Format = o.format
+	}
+
+	return nil
+}
+
+// ustarLimitation returns why th does not fit a plain ustar header, or "" if
+// it does.
+func ustarLimitation(th *tar.Header) string {
+	switch {
+	case !isASCII(th.Name):
+		return "the name is not ASCII"
+	case !ustarPathFits(th.Name):
+		return fmt.Sprintf("the name exceeds the %d-byte name and %d-byte prefix fields", ustarNameSize, ustarPrefixSize)
+	case !isASCII(th.Linkname):
+		return "the link target is not ASCII"
+	case len(th.Linkname) > ustarNameSize:
+		return fmt.Sprintf("the link target exceeds %d bytes", ustarNameSize)
+	case th.Uid > ustarMaxID || th.Gid > ustarMaxID:
+		return fmt.Sprintf("the uid or gid exceeds %d", ustarMaxID)
+	case len(th.Uname) > ustarOwnerSize || len(th.Gname) > ustarOwnerSize || !isASCII(th.Uname) || !isASCII(th.Gname):
+		return fmt.Sprintf("the user or group name is not ASCII of at most %d bytes", ustarOwnerSize)
+	case th.Size > ustarMaxSize:
+		return "the file is 8 GiB or larger"
+	case th.ModTime.Unix() < 0 || th.ModTime.Unix() > ustarMaxSize:
+		return "the mtime does not fit the 11-digit octal field"
+	case th.ModTime.Nanosecond() != 0:
+		return "the mtime has fractional seconds"
+	case len(th.PAXRecords) > 0:
+		return "it has PAX records"
+	default:
+		return ""
+	}
+}
+
+// ustarPathFits reports whether name fits the ustar name field, possibly
+// split at a slash into the prefix field.
+func ustarPathFits(name string) bool {
+	if len(name) <= ustarNameSize {
+		return true
+	}
+
+	n := len(name)
+	if n > ustarPrefixSize+1 {
+		n = ustarPrefixSize + 1
+	} else if name[n-1] == '/' {
+		n--
+	}
+
+	i := strings.LastIndex(name[:n], "/")
+
+	return i > 0 && len(name)-i-1 <= ustarNameSize && len(name)-i-1 > 0
+}
+
+// parseOwner parses an -owner or -group value: NAME, ID or NAME:ID. A name
+// alone keeps id 0, as ids are not looked up on the host.
+func parseOwner(v string, name *string, id *int) error {
+	n, idStr, hasID := strings.Cut(v, ":")
+	if !hasID && v != "" && strings.Trim(v, "0123456789") == "" {
+		n, idStr, hasID = "", v, true
+	}
+
+	*name, *id = n, 0
+
+	if hasID {
+		i, err := strconv.Atoi(idStr)
+		if err != nil || i < 0 {
+			return fmt.Errorf("invalid id %q", idStr)
+		}
+
+		*id = i
+	}
+
+	return nil
+}
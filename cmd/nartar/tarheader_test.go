@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTarOptions returns the tar options the commands have by default.
+func testTarOptions(t *testing.T, args ...string) *tarOptions {
+	t.Helper()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts := addTarOptionFlags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	return opts
+}
+
+func TestTarRoundTrip(t *testing.T) {
+	for _, hardlinks := range []bool{false, true} {
+		name := "copies"
+		if hardlinks {
+			name = "hardlinks"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			opts := testTarOptions(t)
+			opts.hardlinks = hardlinks
+
+			var archive bytes.Buffer
+			if err := narToTarRoot(bytes.NewReader(buildNar(t, testTree)), &archive, "-", opts); err != nil {
+				t.Fatal(err)
+			}
+
+			// The second of the identical files is a hard link to the
+			// first with -hardlinks.
+			links := 0
+
+			tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+			for {
+				th, err := tr.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if th.Format != tar.FormatUSTAR {
+					t.Errorf("%s is written as %v, not ustar", th.Name, th.Format)
+				}
+
+				if th.Typeflag == tar.TypeLink {
+					links++
+
+					if th.Name != "-/share/doc/README.md" || th.Linkname != "-/share/doc/README" {
+						t.Errorf("unexpected hard link %s to %s", th.Name, th.Linkname)
+					}
+				}
+			}
+
+			if want := map[bool]int{false: 0, true: 1}[hardlinks]; links != want {
+				t.Errorf("%d hard links, want %d", links, want)
+			}
+
+			var out bytes.Buffer
+			if err := tarToNar(&archive, &out, "-", paxIgnore, "", false, testReadOptions(t)); err != nil {
+				t.Fatal(err)
+			}
+
+			checkEntries(t, readNar(t, out.Bytes()), testTree)
+		})
+	}
+}
+
+func TestUstarLimits(t *testing.T) {
+	long := func(n int) string { return strings.Repeat("a", n) }
+
+	tests := []struct {
+		desc string
+		th   tar.Header
+		ok   bool
+	}{
+		{"largest size", tar.Header{Name: "f", Size: ustarMaxSize}, true},
+		{"8 GiB", tar.Header{Name: "f", Size: ustarMaxSize + 1}, false},
+		{"latest mtime", tar.Header{Name: "f", ModTime: time.Unix(ustarMaxSize, 0)}, true},
+		{"mtime past the field", tar.Header{Name: "f", ModTime: time.Unix(ustarMaxSize+1, 0)}, false},
+		{"mtime before 1970", tar.Header{Name: "f", ModTime: time.Unix(-1, 0)}, false},
+		{"largest uid", tar.Header{Name: "f", Uid: ustarMaxID, Gid: ustarMaxID}, true},
+		{"uid past the field", tar.Header{Name: "f", Uid: ustarMaxID + 1}, false},
+		{"longest name", tar.Header{Name: long(ustarNameSize)}, true},
+		{"name split into the prefix", tar.Header{Name: long(ustarPrefixSize) + "/" + long(ustarNameSize)}, true},
+		{"prefix too long", tar.Header{Name: long(ustarPrefixSize+1) + "/" + long(ustarNameSize)}, false},
+		{"name after the prefix too long", tar.Header{Name: long(ustarPrefixSize) + "/" + long(ustarNameSize+1)}, false},
+		{"longest link target", tar.Header{Name: "l", Linkname: long(ustarNameSize)}, true},
+		{"link target too long", tar.Header{Name: "l", Linkname: long(ustarNameSize + 1)}, false},
+		{"longest owner", tar.Header{Name: "f", Uname: long(ustarOwnerSize)}, true},
+		{"owner too long", tar.Header{Name: "f", Uname: long(ustarOwnerSize + 1)}, false},
+	}
+
+	for _, tt := range tests {
+		if tt.th.ModTime.IsZero() {
+			tt.th.ModTime = time.Unix(0, 0)
+		}
+
+		reason := ustarLimitation(&tt.th)
+		if ok := reason == ""; ok != tt.ok {
+			t.Errorf("%s: fits ustar is %t (%q), want %t", tt.desc, ok, reason, tt.ok)
+			continue
+		}
+
+		if !tt.ok {
+			continue
+		}
+
+		// What fits must also be written as ustar by archive/tar.
+		th := tt.th
+		th.Format = tar.FormatUSTAR
+
+		if err := tar.NewWriter(io.Discard).WriteHeader(&th); err != nil {
+			t.Errorf("%s: %v", tt.desc, err)
+		}
+	}
+}
+
+func TestSetFormatUstar(t *testing.T) {
+	epoch := time.Unix(0, 0)
+	opts := testTarOptions(t, "-tar-format", "ustar")
+
+	if err := opts.setFormat(&tar.Header{Name: "f", Size: ustarMaxSize, ModTime: epoch}); err != nil {
+		t.Errorf("largest ustar size: %v", err)
+	}
+
+	if err := opts.setFormat(&tar.Header{Name: "f", Size: ustarMaxSize + 1, ModTime: epoch}); err == nil {
+		t.Error("8 GiB file written as ustar")
+	}
+
+	opts = testTarOptions(t)
+
+	th := &tar.Header{Name: "f", Size: ustarMaxSize + 1, ModTime: epoch}
+	if err := opts.setFormat(th); err != nil || th.Format != tar.FormatPAX {
+		t.Errorf("8 GiB file written as %v (%v), want PAX", th.Format, err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// narToCommand pipes the contents of every regular file in a NAR to command,
+// run by sh, instead of writing an archive. Like GNU tar's --to-command, the
+// command learns about the file from TAR_* environment variables, with
+// TAR_FILENAME holding the tar member name below root; NARTAR_PATH holds the
+// NAR path. Failing commands are reported and make the conversion fail once
+// all files have been processed.
+func narToCommand(in io.Reader, command string, root string, opts *tarOptions) error {
+	nr, err := newNarReader(in)
+	if err != nil {
+		return fmt.Errorf("opening nar: %w", err)
+	}
+	defer nr.Close()
+
+	failed := 0
+	seen := make(map[string]string)
+
+	for {
+		hdr, err := nr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("reading nar header: %w", err)
+		}
+
+		logNarEntry(hdr)
+
+		if hdr.Type != nar.TypeRegular {
+			continue
+		}
+
+		unhacked, err := opts.paths.unhack(hdr.Path, seen)
+		if err != nil {
+			return err
+		}
+
+		mapped, ok := opts.paths.apply(unhacked)
+		if !ok {
+			continue
+		}
+
+		mappedHdr := *hdr
+		mappedHdr.Path = mapped
+
+		name, _, err := tarPathForNarHeader(&mappedHdr, root)
+		if err != nil {
+			return err
+		}
+
+		mode := opts.modes.forFile(hdr.Executable)
+		content := io.LimitReader(nr, hdr.Size)
+
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stdin = content
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(),
+			"TAR_FILENAME="+name,
+			"TAR_REALNAME="+name,
+			"TAR_FILETYPE=f",
+			"TAR_SIZE="+strconv.FormatInt(hdr.Size, 10),
+			"TAR_MODE="+fmt.Sprintf("%04o", mode),
+			"TAR_MTIME="+strconv.FormatInt(opts.modTime(hdr.Path).Unix(), 10),
+			"TAR_UID="+strconv.Itoa(opts.uid),
+			"TAR_GID="+strconv.Itoa(opts.gid),
+			"TAR_UNAME="+opts.uname,
+			"TAR_GNAME="+opts.gname,
+			"NARTAR_PATH="+hdr.Path,
+			"NARTAR_EXECUTABLE="+strconv.FormatBool(hdr.Executable),
+		)
+
+		if err := cmd.Run(); err != nil {
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				return fmt.Errorf("running %q: %w", command, err)
+			}
+
+			warnf("%q for %s: %v", command, name, err)
+			failed++
+		}
+
+		// The command need not read all of its input.
+		if _, err := io.Copy(io.Discard, content); err != nil {
+			return fmt.Errorf("reading file content: %w", err)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%q failed for %d files", command, failed)
+	}
+
+	return nil
+}
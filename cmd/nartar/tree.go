@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// treeNode is an in-memory representation of a NAR node, used by output
+// formats that need the complete directory structure before writing.
+type treeNode struct {
+	name       string
+	kind       nar.NodeType
+	linkTarget string
+	data       []byte
+	executable bool
+
+	// children are kept in NAR order, i.e. sorted by name.
+	children []*treeNode
+}
+
+// readNarTree reads a NAR, including all file contents, into memory.
+func readNarTree(in io.Reader) (*treeNode, error) {
+	nr, err := newNarReader(in)
+	if err != nil {
+		return nil, fmt.Errorf("opening nar: %w", err)
+	}
+	defer nr.Close()
+
+	nodes := make(map[string]*treeNode)
+
+	var root *treeNode
+
+	for {
+		hdr, err := nr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("reading nar header: %w", err)
+		}
+
+		logNarEntry(hdr)
+
+		n := &treeNode{
+			name:       path.Base(hdr.Path),
+			kind:       hdr.Type,
+			linkTarget: hdr.LinkTarget,
+			executable: hdr.Executable,
+		}
+
+		if hdr.Type == nar.TypeRegular {
+			n.data = make([]byte, hdr.Size)
+			if _, err := io.ReadFull(nr, n.data); err != nil {
+				return nil, fmt.Errorf("reading %s: %w", hdr.Path, err)
+			}
+		}
+
+		if hdr.Path == "/" {
+			root = n
+		} else {
+			parent := nodes[path.Dir(hdr.Path)]
+			if parent == nil {
+				return nil, fmt.Errorf("missing parent directory for %s", hdr.Path)
+			}
+
+			parent.children = append(parent.children, n)
+		}
+
+		if hdr.Type == nar.TypeDirectory {
+			nodes[hdr.Path] = n
+		}
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("nar has no root node")
+	}
+
+	return root, nil
+}
+
+// walk calls fn for n and all its descendants in depth-first NAR order.
+func (n *treeNode) walk(fn func(*treeNode)) {
+	fn(n)
+
+	for _, c := range n.children {
+		c.walk(fn)
+	}
+}
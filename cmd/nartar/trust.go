@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/narinfo/signature"
+)
+
+// trustOptions are the public keys a narinfo must be signed by, and how many
+// of them must have signed it.
+type trustOptions struct {
+	keys    []signature.PublicKey
+	minSigs int
+}
+
+func addTrustFlags(fs *flag.FlagSet) *trustOptions {
+	t := &trustOptions{}
+
+	fs.Func("trusted-public-keys", "space-separated public keys, as in nix.conf (repeatable)", t.addKeys)
+	fs.Func("public-key", "file holding public keys, as written by keygen -public (repeatable)", func(name string) error {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("reading public key: %w", err)
+		}
+
+		return t.addKeys(string(b))
+	})
+	fs.Func("nix-conf", "read the trusted-public-keys and extra-trusted-public-keys of this nix.conf", func(name string) error {
+		return t.readNixConf(name, false)
+	})
+	fs.IntVar(&t.minSigs, "min-sigs", 1, "number of trusted keys that must have signed each narinfo")
+
+	return t
+}
+
+// addKeys adds the whitespace-separated keys in s.
+func (t *trustOptions) addKeys(s string) error {
+	for _, k := range strings.Fields(s) {
+		pk, err := signature.ParsePublicKey(k)
+		if err != nil {
+			return fmt.Errorf("%q: %w", k, err)
+		}
+
+		t.keys = append(t.keys, pk)
+	}
+
+	return nil
+}
+
+// readNixConf adds the keys of a nix.conf, following its include and
+// !include lines. A missing file is only an error if it is not optional.
+func (t *trustOptions) readNixConf(name string, optional bool) error {
+	f, err := os.Open(name)
+	if optional && errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("reading nix.conf: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+
+		if len(fields) == 2 && (fields[0] == "include" || fields[0] == "!include") {
+			inc := fields[1]
+			if !filepath.IsAbs(inc) {
+				inc = filepath.Join(filepath.Dir(name), inc)
+			}
+
+			if err := t.readNixConf(inc, fields[0] == "!include"); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		switch strings.TrimSpace(key) {
+		case "trusted-public-keys", "extra-trusted-public-keys":
+			if err := t.addKeys(value); err != nil {
+				return fmt.Errorf("%s:%d: %w", name, lineNo, err)
+			}
+		}
+	}
+
+	return sc.Err()
+}
+
+// verify checks that at least -min-sigs of the trusted keys have signed ni,
+// and returns the names of those that have.
+func (t *trustOptions) verify(ni *narinfo.NarInfo) ([]string, error) {
+	if len(t.keys) == 0 {
+		return nil, fmt.Errorf("no trusted public keys; use -trusted-public-keys, -public-key or -nix-conf")
+	}
+
+	fingerprint := ni.Fingerprint()
+	signed := make(map[string]bool)
+	var names []string
+
+	for _, sig := range ni.Signatures {
+		for _, pk := range t.keys {
+			key := pk.String()
+			if !signed[key] && pk.Verify(fingerprint, sig) {
+				signed[key] = true
+				names = append(names, pk.Name)
+			}
+		}
+	}
+
+	if len(names) < t.minSigs {
+		return names, fmt.Errorf("%s has %d valid signatures by trusted keys, %d required", ni.StorePath, len(names), t.minSigs)
+	}
+
+	return names, nil
+}
+
+// runVerify checks the signatures of narinfo files against trusted keys, as
+// Nix does before substituting from a binary cache.
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	trust := addTrustFlags(fs)
+	inputs, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(inputs) == 0 {
+		return fmt.Errorf("verify needs at least one narinfo file")
+	}
+
+	if trust.minSigs < 1 {
+		return fmt.Errorf("-min-sigs must be at least 1")
+	}
+
+	for _, name := range inputs {
+		if err := verifyNarinfoFile(name, trust); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func verifyNarinfoFile(name string, trust *trustOptions) error {
+	in, err := openInput(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	ni, err := parseNarinfo(in)
+	if err != nil {
+		return err
+	}
+
+	names, err := trust.verify(ni)
+	if err != nil {
+		return err
+	}
+
+	if verbosity > 0 {
+		clearProgress()
+		fmt.Fprintf(os.Stderr, "%s: signed by %s\n", ni.StorePath, strings.Join(names, ", "))
+	}
+
+	return nil
+}
+
+// parseNarinfo reads a narinfo file and checks that it is well formed.
+func parseNarinfo(r io.Reader) (*narinfo.NarInfo, error) {
+	ni, err := narinfo.Parse(r)
+	if err != nil {
+		return nil, fmt.Errorf("parsing narinfo: %w", err)
+	}
+
+	if ni.NarHash == nil {
+		return nil, fmt.Errorf("narinfo has no NarHash")
+	}
+
+	if err := ni.Check(); err != nil {
+		return nil, err
+	}
+
+	return ni, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cacheNixosKey is the public key of cache.nixos.org, which signed the
+// narinfo of netToolsNarinfo.
+const (
+	cacheNixosKey = "cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY="
+
+	netToolsNarinfo = `StorePath: /nix/store/00bgd045z0d4icpbc2yyz4gx48ak44la-net-tools-1.60_p20170221182432
+URL: nar/1094wph9z4nwlgvsd53abfz8i117ykiv5dwnq9nnhz846s7xqd7d.nar.xz
+Compression: xz
+FileHash: sha256:1094wph9z4nwlgvsd53abfz8i117ykiv5dwnq9nnhz846s7xqd7d
+FileSize: 114980
+NarHash: sha256:0lxjvvpr59c2mdram7ympy5ay741f180kv3349hvfc3f8nrmbqf6
+NarSize: 464152
+References: 7gx4kiv5m0i7d7qkixq2cwzbr10lvxwc-glibc-2.27
+Deriver: 10dx1q4ivjb115y3h90mipaaz533nr0d-net-tools-1.60_p20170221182432.drv
+Sig: cache.nixos.org-1:sn5s/RrqEI+YG6/PjwdbPjcAC7rcta7sJU4mFOawGvJBLsWkyLtBrT2EuFt/LJjWkTZ+ZWOI9NTtjo/woMdvAg==
+Sig: hydra.other.net-1:JXQ3Z/PXf0EZSFkFioa4FbyYpbbTbHlFBtZf4VqU0tuMTWzhMD7p9Q7acJjLn3jofOtilAAwRILKIfVuyrbjAA==
+`
+)
+
+func TestTrustVerify(t *testing.T) {
+	signedCurl := curlNarinfo + "Sig: " + curlTest1Sig + "\n"
+
+	// The curl narinfo signed by test1 again, and by cache.nixos.org over a
+	// different fingerprint.
+	doubleSigned := signedCurl + "Sig: " + curlTest1Sig + "\nSig: cache.nixos.org-1:sn5s/RrqEI+YG6/PjwdbPjcAC7rcta7sJU4mFOawGvJBLsWkyLtBrT2EuFt/LJjWkTZ+ZWOI9NTtjo/woMdvAg==\n"
+
+	tests := []struct {
+		desc    string
+		narinfo string
+		keys    string
+		minSigs int
+		signers string
+		err     string
+	}{
+		{desc: "signed by cache.nixos.org", narinfo: netToolsNarinfo, keys: cacheNixosKey, minSigs: 1, signers: "cache.nixos.org-1"},
+		{desc: "one of several keys", narinfo: netToolsNarinfo, keys: test1PublicKey + " " + cacheNixosKey, minSigs: 1, signers: "cache.nixos.org-1"},
+		{desc: "too few trusted signatures", narinfo: netToolsNarinfo, keys: test1PublicKey + " " + cacheNixosKey, minSigs: 2, err: "1 valid signatures by trusted keys, 2 required"},
+		{desc: "signed by an untrusted key", narinfo: netToolsNarinfo, keys: test1PublicKey, minSigs: 1, err: "0 valid signatures"},
+		{desc: "signed by test1", narinfo: signedCurl, keys: test1PublicKey, minSigs: 1, signers: "test1"},
+		{desc: "signatures counted once per key", narinfo: doubleSigned, keys: test1PublicKey + " " + cacheNixosKey, minSigs: 2, err: "1 valid signatures"},
+		{desc: "tampered", narinfo: strings.Replace(signedCurl, "NarSize: 196040", "NarSize: 196041", 1), keys: test1PublicKey, minSigs: 1, err: "0 valid signatures"},
+		{desc: "no keys", narinfo: signedCurl, minSigs: 1, err: "no trusted public keys"},
+	}
+
+	for _, tt := range tests {
+		trust := &trustOptions{minSigs: tt.minSigs}
+		if err := trust.addKeys(tt.keys); err != nil {
+			t.Fatal(err)
+		}
+
+		ni, err := parseNarinfo(strings.NewReader(tt.narinfo))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signers, err := trust.verify(ni)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got %v, want an error with %q", tt.desc, err, tt.err)
+			}
+
+			continue
+		}
+
+		if err != nil || strings.Join(signers, " ") != tt.signers {
+			t.Errorf("%s: signed by %q (%v), want %q", tt.desc, signers, err, tt.signers)
+		}
+	}
+}
+
+func TestTrustNixConf(t *testing.T) {
+	dir := t.TempDir()
+
+	write := func(name, content string) string {
+		t.Helper()
+
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		return p
+	}
+
+	write("extra.conf", "extra-trusted-public-keys = "+test1PublicKey+"\n")
+	conf := write("nix.conf", strings.Join([]string{
+		"# trusted-public-keys = ignored:AAAA",
+		"substituters = https://cache.nixos.org",
+		"trusted-public-keys = " + cacheNixosKey + " # the default",
+		"include extra.conf",
+		"!include missing.conf",
+	}, "\n"))
+
+	trust := &trustOptions{}
+	if err := trust.readNixConf(conf, false); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, k := range trust.keys {
+		names = append(names, k.String())
+	}
+
+	if got, want := strings.Join(names, " "), cacheNixosKey+" "+test1PublicKey; got != want {
+		t.Errorf("read keys %s, want %s", got, want)
+	}
+
+	for desc, content := range map[string]string{
+		"a missing include": "include missing.conf\n",
+		"a bad key":         "trusted-public-keys = test1:short\n",
+	} {
+		if err := (&trustOptions{}).readNixConf(write("bad.conf", content), false); err == nil {
+			t.Errorf("nix.conf with %s: no error", desc)
+		}
+	}
+
+	if err := (&trustOptions{}).readNixConf(filepath.Join(dir, "none.conf"), false); err == nil {
+		t.Error("missing nix.conf: no error")
+	}
+}
+
+func TestRunVerify(t *testing.T) {
+	withoutConfig(t)
+
+	name := filepath.Join(t.TempDir(), "net-tools.narinfo")
+	if err := os.WriteFile(name, []byte(netToolsNarinfo), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runVerify([]string{"-trusted-public-keys", cacheNixosKey, name}); err != nil {
+		t.Error(err)
+	}
+
+	for _, args := range [][]string{
+		{"-trusted-public-keys", test1PublicKey, name},
+		{"-trusted-public-keys", cacheNixosKey, "-min-sigs", "2", name},
+		{"-trusted-public-keys", cacheNixosKey, "-min-sigs", "0", name},
+		{"-trusted-public-keys", cacheNixosKey},
+	} {
+		if err := runVerify(args); err == nil {
+			t.Errorf("verify %q: no error", args)
+		}
+	}
+}
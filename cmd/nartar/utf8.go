@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// What -invalid-utf8 does with paths and symlink targets that are not valid
+// UTF-8, which NARs allow but many tar consumers and filesystems do not.
+const (
+	utf8Pass   = "pass"
+	utf8Reject = "reject"
+	utf8Escape = "escape"
+)
+
+// utf8Policy is the -invalid-utf8 policy.
+type utf8Policy string
+
+// addUTF8PolicyFlag registers -invalid-utf8 on fs, once for the commands
+// that both read and write archives.
+func addUTF8PolicyFlag(fs *flag.FlagSet) *utf8Policy {
+	if f := fs.Lookup("invalid-utf8"); f != nil {
+		return f.Value.(*utf8Policy)
+	}
+
+	p := new(utf8Policy)
+	*p = utf8Pass
+	fs.Var(p, "invalid-utf8", "paths and symlink targets that are not valid UTF-8: pass (default) keeps their bytes, reject fails, escape writes the invalid bytes as %XX and % as %25")
+
+	return p
+}
+
+func (p *utf8Policy) String() string {
+	if p == nil || *p == "" {
+		return utf8Pass
+	}
+
+	return string(*p)
+}
+
+func (p *utf8Policy) Set(v string) error {
+	switch v {
+	case utf8Pass, utf8Reject, utf8Escape:
+		*p = utf8Policy(v)
+		return nil
+	default:
+		return fmt.Errorf("unsupported -invalid-utf8 policy %q", v)
+	}
+}
+
+// apply applies the policy to s, a path or symlink target. Escaping, a %
+// is escaped too, as %25, so that no two strings are escaped alike.
+func (p *utf8Policy) apply(s string) (string, error) {
+	if p == nil || *p == utf8Pass {
+		return s, nil
+	}
+
+	if *p == utf8Reject {
+		if !utf8.ValidString(s) {
+			return "", fmt.Errorf("%q is not valid UTF-8; use -invalid-utf8 pass or escape to convert it", s)
+		}
+
+		return s, nil
+	}
+
+	if utf8.ValidString(s) && !strings.Contains(s, "%") {
+		return s, nil
+	}
+
+	var b strings.Builder
+
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		if r == utf8.RuneError && size == 1 || r == '%' {
+			fmt.Fprintf(&b, "%%%02X", s[0])
+		} else {
+			b.WriteString(s[:size])
+		}
+
+		s = s[size:]
+	}
+
+	return b.String(), nil
+}
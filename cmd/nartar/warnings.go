@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Warning categories, which -warning turns on, off or into errors.
+const (
+	warnSkippedSpecial   = "skipped-special"
+	warnIgnoredPAX       = "ignored-pax"
+	warnLongPathUpgraded = "long-path-upgraded"
+	warnCaseHack         = "case-hack"
+	warnNarFixed         = "nar-fixed"
+)
+
+// What a warning category does.
+const (
+	warnOff = iota
+	warnOn
+	warnError
+)
+
+// warningLevels holds the level of every category. Only the categories that
+// nartar has always reported are on by default.
+var warningLevels = map[string]int{
+	warnSkippedSpecial:   warnOn,
+	warnIgnoredPAX:       warnOff,
+	warnLongPathUpgraded: warnOff,
+	warnCaseHack:         warnOn,
+	warnNarFixed:         warnOn,
+}
+
+func addWarningFlag(fs *flag.FlagSet) {
+	fs.Func("warning", "CATEGORY, no-CATEGORY or error:CATEGORY to show, hide or fail on a warning category, or all (repeatable)", setWarning)
+}
+
+// setWarning parses a -warning value, which may list several settings
+// separated by commas.
+func setWarning(v string) error {
+	for _, setting := range strings.Split(v, ",") {
+		level, cat := warnOn, setting
+
+		if c, ok := strings.CutPrefix(setting, "no-"); ok {
+			level, cat = warnOff, c
+		} else if c, ok := strings.CutPrefix(setting, "error:"); ok {
+			level, cat = warnError, c
+		}
+
+		if cat == "all" {
+			for c := range warningLevels {
+				warningLevels[c] = level
+			}
+
+			continue
+		}
+
+		if _, ok := warningLevels[cat]; !ok {
+			return fmt.Errorf("unknown warning category %q (use %s or all)", cat, strings.Join(warningCategories(), ", "))
+		}
+
+		warningLevels[cat] = level
+	}
+
+	return nil
+}
+
+func warningCategories() []string {
+	cats := make([]string, 0, len(warningLevels))
+	for c := range warningLevels {
+		cats = append(cats, c)
+	}
+	sort.Strings(cats)
+
+	return cats
+}
+
+// warnCategory reports a warning of the category cat, tagged with it. It
+// returns an error instead if the category is fatal.
+func warnCategory(cat string, format string, args ...interface{}) error {
+	switch warningLevels[cat] {
+	case warnOff:
+		return nil
+	case warnError:
+		return fmt.Errorf(format+" [-warning=error:%s]", append(args, cat)...)
+	default:
+		warnf(format+" [%s]", append(args, cat)...)
+		return nil
+	}
+}
@@ -2,4 +2,12 @@ module nartar
 
 go 1.20
 
-require github.com/nix-community/go-nix v0.0.0-20250101154619-4bdde671e0a1
+require (
+	github.com/andybalholm/brotli v1.1.1
+	github.com/klauspost/compress v1.17.9
+	github.com/nix-community/go-nix v0.0.0-20250101154619-4bdde671e0a1
+	github.com/ulikunitz/xz v0.5.12
+	lukechampine.com/blake3 v1.3.0
+)
+
+require github.com/klauspost/cpuid/v2 v2.0.12 // indirect